@@ -0,0 +1,57 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/proxy"
+)
+
+// alpnTargets maps protocols negotiated via ALPN to the dialer for their
+// target. Connections that negotiated another protocol (or none at all)
+// use the default dialer of the tunnel.
+type alpnTargets map[string]proxy.Dialer
+
+// Build dialers for a map of protocol to target address. Returns nil if
+// no targets are given.
+func newALPNTargets(targets map[string]string, timeout time.Duration, withTLS *targetTLS) (alpnTargets, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	dialers := alpnTargets{}
+	for protocol, target := range targets {
+		dial, err := backendDialer(target, timeout, withTLS)
+		if err != nil {
+			return nil, fmt.Errorf("target for protocol '%s': %w", protocol, err)
+		}
+		dialers[protocol] = dial
+	}
+	return dialers, nil
+}
+
+// dialer picks the dialer for an established (and handshaked) connection,
+// based on the protocol it negotiated.
+func (a alpnTargets) dialer(conn net.Conn, fallback proxy.Dialer) proxy.Dialer {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if dial, ok := a[tlsConn.ConnectionState().NegotiatedProtocol]; ok {
+			return dial
+		}
+	}
+	return fallback
+}
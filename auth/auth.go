@@ -18,6 +18,7 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
@@ -86,50 +87,25 @@ func (a ACL) VerifyPeerCertificateServer(rawCerts [][]byte, verifiedChains [][]*
 		return nil
 	}
 
-	cert := verifiedChains[0][0]
-
-	// Check CN against --allow-cn flag(s).
-	if contains(a.AllowedCNs, cert.Subject.CommonName) {
-		return nil
-	}
-
-	// Check OUs against --allow-ou flag(s).
-	if intersects(a.AllowedOUs, cert.Subject.OrganizationalUnit) {
-		return nil
-	}
-
-	// Check DNS SANs against --allow-dns-san flag(s).
-	if intersects(a.AllowedDNSs, cert.DNSNames) {
-		return nil
-	}
-
-	// Check IP SANs against --allow-dns-san flag(s).
-	if intersectsIP(a.AllowedIPs, cert.IPAddresses) {
-		return nil
-	}
-
-	// Check URI SANs against --allow-uri-san flag(s).
-	if intersectsURI(a.AllowedURIs, cert.URIs) {
-		return nil
-	}
+	return a.check(verifiedChains[0][0], nil, nil)
+}
 
-	// Check against OPA
-	if a.AllowOPAQuery != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), a.OPAQueryTimeout)
-		defer cancel()
-		input := map[string]interface{}{
-			"certificate": cert,
+// VerifyConnectionServer returns an implementation of VerifyConnection for
+// crypto/tls.Config for servers, that enforces access controls like
+// VerifyPeerCertificateServer, with the IP address of the client passed to
+// the OPA policy as input.source.ip. The peer certificate must have been
+// verified already, by crypto/tls (with tls.RequireAndVerifyClientCert) or by
+// VerifyPeerCertificate (e.g. for SPIFFE).
+func (a ACL) VerifyConnectionServer(source net.IP) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("unauthorized: invalid principal, or principal not allowed")
 		}
-		results, err := a.AllowOPAQuery.Eval(ctx, rego.EvalInput(input))
-		if err != nil {
-			return fmt.Errorf("unauthorized: policy returned error: %w", err)
-		}
-		if results.Allowed() {
+		if a.AllowAll {
 			return nil
 		}
+		return a.check(state.PeerCertificates[0], source, nil)
 	}
-
-	return errors.New("unauthorized: invalid principal, or principal not allowed")
 }
 
 // VerifyPeerCertificateClient is an implementation of VerifyPeerCertificate
@@ -148,29 +124,49 @@ func (a ACL) VerifyPeerCertificateClient(rawCerts [][]byte, verifiedChains [][]*
 		return nil
 	}
 
-	cert := verifiedChains[0][0]
+	return a.check(verifiedChains[0][0], nil, nil)
+}
 
-	// Check CN against --verify-cn flag(s).
+// VerifyRequest checks that the ACL grants the given (verified) peer
+// certificate access to a request, e.g. on an HTTP connection. The fields of
+// the request are passed to the OPA policy as input.request, and the IP
+// address of the client (if known) as input.source.ip, next to
+// input.certificate. If the given ACL is empty, access is denied (fails
+// closed).
+func (a ACL) VerifyRequest(cert *x509.Certificate, source net.IP, request map[string]interface{}) error {
+	if cert == nil {
+		return errors.New("unauthorized: invalid principal, or principal not allowed")
+	}
+	if a.AllowAll {
+		return nil
+	}
+	return a.check(cert, source, request)
+}
+
+// Check a certificate against the ACL, and the OPA policy (with the source
+// address and the request in the input, if given).
+func (a ACL) check(cert *x509.Certificate, source net.IP, request map[string]interface{}) error {
+	// Check CN against --allow-cn/--verify-cn flag(s).
 	if contains(a.AllowedCNs, cert.Subject.CommonName) {
 		return nil
 	}
 
-	// Check OUs against --verify-ou flag(s).
+	// Check OUs against --allow-ou/--verify-ou flag(s).
 	if intersects(a.AllowedOUs, cert.Subject.OrganizationalUnit) {
 		return nil
 	}
 
-	// Check DNS SANs against --verify-dns-san flag(s).
+	// Check DNS SANs against --allow-dns/--verify-dns flag(s).
 	if intersects(a.AllowedDNSs, cert.DNSNames) {
 		return nil
 	}
 
-	// Check IP SANs against --verify-dns-san flag(s).
+	// Check IP SANs against --allow-ip/--verify-ip flag(s).
 	if intersectsIP(a.AllowedIPs, cert.IPAddresses) {
 		return nil
 	}
 
-	// Check URI SANs against --verify-uri-san flag(s).
+	// Check URI SANs against --allow-uri/--verify-uri flag(s).
 	if intersectsURI(a.AllowedURIs, cert.URIs) {
 		return nil
 	}
@@ -182,6 +178,12 @@ func (a ACL) VerifyPeerCertificateClient(rawCerts [][]byte, verifiedChains [][]*
 		input := map[string]interface{}{
 			"certificate": cert,
 		}
+		if source != nil {
+			input["source"] = map[string]interface{}{"ip": source.String()}
+		}
+		if request != nil {
+			input["request"] = request
+		}
 		results, err := a.AllowOPAQuery.Eval(ctx, rego.EvalInput(input))
 		if err != nil {
 			return fmt.Errorf("unauthorized: policy returned error: %w", err)
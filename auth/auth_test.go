@@ -18,6 +18,7 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"net"
@@ -162,6 +163,58 @@ func TestAuthorizeOPAAcceptCommonName(t *testing.T) {
 	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "Rego policy validates CN should pass")
 }
 
+func TestVerifyRequest(t *testing.T) {
+	module := `package policy
+	import input
+	default allow := false
+	allow = true {
+		input.certificate.Subject.CommonName == "gopher"
+		input.request.method == "GET"
+	}
+	`
+	allowQuery, _ := rego.New(
+		rego.Query("data.policy.allow"),
+		rego.Module("test.rego", module),
+	).PrepareForEval(context.Background())
+
+	testACL := ACL{
+		AllowOPAQuery:   policy.WrapForTest(&allowQuery),
+		OPAQueryTimeout: 10 * time.Second,
+	}
+	cert := fakeChains[0][0]
+	assert.Nil(t, testACL.VerifyRequest(cert, nil, map[string]interface{}{"method": "GET"}), "Rego policy validates request should pass")
+	assert.NotNil(t, testACL.VerifyRequest(cert, nil, map[string]interface{}{"method": "POST"}), "Rego policy on different method should be rejected")
+	assert.NotNil(t, testACL.VerifyRequest(cert, nil, nil), "Rego policy without request should be rejected")
+	assert.NotNil(t, ACL{AllowAll: true}.VerifyRequest(nil, nil, nil), "Request without certificate should be rejected")
+	assert.Nil(t, ACL{AllowedCNs: []string{"gopher"}}.VerifyRequest(cert, nil, nil), "Request with allowed CN should pass")
+}
+
+func TestVerifyConnectionServer(t *testing.T) {
+	module := `package policy
+	import input
+	default allow := false
+	allow = true {
+		input.certificate.Subject.CommonName == "gopher"
+		net.cidr_contains("10.0.0.0/8", input.source.ip)
+	}
+	`
+	allowQuery, _ := rego.New(
+		rego.Query("data.policy.allow"),
+		rego.Module("test.rego", module),
+	).PrepareForEval(context.Background())
+
+	testACL := ACL{
+		AllowOPAQuery:   policy.WrapForTest(&allowQuery),
+		OPAQueryTimeout: 10 * time.Second,
+	}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{fakeChains[0][0]}}
+	assert.Nil(t, testACL.VerifyConnectionServer(net.ParseIP("10.1.2.3"))(state), "Rego policy validates source should pass")
+	assert.NotNil(t, testACL.VerifyConnectionServer(net.ParseIP("192.168.1.1"))(state), "Rego policy on different source should be rejected")
+	assert.NotNil(t, testACL.VerifyConnectionServer(nil)(state), "Rego policy without source should be rejected")
+	assert.NotNil(t, ACL{AllowAll: true}.VerifyConnectionServer(nil)(tls.ConnectionState{}), "Connection without certificate should be rejected")
+	assert.Nil(t, testACL.VerifyRequest(fakeChains[0][0], net.ParseIP("10.0.0.1"), nil), "source should be passed for requests")
+}
+
 func TestAuthorizeOPAAcceptDNSn(t *testing.T) {
 	module := `package policy
 	import input
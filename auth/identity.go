@@ -0,0 +1,100 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/policy"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// Kinds of identities a principal can be identified by (see NewIdentity).
+const (
+	// IdentityCN is the common name of the certificate.
+	IdentityCN = "cn"
+	// IdentityURI is the first URI SAN of the certificate, e.g. its SPIFFE ID.
+	IdentityURI = "uri"
+	// IdentityPolicy is the result of an OPA query.
+	IdentityPolicy = "opa"
+)
+
+// IdentityKinds lists the supported kinds of identities.
+var IdentityKinds = []string{IdentityCN, IdentityURI, IdentityPolicy}
+
+// Identity returns a key that identifies the principal of a (verified)
+// certificate, e.g. to apply quotas per client. An empty key means that the
+// principal has no identity of the given kind.
+type Identity func(cert *x509.Certificate) (string, error)
+
+// NewIdentity returns the identity of the given kind. The policy (and its
+// timeout) is only used for IdentityPolicy, and required for it.
+func NewIdentity(kind string, p policy.Policy, timeout time.Duration) (Identity, error) {
+	switch kind {
+	case IdentityCN:
+		return CommonNameIdentity, nil
+	case IdentityURI:
+		return URIIdentity, nil
+	case IdentityPolicy:
+		if p == nil {
+			return nil, fmt.Errorf("identity '%s' requires a policy", kind)
+		}
+		return PolicyIdentity(p, timeout), nil
+	}
+	return nil, fmt.Errorf("invalid identity '%s'", kind)
+}
+
+// CommonNameIdentity identifies principals by the common name of their
+// certificate.
+func CommonNameIdentity(cert *x509.Certificate) (string, error) {
+	return cert.Subject.CommonName, nil
+}
+
+// URIIdentity identifies principals by the first URI SAN of their
+// certificate, e.g. their SPIFFE ID.
+func URIIdentity(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) == 0 {
+		return "", nil
+	}
+	return cert.URIs[0].String(), nil
+}
+
+// PolicyIdentity identifies principals by the result of an OPA query, which
+// gets the certificate as input.certificate (like access control policies).
+// The query must return a string, or be undefined for principals that have
+// no identity.
+func PolicyIdentity(p policy.Policy, timeout time.Duration) Identity {
+	return func(cert *x509.Certificate) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		results, err := p.Eval(ctx, rego.EvalInput(map[string]interface{}{
+			"certificate": cert,
+		}))
+		if err != nil {
+			return "", fmt.Errorf("policy returned error: %w", err)
+		}
+		if len(results) == 0 || len(results[0].Expressions) == 0 {
+			return "", nil
+		}
+		identity, ok := results[0].Expressions[0].Value.(string)
+		if !ok {
+			return "", fmt.Errorf("policy returned %T, not a string", results[0].Expressions[0].Value)
+		}
+		return identity, nil
+	}
+}
@@ -0,0 +1,81 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/policy"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentity(t *testing.T) {
+	cert := fakeChains[0][0]
+
+	identity, err := NewIdentity(IdentityCN, nil, 0)
+	assert.Nil(t, err)
+	key, err := identity(cert)
+	assert.Nil(t, err)
+	assert.Equal(t, "gopher", key)
+
+	identity, err = NewIdentity(IdentityURI, nil, 0)
+	assert.Nil(t, err)
+	key, err = identity(cert)
+	assert.Nil(t, err)
+	assert.Equal(t, "scheme://valid/path", key)
+	key, err = identity(&x509.Certificate{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", key, "certificate without URI SAN should have no identity")
+
+	_, err = NewIdentity(IdentityPolicy, nil, 0)
+	assert.NotNil(t, err, "policy identity requires a policy")
+	_, err = NewIdentity("invalid", nil, 0)
+	assert.NotNil(t, err, "invalid identity should be rejected")
+}
+
+func TestPolicyIdentity(t *testing.T) {
+	module := `package policy
+	import input
+	key := concat("/", ["team", input.certificate.Subject.OrganizationalUnit[0]]) {
+		input.certificate.Subject.CommonName == "gopher"
+	}
+	count := 1
+	`
+	prepare := func(query string) policy.Policy {
+		prepared, err := rego.New(
+			rego.Query(query),
+			rego.Module("test.rego", module),
+		).PrepareForEval(context.Background())
+		assert.Nil(t, err)
+		return policy.WrapForTest(&prepared)
+	}
+
+	identity, err := NewIdentity(IdentityPolicy, prepare("data.policy.key"), 10*time.Second)
+	assert.Nil(t, err)
+	key, err := identity(fakeChains[0][0])
+	assert.Nil(t, err)
+	assert.Equal(t, "team/triangle", key)
+
+	key, err = identity(&x509.Certificate{})
+	assert.Nil(t, err, "undefined result should not be an error")
+	assert.Equal(t, "", key, "undefined result should be no identity")
+
+	_, err = PolicyIdentity(prepare("data.policy.count"), 10*time.Second)(fakeChains[0][0])
+	assert.NotNil(t, err, "non-string result should be an error")
+}
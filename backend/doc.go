@@ -0,0 +1,3 @@
+// Package backend implements a pool of backend targets with load balancing,
+// active health checks and passive ejection of backends that fail to dial.
+package backend
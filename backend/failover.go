@@ -0,0 +1,235 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// FailoverOptions for a failover dialer. Zero values disable the
+// corresponding feature.
+type FailoverOptions struct {
+	// Timeout limits the total time spent on a single call to Dial, across
+	// all targets that are tried.
+	Timeout time.Duration
+	// Backoff is the time for which a target is marked down after its first
+	// failure. It doubles on every consecutive failure, up to MaxBackoff (if
+	// MaxBackoff is zero, it doesn't grow).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Logger is used to log when targets are marked down or fail over.
+	Logger Logger
+}
+
+// Failover dials a list of targets in priority order. Targets that fail to
+// dial are marked down with exponential backoff, and skipped until their
+// backoff expires.
+type Failover struct {
+	backends []*Backend
+	options  FailoverOptions
+	// Index of the target we last connected to, or -1
+	current int32
+}
+
+// NewFailover creates a failover dialer. Targets are given in priority order,
+// along with a dialer for each target (e.g. one that performs a handshake).
+func NewFailover(targets []string, dialers []Dialer, options FailoverOptions) (*Failover, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("at least one target is required")
+	}
+	if len(targets) != len(dialers) {
+		return nil, errors.New("need exactly one dialer per target")
+	}
+
+	f := &Failover{options: options, current: -1}
+	for i, target := range targets {
+		f.backends = append(f.backends, backendWithDialer(target, dialers[i]))
+	}
+	return f, nil
+}
+
+// Dial the first target (by priority) that isn't marked down. If dialing
+// fails, the next target is tried until the timeout expires. If all targets
+// are marked down, all of them are tried as a last resort.
+func (f *Failover) Dial() (net.Conn, error) {
+	var deadline time.Time
+	if f.options.Timeout > 0 {
+		deadline = time.Now().Add(f.options.Timeout)
+	}
+
+	candidates := f.available(time.Now())
+	if len(candidates) == 0 {
+		candidates = f.backends
+	}
+
+	var err error
+	for _, b := range candidates {
+		timeout := time.Duration(0)
+		if !deadline.IsZero() {
+			timeout = time.Until(deadline)
+			if timeout <= 0 {
+				break
+			}
+		}
+
+		var conn net.Conn
+		conn, err = dialWithin(b.dial, timeout)
+		if err != nil {
+			f.markDown(b, err)
+			continue
+		}
+		f.markUp(b)
+		return b.track(conn), nil
+	}
+	if err == nil {
+		err = timeoutError{}
+	}
+	return nil, err
+}
+
+// Targets that aren't marked down, in priority order.
+func (f *Failover) available(now time.Time) []*Backend {
+	out := make([]*Backend, 0, len(f.backends))
+	for _, b := range f.backends {
+		b.mu.Lock()
+		ok := !now.Before(b.ejectedUntil)
+		b.mu.Unlock()
+		if ok {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (f *Failover) markDown(b *Backend, err error) {
+	b.dialErrorCounter.Inc(1)
+
+	b.mu.Lock()
+	b.failures++
+	backoff := f.options.Backoff
+	for i := 1; i < b.failures && backoff < f.options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if f.options.MaxBackoff > 0 && backoff > f.options.MaxBackoff {
+		backoff = f.options.MaxBackoff
+	}
+	b.healthy = false
+	b.lastError = err
+	b.ejectedUntil = time.Now().Add(backoff)
+	b.mu.Unlock()
+
+	b.ejectionCounter.Inc(1)
+	b.healthyGauge.Update(0)
+	f.logf("marking target %s down for %s: %s", b.Address, backoff, err)
+}
+
+func (f *Failover) markUp(b *Backend) {
+	b.mu.Lock()
+	b.failures = 0
+	b.healthy = true
+	b.lastError = nil
+	b.ejectedUntil = time.Time{}
+	b.mu.Unlock()
+	b.healthyGauge.Update(1)
+
+	index := int32(-1)
+	for i := range f.backends {
+		if f.backends[i] == b {
+			index = int32(i)
+		}
+	}
+	if previous := atomic.SwapInt32(&f.current, index); previous != index {
+		f.logf("using target %s", b.Address)
+	}
+}
+
+// Active returns the target we last successfully connected to, if any.
+func (f *Failover) Active() string {
+	if i := atomic.LoadInt32(&f.current); i >= 0 {
+		return f.backends[i].Address
+	}
+	return ""
+}
+
+// Status returns a snapshot of the state of all targets, in priority order.
+func (f *Failover) Status() []Status {
+	now := time.Now()
+	current := atomic.LoadInt32(&f.current)
+	out := make([]Status, len(f.backends))
+	for i, b := range f.backends {
+		b.mu.Lock()
+		out[i] = Status{
+			Address: b.Address,
+			Healthy: b.healthy,
+			Ejected: now.Before(b.ejectedUntil),
+			Active:  int32(i) == current,
+			Open:    b.openConns(),
+		}
+		if b.lastError != nil {
+			out[i].Error = b.lastError.Error()
+		}
+		b.mu.Unlock()
+	}
+	return out
+}
+
+func (f *Failover) logf(format string, v ...interface{}) {
+	if f.options.Logger != nil {
+		f.options.Logger.Printf(format, v...)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timed out trying to connect to any target" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Dial with an upper bound on the time we wait, even if the dialer itself
+// has a longer timeout. A connection that completes after we gave up on it
+// is closed. A timeout of zero means no limit.
+func dialWithin(dial Dialer, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, timeoutError{}
+	}
+}
@@ -0,0 +1,140 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tcpDialer(address string) Dialer {
+	return func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, time.Second)
+	}
+}
+
+func TestNewFailoverInvalid(t *testing.T) {
+	_, err := NewFailover(nil, nil, FailoverOptions{})
+	assert.NotNil(t, err, "should reject empty target list")
+
+	_, err = NewFailover([]string{"a", "b"}, []Dialer{tcpDialer("a")}, FailoverOptions{})
+	assert.NotNil(t, err, "should reject mismatched dialers")
+}
+
+func TestFailoverPriority(t *testing.T) {
+	targets, cleanup := testBackends(t, 2)
+	defer cleanup()
+
+	f, err := NewFailover(targets, []Dialer{tcpDialer(targets[0]), tcpDialer(targets[1])}, FailoverOptions{
+		Timeout: time.Second,
+		Backoff: time.Hour,
+	})
+	assert.Nil(t, err, "should create failover dialer")
+	assert.Equal(t, "", f.Active(), "no active target before first dial")
+
+	for i := 0; i < 3; i++ {
+		conn, err := f.Dial()
+		assert.Nil(t, err, "should dial target")
+		assert.Equal(t, targets[0], conn.RemoteAddr().String(), "should always use first target")
+		defer conn.Close()
+	}
+	assert.Equal(t, targets[0], f.Active())
+	assert.Equal(t, int64(3), f.Status()[0].Open)
+	assert.True(t, f.Status()[0].Active)
+}
+
+func TestFailoverMarksDown(t *testing.T) {
+	targets, cleanup := testBackends(t, 1)
+	defer cleanup()
+	down := closedPort(t)
+
+	calls := 0
+	dialDown := func() (net.Conn, error) {
+		calls++
+		return tcpDialer(down)()
+	}
+
+	f, err := NewFailover([]string{down, targets[0]}, []Dialer{dialDown, tcpDialer(targets[0])}, FailoverOptions{
+		Timeout: time.Second,
+		Backoff: time.Hour,
+		Logger:  &testLogger{},
+	})
+	assert.Nil(t, err, "should create failover dialer")
+
+	for i := 0; i < 3; i++ {
+		conn, err := f.Dial()
+		assert.Nil(t, err, "should fail over to second target")
+		assert.Equal(t, targets[0], conn.RemoteAddr().String())
+		conn.Close()
+	}
+	assert.Equal(t, 1, calls, "should skip target that is marked down")
+	assert.Equal(t, targets[0], f.Active())
+
+	status := f.Status()
+	assert.True(t, status[0].Ejected, "first target should be marked down")
+	assert.False(t, status[0].Healthy, "first target should be unhealthy")
+	assert.NotEmpty(t, status[0].Error, "should report error")
+	assert.True(t, status[1].Active, "second target should be active")
+}
+
+func TestFailoverBackoff(t *testing.T) {
+	failing := func() (net.Conn, error) { return nil, errors.New("failed") }
+	f, err := NewFailover([]string{"a"}, []Dialer{failing}, FailoverOptions{
+		Backoff:    time.Second,
+		MaxBackoff: 3 * time.Second,
+	})
+	assert.Nil(t, err, "should create failover dialer")
+
+	b := f.backends[0]
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		// All targets are down, so we should still try the (only) target.
+		_, err := f.Dial()
+		assert.NotNil(t, err, "dial should fail")
+
+		b.mu.Lock()
+		backoff := time.Until(b.ejectedUntil)
+		b.mu.Unlock()
+		assert.InDelta(t, float64(expected), float64(backoff), float64(100*time.Millisecond), "unexpected backoff")
+	}
+}
+
+func TestFailoverTimeout(t *testing.T) {
+	targets, cleanup := testBackends(t, 1)
+	defer cleanup()
+
+	slow := func() (net.Conn, error) {
+		time.Sleep(500 * time.Millisecond)
+		return tcpDialer(targets[0])()
+	}
+	f, err := NewFailover([]string{"slow", targets[0]}, []Dialer{slow, tcpDialer(targets[0])}, FailoverOptions{
+		Timeout: 100 * time.Millisecond,
+		Backoff: time.Hour,
+	})
+	assert.Nil(t, err, "should create failover dialer")
+
+	start := time.Now()
+	_, err = f.Dial()
+	assert.NotNil(t, err, "should time out")
+	assert.Less(t, time.Since(start), 400*time.Millisecond, "should give up after timeout")
+
+	// Slow target is now marked down, so we use the other one.
+	conn, err := f.Dial()
+	assert.Nil(t, err, "should dial second target")
+	conn.Close()
+}
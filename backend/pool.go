@@ -0,0 +1,397 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// RoundRobin cycles through healthy backends in order.
+	RoundRobin = "round-robin"
+	// LeastConnections picks the healthy backend with the fewest open connections.
+	LeastConnections = "least-connections"
+	// RandomOfTwo picks two healthy backends at random, and uses the one with
+	// fewer open connections ("power of two choices").
+	RandomOfTwo = "random-of-two"
+)
+
+// Policies lists all supported load balancing policies.
+var Policies = []string{RoundRobin, LeastConnections, RandomOfTwo}
+
+// Logger is used by this package to log messages
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Dialer represents a function that can dial a backend.
+type Dialer func() (net.Conn, error)
+
+// HealthCheck builds a check function for a single backend, given a dialer
+// for that backend. The check is run periodically if health checks are on.
+type HealthCheck func(dial Dialer) func() error
+
+// Options for a pool. Zero values disable the corresponding feature.
+type Options struct {
+	// Policy is one of RoundRobin (default), LeastConnections or RandomOfTwo.
+	Policy string
+	// DialTimeout limits the time to dial a single backend.
+	DialTimeout time.Duration
+	// Dial connects to a backend, e.g. to wrap connections in TLS. Defaults
+	// to net.DialTimeout with DialTimeout.
+	Dial func(network, address string) (net.Conn, error)
+	// HealthCheck and HealthCheckInterval configure active health checks.
+	HealthCheck         HealthCheck
+	HealthCheckInterval time.Duration
+	// MaxFailures is the number of consecutive dial failures after which a
+	// backend is ejected for EjectionTime.
+	MaxFailures  int
+	EjectionTime time.Duration
+	// Logger is used to log changes in backend health.
+	Logger Logger
+}
+
+// Pool holds a set of backends and balances connections between them.
+type Pool struct {
+	backends []*Backend
+	options  Options
+	// Counter for round-robin
+	next uint64
+	// Closed to stop health checks
+	quit chan struct{}
+	once sync.Once
+}
+
+// Backend is a single target in a pool.
+type Backend struct {
+	// Address of the backend, as given to New.
+	Address string
+
+	dial  Dialer
+	check func() error
+	// Number of open connections
+	active int64
+
+	mu sync.Mutex
+	// Result of the last active health check
+	healthy   bool
+	lastError error
+	// Consecutive dial failures, and time until which backend is ejected
+	failures     int
+	ejectedUntil time.Time
+
+	openCounter      metrics.Counter
+	dialErrorCounter metrics.Counter
+	ejectionCounter  metrics.Counter
+	healthyGauge     metrics.Gauge
+}
+
+// Status is a snapshot of the state of a backend, for the status endpoint.
+type Status struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+	Active  bool   `json:"active,omitempty"`
+	Open    int64  `json:"open_connections"`
+	Error   string `json:"error,omitempty"`
+}
+
+// New creates a pool for the given targets. The parse function resolves a
+// target into a network and address suitable for net.Dial.
+func New(targets []string, parse func(string) (string, string, error), options Options) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("at least one target is required")
+	}
+	if options.Policy == "" {
+		options.Policy = RoundRobin
+	}
+	if !ValidPolicy(options.Policy) {
+		return nil, fmt.Errorf("invalid load balancing policy '%s' (must be one of: %s)", options.Policy, strings.Join(Policies, ", "))
+	}
+
+	p := &Pool{options: options, quit: make(chan struct{})}
+	for _, target := range targets {
+		network, address, err := parse(target)
+		if err != nil {
+			return nil, err
+		}
+		p.backends = append(p.backends, newBackend(target, network, address, options))
+	}
+	return p, nil
+}
+
+// ValidPolicy returns true if the given load balancing policy is supported.
+func ValidPolicy(policy string) bool {
+	for _, p := range Policies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func newBackend(target, network, address string, options Options) *Backend {
+	timeout := options.DialTimeout
+	b := backendWithDialer(target, func() (net.Conn, error) {
+		if options.Dial != nil {
+			return options.Dial(network, address)
+		}
+		return net.DialTimeout(network, address, timeout)
+	})
+	if options.HealthCheck != nil {
+		b.check = options.HealthCheck(b.dial)
+	}
+	return b
+}
+
+func backendWithDialer(target string, dial Dialer) *Backend {
+	b := &Backend{
+		Address:          target,
+		dial:             dial,
+		healthy:          true,
+		openCounter:      metrics.GetOrRegisterCounter(metricName(target, "conn.open"), metrics.DefaultRegistry),
+		dialErrorCounter: metrics.GetOrRegisterCounter(metricName(target, "dial.error"), metrics.DefaultRegistry),
+		ejectionCounter:  metrics.GetOrRegisterCounter(metricName(target, "ejections"), metrics.DefaultRegistry),
+		healthyGauge:     metrics.GetOrRegisterGauge(metricName(target, "healthy"), metrics.DefaultRegistry),
+	}
+	b.healthyGauge.Update(1)
+	return b
+}
+
+// Metric names for a backend, e.g. "backend.localhost_8080.conn.open".
+func metricName(target, name string) string {
+	replacer := strings.NewReplacer(".", "_", ":", "_", "/", "_", "[", "", "]", "")
+	return fmt.Sprintf("backend.%s.%s", replacer.Replace(target), name)
+}
+
+// Start runs active health checks in the background, if enabled.
+func (p *Pool) Start() {
+	if p.options.HealthCheck == nil || p.options.HealthCheckInterval <= 0 {
+		return
+	}
+	for _, b := range p.backends {
+		go p.healthCheckLoop(b)
+	}
+}
+
+// Stop stops active health checks. Open connections are not affected.
+func (p *Pool) Stop() {
+	p.once.Do(func() { close(p.quit) })
+}
+
+func (p *Pool) healthCheckLoop(b *Backend) {
+	ticker := time.NewTicker(p.options.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.runHealthCheck(b)
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) runHealthCheck(b *Backend) {
+	err := b.check()
+
+	b.mu.Lock()
+	changed := b.healthy != (err == nil)
+	b.healthy = err == nil
+	b.lastError = err
+	b.mu.Unlock()
+
+	if err == nil {
+		b.healthyGauge.Update(1)
+	} else {
+		b.healthyGauge.Update(0)
+	}
+	if changed {
+		p.logf("backend %s is now %s", b.Address, healthString(err))
+	}
+}
+
+func healthString(err error) string {
+	if err == nil {
+		return "healthy"
+	}
+	return fmt.Sprintf("unhealthy: %s", err)
+}
+
+// Dial picks a backend according to the load balancing policy and dials it.
+// If dialing fails, the remaining healthy backends are tried in turn. If no
+// backend is healthy, all backends are tried as a last resort.
+func (p *Pool) Dial() (net.Conn, error) {
+	candidates := p.available(time.Now())
+	if len(candidates) == 0 {
+		candidates = append([]*Backend{}, p.backends...)
+	}
+
+	var err error
+	for len(candidates) > 0 {
+		i := p.pick(candidates)
+		b := candidates[i]
+
+		var conn net.Conn
+		conn, err = b.connect(p)
+		if err == nil {
+			return conn, nil
+		}
+		candidates = append(candidates[:i], candidates[i+1:]...)
+	}
+	return nil, err
+}
+
+// Backends that are healthy and not ejected.
+func (p *Pool) available(now time.Time) []*Backend {
+	out := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		b.mu.Lock()
+		ok := b.healthy && !now.Before(b.ejectedUntil)
+		b.mu.Unlock()
+		if ok {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// Pick a backend from candidates, returns its index.
+func (p *Pool) pick(candidates []*Backend) int {
+	n := len(candidates)
+	if n == 1 {
+		return 0
+	}
+	switch p.options.Policy {
+	case LeastConnections:
+		// Start at a rotating offset, so that ties are spread evenly.
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+		best := start
+		for j := 1; j < n; j++ {
+			i := (start + j) % n
+			if candidates[i].openConns() < candidates[best].openConns() {
+				best = i
+			}
+		}
+		return best
+	case RandomOfTwo:
+		// #nosec G404 -- no need for secure randomness in load balancing
+		a, b := rand.Intn(n), rand.Intn(n-1)
+		if b >= a {
+			b++
+		}
+		if candidates[b].openConns() < candidates[a].openConns() {
+			return b
+		}
+		return a
+	default:
+		return int((atomic.AddUint64(&p.next, 1) - 1) % uint64(n))
+	}
+}
+
+// Status returns a snapshot of the state of all backends.
+func (p *Pool) Status() []Status {
+	now := time.Now()
+	out := make([]Status, len(p.backends))
+	for i, b := range p.backends {
+		b.mu.Lock()
+		out[i] = Status{
+			Address: b.Address,
+			Healthy: b.healthy,
+			Ejected: now.Before(b.ejectedUntil),
+			Open:    b.openConns(),
+		}
+		if b.lastError != nil {
+			out[i].Error = b.lastError.Error()
+		}
+		b.mu.Unlock()
+	}
+	return out
+}
+
+func (p *Pool) logf(format string, v ...interface{}) {
+	if p.options.Logger != nil {
+		p.options.Logger.Printf(format, v...)
+	}
+}
+
+func (b *Backend) openConns() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Dial the backend, and keep track of failures for passive ejection.
+func (b *Backend) connect(p *Pool) (net.Conn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		b.dialErrorCounter.Inc(1)
+		b.mu.Lock()
+		b.failures++
+		b.lastError = err
+		eject := p.options.MaxFailures > 0 && b.failures >= p.options.MaxFailures && p.options.EjectionTime > 0
+		if eject {
+			b.failures = 0
+			b.ejectedUntil = time.Now().Add(p.options.EjectionTime)
+		}
+		b.mu.Unlock()
+		if eject {
+			b.ejectionCounter.Inc(1)
+			p.logf("ejecting backend %s for %s after repeated dial errors: %s", b.Address, p.options.EjectionTime, err)
+		}
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+
+	return b.track(conn), nil
+}
+
+// Keep track of an open connection to the backend.
+func (b *Backend) track(conn net.Conn) net.Conn {
+	atomic.AddInt64(&b.active, 1)
+	b.openCounter.Inc(1)
+	return &trackedConn{Conn: conn, backend: b}
+}
+
+// trackedConn decrements the open connection count of a backend on close.
+type trackedConn struct {
+	net.Conn
+	backend *Backend
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.backend.active, -1)
+		c.backend.openCounter.Dec(1)
+	})
+	return c.Conn.Close()
+}
+
+// Unwrap returns the underlying connection, so that callers can still
+// half-close TCP and UNIX sockets.
+func (c *trackedConn) Unwrap() net.Conn {
+	return c.Conn
+}
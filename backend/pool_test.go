@@ -0,0 +1,277 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLogger struct{}
+
+func (t *testLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+func parseTCP(target string) (string, string, error) {
+	if target == "invalid" {
+		return "", "", errors.New("invalid address")
+	}
+	return "tcp", target, nil
+}
+
+// Start n listeners that accept (and hold on to) connections.
+func testBackends(t *testing.T, n int) ([]string, func()) {
+	targets := []string{}
+	listeners := []net.Listener{}
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err, "should be able to listen on random port")
+		go func() {
+			for {
+				if _, err := ln.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+		targets = append(targets, ln.Addr().String())
+		listeners = append(listeners, ln)
+	}
+	return targets, func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+}
+
+// Address of a port that nobody is listening on.
+func closedPort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(nil, parseTCP, Options{})
+	assert.NotNil(t, err, "should reject empty target list")
+
+	_, err = New([]string{"localhost:8080"}, parseTCP, Options{Policy: "invalid"})
+	assert.NotNil(t, err, "should reject invalid policy")
+
+	_, err = New([]string{"localhost:8080", "invalid"}, parseTCP, Options{})
+	assert.NotNil(t, err, "should reject invalid target")
+
+	assert.True(t, ValidPolicy(RandomOfTwo))
+	assert.False(t, ValidPolicy("invalid"))
+}
+
+func TestRoundRobin(t *testing.T) {
+	targets, cleanup := testBackends(t, 3)
+	defer cleanup()
+
+	pool, err := New(targets, parseTCP, Options{Policy: RoundRobin, DialTimeout: time.Second})
+	assert.Nil(t, err, "should create pool")
+
+	for i := 0; i < 6; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should dial backend")
+		assert.Equal(t, targets[i%3], conn.RemoteAddr().String(), "should cycle through backends")
+		defer conn.Close()
+	}
+
+	for _, status := range pool.Status() {
+		assert.Equal(t, int64(2), status.Open, "each backend should have two open connections")
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	targets, cleanup := testBackends(t, 2)
+	defer cleanup()
+
+	pool, err := New(targets, parseTCP, Options{Policy: LeastConnections, DialTimeout: time.Second})
+	assert.Nil(t, err, "should create pool")
+
+	// Open two connections, close the one on the first backend.
+	first, err := pool.Dial()
+	assert.Nil(t, err, "should dial backend")
+	second, err := pool.Dial()
+	assert.Nil(t, err, "should dial backend")
+	defer second.Close()
+	assert.NotEqual(t, first.RemoteAddr().String(), second.RemoteAddr().String(), "should spread connections")
+
+	target := first.RemoteAddr().String()
+	first.Close()
+	first.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should dial backend")
+		assert.Equal(t, target, conn.RemoteAddr().String(), "should pick backend with fewer connections")
+		conn.Close()
+	}
+}
+
+func TestRandomOfTwo(t *testing.T) {
+	targets, cleanup := testBackends(t, 2)
+	defer cleanup()
+
+	pool, err := New(targets, parseTCP, Options{Policy: RandomOfTwo, DialTimeout: time.Second})
+	assert.Nil(t, err, "should create pool")
+
+	// With two backends, both are always compared, so connections alternate.
+	for i := 0; i < 4; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should dial backend")
+		defer conn.Close()
+	}
+	for _, status := range pool.Status() {
+		assert.Equal(t, int64(2), status.Open, "connections should be balanced")
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	targets, cleanup := testBackends(t, 1)
+	defer cleanup()
+	down := closedPort(t)
+
+	pool, err := New([]string{down, targets[0]}, parseTCP, Options{
+		Policy:       RoundRobin,
+		DialTimeout:  time.Second,
+		MaxFailures:  2,
+		EjectionTime: time.Hour,
+		Logger:       &testLogger{},
+	})
+	assert.Nil(t, err, "should create pool")
+
+	// Dial errors fall through to the healthy backend.
+	for i := 0; i < 4; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should fall back to healthy backend")
+		assert.Equal(t, targets[0], conn.RemoteAddr().String())
+		conn.Close()
+	}
+
+	status := pool.Status()
+	assert.True(t, status[0].Ejected, "failing backend should be ejected")
+	assert.NotEmpty(t, status[0].Error, "should report dial error")
+	assert.False(t, status[1].Ejected, "healthy backend should not be ejected")
+}
+
+func TestAllBackendsDown(t *testing.T) {
+	pool, err := New([]string{closedPort(t), closedPort(t)}, parseTCP, Options{
+		DialTimeout:  time.Second,
+		MaxFailures:  1,
+		EjectionTime: time.Hour,
+	})
+	assert.Nil(t, err, "should create pool")
+
+	_, err = pool.Dial()
+	assert.NotNil(t, err, "should fail if all backends are down")
+
+	// Even if all backends are ejected, we still try them.
+	_, err = pool.Dial()
+	assert.NotNil(t, err, "should fail if all backends are down")
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	targets, cleanup := testBackends(t, 2)
+	defer cleanup()
+
+	unhealthy := targets[0]
+	pool, err := New(targets, parseTCP, Options{
+		DialTimeout: time.Second,
+		HealthCheck: func(dial Dialer) func() error {
+			return func() error {
+				conn, err := dial()
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				if conn.RemoteAddr().String() == unhealthy {
+					return errors.New("unhealthy")
+				}
+				return nil
+			}
+		},
+		HealthCheckInterval: 10 * time.Millisecond,
+		Logger:              &testLogger{},
+	})
+	assert.Nil(t, err, "should create pool")
+
+	pool.Start()
+	defer pool.Stop()
+
+	assert.Eventually(t, func() bool {
+		return !pool.Status()[0].Healthy
+	}, 5*time.Second, 10*time.Millisecond, "should mark backend as unhealthy")
+
+	for i := 0; i < 4; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should dial healthy backend")
+		assert.Equal(t, targets[1], conn.RemoteAddr().String(), "should skip unhealthy backend")
+		conn.Close()
+	}
+
+	// Stop should be idempotent
+	pool.Stop()
+}
+
+func TestUnwrap(t *testing.T) {
+	targets, cleanup := testBackends(t, 1)
+	defer cleanup()
+
+	pool, err := New(targets, parseTCP, Options{DialTimeout: time.Second})
+	assert.Nil(t, err, "should create pool")
+
+	conn, err := pool.Dial()
+	assert.Nil(t, err, "should dial backend")
+	defer conn.Close()
+
+	_, ok := conn.(interface{ Unwrap() net.Conn }).Unwrap().(*net.TCPConn)
+	assert.True(t, ok, "should unwrap to TCP connection")
+}
+
+func TestCustomDial(t *testing.T) {
+	targets, cleanup := testBackends(t, 1)
+	defer cleanup()
+
+	dialed := []string{}
+	pool, err := New(targets, parseTCP, Options{
+		Dial: func(network, address string) (net.Conn, error) {
+			dialed = append(dialed, network+":"+address)
+			return net.Dial(network, address)
+		},
+	})
+	assert.Nil(t, err, "should create pool")
+
+	conn, err := pool.Dial()
+	assert.Nil(t, err, "should dial backend")
+	defer conn.Close()
+	assert.Equal(t, []string{"tcp:" + targets[0]}, dialed, "should use custom dial function")
+}
+
+func TestMetricName(t *testing.T) {
+	assert.Equal(t, "backend.localhost_8080.healthy", metricName("localhost:8080", "healthy"))
+	assert.Equal(t, "backend.unix__tmp_foo_sock.healthy", metricName("unix:/tmp/foo.sock", "healthy"))
+	assert.Equal(t, "backend.__1_8080.healthy", metricName("[::1]:8080", "healthy"))
+}
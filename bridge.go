@@ -0,0 +1,132 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
+)
+
+// Bridging between two PKIs: in server mode, connections can be re-encrypted
+// towards targets that require TLS themselves, and in client mode the
+// listener can terminate TLS from applications. Both use credentials of
+// their own, separate from those of the tunnel.
+
+// targetTLS dials targets with TLS in server mode, presenting its own client
+// certificate and verifying targets against its own trust bundle.
+type targetTLS struct {
+	source     certloader.TLSConfigSource
+	config     certloader.TLSClientConfig
+	serverName string
+}
+
+// Build the TLS client config for targets. Without a server name override,
+// the host of each target is used for hostname verification.
+func newTargetTLS(creds config.Credentials, serverName string) (*targetTLS, error) {
+	source, err := bridgeTLSConfigSource(creds)
+	if err != nil {
+		return nil, err
+	}
+	base, err := buildClientConfig(*enabledCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig, err := source.GetClientConfig(base)
+	if err != nil {
+		return nil, err
+	}
+	return &targetTLS{source: source, config: clientConfig, serverName: serverName}, nil
+}
+
+// Dial a target (with network and address as returned by
+// socket.ParseAddress). Connections are plain if t is nil.
+func (t *targetTLS) dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	if t == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+	serverName := t.serverName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("no server name for target '%s'", address)
+		}
+		serverName = strings.TrimSuffix(host, ".")
+	}
+	config := serverNameConfig{t.config, serverName}
+	return certloader.DialerWithCertificate(config, timeout, &net.Dialer{Timeout: timeout}).Dial(network, address)
+}
+
+// Reload the credentials for targets, if any.
+func (t *targetTLS) reload() error {
+	if t == nil {
+		return nil
+	}
+	return t.source.Reload()
+}
+
+// Build the TLS config source for the target or listener of a bridge.
+// Unlike tunnel credentials, these never fall back to the global flags:
+// without a certificate, only the CA bundle (or system roots) is used.
+func bridgeTLSConfigSource(creds config.Credentials) (certloader.TLSConfigSource, error) {
+	if creds.IsEmpty() {
+		cert, err := certloader.NoCertificate(creds.CACert)
+		if err != nil {
+			return nil, err
+		}
+		return certloader.TLSConfigSourceFromCertificate(cert, logger), nil
+	}
+	return credentialsTLSConfigSource(creds, false)
+}
+
+// Build the TLS config for a listener in client mode. Applications must
+// present a certificate signed by the CA bundle, if one was given.
+func listenTLSConfig(source certloader.TLSConfigSource, requireClientCert bool) (certloader.TLSServerConfig, error) {
+	config, err := buildServerConfig(*enabledCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if !requireClientCert {
+		config.ClientAuth = tls.NoClientCert
+	}
+	return source.GetServerConfig(config)
+}
+
+// Credentials for targets in server mode, from the --target-* flags.
+func serverTargetCredentials() config.Credentials {
+	return config.Credentials{
+		Keystore:  *serverTargetKeystore,
+		Cert:      *serverTargetCert,
+		Key:       *serverTargetKey,
+		StorePass: *serverTargetStorePass,
+		CACert:    *serverTargetCACert,
+	}
+}
+
+// Credentials for the listener in client mode, from the --listen-* flags.
+func clientListenCredentials() config.Credentials {
+	return config.Credentials{
+		Keystore:  *clientListenKeystore,
+		Cert:      *clientListenCert,
+		Key:       *clientListenKey,
+		StorePass: *clientListenStorePass,
+		CACert:    *clientListenCACert,
+	}
+}
@@ -0,0 +1,137 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTargetTLSFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	*serverForwardAddress = []string{"localhost:8443"}
+	*serverALPNTargets = map[string]string{}
+	defer func() {
+		*serverForwardAddress = nil
+		*serverTargetTLS = false
+		*serverTargetCert = ""
+		*serverTargetKey = ""
+		*serverTargetKeystore = ""
+		*serverTargetCACert = ""
+		*serverTargetServerName = ""
+		*serverProxyProtocol = false
+	}()
+
+	*serverTargetCACert = "ca.pem"
+	assert.NotNil(t, serverValidateFlags(), "--target-cacert requires --target-tls")
+
+	*serverTargetTLS = true
+	assert.Nil(t, serverValidateFlags(), "--target-tls with --target-cacert should be valid")
+
+	*serverTargetCert = "cert.pem"
+	assert.NotNil(t, serverValidateFlags(), "--target-cert requires --target-key")
+	*serverTargetKey = "key.pem"
+	assert.Nil(t, serverValidateFlags(), "--target-cert/--target-key should be valid")
+
+	*serverTargetKeystore = "keystore.p12"
+	assert.NotNil(t, serverValidateFlags(), "--target-keystore and --target-cert are mutually exclusive")
+	*serverTargetKeystore = ""
+
+	*serverProxyProtocol = true
+	assert.NotNil(t, serverValidateFlags(), "--target-tls and --proxy-protocol are mutually exclusive")
+	*serverProxyProtocol = false
+
+	*serverForwardAddress = []string{"unix:/tmp/backend.sock"}
+	assert.NotNil(t, serverValidateFlags(), "unix targets require --target-server-name")
+	*serverTargetServerName = "backend"
+	assert.Nil(t, serverValidateFlags(), "unix targets with --target-server-name should be valid")
+}
+
+func TestClientListenTLSFlagValidation(t *testing.T) {
+	setValidClientFlags(t)
+	defer func() {
+		*clientListenCert = ""
+		*clientListenKey = ""
+		*clientListenKeystore = ""
+		*clientListenCACert = ""
+	}()
+
+	assert.Nil(t, clientValidateFlags(), "plain listener should be valid")
+
+	*clientListenCACert = "ca.pem"
+	assert.NotNil(t, clientValidateFlags(), "--listen-cacert requires a certificate")
+
+	*clientListenKeystore = "keystore.p12"
+	assert.Nil(t, clientValidateFlags(), "--listen-keystore should be valid")
+
+	*clientListenCert = "cert.pem"
+	*clientListenKey = "key.pem"
+	assert.NotNil(t, clientValidateFlags(), "--listen-keystore and --listen-cert are mutually exclusive")
+	*clientListenKeystore = ""
+	assert.Nil(t, clientValidateFlags(), "--listen-cert/--listen-key should be valid")
+
+	*clientListenKey = ""
+	assert.NotNil(t, clientValidateFlags(), "--listen-cert requires --listen-key")
+}
+
+func TestTargetTLSServerName(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+
+	cert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-key.pem")
+	assert.Nil(t, err, "should load server certificate")
+	target, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// Without an override, the host of the target is verified.
+	withTLS, err := newTargetTLS(config.Credentials{CACert: "test-keys/cacert.pem"}, "")
+	assert.Nil(t, err, "should load CA bundle")
+	conn, err := withTLS.dial("tcp", target.Addr().String(), 5*time.Second)
+	assert.Nil(t, err, "should verify target by IP address")
+	if err == nil {
+		conn.Close()
+	}
+
+	withTLS, err = newTargetTLS(config.Credentials{CACert: "test-keys/cacert.pem"}, "backend.example.com")
+	assert.Nil(t, err, "should load CA bundle")
+	_, err = withTLS.dial("tcp", target.Addr().String(), 5*time.Second)
+	assert.NotNil(t, err, "should reject target that doesn't match the server name")
+
+	// Without TLS, connections are plain.
+	var plain *targetTLS
+	conn, err = plain.dial("tcp", target.Addr().String(), 5*time.Second)
+	assert.Nil(t, err, "should dial plain connection")
+	if err == nil {
+		_, ok := conn.(*net.TCPConn)
+		assert.True(t, ok, "should be a plain TCP connection")
+		conn.Close()
+	}
+	assert.Nil(t, plain.reload(), "reload without TLS is a no-op")
+}
@@ -18,7 +18,18 @@ package certloader
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+
+	"github.com/ghostunnel/ghostunnel/socket"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	rejectedSourceCounter = metrics.GetOrRegisterCounter("source.rejected", metrics.DefaultRegistry)
+
+	errRejectedSource = errors.New("source address not allowed")
 )
 
 // Listener holds a *net.Listener, wrapping incoming connections in TLS,
@@ -28,7 +39,9 @@ import (
 type Listener struct {
 	net.Listener
 
-	config TLSServerConfig
+	mu      sync.RWMutex
+	config  TLSServerConfig
+	sources *socket.SourceFilter
 }
 
 func NewListener(listener net.Listener, config TLSServerConfig) *Listener {
@@ -38,10 +51,85 @@ func NewListener(listener net.Listener, config TLSServerConfig) *Listener {
 	}
 }
 
+// Accept waits for the next connection and wraps it in TLS. If a source
+// filter is set, connections from other sources fail before the TLS
+// handshake starts, so that they cost as little as possible.
 func (l *Listener) Accept() (net.Conn, error) {
 	c, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
-	return tls.Server(c, l.config.GetServerConfig()), nil
+	if sources := l.getSourceFilter(); sources != nil {
+		c = &sourceCheckedConn{Conn: c, sources: sources}
+	}
+	return tls.Server(c, l.getConfig().GetServerConfig()), nil
+}
+
+// SetConfig replaces the TLS configuration used for new incoming connections,
+// e.g. to apply updated access control settings. Connections that were already
+// accepted are not affected.
+func (l *Listener) SetConfig(config TLSServerConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+func (l *Listener) getConfig() TLSServerConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.config
+}
+
+// SetSourceFilter sets the filter for the sources of new incoming connections,
+// or disables it if nil.
+func (l *Listener) SetSourceFilter(sources *socket.SourceFilter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sources = sources
+}
+
+func (l *Listener) getSourceFilter() *socket.SourceFilter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sources
+}
+
+// sourceCheckedConn checks the source of a connection on first use, i.e.
+// when the TLS handshake reads the ClientHello. The source isn't checked in
+// Accept, because the remote address may only be known once a PROXY protocol
+// header was read, and waiting for it would hold up other connections.
+type sourceCheckedConn struct {
+	net.Conn
+	sources *socket.SourceFilter
+	once    sync.Once
+	err     error
+}
+
+func (c *sourceCheckedConn) check() {
+	if !c.sources.Allowed(c.Conn.RemoteAddr()) {
+		rejectedSourceCounter.Inc(1)
+		c.err = errRejectedSource
+		_ = c.Conn.Close()
+	}
+}
+
+func (c *sourceCheckedConn) Read(b []byte) (int, error) {
+	c.once.Do(c.check)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *sourceCheckedConn) Write(b []byte) (int, error) {
+	c.once.Do(c.check)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+// Unwrap returns the underlying connection.
+func (c *sourceCheckedConn) Unwrap() net.Conn {
+	return c.Conn
 }
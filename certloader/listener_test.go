@@ -0,0 +1,122 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/socket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticServerConfig struct{}
+
+func (staticServerConfig) GetServerConfig() *tls.Config {
+	return &tls.Config{}
+}
+
+// Accept connections from the listener and report their handshake results.
+func acceptHandshakes(listener net.Listener) <-chan error {
+	results := make(chan error, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				results <- conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return results
+}
+
+func TestListenerSourceFilter(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	listener := NewListener(raw, staticServerConfig{})
+	defer listener.Close()
+
+	sources, err := socket.LoadSourceFilter(nil, []string{"127.0.0.0/8"})
+	require.Nil(t, err)
+	listener.SetSourceFilter(sources)
+	results := acceptHandshakes(listener)
+
+	rejected := rejectedSourceCounter.Count()
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "connection from denied source should be closed")
+	assert.Equal(t, errRejectedSource, <-results)
+	assert.Equal(t, rejected+1, rejectedSourceCounter.Count())
+
+	// Without a filter, the handshake goes ahead (and fails on the garbage
+	// we send, rather than on the source).
+	listener.SetSourceFilter(nil)
+	conn, err = net.Dial("tcp", raw.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello"))
+	select {
+	case err := <-results:
+		assert.NotEqual(t, errRejectedSource, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection should be handshaked without filter")
+	}
+	assert.Equal(t, rejected+1, rejectedSourceCounter.Count())
+}
+
+func TestListenerSourceFilterDoesntWaitForProxyHeader(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	trusted, err := socket.ParseCIDRs([]string{"127.0.0.0/8"})
+	require.Nil(t, err)
+	listener := NewListener(socket.AcceptProxyProtocol(raw, trusted, 10*time.Second), staticServerConfig{})
+	defer listener.Close()
+
+	sources, err := socket.LoadSourceFilter(nil, []string{"192.0.2.0/24"})
+	require.Nil(t, err)
+	listener.SetSourceFilter(sources)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	// A client that never sends its PROXY header is accepted right away; its
+	// source is checked once the handshake starts.
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("accept should not wait for the PROXY header")
+	}
+}
@@ -0,0 +1,1223 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ModeServer is a tunnel that terminates TLS and forwards to a plain target.
+	ModeServer = "server"
+	// ModeClient is a tunnel that accepts plain connections and forwards over TLS.
+	ModeClient = "client"
+	// ModePassthrough is a tunnel that forwards TLS connections as-is, picking
+	// the target based on the server name in the ClientHello.
+	ModePassthrough = "passthrough"
+)
+
+// Config is the top-level structure of a configuration file.
+type Config struct {
+	// Tunnels lists all tunnels that should be run by the process.
+	Tunnels []Tunnel `yaml:"tunnels"`
+}
+
+// Tunnel describes a single listener/target pair, equivalent to the flags
+// accepted by the "server" or "client" commands.
+type Tunnel struct {
+	// Name uniquely identifies a tunnel in logs and on the status endpoint.
+	Name string `yaml:"name"`
+	// Mode is either "server", "client" or "passthrough".
+	Mode string `yaml:"mode"`
+
+	// Listen and Target, with the same syntax as the --listen/--target flags.
+	Listen string `yaml:"listen"`
+	Target string `yaml:"target"`
+
+	// Targets lists multiple targets. In server mode, connections are balanced
+	// between them. In client mode, they're tried in order of priority.
+	// Mutually exclusive with Target.
+	Targets []string `yaml:"targets"`
+	// Balance configures load balancing and health checks for Targets
+	// (server only).
+	Balance Balance `yaml:"balance"`
+	// Failover configures failover between Targets (client only).
+	Failover Failover `yaml:"failover"`
+
+	// Routes selects the target based on the TLS server name (SNI) sent by
+	// clients (server and passthrough only). Mutually exclusive with Target
+	// and Targets in server mode. In passthrough mode, Target is used for
+	// connections that don't match any route.
+	Routes []Route `yaml:"routes"`
+
+	// ALPN lists the protocols to advertise (server) or request (client) via
+	// ALPN, in order of preference.
+	ALPN []string `yaml:"alpn"`
+	// ALPNTargets maps protocols negotiated via ALPN to the target to use for
+	// them, instead of Target or Targets (server only).
+	ALPNTargets map[string]string `yaml:"alpn-targets"`
+
+	// Multiplex carries connections as streams over a few long-lived TLS
+	// connections between a ghostunnel client and server.
+	Multiplex Multiplex `yaml:"multiplex"`
+	// QUIC carries connections as streams over QUIC connections between a
+	// ghostunnel client and server, instead of TLS over TCP. Servers listen
+	// on the UDP port of Listen.
+	QUIC bool `yaml:"quic"`
+	// WebSocket carries connections between a ghostunnel client and server
+	// over WebSocket (wss://) connections, e.g. to traverse HTTP-only proxies.
+	WebSocket WebSocket `yaml:"websocket"`
+
+	// HTTP parses HTTP requests on incoming connections and forwards them to
+	// the target as a reverse proxy, instead of copying bytes (server only).
+	HTTP HTTP `yaml:"http"`
+
+	// ForwardProxy accepts HTTP CONNECT and/or SOCKS5 requests on the
+	// listener, and connects to the destination requested by the application
+	// instead of a fixed target (client only). Mutually exclusive with Target
+	// and Targets.
+	ForwardProxy ForwardProxy `yaml:"forward-proxy"`
+
+	// TargetTLS connects to the target with TLS, using a client identity and
+	// trust bundle of its own (server only).
+	TargetTLS TargetTLS `yaml:"target-tls"`
+	// ListenTLS terminates TLS on the listener (client only).
+	ListenTLS ListenTLS `yaml:"listen-tls"`
+	// ListenProtocol accepts in-protocol upgrades to TLS (STARTTLS) from
+	// clients for the given protocol: postgres, smtp or ldap (server only).
+	ListenProtocol string `yaml:"listen-protocol"`
+	// TargetProtocol upgrades connections to the target to TLS in-protocol
+	// (STARTTLS) for the given protocol: postgres, mysql, smtp or ldap
+	// (client only).
+	TargetProtocol string `yaml:"target-protocol"`
+
+	// TargetStatus is an HTTP(S) URL for backend health checks (server only).
+	TargetStatus string `yaml:"target-status"`
+	// UnsafeTarget allows non-local targets (server only).
+	UnsafeTarget bool `yaml:"unsafe-target"`
+	// UnsafeListen allows non-local listen addresses (client only).
+	UnsafeListen bool `yaml:"unsafe-listen"`
+	// AcceptProxyProtocol lists CIDR ranges of load balancers that may send
+	// PROXY protocol headers in front of incoming connections (server and
+	// passthrough only).
+	AcceptProxyProtocol []string `yaml:"accept-proxy-protocol"`
+	// ProxyProtocol enables the PROXY protocol towards the target (server
+	// only).
+	ProxyProtocol bool `yaml:"proxy-protocol"`
+	// ProxyProtocolVersion is the version of the PROXY protocol to use, 1 or
+	// 2. Zero defaults to 2.
+	ProxyProtocolVersion int `yaml:"proxy-protocol-version"`
+	// ServerName overrides the name used for hostname verification (client only).
+	ServerName string `yaml:"override-server-name"`
+	// ConnectProxy is an HTTP(S) CONNECT or SOCKS5 proxy URL (client only).
+	ConnectProxy string `yaml:"connect-proxy"`
+	// ConnectProxies is a chain of proxies to connect through, in order
+	// (client only). Mutually exclusive with ConnectProxy.
+	ConnectProxies []string `yaml:"connect-proxies"`
+	// ConnectProxyAuthFile holds credentials (user:password) for proxies
+	// that don't have any in their URL (client only).
+	ConnectProxyAuthFile string `yaml:"connect-proxy-auth-file"`
+	// ConnectProxyFromEnv picks the proxy from HTTPS_PROXY/HTTP_PROXY and
+	// NO_PROXY (client only).
+	ConnectProxyFromEnv bool `yaml:"connect-proxy-from-env"`
+
+	// DisableAuthentication disables client certificates (server: don't
+	// require one, client: don't present one).
+	DisableAuthentication bool `yaml:"disable-authentication"`
+
+	Credentials Credentials `yaml:"credentials"`
+	Access      Access      `yaml:"access"`
+	Timeouts    Timeouts    `yaml:"timeouts"`
+	// Limits on connections to the listener of this tunnel, on top of the
+	// global limits (which apply to all tunnels together).
+	Limits Limits `yaml:"limits"`
+	// Quotas limit connections per client identity, once the client was
+	// authenticated (server only).
+	Quotas Quotas `yaml:"quotas"`
+	// RateLimits limit the rate of data read from and written to clients of
+	// this tunnel. Limits that are not set fall back to the global flags.
+	RateLimits RateLimits `yaml:"rate-limits"`
+	// Sources limit the client addresses that may connect, before the TLS
+	// handshake (server only).
+	Sources Sources `yaml:"sources"`
+}
+
+// Route maps a TLS server name (SNI) to a target. Credentials and access
+// control settings are optional, and default to those of the tunnel.
+type Route struct {
+	// ServerName to match, either exact or a wildcard like "*.example.com".
+	ServerName  string      `yaml:"server-name"`
+	Target      string      `yaml:"target"`
+	Credentials Credentials `yaml:"credentials"`
+	Access      Access      `yaml:"access"`
+}
+
+// Credentials selects the certificate source of a tunnel. If left empty, the
+// tunnel uses the credentials given via global flags (e.g. --keystore).
+type Credentials struct {
+	Keystore        string `yaml:"keystore"`
+	Cert            string `yaml:"cert"`
+	Key             string `yaml:"key"`
+	StorePass       string `yaml:"storepass"`
+	CACert          string `yaml:"cacert"`
+	UseWorkloadAPI  bool   `yaml:"use-workload-api"`
+	WorkloadAPIAddr string `yaml:"use-workload-api-addr"`
+}
+
+// Access holds access control settings. In server mode these correspond to
+// the --allow-* flags, in client mode to the --verify-* flags.
+type Access struct {
+	All    bool     `yaml:"all"`
+	CNs    []string `yaml:"cn"`
+	OUs    []string `yaml:"ou"`
+	DNSs   []string `yaml:"dns"`
+	IPs    []net.IP `yaml:"ip"`
+	URIs   []string `yaml:"uri"`
+	Policy string   `yaml:"policy"`
+	Query  string   `yaml:"query"`
+}
+
+// Balance holds load balancing settings for tunnels with multiple targets.
+// Zero values inherit the corresponding global flag (e.g. --target-balance).
+type Balance struct {
+	Policy              string        `yaml:"policy"`
+	HealthCheckInterval time.Duration `yaml:"health-check-interval"`
+	MaxFailures         int           `yaml:"max-failures"`
+	EjectionTime        time.Duration `yaml:"ejection-time"`
+}
+
+// Failover holds settings for client tunnels with multiple targets. Zero
+// values inherit the corresponding global flag (e.g. --target-backoff).
+type Failover struct {
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max-backoff"`
+}
+
+// Multiplex holds stream multiplexing settings. Servers accept multiplexed
+// sessions from clients that offer them, clients open them.
+type Multiplex struct {
+	Enabled bool `yaml:"enabled"`
+	// Connections is the number of TLS connections to keep open to the
+	// server (client only). Zero inherits --multiplex-connections.
+	Connections int `yaml:"connections"`
+}
+
+// WebSocket holds WebSocket settings. Servers accept upgrades from clients
+// that offer them, clients upgrade each connection to the server.
+type WebSocket struct {
+	Enabled bool `yaml:"enabled"`
+	// Path of upgrade requests. Defaults to "/".
+	Path string `yaml:"path"`
+}
+
+// HTTP holds settings for HTTP mode. In HTTP mode, access control settings
+// are checked for each request instead of on the TLS handshake.
+type HTTP struct {
+	Enabled bool `yaml:"enabled"`
+	// Rules for specific methods and paths, checked in order. The first rule
+	// that matches a request decides if it's allowed, other requests are
+	// checked against the access control settings of the tunnel.
+	Rules []HTTPRule `yaml:"rules"`
+}
+
+// HTTPRule grants access to requests with a given method and path, or
+// denies them altogether.
+type HTTPRule struct {
+	// Methods to match, e.g. GET. Matches any method if empty.
+	Methods []string `yaml:"methods"`
+	// Path to match, exact or a prefix like "/api/*".
+	Path   string `yaml:"path"`
+	Access Access `yaml:"access"`
+	// Deny rejects matching requests, instead of checking Access.
+	Deny bool `yaml:"deny"`
+}
+
+// ForwardProxy holds settings for forward proxy listeners in client mode.
+type ForwardProxy struct {
+	// Protocols to accept on the listener, "connect" (HTTP CONNECT) and/or
+	// "socks5".
+	Protocols []string `yaml:"protocols"`
+	// Allow lists the destinations (HOST:PORT patterns) clients may connect
+	// to, with the same syntax as the --allow-destination flag.
+	Allow []string `yaml:"allow"`
+}
+
+// TargetTLS holds settings for TLS connections to the target in server mode,
+// for targets that require TLS themselves.
+type TargetTLS struct {
+	Enabled bool `yaml:"enabled"`
+	// Credentials are the client certificate to present to the target, and
+	// the CA bundle to verify it with (system roots if not set). They don't
+	// fall back to the credentials of the tunnel or the global flags.
+	Credentials Credentials `yaml:"credentials"`
+	// ServerName overrides the name used for hostname verification of the
+	// target, which defaults to its host. Required for UNIX socket targets.
+	ServerName string `yaml:"server-name"`
+}
+
+// ListenTLS holds settings for TLS listeners in client mode. If a CA bundle
+// is given, applications must present a certificate signed by it.
+type ListenTLS struct {
+	Credentials Credentials `yaml:"credentials"`
+}
+
+// Timeouts for a tunnel. Zero values inherit the corresponding global flag.
+type Timeouts struct {
+	Connect         time.Duration `yaml:"connect"`
+	Close           time.Duration `yaml:"close"`
+	MaxConnLifetime time.Duration `yaml:"max-conn-lifetime"`
+	// Handshake limits TLS handshakes (and WebSocket upgrades) with clients.
+	// Zero inherits --handshake-timeout, which falls back to Connect.
+	Handshake time.Duration `yaml:"handshake"`
+	// Dial limits dialing the target of a connection overall, including
+	// retries or failover between targets.
+	Dial time.Duration `yaml:"dial"`
+	// Idle closes connections once either side sent no data for this long.
+	Idle time.Duration `yaml:"idle"`
+	// UDPIdle closes UDP flows without datagrams for this long (client
+	// tunnels with a UDP listener, and server tunnels with a UDP target).
+	UDPIdle time.Duration `yaml:"udp-idle"`
+}
+
+// Limits on connections to a listener. Zero values mean no limit.
+type Limits struct {
+	// MaxConnections pauses accepting connections while this many are open.
+	MaxConnections int `yaml:"max-connections"`
+	// MaxConnectionsPerIP rejects connections from client IP addresses that
+	// have this many open.
+	MaxConnectionsPerIP int `yaml:"max-connections-per-ip"`
+	// MaxHandshakes limits the number of concurrent TLS handshakes.
+	MaxHandshakes int `yaml:"max-handshakes"`
+}
+
+// Sources lists CIDR ranges (or IP addresses) that clients may or may not
+// connect from. Entries of the form file:PATH refer to files with one range
+// per line, which are re-read on reload.
+type Sources struct {
+	// Allow limits clients to these ranges, if not empty.
+	Allow []string `yaml:"allow"`
+	// Deny rejects clients in these ranges, even if allowed.
+	Deny []string `yaml:"deny"`
+}
+
+// IsEmpty returns true if no sources were set.
+func (s Sources) IsEmpty() bool {
+	return len(s.Allow) == 0 && len(s.Deny) == 0
+}
+
+// Quotas limit connections per client identity.
+type Quotas struct {
+	// Key identifies clients by "cn" (the default), "uri" (the first URI
+	// SAN, e.g. a SPIFFE ID) or "opa" (the result of Query).
+	Key string `yaml:"key"`
+	// Query returns the identity of a client from the access policy, for
+	// key "opa".
+	Query string `yaml:"query"`
+	// Default quota for identities without an override.
+	Default Quota `yaml:"default"`
+	// Overrides replace the default quota for specific identities.
+	Overrides map[string]Quota `yaml:"overrides"`
+}
+
+// Quota for a client identity. Zero values mean no limit.
+type Quota struct {
+	// Rate of new connections per second.
+	Rate float64 `yaml:"rate"`
+	// Burst of new connections allowed on top of Rate. Defaults to Rate.
+	Burst int `yaml:"burst"`
+	// MaxConnections limits the number of open connections.
+	MaxConnections int `yaml:"max-connections"`
+	// Read and Write limit the data read from and written to all
+	// connections of the identity together.
+	Read  Bandwidth `yaml:"read"`
+	Write Bandwidth `yaml:"write"`
+}
+
+// RateLimits on data read from clients (and forwarded to the target), and
+// written to them (after being read from the target).
+type RateLimits struct {
+	// Read and Write limit all connections of the tunnel together.
+	Read  Bandwidth `yaml:"read"`
+	Write Bandwidth `yaml:"write"`
+	// ReadPerConn and WritePerConn limit each connection.
+	ReadPerConn  Bandwidth `yaml:"read-per-conn"`
+	WritePerConn Bandwidth `yaml:"write-per-conn"`
+}
+
+// Bandwidth is a data rate in bytes per second, with an optional burst in
+// bytes, as "RATE[:BURST]" (e.g. "1MiB:4MiB"). Sizes take an optional unit:
+// B, KB, MB, GB (powers of 1000) or KiB, MiB, GiB (powers of 1024). An empty
+// bandwidth means no limit.
+type Bandwidth string
+
+// IsEmpty returns true if no credentials were set.
+func (c Credentials) IsEmpty() bool {
+	return c.Keystore == "" && c.Cert == "" && c.Key == "" && !c.UseWorkloadAPI && c.WorkloadAPIAddr == ""
+}
+
+// HasAccessFlags returns true if any subject-based access control was set
+// (not counting All or the OPA policy).
+func (a Access) HasAccessFlags() bool {
+	return len(a.CNs) > 0 || len(a.OUs) > 0 || len(a.DNSs) > 0 || len(a.IPs) > 0 || len(a.URIs) > 0
+}
+
+// IsEmpty returns true if no access control settings were set.
+func (a Access) IsEmpty() bool {
+	return !a.All && !a.HasAccessFlags() && !a.HasPolicy()
+}
+
+// HasPolicy returns true if an OPA policy or query was set.
+func (a Access) HasPolicy() bool {
+	return a.Policy != "" || a.Query != ""
+}
+
+// IsEmpty returns true if HTTP mode wasn't configured.
+func (h HTTP) IsEmpty() bool {
+	return !h.Enabled && len(h.Rules) == 0
+}
+
+// IsEmpty returns true if no forward proxy was configured.
+func (f ForwardProxy) IsEmpty() bool {
+	return len(f.Protocols) == 0 && len(f.Allow) == 0
+}
+
+// IsEmpty returns true if TLS to the target wasn't configured.
+func (t TargetTLS) IsEmpty() bool {
+	return t == TargetTLS{}
+}
+
+// IsEmpty returns true if the listener doesn't terminate TLS.
+func (l ListenTLS) IsEmpty() bool {
+	return l == ListenTLS{}
+}
+
+// IsEmpty returns true if no quota settings were set.
+func (q Quotas) IsEmpty() bool {
+	return q.Key == "" && q.Query == "" && q.Default == Quota{} && len(q.Overrides) == 0
+}
+
+// Enabled returns true if any quota is set.
+func (q Quotas) Enabled() bool {
+	return q.Default != Quota{} || len(q.Overrides) > 0
+}
+
+// Parse returns the rate and burst of a bandwidth. The burst is zero if not
+// given.
+func (b Bandwidth) Parse() (rate, burst int64, err error) {
+	if b == "" {
+		return 0, 0, nil
+	}
+	rateString, burstString, hasBurst := strings.Cut(string(b), ":")
+	rate, err = parseByteSize(rateString)
+	if err == nil && hasBurst {
+		burst, err = parseByteSize(burstString)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid bandwidth '%s': %w", b, err)
+	}
+	if rate == 0 && burst > 0 {
+		return 0, 0, fmt.Errorf("invalid bandwidth '%s': burst requires a rate", b)
+	}
+	return rate, burst, nil
+}
+
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longest suffixes first, so that "KiB" doesn't match "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// Parse a size in bytes, with an optional unit.
+func parseByteSize(size string) (int64, error) {
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSuffix(size, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size '%s' is too large", size)
+	}
+	return n * multiplier, nil
+}
+
+// Load reads and validates a configuration file. Both YAML and JSON are
+// accepted, as JSON documents are also valid YAML.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates a configuration from the given bytes.
+func Parse(data []byte) (*Config, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	config := &Config{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the structure of the config. It does not check if files
+// referenced in the config exist or if addresses can be resolved.
+func (c *Config) Validate() error {
+	if len(c.Tunnels) == 0 {
+		return errors.New("invalid config: at least one tunnel is required")
+	}
+	names := map[string]bool{}
+	for i, t := range c.Tunnels {
+		if t.Name == "" {
+			return fmt.Errorf("invalid config: tunnel #%d has no name", i+1)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("invalid config: duplicate tunnel name '%s'", t.Name)
+		}
+		names[t.Name] = true
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("invalid config for tunnel '%s': %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks a single tunnel for required and conflicting settings. The
+// server and client commands check their flags the same way, as a tunnel.
+func (t Tunnel) Validate() error {
+	if t.Listen == "" {
+		return errors.New("listen address is required")
+	}
+	if t.Target == "" && len(t.Targets) == 0 && len(t.Routes) == 0 && t.ForwardProxy.IsEmpty() {
+		return errors.New("target address is required")
+	}
+	if t.Target != "" && len(t.Targets) > 0 {
+		return errors.New("target and targets are mutually exclusive")
+	}
+	if len(t.Routes) > 0 && len(t.Targets) > 0 {
+		return errors.New("routes are mutually exclusive with targets")
+	}
+	if err := t.Credentials.validate(); err != nil {
+		return err
+	}
+	if err := t.Access.validate(); err != nil {
+		return err
+	}
+	if err := t.validateALPN(); err != nil {
+		return err
+	}
+	if t.Multiplex.Connections < 0 {
+		return errors.New("multiplex connections can't be negative")
+	}
+	if t.Limits.MaxConnections < 0 || t.Limits.MaxConnectionsPerIP < 0 || t.Limits.MaxHandshakes < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if t.ProxyProtocolVersion < 0 || t.ProxyProtocolVersion > 2 {
+		return fmt.Errorf("invalid proxy-protocol-version %d (must be 1 or 2)", t.ProxyProtocolVersion)
+	}
+	if t.ProxyProtocolVersion != 0 && !t.ProxyProtocol {
+		return errors.New("proxy-protocol-version requires proxy-protocol to be enabled")
+	}
+	if err := t.validateUDP(); err != nil {
+		return err
+	}
+	if err := t.validateQUIC(); err != nil {
+		return err
+	}
+	if err := t.validateWebSocket(); err != nil {
+		return err
+	}
+	if err := t.validateQuotas(); err != nil {
+		return err
+	}
+	if err := t.RateLimits.validate(); err != nil {
+		return err
+	}
+	if !t.Sources.IsEmpty() && (t.Mode != ModeServer || t.QUIC) {
+		return errors.New("sources are only valid in server mode, without quic")
+	}
+
+	switch t.Mode {
+	case ModeServer:
+		hasAccess := t.Access.All || t.Access.HasAccessFlags() || t.Access.HasPolicy()
+		if !t.DisableAuthentication && !hasAccess {
+			return errors.New("at least one access control setting (or disable-authentication) is required")
+		}
+		if t.DisableAuthentication && hasAccess {
+			return errors.New("disable-authentication is mutually exclusive with access control settings")
+		}
+		if t.Access.All && (t.Access.HasAccessFlags() || t.Access.HasPolicy()) {
+			return errors.New("access 'all' is mutually exclusive with other access control settings")
+		}
+		if t.Failover != (Failover{}) {
+			return errors.New("failover is only valid in client mode")
+		}
+		if len(t.Routes) > 0 && t.Target != "" {
+			return errors.New("routes are mutually exclusive with target")
+		}
+		if t.Multiplex.Connections > 0 {
+			return errors.New("multiplex connections are only valid in client mode")
+		}
+		if t.hasConnectProxy() || t.ConnectProxyAuthFile != "" {
+			return errors.New("connect proxy settings are only valid in client mode")
+		}
+		if !t.ForwardProxy.IsEmpty() {
+			return errors.New("forward-proxy is only valid in client mode")
+		}
+		if !t.ListenTLS.IsEmpty() {
+			return errors.New("listen-tls is only valid in client mode")
+		}
+		if t.TargetProtocol != "" {
+			return errors.New("target-protocol is only valid in client mode")
+		}
+		if err := t.validateRoutes(); err != nil {
+			return err
+		}
+		if err := t.validateHTTP(); err != nil {
+			return err
+		}
+		if err := t.validateTargetTLS(); err != nil {
+			return err
+		}
+		if err := t.validateListenProtocol(); err != nil {
+			return err
+		}
+	case ModeClient:
+		if t.Access.All {
+			return errors.New("access 'all' is only valid in server mode")
+		}
+		if t.TargetStatus != "" {
+			return errors.New("target-status is only valid in server mode")
+		}
+		if t.Balance != (Balance{}) {
+			return errors.New("balance is only valid in server mode")
+		}
+		if len(t.Routes) > 0 {
+			return errors.New("routes are only valid in server mode")
+		}
+		if len(t.ALPNTargets) > 0 {
+			return errors.New("alpn-targets are only valid in server mode")
+		}
+		if len(t.AcceptProxyProtocol) > 0 {
+			return errors.New("accept-proxy-protocol is only valid in server and passthrough mode")
+		}
+		if t.Multiplex != (Multiplex{}) && !t.Multiplex.Enabled {
+			return errors.New("multiplex connections require multiplex to be enabled")
+		}
+		if t.Multiplex.Enabled && len(t.ALPN) > 0 {
+			return errors.New("alpn can't be used with multiplex in client mode")
+		}
+		if !t.HTTP.IsEmpty() {
+			return errors.New("http is only valid in server mode")
+		}
+		if t.ConnectProxy != "" && len(t.ConnectProxies) > 0 {
+			return errors.New("connect-proxy and connect-proxies are mutually exclusive")
+		}
+		if t.ConnectProxyFromEnv && (t.ConnectProxy != "" || len(t.ConnectProxies) > 0) {
+			return errors.New("connect-proxy-from-env is mutually exclusive with connect-proxy and connect-proxies")
+		}
+		if t.ConnectProxyAuthFile != "" && !t.hasConnectProxy() {
+			return errors.New("connect-proxy-auth-file requires a connect proxy")
+		}
+		if !t.TargetTLS.IsEmpty() {
+			return errors.New("target-tls is only valid in server mode")
+		}
+		if t.ListenProtocol != "" {
+			return errors.New("listen-protocol is only valid in server mode")
+		}
+		if err := t.validateForwardProxy(); err != nil {
+			return err
+		}
+		if err := t.validateListenTLS(); err != nil {
+			return err
+		}
+		if err := t.validateTargetProtocol(); err != nil {
+			return err
+		}
+	case ModePassthrough:
+		if err := t.validatePassthrough(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid mode '%s' (must be server, client or passthrough)", t.Mode)
+	}
+	return nil
+}
+
+// AllTargets returns Targets, the targets of all Routes (followed by Target,
+// if set), or Target as a single-element list.
+func (t Tunnel) AllTargets() []string {
+	if len(t.Targets) > 0 {
+		return t.Targets
+	}
+	if len(t.Routes) > 0 {
+		targets := make([]string, 0, len(t.Routes)+1)
+		for _, r := range t.Routes {
+			targets = append(targets, r.Target)
+		}
+		if t.Target != "" {
+			targets = append(targets, t.Target)
+		}
+		return targets
+	}
+	return []string{t.Target}
+}
+
+// AllConnectProxies returns ConnectProxies, or ConnectProxy as a
+// single-element list (empty if neither is set).
+func (t Tunnel) AllConnectProxies() []string {
+	if len(t.ConnectProxies) > 0 {
+		return t.ConnectProxies
+	}
+	if t.ConnectProxy != "" {
+		return []string{t.ConnectProxy}
+	}
+	return nil
+}
+
+// Returns true if the tunnel connects to its target through a proxy.
+func (t Tunnel) hasConnectProxy() bool {
+	return t.ConnectProxy != "" || len(t.ConnectProxies) > 0 || t.ConnectProxyFromEnv
+}
+
+// Check the forward proxy settings of a client tunnel. The syntax of allowed
+// destinations is checked by the main package.
+func (t Tunnel) validateForwardProxy() error {
+	if t.ForwardProxy.IsEmpty() {
+		return nil
+	}
+	if len(t.ForwardProxy.Protocols) == 0 {
+		return errors.New("forward-proxy requires at least one protocol")
+	}
+	for _, p := range t.ForwardProxy.Protocols {
+		if p != "connect" && p != "socks5" {
+			return fmt.Errorf("invalid forward-proxy protocol '%s' (must be connect or socks5)", p)
+		}
+	}
+	if len(t.ForwardProxy.Allow) == 0 {
+		return errors.New("forward-proxy requires at least one allowed destination")
+	}
+	if t.Target != "" || len(t.Targets) > 0 {
+		return errors.New("forward-proxy is mutually exclusive with target and targets")
+	}
+	if t.Failover != (Failover{}) {
+		return errors.New("failover can't be used with forward-proxy")
+	}
+	if t.Multiplex.Enabled {
+		return errors.New("multiplex can't be used with forward-proxy")
+	}
+	if t.ServerName != "" {
+		return errors.New("override-server-name can't be used with forward-proxy")
+	}
+	return nil
+}
+
+// Check the protocol of a client tunnel's target, if it's upgraded to TLS
+// in-protocol. The upgrade happens on every connection to the target, so it
+// can't be combined with settings that share or negotiate connections.
+func (t Tunnel) validateTargetProtocol() error {
+	switch t.TargetProtocol {
+	case "":
+		return nil
+	case "postgres", "mysql", "smtp", "ldap":
+	default:
+		return fmt.Errorf("invalid target-protocol '%s' (must be postgres, mysql, smtp or ldap)", t.TargetProtocol)
+	}
+	if t.Multiplex.Enabled {
+		return errors.New("target-protocol can't be used with multiplex")
+	}
+	if len(t.ALPN) > 0 {
+		return errors.New("target-protocol can't be used with alpn")
+	}
+	if !t.ForwardProxy.IsEmpty() {
+		return errors.New("target-protocol can't be used with forward-proxy")
+	}
+	return nil
+}
+
+// Check the protocol for which a server tunnel accepts upgrades to TLS, if
+// any. The PROXY protocol header would arrive before the greeting of SMTP
+// targets, which is read and dropped.
+func (t Tunnel) validateListenProtocol() error {
+	switch t.ListenProtocol {
+	case "":
+		return nil
+	case "postgres", "smtp", "ldap":
+	default:
+		return fmt.Errorf("invalid listen-protocol '%s' (must be postgres, smtp or ldap)", t.ListenProtocol)
+	}
+	if t.HTTP.Enabled {
+		return errors.New("listen-protocol can't be used with http")
+	}
+	if t.Multiplex.Enabled {
+		return errors.New("listen-protocol can't be used with multiplex")
+	}
+	if len(t.ALPNTargets) > 0 {
+		return errors.New("listen-protocol can't be used with alpn-targets")
+	}
+	if t.ListenProtocol == "smtp" && t.ProxyProtocol {
+		return errors.New("listen-protocol smtp can't be used with proxy-protocol")
+	}
+	return nil
+}
+
+// Check UDP listeners and targets. Client tunnels may listen on a UDP
+// address, and forward flows to server tunnels with a single UDP target.
+// Flows are carried as frames, so they can't be combined with settings that
+// expect a stream.
+func (t Tunnel) validateUDP() error {
+	udpListen := strings.HasPrefix(t.Listen, "udp:")
+	udpTarget := strings.HasPrefix(t.Target, "udp:")
+	if udpListen && t.Mode != ModeClient {
+		return errors.New("udp listen addresses are only valid in client mode")
+	}
+	if udpTarget && t.Mode != ModeServer {
+		return errors.New("udp targets are only valid in server mode")
+	}
+	others := append([]string{}, t.Targets...)
+	for _, r := range t.Routes {
+		others = append(others, r.Target)
+	}
+	for _, target := range t.ALPNTargets {
+		others = append(others, target)
+	}
+	for _, target := range others {
+		if strings.HasPrefix(target, "udp:") {
+			return errors.New("udp targets can't be used in targets, routes or alpn-targets")
+		}
+	}
+
+	switch {
+	case udpTarget:
+		if len(t.Routes) > 0 || len(t.ALPNTargets) > 0 {
+			return errors.New("udp targets can't be used with routes or alpn-targets")
+		}
+		if t.HTTP.Enabled || t.ProxyProtocol || t.ListenProtocol != "" {
+			return errors.New("udp targets can't be used with http, proxy-protocol or listen-protocol")
+		}
+		if t.Multiplex.Enabled || len(t.ALPN) > 0 || t.TargetTLS.Enabled {
+			return errors.New("udp targets can't be used with multiplex, alpn or target-tls")
+		}
+	case udpListen:
+		if !t.ForwardProxy.IsEmpty() || !t.ListenTLS.IsEmpty() || t.TargetProtocol != "" {
+			return errors.New("udp listen addresses can't be used with forward-proxy, listen-tls or target-protocol")
+		}
+		if t.Multiplex.Enabled || len(t.ALPN) > 0 {
+			return errors.New("udp listen addresses can't be used with multiplex or alpn")
+		}
+	}
+	return nil
+}
+
+// Check tunnels that carry connections over QUIC. Servers listen on a UDP
+// port and clients dial one, and both negotiate a protocol of their own via
+// ALPN, so they can't be combined with settings that expect TLS over TCP.
+func (t Tunnel) validateQUIC() error {
+	if !t.QUIC {
+		return nil
+	}
+	if t.Mode == ModePassthrough {
+		return errors.New("quic is not valid in passthrough mode")
+	}
+	if t.Multiplex.Enabled || len(t.ALPN) > 0 {
+		return errors.New("quic can't be used with multiplex or alpn")
+	}
+	if t.Mode == ModeServer {
+		if !IsHostPort(t.Listen) {
+			return errors.New("quic requires a HOST:PORT listen address in server mode")
+		}
+		if strings.HasPrefix(t.Target, "udp:") {
+			return errors.New("quic can't be used with a udp target")
+		}
+		if len(t.Routes) > 0 || len(t.ALPNTargets) > 0 {
+			return errors.New("quic can't be used with routes or alpn-targets")
+		}
+		if len(t.AcceptProxyProtocol) > 0 || t.ListenProtocol != "" {
+			return errors.New("quic can't be used with accept-proxy-protocol or listen-protocol")
+		}
+		return nil
+	}
+	if strings.HasPrefix(t.Listen, "udp:") {
+		return errors.New("quic can't be used with a udp listen address")
+	}
+	if !t.ForwardProxy.IsEmpty() || t.TargetProtocol != "" || t.hasConnectProxy() {
+		return errors.New("quic can't be used with forward-proxy, target-protocol or connect proxies")
+	}
+	for _, target := range t.AllTargets() {
+		if !IsHostPort(target) {
+			return fmt.Errorf("quic requires HOST:PORT targets, not '%s'", target)
+		}
+	}
+	return nil
+}
+
+// Check tunnels that carry connections over WebSocket. Connections are
+// upgraded after the TLS handshake, and the upgrade is negotiated via ALPN,
+// so they can't be combined with settings that use ALPN or the TLS connection
+// otherwise.
+func (t Tunnel) validateWebSocket() error {
+	if !t.WebSocket.Enabled {
+		if t.WebSocket.Path != "" {
+			return errors.New("websocket path requires websocket to be enabled")
+		}
+		return nil
+	}
+	if t.Mode == ModePassthrough {
+		return errors.New("websocket is not valid in passthrough mode")
+	}
+	if t.WebSocket.Path != "" && !strings.HasPrefix(t.WebSocket.Path, "/") {
+		return fmt.Errorf("invalid websocket path '%s' (must start with '/')", t.WebSocket.Path)
+	}
+	if t.QUIC || t.Multiplex.Enabled || len(t.ALPN) > 0 {
+		return errors.New("websocket can't be used with quic, multiplex or alpn")
+	}
+	if t.Mode == ModeServer {
+		if strings.HasPrefix(t.Target, "udp:") {
+			return errors.New("websocket can't be used with a udp target")
+		}
+		if t.HTTP.Enabled || len(t.ALPNTargets) > 0 || t.ListenProtocol != "" {
+			return errors.New("websocket can't be used with http, alpn-targets or listen-protocol")
+		}
+		return nil
+	}
+	if strings.HasPrefix(t.Listen, "udp:") {
+		return errors.New("websocket can't be used with a udp listen address")
+	}
+	if !t.ForwardProxy.IsEmpty() || t.TargetProtocol != "" {
+		return errors.New("websocket can't be used with forward-proxy or target-protocol")
+	}
+	for _, target := range t.AllTargets() {
+		if !IsHostPort(target) {
+			return fmt.Errorf("websocket requires HOST:PORT targets, not '%s'", target)
+		}
+	}
+	return nil
+}
+
+func (t Tunnel) validateQuotas() error {
+	if t.Quotas.IsEmpty() {
+		return nil
+	}
+	if t.Mode != ModeServer {
+		return errors.New("quotas are only valid in server mode")
+	}
+	if t.DisableAuthentication {
+		return errors.New("quotas can't be used with disable-authentication")
+	}
+	switch t.Quotas.Key {
+	case "", "cn", "uri":
+		if t.Quotas.Query != "" {
+			return errors.New("quotas query requires key 'opa'")
+		}
+	case "opa":
+		if t.Quotas.Query == "" || t.Access.Policy == "" {
+			return errors.New("quotas key 'opa' requires a query and an access policy")
+		}
+	default:
+		return fmt.Errorf("invalid quotas key '%s' (must be cn, uri or opa)", t.Quotas.Key)
+	}
+	if err := t.Quotas.Default.validate(); err != nil {
+		return err
+	}
+	for identity, quota := range t.Quotas.Overrides {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("quotas override for '%s': %w", identity, err)
+		}
+	}
+	return nil
+}
+
+func (q Quota) validate() error {
+	if q.Rate < 0 || q.Burst < 0 || q.MaxConnections < 0 {
+		return errors.New("quotas must not be negative")
+	}
+	if q.Burst > 0 && q.Rate == 0 {
+		return errors.New("quota burst requires a rate")
+	}
+	for _, bandwidth := range []Bandwidth{q.Read, q.Write} {
+		if _, _, err := bandwidth.Parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r RateLimits) validate() error {
+	for _, bandwidth := range []Bandwidth{r.Read, r.Write, r.ReadPerConn, r.WritePerConn} {
+		if _, _, err := bandwidth.Parse(); err != nil {
+			return fmt.Errorf("rate-limits: %w", err)
+		}
+	}
+	return nil
+}
+
+// IsHostPort returns true if the address is a HOST:PORT address, rather than
+// a socket of another kind (e.g. unix:PATH or udp:HOST:PORT).
+func IsHostPort(addr string) bool {
+	for _, prefix := range []string{"unix:", "udp:", "systemd:", "launchd:"} {
+		if strings.HasPrefix(addr, prefix) {
+			return false
+		}
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err == nil
+}
+
+// Check the settings for TLS connections to the target of a server tunnel.
+// The PROXY protocol header would end up inside the TLS connection, where
+// targets don't expect it, so the two can't be combined.
+func (t Tunnel) validateTargetTLS() error {
+	if !t.TargetTLS.Enabled {
+		if !t.TargetTLS.IsEmpty() {
+			return errors.New("target-tls settings require target-tls to be enabled")
+		}
+		return nil
+	}
+	if err := t.TargetTLS.Credentials.validate(); err != nil {
+		return fmt.Errorf("target-tls: %w", err)
+	}
+	if t.ProxyProtocol {
+		return errors.New("target-tls can't be used with proxy-protocol")
+	}
+	if t.TargetTLS.ServerName != "" {
+		return nil
+	}
+	targets := t.AllTargets()
+	for _, target := range t.ALPNTargets {
+		targets = append(targets, target)
+	}
+	for _, target := range targets {
+		if strings.HasPrefix(target, "unix:") {
+			return fmt.Errorf("target-tls requires a server-name for UNIX socket target '%s'", target)
+		}
+	}
+	return nil
+}
+
+// Check the settings for TLS listeners of a client tunnel, which need a
+// certificate from a file or keystore.
+func (t Tunnel) validateListenTLS() error {
+	if t.ListenTLS.IsEmpty() {
+		return nil
+	}
+	creds := t.ListenTLS.Credentials
+	if err := creds.validate(); err != nil {
+		return fmt.Errorf("listen-tls: %w", err)
+	}
+	if creds.UseWorkloadAPI || creds.WorkloadAPIAddr != "" {
+		return errors.New("listen-tls doesn't support the workload API")
+	}
+	if creds.Cert == "" && creds.Keystore == "" {
+		return errors.New("listen-tls requires a cert/key or keystore")
+	}
+	return nil
+}
+
+// Check that routes have unique server names, and valid settings.
+func (t Tunnel) validateRoutes() error {
+	if len(t.Routes) > 0 && t.TargetStatus != "" {
+		return errors.New("target-status can't be used with routes")
+	}
+	names := map[string]bool{}
+	for _, r := range t.Routes {
+		name := strings.ToLower(r.ServerName)
+		if name == "" {
+			return errors.New("route has no server-name")
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate route for server-name '%s'", r.ServerName)
+		}
+		names[name] = true
+		if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return fmt.Errorf("invalid server-name '%s' (wildcard is only allowed as first label)", r.ServerName)
+		}
+		if r.Target == "" {
+			return fmt.Errorf("route for '%s': target address is required", r.ServerName)
+		}
+		if err := r.Credentials.validate(); err != nil {
+			return fmt.Errorf("route for '%s': %w", r.ServerName, err)
+		}
+		if err := r.Access.validate(); err != nil {
+			return fmt.Errorf("route for '%s': %w", r.ServerName, err)
+		}
+		if t.DisableAuthentication && !r.Access.IsEmpty() {
+			return fmt.Errorf("route for '%s': disable-authentication is mutually exclusive with access control settings", r.ServerName)
+		}
+		if r.Access.All && (r.Access.HasAccessFlags() || r.Access.HasPolicy()) {
+			return fmt.Errorf("route for '%s': access 'all' is mutually exclusive with other access control settings", r.ServerName)
+		}
+	}
+	return nil
+}
+
+// Check that HTTP rules are well-formed, and that HTTP mode isn't combined
+// with settings that need raw connections to the target.
+func (t Tunnel) validateHTTP() error {
+	if !t.HTTP.Enabled {
+		if len(t.HTTP.Rules) > 0 {
+			return errors.New("http rules require http to be enabled")
+		}
+		return nil
+	}
+	if len(t.Routes) > 0 {
+		return errors.New("http can't be used with routes")
+	}
+	if t.ProxyProtocol {
+		return errors.New("http can't be used with proxy-protocol")
+	}
+	for _, r := range t.HTTP.Rules {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("invalid http rule path '%s' (must start with /)", r.Path)
+		}
+		if strings.Contains(strings.TrimSuffix(r.Path, "*"), "*") {
+			return fmt.Errorf("invalid http rule path '%s' (wildcard is only allowed at the end)", r.Path)
+		}
+		for _, m := range r.Methods {
+			if m == "" || strings.ContainsAny(m, " /") {
+				return fmt.Errorf("http rule for '%s': invalid method '%s'", r.Path, m)
+			}
+		}
+		if err := r.Access.validate(); err != nil {
+			return fmt.Errorf("http rule for '%s': %w", r.Path, err)
+		}
+		if r.Access.HasPolicy() {
+			return fmt.Errorf("http rule for '%s': policy is not supported in rules (the tunnel policy gets the request as input)", r.Path)
+		}
+		if r.Deny && !r.Access.IsEmpty() {
+			return fmt.Errorf("http rule for '%s': deny is mutually exclusive with access control settings", r.Path)
+		}
+		if !r.Deny && r.Access.IsEmpty() {
+			return fmt.Errorf("http rule for '%s': access control settings (or deny) are required", r.Path)
+		}
+		if r.Access.All && r.Access.HasAccessFlags() {
+			return fmt.Errorf("http rule for '%s': access 'all' is mutually exclusive with other access control settings", r.Path)
+		}
+		if t.DisableAuthentication && !r.Access.IsEmpty() {
+			return fmt.Errorf("http rule for '%s': disable-authentication is mutually exclusive with access control settings", r.Path)
+		}
+	}
+	return nil
+}
+
+// Check that a passthrough tunnel doesn't use settings that only apply to
+// tunnels that terminate or originate TLS.
+func (t Tunnel) validatePassthrough() error {
+	if t.Credentials != (Credentials{}) || !t.Access.IsEmpty() || t.DisableAuthentication {
+		return errors.New("credentials and access control settings are not valid in passthrough mode")
+	}
+	if len(t.Targets) > 0 || t.Balance != (Balance{}) || t.Failover != (Failover{}) {
+		return errors.New("targets, balance and failover are not valid in passthrough mode")
+	}
+	if len(t.ALPN) > 0 || len(t.ALPNTargets) > 0 {
+		return errors.New("alpn and alpn-targets are not valid in passthrough mode")
+	}
+	if t.Multiplex != (Multiplex{}) {
+		return errors.New("multiplex is not valid in passthrough mode")
+	}
+	if !t.HTTP.IsEmpty() {
+		return errors.New("http is not valid in passthrough mode")
+	}
+	if !t.ForwardProxy.IsEmpty() {
+		return errors.New("forward-proxy is not valid in passthrough mode")
+	}
+	if !t.TargetTLS.IsEmpty() || !t.ListenTLS.IsEmpty() {
+		return errors.New("target-tls and listen-tls are not valid in passthrough mode")
+	}
+	if t.TargetProtocol != "" || t.ListenProtocol != "" {
+		return errors.New("target-protocol and listen-protocol are not valid in passthrough mode")
+	}
+	if t.TargetStatus != "" || t.UnsafeListen || t.ServerName != "" || t.hasConnectProxy() || t.ConnectProxyAuthFile != "" {
+		return errors.New("target-status, unsafe-listen, override-server-name and connect proxy settings are not valid in passthrough mode")
+	}
+	if err := t.validateRoutes(); err != nil {
+		return err
+	}
+	for _, r := range t.Routes {
+		if r.Credentials != (Credentials{}) || !r.Access.IsEmpty() {
+			return fmt.Errorf("route for '%s': credentials and access control settings are not valid in passthrough mode", r.ServerName)
+		}
+	}
+	return nil
+}
+
+// Check that ALPN protocols are valid, and that every protocol in
+// alpn-targets is also advertised.
+func (t Tunnel) validateALPN() error {
+	protocols := map[string]bool{}
+	for _, p := range t.ALPN {
+		if p == "" || len(p) > 255 {
+			return fmt.Errorf("invalid alpn protocol '%s' (must be 1-255 bytes)", p)
+		}
+		protocols[p] = true
+	}
+	if len(t.ALPNTargets) > 0 && len(t.Routes) > 0 {
+		return errors.New("alpn-targets can't be used with routes")
+	}
+	for p, target := range t.ALPNTargets {
+		if !protocols[p] {
+			return fmt.Errorf("alpn-targets protocol '%s' is not listed in alpn", p)
+		}
+		if target == "" {
+			return fmt.Errorf("alpn-targets protocol '%s' has no target", p)
+		}
+	}
+	return nil
+}
+
+func (c Credentials) validate() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("cert/key must be set together")
+	}
+	if c.Keystore != "" && c.Cert != "" {
+		return errors.New("keystore and cert/key are mutually exclusive")
+	}
+	return nil
+}
+
+func (a Access) validate() error {
+	if a.HasPolicy() && (a.Policy == "" || a.Query == "") {
+		return errors.New("access policy and query have to be used together")
+	}
+	if a.HasPolicy() && a.HasAccessFlags() {
+		return errors.New("access policy is mutually exclusive with other access control settings")
+	}
+	return nil
+}
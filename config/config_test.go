@@ -0,0 +1,969 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfigYAML = `
+tunnels:
+  - name: web
+    mode: server
+    listen: 0.0.0.0:8443
+    target: localhost:8080
+    target-status: http://localhost:8080/health
+    credentials:
+      cert: server-cert.pem
+      key: server-key.pem
+      cacert: cacert.pem
+    access:
+      cn: [client]
+      ip: [127.0.0.1]
+    timeouts:
+      connect: 5s
+      max-conn-lifetime: 1h
+      idle: 10m
+  - name: api
+    mode: server
+    listen: 0.0.0.0:9443
+    targets: [localhost:9001, localhost:9002]
+    balance:
+      policy: least-connections
+      health-check-interval: 10s
+    access:
+      all: true
+  - name: db
+    mode: client
+    listen: unix:/tmp/db.sock
+    target: db.example.com:5432
+    override-server-name: db
+    access:
+      uri: ["spiffe://example.com/db"]
+`
+
+var testConfigJSON = `{
+  "tunnels": [
+    {
+      "name": "web",
+      "mode": "server",
+      "listen": "0.0.0.0:8443",
+      "target": "localhost:8080",
+      "access": {"all": true},
+      "timeouts": {"close": "3s"}
+    }
+  ]
+}`
+
+func TestParseYAML(t *testing.T) {
+	config, err := Parse([]byte(testConfigYAML))
+	assert.Nil(t, err, "should parse valid YAML config")
+	if err != nil {
+		return
+	}
+
+	assert.Len(t, config.Tunnels, 3)
+
+	web := config.Tunnels[0]
+	assert.Equal(t, "web", web.Name)
+	assert.Equal(t, ModeServer, web.Mode)
+	assert.Equal(t, "server-cert.pem", web.Credentials.Cert)
+	assert.Equal(t, []string{"client"}, web.Access.CNs)
+	assert.True(t, web.Access.IPs[0].Equal(net.IPv4(127, 0, 0, 1)), "should parse IP addresses")
+	assert.Equal(t, 5*time.Second, web.Timeouts.Connect)
+	assert.Equal(t, time.Hour, web.Timeouts.MaxConnLifetime)
+	assert.Equal(t, time.Duration(0), web.Timeouts.Close)
+	assert.Equal(t, 10*time.Minute, web.Timeouts.Idle)
+
+	api := config.Tunnels[1]
+	assert.Equal(t, []string{"localhost:9001", "localhost:9002"}, api.Targets)
+	assert.Equal(t, "least-connections", api.Balance.Policy)
+	assert.Equal(t, 10*time.Second, api.Balance.HealthCheckInterval)
+
+	db := config.Tunnels[2]
+	assert.Equal(t, ModeClient, db.Mode)
+	assert.Equal(t, "db", db.ServerName)
+	assert.True(t, db.Credentials.IsEmpty(), "credentials should be empty")
+}
+
+func TestParseJSON(t *testing.T) {
+	config, err := Parse([]byte(testConfigJSON))
+	assert.Nil(t, err, "should parse valid JSON config")
+	if err != nil {
+		return
+	}
+
+	assert.Len(t, config.Tunnels, 1)
+	assert.True(t, config.Tunnels[0].Access.All)
+	assert.Equal(t, 3*time.Second, config.Tunnels[0].Timeouts.Close)
+}
+
+func TestLoad(t *testing.T) {
+	f, err := os.CreateTemp("", "ghostunnel-config")
+	assert.Nil(t, err, "temp file error")
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(testConfigYAML)
+	assert.Nil(t, err, "temp file write error")
+	_ = f.Close()
+
+	config, err := Load(f.Name())
+	assert.Nil(t, err, "should load valid config file")
+	assert.NotNil(t, config, "config should not be nil")
+
+	_, err = Load("/does/not/exist")
+	assert.NotNil(t, err, "should fail on missing config file")
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, input := range map[string]string{
+		"malformed":      `tunnels: [`,
+		"unknown field":  `tunnels: [{name: a, mode: server, listen: x, target: y, access: {all: true}, foo: bar}]`,
+		"no tunnels":     `tunnels: []`,
+		"no name":        `tunnels: [{mode: server, listen: x, target: y, access: {all: true}}]`,
+		"duplicate name": `tunnels: [{name: a, mode: server, listen: x, target: y, access: {all: true}}, {name: a, mode: server, listen: x, target: y, access: {all: true}}]`,
+		"invalid mode":   `tunnels: [{name: a, mode: foo, listen: x, target: y}]`,
+		"no listen":      `tunnels: [{name: a, mode: server, target: y, access: {all: true}}]`,
+		"no target":      `tunnels: [{name: a, mode: server, listen: x, access: {all: true}}]`,
+		"bad duration":   `tunnels: [{name: a, mode: server, listen: x, target: y, access: {all: true}, timeouts: {connect: abc}}]`,
+	} {
+		_, err := Parse([]byte(input))
+		assert.NotNil(t, err, "should reject invalid config: %s", name)
+	}
+}
+
+func TestTunnelValidate(t *testing.T) {
+	base := Tunnel{Name: "a", Mode: ModeServer, Listen: "x", Target: "y"}
+
+	tunnel := base
+	assert.NotNil(t, tunnel.Validate(), "server needs access control settings")
+
+	tunnel.DisableAuthentication = true
+	assert.Nil(t, tunnel.Validate(), "disable-authentication is sufficient")
+
+	tunnel.Access.All = true
+	assert.NotNil(t, tunnel.Validate(), "disable-authentication excludes access control")
+
+	tunnel = base
+	tunnel.Access = Access{All: true, CNs: []string{"a"}}
+	assert.NotNil(t, tunnel.Validate(), "all excludes other access control settings")
+
+	tunnel.Access = Access{Policy: "policy.rego"}
+	assert.NotNil(t, tunnel.Validate(), "policy needs a query")
+
+	tunnel.Access = Access{Policy: "policy.rego", Query: "data.allow", CNs: []string{"a"}}
+	assert.NotNil(t, tunnel.Validate(), "policy excludes other access control settings")
+
+	tunnel.Access = Access{CNs: []string{"a"}}
+	tunnel.Credentials = Credentials{Cert: "cert.pem"}
+	assert.NotNil(t, tunnel.Validate(), "cert needs key")
+
+	tunnel.Credentials = Credentials{Cert: "cert.pem", Key: "key.pem", Keystore: "keystore.p12"}
+	assert.NotNil(t, tunnel.Validate(), "cert/key excludes keystore")
+
+	tunnel = base
+	tunnel.Mode = ModeClient
+	assert.Nil(t, tunnel.Validate(), "client doesn't need access control settings")
+
+	tunnel.Access.All = true
+	assert.NotNil(t, tunnel.Validate(), "all is not valid in client mode")
+
+	tunnel.Access.All = false
+	tunnel.TargetStatus = "http://localhost/"
+	assert.NotNil(t, tunnel.Validate(), "target-status is not valid in client mode")
+
+	tunnel.TargetStatus = ""
+	tunnel.Target = ""
+	tunnel.Targets = []string{"a", "b"}
+	tunnel.Failover.Backoff = time.Second
+	assert.Nil(t, tunnel.Validate(), "targets and failover are valid in client mode")
+
+	tunnel.Balance.Policy = "round-robin"
+	assert.NotNil(t, tunnel.Validate(), "balance is not valid in client mode")
+
+	tunnel = base
+	tunnel.Access.All = true
+	tunnel.Targets = []string{"a", "b"}
+	assert.NotNil(t, tunnel.Validate(), "target excludes targets")
+
+	tunnel.Target = ""
+	assert.Nil(t, tunnel.Validate(), "targets is valid in server mode")
+
+	tunnel.Failover.Backoff = time.Second
+	assert.NotNil(t, tunnel.Validate(), "failover is not valid in server mode")
+	tunnel.Failover.Backoff = 0
+	assert.Equal(t, []string{"a", "b"}, tunnel.AllTargets())
+
+	tunnel.Targets = nil
+	tunnel.Target = "y"
+	assert.Equal(t, []string{"y"}, tunnel.AllTargets())
+}
+
+func TestTunnelValidateRoutes(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "x",
+		Access: Access{CNs: []string{"client"}},
+		Routes: []Route{
+			{ServerName: "a.example.com", Target: "a"},
+			{ServerName: "*.example.com", Target: "b", Access: Access{All: true}},
+		},
+	}
+	assert.Nil(t, tunnel.Validate(), "routes are valid in server mode")
+	assert.Equal(t, []string{"a", "b"}, tunnel.AllTargets())
+
+	tunnel.Target = "x"
+	assert.NotNil(t, tunnel.Validate(), "routes exclude target")
+	tunnel.Target = ""
+
+	tunnel.TargetStatus = "http://localhost/"
+	assert.NotNil(t, tunnel.Validate(), "routes exclude target-status")
+	tunnel.TargetStatus = ""
+
+	for _, routes := range [][]Route{
+		{{ServerName: "", Target: "a"}},
+		{{ServerName: "a", Target: ""}},
+		{{ServerName: "a", Target: "a"}, {ServerName: "A", Target: "b"}},
+		{{ServerName: "a.*.example.com", Target: "a"}},
+		{{ServerName: "a", Target: "a", Credentials: Credentials{Cert: "cert"}}},
+		{{ServerName: "a", Target: "a", Access: Access{Policy: "policy.rego"}}},
+		{{ServerName: "a", Target: "a", Access: Access{All: true, CNs: []string{"a"}}}},
+	} {
+		tunnel.Routes = routes
+		assert.NotNil(t, tunnel.Validate(), "invalid routes should fail: %v", routes)
+	}
+
+	tunnel.Routes = []Route{{ServerName: "a", Target: "a"}}
+	tunnel.Mode = ModeClient
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "routes are not valid in client mode")
+}
+
+func TestTunnelValidateALPN(t *testing.T) {
+	tunnel := Tunnel{
+		Name:        "t",
+		Mode:        ModeServer,
+		Listen:      "x",
+		Target:      "y",
+		Access:      Access{All: true},
+		ALPN:        []string{"h2", "http/1.1"},
+		ALPNTargets: map[string]string{"h2": "z"},
+	}
+	assert.Nil(t, tunnel.Validate(), "alpn and alpn-targets are valid in server mode")
+
+	tunnel.ALPNTargets = map[string]string{"grpc": "z"}
+	assert.NotNil(t, tunnel.Validate(), "alpn-targets protocol must be listed in alpn")
+
+	tunnel.ALPNTargets = map[string]string{"h2": ""}
+	assert.NotNil(t, tunnel.Validate(), "alpn-targets must have a target")
+
+	tunnel.ALPNTargets = nil
+	tunnel.ALPN = []string{""}
+	assert.NotNil(t, tunnel.Validate(), "empty alpn protocol is invalid")
+
+	tunnel.ALPN = []string{"h2"}
+	tunnel.ALPNTargets = map[string]string{"h2": "z"}
+	tunnel.Target = ""
+	tunnel.Routes = []Route{{ServerName: "a", Target: "a"}}
+	assert.NotNil(t, tunnel.Validate(), "alpn-targets can't be used with routes")
+
+	tunnel.Routes = nil
+	tunnel.Target = "y"
+	tunnel.Mode = ModeClient
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "alpn-targets are not valid in client mode")
+
+	tunnel.ALPNTargets = nil
+	assert.Nil(t, tunnel.Validate(), "alpn is valid in client mode")
+}
+
+func TestTunnelValidatePassthrough(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModePassthrough,
+		Listen: "x",
+		Routes: []Route{{ServerName: "a.example.com", Target: "a"}},
+	}
+	assert.Nil(t, tunnel.Validate(), "routes are valid in passthrough mode")
+
+	tunnel.Target = "b"
+	assert.Nil(t, tunnel.Validate(), "target is a fallback for routes in passthrough mode")
+	assert.Equal(t, []string{"a", "b"}, tunnel.AllTargets())
+
+	tunnel.Routes = nil
+	assert.Nil(t, tunnel.Validate(), "target alone is valid in passthrough mode")
+
+	tunnel.Credentials.CACert = "cacert.pem"
+	assert.NotNil(t, tunnel.Validate(), "credentials are not valid in passthrough mode")
+	tunnel.Credentials = Credentials{}
+
+	tunnel.Access.All = true
+	assert.NotNil(t, tunnel.Validate(), "access is not valid in passthrough mode")
+	tunnel.Access = Access{}
+
+	tunnel.ALPN = []string{"h2"}
+	assert.NotNil(t, tunnel.Validate(), "alpn is not valid in passthrough mode")
+	tunnel.ALPN = nil
+
+	tunnel.Routes = []Route{{ServerName: "a", Target: "a", Access: Access{All: true}}}
+	assert.NotNil(t, tunnel.Validate(), "route access is not valid in passthrough mode")
+}
+
+func TestTunnelValidateMultiplex(t *testing.T) {
+	tunnel := Tunnel{
+		Name:      "t",
+		Mode:      ModeServer,
+		Listen:    "x",
+		Target:    "y",
+		Access:    Access{All: true},
+		Multiplex: Multiplex{Enabled: true},
+	}
+	assert.Nil(t, tunnel.Validate(), "multiplex is valid in server mode")
+
+	tunnel.Multiplex.Connections = 4
+	assert.NotNil(t, tunnel.Validate(), "multiplex connections are not valid in server mode")
+
+	tunnel.Mode = ModeClient
+	tunnel.Access = Access{}
+	assert.Nil(t, tunnel.Validate(), "multiplex connections are valid in client mode")
+
+	tunnel.Multiplex.Connections = -1
+	assert.NotNil(t, tunnel.Validate(), "multiplex connections can't be negative")
+
+	tunnel.Multiplex = Multiplex{Connections: 4}
+	assert.NotNil(t, tunnel.Validate(), "multiplex connections require multiplex to be enabled")
+
+	tunnel.Multiplex = Multiplex{Enabled: true}
+	tunnel.ALPN = []string{"h2"}
+	assert.NotNil(t, tunnel.Validate(), "alpn can't be used with multiplex in client mode")
+
+	tunnel.ALPN = nil
+	tunnel.Mode = ModePassthrough
+	assert.NotNil(t, tunnel.Validate(), "multiplex is not valid in passthrough mode")
+}
+
+func TestTunnelValidateProxyProtocol(t *testing.T) {
+	tunnel := Tunnel{
+		Name:          "t",
+		Mode:          ModeServer,
+		Listen:        "x",
+		Target:        "y",
+		Access:        Access{All: true},
+		ProxyProtocol: true,
+	}
+	assert.Nil(t, tunnel.Validate(), "proxy-protocol without version is valid")
+
+	for _, version := range []int{1, 2} {
+		tunnel.ProxyProtocolVersion = version
+		assert.Nil(t, tunnel.Validate(), "proxy-protocol-version %d is valid", version)
+	}
+
+	tunnel.ProxyProtocolVersion = 3
+	assert.NotNil(t, tunnel.Validate(), "proxy-protocol-version 3 is invalid")
+
+	tunnel.ProxyProtocolVersion = 1
+	tunnel.ProxyProtocol = false
+	assert.NotNil(t, tunnel.Validate(), "proxy-protocol-version requires proxy-protocol")
+}
+
+func TestTunnelValidateAcceptProxyProtocol(t *testing.T) {
+	tunnel := Tunnel{
+		Name:                "t",
+		Mode:                ModeServer,
+		Listen:              "x",
+		Target:              "y",
+		Access:              Access{All: true},
+		AcceptProxyProtocol: []string{"10.0.0.0/8"},
+	}
+	assert.Nil(t, tunnel.Validate(), "accept-proxy-protocol is valid in server mode")
+
+	tunnel.Mode = ModePassthrough
+	tunnel.Access = Access{}
+	assert.Nil(t, tunnel.Validate(), "accept-proxy-protocol is valid in passthrough mode")
+
+	tunnel.Mode = ModeClient
+	assert.NotNil(t, tunnel.Validate(), "accept-proxy-protocol is not valid in client mode")
+}
+
+func TestTunnelValidateHTTP(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "x",
+		Target: "y",
+		Access: Access{CNs: []string{"client"}},
+		HTTP: HTTP{
+			Enabled: true,
+			Rules: []HTTPRule{
+				{Path: "/admin/*", Access: Access{CNs: []string{"admin"}}},
+				{Methods: []string{"DELETE"}, Path: "/*", Deny: true},
+				{Path: "/healthz", Access: Access{All: true}},
+			},
+		},
+	}
+	assert.Nil(t, tunnel.Validate(), "http is valid in server mode")
+
+	for _, c := range []struct {
+		name   string
+		modify func(t *Tunnel)
+	}{
+		{"rules without http", func(t *Tunnel) { t.HTTP.Enabled = false }},
+		{"with routes", func(t *Tunnel) {
+			t.Target = ""
+			t.Routes = []Route{{ServerName: "a", Target: "b"}}
+		}},
+		{"with proxy-protocol", func(t *Tunnel) { t.ProxyProtocol = true }},
+		{"relative path", func(t *Tunnel) { t.HTTP.Rules[0].Path = "admin" }},
+		{"wildcard in the middle", func(t *Tunnel) { t.HTTP.Rules[0].Path = "/*/admin" }},
+		{"empty method", func(t *Tunnel) { t.HTTP.Rules[1].Methods = []string{""} }},
+		{"no access", func(t *Tunnel) { t.HTTP.Rules[0].Access = Access{} }},
+		{"deny with access", func(t *Tunnel) { t.HTTP.Rules[1].Access = Access{All: true} }},
+		{"policy in rule", func(t *Tunnel) { t.HTTP.Rules[0].Access = Access{Policy: "p", Query: "q"} }},
+		{"all with cn in rule", func(t *Tunnel) { t.HTTP.Rules[2].Access.CNs = []string{"a"} }},
+		{"disable-authentication with access in rule", func(t *Tunnel) {
+			t.Access = Access{}
+			t.DisableAuthentication = true
+		}},
+		{"client mode", func(t *Tunnel) { t.Mode = ModeClient }},
+		{"passthrough mode", func(t *Tunnel) {
+			t.Mode = ModePassthrough
+			t.Access = Access{}
+		}},
+	} {
+		invalid := tunnel
+		invalid.HTTP.Rules = append([]HTTPRule{}, tunnel.HTTP.Rules...)
+		c.modify(&invalid)
+		assert.NotNil(t, invalid.Validate(), "%s should be invalid", c.name)
+	}
+
+	tunnel.Access = Access{}
+	tunnel.DisableAuthentication = true
+	tunnel.HTTP.Rules = []HTTPRule{{Path: "/admin/*", Deny: true}}
+	assert.Nil(t, tunnel.Validate(), "deny rules are valid with disable-authentication")
+}
+
+func TestTunnelValidateConnectProxy(t *testing.T) {
+	tunnel := Tunnel{
+		Name:           "t",
+		Mode:           ModeClient,
+		Listen:         "x",
+		Target:         "y",
+		ConnectProxies: []string{"socks5://proxy", "http://proxy"},
+	}
+	assert.Nil(t, tunnel.Validate(), "connect-proxies are valid in client mode")
+	assert.Equal(t, tunnel.ConnectProxies, tunnel.AllConnectProxies())
+
+	tunnel.ConnectProxy = "http://proxy"
+	assert.NotNil(t, tunnel.Validate(), "connect-proxy and connect-proxies are mutually exclusive")
+
+	tunnel.ConnectProxies = nil
+	assert.Equal(t, []string{"http://proxy"}, tunnel.AllConnectProxies())
+	tunnel.ConnectProxyAuthFile = "credentials"
+	assert.Nil(t, tunnel.Validate(), "connect-proxy-auth-file is valid with connect-proxy")
+
+	tunnel.ConnectProxyFromEnv = true
+	assert.NotNil(t, tunnel.Validate(), "connect-proxy-from-env is mutually exclusive with connect-proxy")
+
+	tunnel.ConnectProxy = ""
+	assert.Nil(t, tunnel.Validate(), "connect-proxy-auth-file is valid with connect-proxy-from-env")
+	assert.Nil(t, tunnel.AllConnectProxies())
+
+	tunnel.ConnectProxyFromEnv = false
+	assert.NotNil(t, tunnel.Validate(), "connect-proxy-auth-file requires a connect proxy")
+
+	tunnel.ConnectProxyAuthFile = ""
+	tunnel.ConnectProxyFromEnv = true
+	tunnel.Mode = ModeServer
+	tunnel.Access = Access{All: true}
+	assert.NotNil(t, tunnel.Validate(), "connect proxy settings are not valid in server mode")
+}
+
+func TestTunnelValidateForwardProxy(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeClient,
+		Listen: "x",
+		ForwardProxy: ForwardProxy{
+			Protocols: []string{"connect", "socks5"},
+			Allow:     []string{"*.example.com:443"},
+		},
+	}
+	assert.Nil(t, tunnel.Validate(), "forward-proxy is valid in client mode without a target")
+
+	tunnel.Target = "y"
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy and target are mutually exclusive")
+	tunnel.Target = ""
+
+	tunnel.Multiplex.Enabled = true
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy can't be used with multiplex")
+	tunnel.Multiplex.Enabled = false
+
+	tunnel.ServerName = "name"
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy can't be used with override-server-name")
+	tunnel.ServerName = ""
+
+	tunnel.ForwardProxy.Protocols = []string{"http"}
+	assert.NotNil(t, tunnel.Validate(), "invalid forward-proxy protocol should be rejected")
+
+	tunnel.ForwardProxy.Protocols = nil
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy requires protocols")
+
+	tunnel.ForwardProxy.Protocols = []string{"connect"}
+	tunnel.ForwardProxy.Allow = nil
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy requires allowed destinations")
+
+	tunnel.ForwardProxy.Allow = []string{"*:443"}
+	tunnel.Mode = ModeServer
+	tunnel.Target = "y"
+	tunnel.Access = Access{All: true}
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy is not valid in server mode")
+
+	tunnel.Mode = ModePassthrough
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "forward-proxy is not valid in passthrough mode")
+}
+
+func TestTunnelValidateTargetTLS(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "x",
+		Target: "localhost:8443",
+		Access: Access{All: true},
+		TargetTLS: TargetTLS{
+			Enabled:     true,
+			Credentials: Credentials{Keystore: "backend.p12", CACert: "backend-ca.pem"},
+		},
+	}
+	assert.Nil(t, tunnel.Validate(), "target-tls is valid in server mode")
+
+	tunnel.TargetTLS.Credentials.Cert = "cert.pem"
+	assert.NotNil(t, tunnel.Validate(), "target-tls credentials should be validated")
+	tunnel.TargetTLS.Credentials.Cert = ""
+
+	tunnel.ProxyProtocol = true
+	assert.NotNil(t, tunnel.Validate(), "target-tls can't be used with proxy-protocol")
+	tunnel.ProxyProtocol = false
+
+	tunnel.Target = "unix:/tmp/backend.sock"
+	assert.NotNil(t, tunnel.Validate(), "UNIX socket targets require a server name")
+	tunnel.TargetTLS.ServerName = "backend"
+	assert.Nil(t, tunnel.Validate(), "UNIX socket targets are valid with a server name")
+
+	tunnel.TargetTLS.Enabled = false
+	assert.NotNil(t, tunnel.Validate(), "target-tls settings require target-tls to be enabled")
+
+	tunnel.TargetTLS = TargetTLS{Enabled: true}
+	tunnel.Mode = ModeClient
+	tunnel.Target = "localhost:8443"
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "target-tls is not valid in client mode")
+
+	tunnel.Mode = ModePassthrough
+	assert.NotNil(t, tunnel.Validate(), "target-tls is not valid in passthrough mode")
+}
+
+func TestTunnelValidateListenTLS(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeClient,
+		Listen: "x",
+		Target: "y",
+		ListenTLS: ListenTLS{
+			Credentials: Credentials{Cert: "cert.pem", Key: "key.pem", CACert: "app-ca.pem"},
+		},
+	}
+	assert.Nil(t, tunnel.Validate(), "listen-tls is valid in client mode")
+
+	tunnel.ListenTLS.Credentials.Key = ""
+	assert.NotNil(t, tunnel.Validate(), "listen-tls credentials should be validated")
+
+	tunnel.ListenTLS.Credentials = Credentials{CACert: "app-ca.pem"}
+	assert.NotNil(t, tunnel.Validate(), "listen-tls requires a certificate")
+
+	tunnel.ListenTLS.Credentials = Credentials{UseWorkloadAPI: true}
+	assert.NotNil(t, tunnel.Validate(), "listen-tls doesn't support the workload API")
+
+	tunnel.ListenTLS.Credentials = Credentials{Keystore: "server.p12"}
+	tunnel.Mode = ModeServer
+	tunnel.Access = Access{All: true}
+	assert.NotNil(t, tunnel.Validate(), "listen-tls is not valid in server mode")
+
+	tunnel.Mode = ModePassthrough
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "listen-tls is not valid in passthrough mode")
+}
+
+func TestTunnelValidateTargetProtocol(t *testing.T) {
+	tunnel := Tunnel{
+		Name:           "t",
+		Mode:           ModeClient,
+		Listen:         "x",
+		Target:         "y",
+		TargetProtocol: "postgres",
+	}
+	assert.Nil(t, tunnel.Validate(), "target-protocol is valid in client mode")
+
+	tunnel.TargetProtocol = "ftp"
+	assert.NotNil(t, tunnel.Validate(), "target-protocol should be validated")
+
+	tunnel.TargetProtocol = "smtp"
+	tunnel.Multiplex = Multiplex{Enabled: true}
+	assert.NotNil(t, tunnel.Validate(), "target-protocol can't be used with multiplex")
+
+	tunnel.Multiplex = Multiplex{}
+	tunnel.ALPN = []string{"h2"}
+	assert.NotNil(t, tunnel.Validate(), "target-protocol can't be used with alpn")
+
+	tunnel.ALPN = nil
+	tunnel.Target = ""
+	tunnel.ForwardProxy = ForwardProxy{Protocols: []string{"connect"}, Allow: []string{"*:443"}}
+	assert.NotNil(t, tunnel.Validate(), "target-protocol can't be used with forward-proxy")
+
+	tunnel.ForwardProxy = ForwardProxy{}
+	tunnel.Target = "y"
+	tunnel.Mode = ModeServer
+	tunnel.Access = Access{All: true}
+	assert.NotNil(t, tunnel.Validate(), "target-protocol is not valid in server mode")
+
+	tunnel.Mode = ModePassthrough
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "target-protocol is not valid in passthrough mode")
+}
+
+func TestTunnelValidateListenProtocol(t *testing.T) {
+	tunnel := Tunnel{
+		Name:           "t",
+		Mode:           ModeServer,
+		Listen:         "x",
+		Target:         "y",
+		Access:         Access{All: true},
+		ListenProtocol: "smtp",
+	}
+	assert.Nil(t, tunnel.Validate(), "listen-protocol is valid in server mode")
+
+	tunnel.ListenProtocol = "mysql"
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol should be validated")
+
+	tunnel.ListenProtocol = "smtp"
+	tunnel.ProxyProtocol = true
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol smtp can't be used with proxy-protocol")
+	tunnel.ListenProtocol = "postgres"
+	assert.Nil(t, tunnel.Validate(), "listen-protocol postgres can be used with proxy-protocol")
+	tunnel.ProxyProtocol = false
+
+	tunnel.HTTP = HTTP{Enabled: true}
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol can't be used with http")
+	tunnel.HTTP = HTTP{}
+
+	tunnel.Multiplex = Multiplex{Enabled: true}
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol can't be used with multiplex")
+	tunnel.Multiplex = Multiplex{}
+
+	tunnel.ALPN = []string{"h2"}
+	tunnel.ALPNTargets = map[string]string{"h2": "z"}
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol can't be used with alpn-targets")
+	tunnel.ALPN = nil
+	tunnel.ALPNTargets = nil
+
+	tunnel.Mode = ModeClient
+	tunnel.Access = Access{}
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol is not valid in client mode")
+
+	tunnel.Mode = ModePassthrough
+	assert.NotNil(t, tunnel.Validate(), "listen-protocol is not valid in passthrough mode")
+}
+
+func TestTunnelValidateUDP(t *testing.T) {
+	server := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "x",
+		Target: "udp:localhost:53",
+		Access: Access{All: true},
+	}
+	assert.Nil(t, server.Validate(), "udp target is valid in server mode")
+
+	server.ProxyProtocol = true
+	assert.NotNil(t, server.Validate(), "udp target can't be used with proxy-protocol")
+	server.ProxyProtocol = false
+
+	server.ALPN = []string{"h2"}
+	assert.NotNil(t, server.Validate(), "udp target can't be used with alpn")
+	server.ALPN = nil
+
+	server.Target = ""
+	server.Targets = []string{"udp:localhost:53", "udp:localhost:54"}
+	assert.NotNil(t, server.Validate(), "udp targets can't be balanced")
+	server.Targets = nil
+	server.Target = "udp:localhost:53"
+
+	server.Listen = "udp:localhost:8443"
+	assert.NotNil(t, server.Validate(), "udp listen addresses are not valid in server mode")
+
+	client := Tunnel{
+		Name:   "t",
+		Mode:   ModeClient,
+		Listen: "udp:localhost:53",
+		Target: "y",
+	}
+	assert.Nil(t, client.Validate(), "udp listen address is valid in client mode")
+
+	client.Multiplex = Multiplex{Enabled: true}
+	assert.NotNil(t, client.Validate(), "udp listen address can't be used with multiplex")
+	client.Multiplex = Multiplex{}
+
+	client.TargetProtocol = "postgres"
+	assert.NotNil(t, client.Validate(), "udp listen address can't be used with target-protocol")
+	client.TargetProtocol = ""
+
+	client.Target = "udp:localhost:8443"
+	assert.NotNil(t, client.Validate(), "udp targets are not valid in client mode")
+}
+
+func TestTunnelValidateQUIC(t *testing.T) {
+	server := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "localhost:8443",
+		Target: "localhost:8080",
+		Access: Access{All: true},
+		QUIC:   true,
+	}
+	assert.Nil(t, server.Validate(), "quic is valid in server mode")
+
+	server.HTTP = HTTP{Enabled: true}
+	assert.Nil(t, server.Validate(), "quic can be used with http")
+	server.HTTP = HTTP{}
+
+	server.Multiplex = Multiplex{Enabled: true}
+	assert.NotNil(t, server.Validate(), "quic can't be used with multiplex")
+	server.Multiplex = Multiplex{}
+
+	server.ListenProtocol = "postgres"
+	assert.NotNil(t, server.Validate(), "quic can't be used with listen-protocol")
+	server.ListenProtocol = ""
+
+	server.Listen = "unix:/tmp/socket"
+	assert.NotNil(t, server.Validate(), "quic requires a HOST:PORT listen address")
+	server.Listen = "localhost:8443"
+
+	server.Target = "udp:localhost:53"
+	assert.NotNil(t, server.Validate(), "quic can't be used with a udp target")
+
+	client := Tunnel{
+		Name:   "t",
+		Mode:   ModeClient,
+		Listen: "unix:/tmp/socket",
+		Target: "example.com:8443",
+		QUIC:   true,
+	}
+	assert.Nil(t, client.Validate(), "quic is valid in client mode")
+
+	client.ALPN = []string{"h2"}
+	assert.NotNil(t, client.Validate(), "quic can't be used with alpn")
+	client.ALPN = nil
+
+	client.ConnectProxy = "socks5://localhost:1080"
+	assert.NotNil(t, client.Validate(), "quic can't be used with a connect proxy")
+	client.ConnectProxy = ""
+
+	client.Target = "unix:/tmp/target"
+	assert.NotNil(t, client.Validate(), "quic requires HOST:PORT targets")
+
+	passthrough := Tunnel{
+		Name:   "t",
+		Mode:   ModePassthrough,
+		Listen: "localhost:8443",
+		Target: "localhost:8080",
+		QUIC:   true,
+	}
+	assert.NotNil(t, passthrough.Validate(), "quic is not valid in passthrough mode")
+}
+
+func TestTunnelValidateWebSocket(t *testing.T) {
+	server := Tunnel{
+		Name:      "t",
+		Mode:      ModeServer,
+		Listen:    "localhost:8443",
+		Target:    "localhost:8080",
+		Access:    Access{All: true},
+		WebSocket: WebSocket{Enabled: true, Path: "/tunnel"},
+	}
+	assert.Nil(t, server.Validate(), "websocket is valid in server mode")
+
+	server.HTTP = HTTP{Enabled: true}
+	assert.NotNil(t, server.Validate(), "websocket can't be used with http")
+	server.HTTP = HTTP{}
+
+	server.QUIC = true
+	assert.NotNil(t, server.Validate(), "websocket can't be used with quic")
+	server.QUIC = false
+
+	server.WebSocket.Path = "tunnel"
+	assert.NotNil(t, server.Validate(), "websocket path must start with '/'")
+	server.WebSocket.Path = "/tunnel"
+
+	server.Target = "udp:localhost:53"
+	assert.NotNil(t, server.Validate(), "websocket can't be used with a udp target")
+
+	client := Tunnel{
+		Name:         "t",
+		Mode:         ModeClient,
+		Listen:       "unix:/tmp/socket",
+		Target:       "example.com:443",
+		ConnectProxy: "http://proxy.example.com:3128",
+		WebSocket:    WebSocket{Enabled: true},
+	}
+	assert.Nil(t, client.Validate(), "websocket can be used with a connect proxy")
+
+	client.Multiplex = Multiplex{Enabled: true}
+	assert.NotNil(t, client.Validate(), "websocket can't be used with multiplex")
+	client.Multiplex = Multiplex{}
+
+	client.Target = "unix:/tmp/target"
+	assert.NotNil(t, client.Validate(), "websocket requires HOST:PORT targets")
+
+	disabled := Tunnel{
+		Name:      "t",
+		Mode:      ModeClient,
+		Listen:    "unix:/tmp/socket",
+		Target:    "example.com:443",
+		WebSocket: WebSocket{Path: "/tunnel"},
+	}
+	assert.NotNil(t, disabled.Validate(), "websocket path requires websocket to be enabled")
+}
+
+func TestTunnelValidateLimits(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "localhost:8443",
+		Target: "localhost:8080",
+		Access: Access{All: true},
+		Limits: Limits{MaxConnections: 100, MaxConnectionsPerIP: 10, MaxHandshakes: 5},
+	}
+	assert.Nil(t, tunnel.Validate(), "limits should be valid")
+
+	tunnel.Limits.MaxHandshakes = -1
+	assert.NotNil(t, tunnel.Validate(), "negative limits should be rejected")
+}
+
+func TestTunnelValidateQuotas(t *testing.T) {
+	tunnel := Tunnel{
+		Name:   "t",
+		Mode:   ModeServer,
+		Listen: "localhost:8443",
+		Target: "localhost:8080",
+		Access: Access{All: true},
+		Quotas: Quotas{
+			Key:       "uri",
+			Default:   Quota{Rate: 10, Burst: 20, MaxConnections: 100},
+			Overrides: map[string]Quota{"spiffe://example.com/batch": {MaxConnections: 5}},
+		},
+	}
+	assert.Nil(t, tunnel.Validate(), "quotas should be valid")
+
+	invalid := tunnel
+	invalid.Quotas.Key = "dns"
+	assert.NotNil(t, invalid.Validate(), "invalid key should be rejected")
+
+	invalid = tunnel
+	invalid.Quotas.Key = "opa"
+	assert.NotNil(t, invalid.Validate(), "opa key without query should be rejected")
+	invalid.Quotas.Query = "data.policy.key"
+	assert.NotNil(t, invalid.Validate(), "opa key without access policy should be rejected")
+	invalid.Access = Access{Policy: "policy.rego", Query: "data.policy.allow"}
+	assert.Nil(t, invalid.Validate(), "opa key with query and access policy should be valid")
+
+	invalid = tunnel
+	invalid.Quotas.Overrides = map[string]Quota{"x": {Burst: 5}}
+	assert.NotNil(t, invalid.Validate(), "burst without rate should be rejected")
+
+	invalid = tunnel
+	invalid.Quotas.Default.MaxConnections = -1
+	assert.NotNil(t, invalid.Validate(), "negative quotas should be rejected")
+
+	invalid = tunnel
+	invalid.Mode = ModeClient
+	invalid.Access = Access{}
+	assert.NotNil(t, invalid.Validate(), "quotas should be rejected in client mode")
+}
+
+func TestBandwidthParse(t *testing.T) {
+	for bandwidth, expected := range map[Bandwidth][2]int64{
+		"":          {0, 0},
+		"1000":      {1000, 0},
+		"10KB":      {10000, 0},
+		"1MiB:4MiB": {1 << 20, 4 << 20},
+		"1GB:2GiB":  {1000 * 1000 * 1000, 2 << 30},
+		"100B:1KiB": {100, 1024},
+	} {
+		rate, burst, err := bandwidth.Parse()
+		assert.Nil(t, err, "'%s' should be valid", bandwidth)
+		assert.Equal(t, expected, [2]int64{rate, burst}, "'%s'", bandwidth)
+	}
+
+	for _, invalid := range []Bandwidth{"fast", "1XB", "-1", "1MiB:", "0:1MiB", "1.5MB"} {
+		_, _, err := invalid.Parse()
+		assert.NotNil(t, err, "'%s' should be rejected", invalid)
+	}
+}
+
+func TestTunnelValidateRateLimits(t *testing.T) {
+	tunnel := Tunnel{
+		Name:       "t",
+		Mode:       ModeServer,
+		Listen:     "localhost:8443",
+		Target:     "localhost:8080",
+		Access:     Access{All: true},
+		RateLimits: RateLimits{Read: "10MiB", WritePerConn: "1MiB:4MiB"},
+	}
+	assert.Nil(t, tunnel.Validate(), "rate limits should be valid")
+
+	tunnel.RateLimits.ReadPerConn = "fast"
+	assert.NotNil(t, tunnel.Validate(), "invalid rate limits should be rejected")
+
+	tunnel.RateLimits = RateLimits{}
+	tunnel.Quotas.Default.Write = "1MiB:"
+	assert.NotNil(t, tunnel.Validate(), "invalid quota bandwidth should be rejected")
+}
+
+func TestTunnelValidateSources(t *testing.T) {
+	tunnel := Tunnel{
+		Name:    "t",
+		Mode:    ModeServer,
+		Listen:  "localhost:8443",
+		Target:  "localhost:8080",
+		Access:  Access{All: true},
+		Sources: Sources{Allow: []string{"10.0.0.0/8"}, Deny: []string{"file:/etc/ghostunnel/deny.txt"}},
+	}
+	assert.Nil(t, tunnel.Validate(), "sources should be valid")
+
+	invalid := tunnel
+	invalid.QUIC = true
+	assert.NotNil(t, invalid.Validate(), "sources should be rejected with quic")
+
+	invalid = tunnel
+	invalid.Mode = ModeClient
+	invalid.Access = Access{}
+	assert.NotNil(t, invalid.Validate(), "sources should be rejected in client mode")
+}
@@ -0,0 +1,4 @@
+// Package config provides types and methods for loading a declarative
+// configuration file (YAML or JSON) that describes one or more server and
+// client tunnels to run within a single ghostunnel process.
+package config
@@ -0,0 +1,227 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/proxy"
+)
+
+// destinationPattern matches destinations of forward proxy connections.
+// Hosts are matched exactly, by wildcard (e.g. "*.example.com", which
+// matches exactly one label like in certificates), by CIDR range (for IP
+// destinations only, names are not resolved) or with "*" for any host.
+// Ports are matched exactly, by range (e.g. "8000-8999") or with "*".
+type destinationPattern struct {
+	host     string
+	wildcard bool
+	network  *net.IPNet
+	minPort  int
+	maxPort  int
+}
+
+// destinationAllowlist is the list of destinations forward proxy clients may
+// connect to. Anything not on the list is denied.
+type destinationAllowlist []destinationPattern
+
+// Parse destination patterns, in the form HOST:PORT.
+func parseDestinationPatterns(patterns []string) (destinationAllowlist, error) {
+	allow := make(destinationAllowlist, 0, len(patterns))
+	for _, p := range patterns {
+		pattern, err := parseDestinationPattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination '%s': %w", p, err)
+		}
+		allow = append(allow, pattern)
+	}
+	return allow, nil
+}
+
+func parseDestinationPattern(p string) (destinationPattern, error) {
+	host, port, err := net.SplitHostPort(p)
+	if err != nil {
+		return destinationPattern{}, errors.New("must be HOST:PORT")
+	}
+
+	var pattern destinationPattern
+	pattern.minPort, pattern.maxPort, err = parsePortRange(port)
+	if err != nil {
+		return destinationPattern{}, err
+	}
+
+	host = normalizeHost(host)
+	switch {
+	case host == "":
+		return destinationPattern{}, errors.New("host is required")
+	case host == "*":
+		pattern.wildcard = true
+	case strings.HasPrefix(host, "*."):
+		if strings.Contains(host[2:], "*") || len(host) == 2 {
+			return destinationPattern{}, errors.New("wildcards must be a single leading label, like *.example.com")
+		}
+		pattern.host = host[1:]
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return destinationPattern{}, err
+		}
+		pattern.network = network
+	case strings.Contains(host, "*"):
+		return destinationPattern{}, errors.New("wildcards must be a single leading label, like *.example.com")
+	default:
+		pattern.host = host
+	}
+	return pattern, nil
+}
+
+// Parse a port, port range ("8000-8999") or "*" for any port.
+func parsePortRange(port string) (int, int, error) {
+	if port == "*" {
+		return 1, 65535, nil
+	}
+	low, high, isRange := strings.Cut(port, "-")
+	if !isRange {
+		high = low
+	}
+	minPort, err := strconv.Atoi(low)
+	if err != nil || minPort < 1 || minPort > 65535 {
+		return 0, 0, fmt.Errorf("invalid port '%s'", low)
+	}
+	maxPort, err := strconv.Atoi(high)
+	if err != nil || maxPort < minPort || maxPort > 65535 {
+		return 0, 0, fmt.Errorf("invalid port '%s'", high)
+	}
+	return minPort, maxPort, nil
+}
+
+// Lower-case a host name and remove the trailing dot, if any.
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Check if a destination (host:port) is on the list.
+func (a destinationAllowlist) allowed(destination string) bool {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return false
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	host = normalizeHost(host)
+	ip := net.ParseIP(host)
+	for _, p := range a {
+		if portNumber < p.minPort || portNumber > p.maxPort {
+			continue
+		}
+		if p.matchesHost(host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p destinationPattern) matchesHost(host string, ip net.IP) bool {
+	switch {
+	case p.wildcard:
+		return true
+	case p.network != nil:
+		return ip != nil && p.network.Contains(ip)
+	case strings.HasPrefix(p.host, "."):
+		// "*.example.com" matches exactly one label
+		i := strings.IndexByte(host, '.')
+		return ip == nil && i > 0 && host[i:] == p.host
+	case ip != nil:
+		return ip.Equal(net.ParseIP(p.host))
+	default:
+		return host == p.host
+	}
+}
+
+// forwardProxy connects forward proxy clients to the destination they ask
+// for, if it's allowed, with mutual TLS.
+type forwardProxy struct {
+	allow destinationAllowlist
+	dial  func(destination string) (net.Conn, error)
+}
+
+// Build a forward proxy that dials destinations with the given TLS config
+// (certificate and server verification), through the given dialer. The
+// server name for hostname verification is the host of each destination.
+func newForwardProxy(allow destinationAllowlist, tlsConfigSource certloader.TLSConfigSource, tlsConfig *tls.Config, dialer Dialer, timeout time.Duration) (*forwardProxy, error) {
+	clientConfig, err := tlsConfigSource.GetClientConfig(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardProxy{
+		allow: allow,
+		dial: func(destination string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(destination)
+			if err != nil {
+				return nil, err
+			}
+			config := serverNameConfig{clientConfig, strings.TrimSuffix(host, ".")}
+			return certloader.DialerWithCertificate(config, timeout, dialer).Dial("tcp", destination)
+		},
+	}, nil
+}
+
+// Pick the dialer for a forward proxy connection. Destinations that aren't
+// allowed are rejected right away, others are dialed when the proxy asks
+// for the backend. Either way, the client is told about the outcome.
+func (f *forwardProxy) route(conn net.Conn) (proxy.Dialer, error) {
+	fc, ok := conn.(*proxy.ForwardProxyConn)
+	if !ok {
+		return nil, errors.New("not a forward proxy connection")
+	}
+	destination := fc.Destination()
+	if !f.allow.allowed(destination) {
+		_ = fc.Reply(proxy.ErrDestinationNotAllowed)
+		return nil, fmt.Errorf("destination '%s' is not allowed", destination)
+	}
+	return func() (net.Conn, error) {
+		backend, err := f.dial(destination)
+		if replyErr := fc.Reply(err); err == nil && replyErr != nil {
+			backend.Close()
+			return nil, replyErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("destination '%s': %w", destination, err)
+		}
+		return backend, nil
+	}, nil
+}
+
+// serverNameConfig sets the server name for hostname verification on the
+// TLS config of a client.
+type serverNameConfig struct {
+	certloader.TLSClientConfig
+	serverName string
+}
+
+func (c serverNameConfig) GetClientConfig() *tls.Config {
+	config := c.TLSClientConfig.GetClientConfig()
+	config.ServerName = c.serverName
+	return config
+}
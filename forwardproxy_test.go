@@ -0,0 +1,79 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestinationAllowlist(t *testing.T) {
+	allow, err := parseDestinationPatterns([]string{
+		"*.example.com:443",
+		"api.example.org:8000-8099",
+		"10.0.0.0/8:*",
+		"[2001:db8::1]:443",
+		"Backend.Example.NET.:22",
+	})
+	assert.Nil(t, err, "should be able to parse destinations")
+
+	testCases := []struct {
+		destination string
+		allowed     bool
+	}{
+		{"a.example.com:443", true},
+		{"A.EXAMPLE.COM.:443", true},
+		{"a.b.example.com:443", false}, // wildcard matches one label
+		{"example.com:443", false},
+		{"a.example.com:8443", false},
+		{"api.example.org:8000", true},
+		{"api.example.org:8099", true},
+		{"api.example.org:8100", false},
+		{"10.1.2.3:22", true},
+		{"11.1.2.3:22", false},
+		{"10.example.com:22", false}, // names are not resolved
+		{"[2001:db8::1]:443", true},
+		{"[2001:db8:0::1]:443", true},
+		{"backend.example.net:22", true},
+		{"invalid", false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.allowed, allow.allowed(tc.destination), "destination %s", tc.destination)
+	}
+
+	anyHost, err := parseDestinationPatterns([]string{"*:443"})
+	assert.Nil(t, err, "should be able to parse wildcard host")
+	assert.True(t, anyHost.allowed("anything.example:443"))
+	assert.True(t, anyHost.allowed("192.0.2.1:443"))
+	assert.False(t, anyHost.allowed("192.0.2.1:80"))
+}
+
+func TestParseDestinationPatternsInvalid(t *testing.T) {
+	for _, pattern := range []string{
+		"example.com",
+		":443",
+		"example.com:0",
+		"example.com:65536",
+		"example.com:http",
+		"example.com:9000-8000",
+		"a.*.example.com:443",
+		"*example.com:443",
+		"10.0.0.0/33:443",
+	} {
+		_, err := parseDestinationPatterns([]string{pattern})
+		assert.NotNil(t, err, "%s should be invalid", pattern)
+	}
+}
@@ -0,0 +1,141 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/auth"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/ghostunnel/ghostunnel/proxy"
+)
+
+// httpAccess authorizes requests on connections in HTTP mode. The first rule
+// that matches the method and path of a request decides if it's allowed,
+// other requests are checked against the access control settings of the
+// tunnel (with the request in the input of the OPA policy, if any).
+type httpAccess struct {
+	acl         auth.ACL
+	disableAuth bool
+	rules       []httpRule
+}
+
+type httpRule struct {
+	methods []string
+	path    string
+	// Match path as a prefix (the rule path ended with a "*")
+	prefix bool
+	deny   bool
+	acl    auth.ACL
+}
+
+// Build the HTTP options for a proxy, checking requests against the given
+// ACL and rules.
+func newHTTPOptions(acl auth.ACL, disableAuth bool, rules []config.HTTPRule, timeout time.Duration) (*proxy.HTTPOptions, error) {
+	access := &httpAccess{acl: acl, disableAuth: disableAuth}
+	for _, r := range rules {
+		rule := httpRule{
+			path: strings.TrimSuffix(r.Path, "*"),
+			deny: r.Deny,
+		}
+		rule.prefix = rule.path != r.Path
+		for _, m := range r.Methods {
+			rule.methods = append(rule.methods, strings.ToUpper(m))
+		}
+		if !r.Deny {
+			var err error
+			rule.acl, _, err = buildACL(r.Access, timeout)
+			if err != nil {
+				return nil, fmt.Errorf("http rule for '%s': %w", r.Path, err)
+			}
+		}
+		access.rules = append(access.rules, rule)
+	}
+	return &proxy.HTTPOptions{Authorize: access.authorize}, nil
+}
+
+func (a *httpAccess) authorize(r *http.Request, state tls.ConnectionState) error {
+	var cert *x509.Certificate
+	if len(state.PeerCertificates) > 0 {
+		cert = state.PeerCertificates[0]
+	}
+	for _, rule := range a.rules {
+		if !rule.matches(r) {
+			continue
+		}
+		if rule.deny {
+			return errors.New("denied by rule")
+		}
+		return rule.acl.VerifyRequest(cert, httpRequestSource(r), nil)
+	}
+	if a.disableAuth {
+		return nil
+	}
+	return a.acl.VerifyRequest(cert, httpRequestSource(r), httpRequestInput(r))
+}
+
+// Check if a rule matches the method and path of a request. Paths are
+// cleaned before matching, so that e.g. "/api/../admin" can't get around a
+// rule for "/admin/*".
+func (r httpRule) matches(req *http.Request) bool {
+	if len(r.methods) > 0 && !slices.Contains(r.methods, req.Method) {
+		return false
+	}
+	cleaned := path.Clean("/" + req.URL.Path)
+	if !r.prefix {
+		return cleaned == path.Clean(r.path)
+	}
+	// A rule for "/admin/*" also matches "/admin".
+	return strings.HasPrefix(cleaned, r.path) || cleaned+"/" == r.path
+}
+
+// IP address of the client of a request, as passed to the OPA policy in
+// input.source.ip, or nil if unknown (e.g. on UNIX sockets).
+func httpRequestSource(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Fields of a request, as passed to the OPA policy in input.request. Header
+// names are lower-cased, headers and query parameters map to lists of values.
+func httpRequestInput(r *http.Request) map[string]interface{} {
+	headers := map[string]interface{}{}
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = values
+	}
+	query := map[string]interface{}{}
+	for name, values := range r.URL.Query() {
+		query[name] = values
+	}
+	return map[string]interface{}{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"host":    r.Host,
+		"headers": headers,
+		"query":   query,
+	}
+}
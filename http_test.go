@@ -0,0 +1,137 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/auth"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var httpTestPolicy = `
+package policy
+import input
+default allow := false
+allow {
+    input.certificate.Subject.CommonName == "client"
+    input.request.method == "GET"
+    input.request.headers["x-test"][0] == "yes"
+    input.request.query.q[0] == "1"
+}
+`
+
+func httpTestState(cn string) tls.ConnectionState {
+	return tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}},
+	}
+}
+
+func TestHTTPRules(t *testing.T) {
+	acl, _, err := buildACL(config.Access{CNs: []string{"client"}}, time.Second)
+	assert.Nil(t, err, "should be able to build ACL")
+
+	options, err := newHTTPOptions(acl, false, []config.HTTPRule{
+		{Path: "/admin/*", Access: config.Access{CNs: []string{"admin"}}},
+		{Methods: []string{"delete"}, Path: "/*", Deny: true},
+		{Path: "/healthz", Access: config.Access{All: true}},
+	}, time.Second)
+	assert.Nil(t, err, "should be able to build HTTP options")
+
+	for _, c := range []struct {
+		method, target, cn string
+		allowed            bool
+	}{
+		{"GET", "/", "client", true},
+		{"GET", "/", "other", false},
+		{"GET", "/admin", "client", false},
+		{"GET", "/admin/users", "client", false},
+		{"GET", "/api/../admin/users", "client", false},
+		{"GET", "/admin/users", "admin", true},
+		{"GET", "/administrator", "client", true},
+		{"DELETE", "/api", "client", false},
+		{"GET", "/healthz", "other", true},
+		{"GET", "/healthz/x", "other", false},
+	} {
+		err := options.Authorize(httptest.NewRequest(c.method, c.target, nil), httpTestState(c.cn))
+		if c.allowed {
+			assert.Nil(t, err, "%s %s should be allowed for %s", c.method, c.target, c.cn)
+		} else {
+			assert.NotNil(t, err, "%s %s should be denied for %s", c.method, c.target, c.cn)
+		}
+	}
+
+	err = options.Authorize(httptest.NewRequest("GET", "/", nil), tls.ConnectionState{})
+	assert.NotNil(t, err, "requests without client certificate should be denied")
+}
+
+func TestHTTPDisableAuthentication(t *testing.T) {
+	options, err := newHTTPOptions(auth.ACL{}, true, []config.HTTPRule{
+		{Path: "/admin/*", Deny: true},
+	}, time.Second)
+	assert.Nil(t, err, "should be able to build HTTP options")
+
+	err = options.Authorize(httptest.NewRequest("GET", "/", nil), tls.ConnectionState{})
+	assert.Nil(t, err, "requests should be allowed without authentication")
+	err = options.Authorize(httptest.NewRequest("GET", "/admin/", nil), tls.ConnectionState{})
+	assert.NotNil(t, err, "deny rules should apply without authentication")
+}
+
+func TestHTTPPolicyRequestInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.rego")
+	assert.Nil(t, os.WriteFile(path, []byte(httpTestPolicy), 0600))
+
+	acl, _, err := buildACL(config.Access{Policy: path, Query: "data.policy.allow"}, 5*time.Second)
+	assert.Nil(t, err, "should be able to load policy")
+	options, err := newHTTPOptions(acl, false, nil, time.Second)
+	assert.Nil(t, err, "should be able to build HTTP options")
+
+	r := httptest.NewRequest("GET", "/path?q=1", nil)
+	r.Header.Set("X-Test", "yes")
+	assert.Nil(t, options.Authorize(r, httpTestState("client")), "policy should allow request")
+
+	r = httptest.NewRequest("POST", "/path?q=1", nil)
+	r.Header.Set("X-Test", "yes")
+	assert.NotNil(t, options.Authorize(r, httpTestState("client")), "policy should deny request with other method")
+
+	r = httptest.NewRequest("GET", "/path?q=2", nil)
+	r.Header.Set("X-Test", "yes")
+	assert.NotNil(t, options.Authorize(r, httpTestState("client")), "policy should deny request with other query")
+}
+
+func TestHTTPPolicySourceInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.rego")
+	assert.Nil(t, os.WriteFile(path, []byte(sourceTestPolicy), 0600))
+
+	acl, _, err := buildACL(config.Access{Policy: path, Query: "data.policy.allow"}, 5*time.Second)
+	assert.Nil(t, err, "should be able to load policy")
+	options, err := newHTTPOptions(acl, false, nil, time.Second)
+	assert.Nil(t, err, "should be able to build HTTP options")
+
+	r := httptest.NewRequest("GET", "/path", nil)
+	r.RemoteAddr = "10.1.2.3:51234"
+	assert.Nil(t, options.Authorize(r, httpTestState("client")), "policy should allow request from source")
+
+	r.RemoteAddr = "192.168.1.1:51234"
+	assert.NotNil(t, options.Authorize(r, httpTestState("client")), "policy should deny request from other source")
+}
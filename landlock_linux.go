@@ -20,6 +20,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/url"
@@ -28,6 +29,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/ghostunnel/ghostunnel/config"
 	"github.com/landlock-lsm/go-landlock/landlock"
 )
 
@@ -44,9 +46,10 @@ func addLandlockTestPaths(paths []string) {
 	}
 }
 
-// setupLandlock processes flags given to the process and generates an
-// appropriate landlock rule configuration to limit our privileges.
-func setupLandlock(logger *log.Logger) error {
+// setupLandlock processes flags given to the process (and tunnels declared
+// in the config file, if any) and generates an appropriate landlock rule
+// configuration to limit our privileges.
+func setupLandlock(logger *log.Logger, cfg *config.Config) error {
 	fsRules := []landlock.Rule{}
 	fsRules = append(fsRules, testRules...)
 
@@ -78,76 +81,86 @@ func setupLandlock(logger *log.Logger) error {
 		fsRules = append(fsRules, landlock.RODirs(path))
 	}
 
-	// Process string flags containing addresses or URLs.
-	for _, addr := range []*string{
+	listenAddrs := []*string{
 		serverListenAddress,
 		clientListenAddress,
+		edgeListenAddress,
+		edgeAgentListenAddress,
 		statusAddress,
-	} {
-		if addr == nil || len(*addr) == 0 {
-			continue
-		}
-
-		rule, err := ruleFromStringAddress(*addr, landlock.BindTCP)
-		if err != nil {
-			logger.Printf("error processing argument '%s' for landlock rule", *addr)
-		}
-		if rule != nil {
-			netRules = append(netRules, rule)
-		}
 	}
-
-	for _, addr := range []*string{
-		serverForwardAddress,
+	targetAddrs := []*string{
+		agentEdgeAddress,
+		agentForwardAddress,
 		serverStatusTargetAddress,
-		clientForwardAddress,
 		useWorkloadAPIAddr,
 		metricsURL,
-	} {
-		if addr == nil || len(*addr) == 0 {
+	}
+	for _, targets := range []*[]string{serverForwardAddress, clientForwardAddress} {
+		if targets == nil {
 			continue
 		}
-
-		rule, err := ruleFromStringAddress(*addr, landlock.ConnectTCP)
-		if err != nil {
-			logger.Printf("error processing argument '%s' for landlock rule", *addr)
+		for i := range *targets {
+			targetAddrs = append(targetAddrs, &(*targets)[i])
 		}
-		if rule != nil {
-			netRules = append(netRules, rule)
+	}
+	if serverALPNTargets != nil {
+		for _, target := range *serverALPNTargets {
+			target := target
+			targetAddrs = append(targetAddrs, &target)
 		}
 	}
-
-	// Process string flags containing file paths. Since we need to able to
-	// reload these files even after the file was changed/rewritten, we need to
-	// add a RO rule on the entire parent directory.
-	for _, path := range []*string{
+	filePaths := []*string{
 		serverAllowPolicy,
 		clientAllowPolicy,
+		edgeAllowPolicy,
+		agentAllowPolicy,
 		keystorePath,
 		certPath,
 		keyPath,
 		caBundlePath,
-	} {
-		if path == nil || len(*path) == 0 {
-			continue
-		}
-		if _, err := os.Stat(*path); errors.Is(err, os.ErrNotExist) {
-			continue
+		runConfigPath,
+		clientConnectProxyAuth,
+		serverTargetKeystore,
+		serverTargetCert,
+		serverTargetKey,
+		serverTargetCACert,
+		clientListenKeystore,
+		clientListenCert,
+		clientListenKey,
+		clientListenCACert,
+	}
+
+	// Files of source ranges, for --allow-source and --deny-source.
+	for _, sources := range []*[]string{serverAllowSources, serverDenySources} {
+		if sources != nil {
+			filePaths = append(filePaths, sourceFilePaths(*sources)...)
 		}
+	}
 
-		// Note: If one of these args is a symlink, we also need to add a rule for
-		// the target of the symlink.
-		fsRules = append(fsRules, landlock.RODirs(filepath.Dir(*path)))
+	// Destinations forward proxy clients may connect to.
+	var destinations []string
+	if clientAllowDestination != nil {
+		destinations = append(destinations, *clientAllowDestination...)
+	}
 
-		target, err := filepath.EvalSymlinks(*path)
-		if err != nil {
-			continue
-		}
-		if target != *path {
-			fsRules = append(fsRules, landlock.RODirs(filepath.Dir(target)))
-		}
+	// Proxies from the environment, for --connect-proxy-from-env (or tunnels
+	// with connect-proxy-from-env set).
+	envProxy := envProxyConfig().HTTPSProxy
+	if clientConnectProxyEnv != nil && *clientConnectProxyEnv {
+		targetAddrs = append(targetAddrs, &envProxy)
 	}
 
+	// Addresses and files referenced by tunnels in the config file.
+	configListen, configTargets, configDestinations, configFiles := configLandlockResources(cfg)
+	listenAddrs = append(listenAddrs, configListen...)
+	targetAddrs = append(targetAddrs, configTargets...)
+	destinations = append(destinations, configDestinations...)
+	filePaths = append(filePaths, configFiles...)
+
+	addrFSRules, addrNetRules := landlockRules(logger, listenAddrs, targetAddrs, destinations, filePaths)
+	fsRules = append(fsRules, addrFSRules...)
+	netRules = append(netRules, addrNetRules...)
+
 	// Process net.TCPAddr flags.
 	for _, addr := range []**net.TCPAddr{metricsGraphite} {
 		if addr == nil || *addr == nil {
@@ -164,14 +177,18 @@ func setupLandlock(logger *log.Logger) error {
 	}
 
 	// Process url.URL flags.
-	for _, url := range []**url.URL{clientConnectProxy} {
-		if url == nil || *url == nil {
+	var proxyURLs []*url.URL
+	if clientConnectProxy != nil {
+		proxyURLs = *clientConnectProxy
+	}
+	for _, url := range proxyURLs {
+		if url == nil {
 			continue
 		}
 
-		rule, err := ruleFromURL(*url, landlock.ConnectTCP)
+		rule, err := ruleFromURL(url, landlock.ConnectTCP)
 		if err != nil {
-			logger.Printf("error processing argument '%s' for landlock rule", *url)
+			logger.Printf("error processing argument '%s' for landlock rule", url.Redacted())
 		}
 		if rule != nil {
 			netRules = append(netRules, rule)
@@ -188,11 +205,170 @@ func setupLandlock(logger *log.Logger) error {
 		logger.Printf("warning: unable to set up landlock filesystem rules: %v", err)
 		return err
 	}
+	landlockEnforced.fs = ruleSet(fsRules)
 	err = config.RestrictNet(netRules...)
 	if err != nil {
 		logger.Printf("warning: unable to set up landlock network rules: %v", err)
+		return err
+	}
+	landlockEnforced.net = ruleSet(netRules)
+	return nil
+}
+
+// Addresses and files referenced by tunnels in the config file, if any.
+func configLandlockResources(cfg *config.Config) (listenAddrs, targetAddrs []*string, destinations []string, filePaths []*string) {
+	envProxy := envProxyConfig().HTTPSProxy
+	if cfg != nil {
+		for i := range cfg.Tunnels {
+			t := &cfg.Tunnels[i]
+			listenAddrs = append(listenAddrs, &t.Listen)
+			targetAddrs = append(targetAddrs, &t.Target, &t.TargetStatus, &t.ConnectProxy, &t.Credentials.WorkloadAPIAddr)
+			for j := range t.Targets {
+				targetAddrs = append(targetAddrs, &t.Targets[j])
+			}
+			for j := range t.ConnectProxies {
+				targetAddrs = append(targetAddrs, &t.ConnectProxies[j])
+			}
+			if t.ConnectProxyFromEnv {
+				targetAddrs = append(targetAddrs, &envProxy)
+			}
+			destinations = append(destinations, t.ForwardProxy.Allow...)
+			filePaths = append(filePaths, &t.Access.Policy, &t.Credentials.Keystore, &t.Credentials.Cert, &t.Credentials.Key, &t.Credentials.CACert, &t.ConnectProxyAuthFile)
+			filePaths = append(filePaths, sourceFilePaths(t.Sources.Allow)...)
+			filePaths = append(filePaths, sourceFilePaths(t.Sources.Deny)...)
+			for _, creds := range []*config.Credentials{&t.TargetTLS.Credentials, &t.ListenTLS.Credentials} {
+				targetAddrs = append(targetAddrs, &creds.WorkloadAPIAddr)
+				filePaths = append(filePaths, &creds.Keystore, &creds.Cert, &creds.Key, &creds.CACert)
+			}
+			for _, target := range t.ALPNTargets {
+				target := target
+				targetAddrs = append(targetAddrs, &target)
+			}
+			for j := range t.Routes {
+				r := &t.Routes[j]
+				targetAddrs = append(targetAddrs, &r.Target, &r.Credentials.WorkloadAPIAddr)
+				filePaths = append(filePaths, &r.Access.Policy, &r.Credentials.Keystore, &r.Credentials.Cert, &r.Credentials.Key, &r.Credentials.CACert)
+			}
+		}
+	}
+	return listenAddrs, targetAddrs, destinations, filePaths
+}
+
+// Paths of files referenced by source filter entries (file:PATH).
+func sourceFilePaths(entries []string) []*string {
+	var paths []*string
+	for _, entry := range entries {
+		if path, ok := strings.CutPrefix(entry, "file:"); ok {
+			paths = append(paths, &path)
+		}
+	}
+	return paths
+}
+
+// Landlock rules to listen on and connect to the given addresses, to connect
+// to forward proxy destinations and to read the given files.
+func landlockRules(logger *log.Logger, listenAddrs, targetAddrs []*string, destinations []string, filePaths []*string) (fsRules, netRules []landlock.Rule) {
+	// Process string flags containing addresses or URLs.
+	for _, addr := range listenAddrs {
+		if addr == nil || len(*addr) == 0 {
+			continue
+		}
+
+		rule, err := ruleFromStringAddress(*addr, landlock.BindTCP)
+		if err != nil {
+			logger.Printf("error processing argument '%s' for landlock rule", *addr)
+		}
+		if rule != nil {
+			netRules = append(netRules, rule)
+		}
+	}
+
+	for _, addr := range targetAddrs {
+		if addr == nil || len(*addr) == 0 {
+			continue
+		}
+
+		rule, err := ruleFromStringAddress(*addr, landlock.ConnectTCP)
+		if err != nil {
+			logger.Printf("error processing argument '%s' for landlock rule", *addr)
+		}
+		if rule != nil {
+			netRules = append(netRules, rule)
+		}
+	}
+
+	// Allow connections to all ports of allowed forward proxy destinations,
+	// as we don't know which hosts they'll resolve to.
+	for _, destination := range destinations {
+		rules, err := rulesFromDestination(destination, landlock.ConnectTCP)
+		if err != nil {
+			logger.Printf("error processing destination '%s' for landlock rule", destination)
+		}
+		netRules = append(netRules, rules...)
+	}
+
+	// Process string flags containing file paths. Since we need to able to
+	// reload these files even after the file was changed/rewritten, we need to
+	// add a RO rule on the entire parent directory.
+	for _, path := range filePaths {
+		if path == nil || len(*path) == 0 {
+			continue
+		}
+		if _, err := os.Stat(*path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		// Note: If one of these args is a symlink, we also need to add a rule for
+		// the target of the symlink.
+		fsRules = append(fsRules, landlock.RODirs(filepath.Dir(*path)))
+
+		target, err := filepath.EvalSymlinks(*path)
+		if err != nil {
+			continue
+		}
+		if target != *path {
+			fsRules = append(fsRules, landlock.RODirs(filepath.Dir(target)))
+		}
+	}
+
+	return fsRules, netRules
+}
+
+// Descriptions of the rules set up by setupLandlock, if any, so that we can
+// check config files on reload against them (see checkLandlock).
+var landlockEnforced struct {
+	fs, net map[string]bool
+}
+
+func ruleSet(rules []landlock.Rule) map[string]bool {
+	set := map[string]bool{}
+	for _, rule := range rules {
+		set[fmt.Sprint(rule)] = true
+	}
+	return set
+}
+
+// checkLandlock returns an error if the tunnels in a config file need access
+// that wasn't granted by the landlock rules set up at startup (e.g. to listen
+// on a new port, or to read credentials from a new directory), since landlock
+// rules can't be extended once they're in place.
+func checkLandlock(cfg *config.Config) error {
+	listenAddrs, targetAddrs, destinations, filePaths := configLandlockResources(cfg)
+	fsRules, netRules := landlockRules(logger, listenAddrs, targetAddrs, destinations, filePaths)
+	for _, check := range []struct {
+		enforced map[string]bool
+		rules    []landlock.Rule
+	}{{landlockEnforced.fs, fsRules}, {landlockEnforced.net, netRules}} {
+		if check.enforced == nil {
+			continue
+		}
+		for _, rule := range check.rules {
+			if !check.enforced[fmt.Sprint(rule)] {
+				return fmt.Errorf("--use-landlock: access not granted at startup (%v), restart to apply", rule)
+			}
+		}
 	}
-	return err
+	return nil
 }
 
 func ruleFromStringAddress(addr string, ruleFromPort portRuleFunc) (landlock.Rule, error) {
@@ -203,7 +379,11 @@ func ruleFromStringAddress(addr string, ruleFromPort portRuleFunc) (landlock.Rul
 		// Socket activation - no rule needed
 		return nil, nil
 	}
-	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+	if strings.HasPrefix(addr, "udp:") {
+		// Landlock only restricts TCP - no rule needed
+		return nil, nil
+	}
+	if strings.Contains(addr, "://") {
 		u, err := url.Parse(addr)
 		if err != nil {
 			return nil, err
@@ -224,6 +404,28 @@ func ruleFromStringAddress(addr string, ruleFromPort portRuleFunc) (landlock.Rul
 	return ruleFromPort(uint16(port)), nil
 }
 
+// Rules for the ports of a forward proxy destination pattern (HOST:PORT,
+// where PORT may be a range). Landlock has one rule per port, so wildcard
+// ports are rejected (see validateTunnel) rather than allowing every port.
+func rulesFromDestination(destination string, ruleFromPort portRuleFunc) ([]landlock.Rule, error) {
+	_, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	if port == "*" {
+		return nil, errors.New("wildcard ports can't be allowed by landlock")
+	}
+	minPort, maxPort, err := parsePortRange(port)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]landlock.Rule, 0, maxPort-minPort+1)
+	for p := minPort; p <= maxPort; p++ {
+		rules = append(rules, ruleFromPort(uint16(p)))
+	}
+	return rules, nil
+}
+
 func ruleFromTCPAddress(addr *net.TCPAddr, ruleFromPort portRuleFunc) (landlock.Rule, error) {
 	if addr.Port == 0 {
 		return nil, errors.New("unable to extract port number from address")
@@ -234,12 +436,8 @@ func ruleFromTCPAddress(addr *net.TCPAddr, ruleFromPort portRuleFunc) (landlock.
 func ruleFromURL(u *url.URL, ruleFromPort portRuleFunc) (landlock.Rule, error) {
 	port := u.Port()
 	if len(port) == 0 {
-		if u.Scheme == "http" {
-			return ruleFromPort(uint16(80)), nil
-		}
-		if u.Scheme == "https" {
-			return ruleFromPort(uint16(443)), nil
-		}
+		// Default ports for HTTP(S) URLs, and for upstream proxies
+		port = upstreamProxyPorts[u.Scheme]
 	}
 	numericPort, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
@@ -18,10 +18,18 @@
 
 package main
 
-import "log"
+import (
+	"log"
+
+	"github.com/ghostunnel/ghostunnel/config"
+)
 
 func addLandlockTestPaths(paths []string) {}
 
-func setupLandlock(logger *log.Logger) error {
+func setupLandlock(logger *log.Logger, cfg *config.Config) error {
+	return nil
+}
+
+func checkLandlock(cfg *config.Config) error {
 	return nil
 }
@@ -25,22 +25,30 @@ import (
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ghostunnel/ghostunnel/auth"
+	"github.com/ghostunnel/ghostunnel/backend"
 	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/ghostunnel/ghostunnel/mux"
 	"github.com/ghostunnel/ghostunnel/policy"
 	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/quic"
 	"github.com/ghostunnel/ghostunnel/socket"
+	"github.com/ghostunnel/ghostunnel/starttls"
+	"github.com/ghostunnel/ghostunnel/websocket"
 	"github.com/ghostunnel/ghostunnel/wildcard"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	graphite "github.com/cyberdelia/go-metrics-graphite"
 	gsyslog "github.com/hashicorp/go-syslog"
-	http_dialer "github.com/mwitkow/go-http-dialer"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	metrics "github.com/rcrowley/go-metrics"
 	sqmetrics "github.com/square/go-sq-metrics"
@@ -72,9 +80,30 @@ var (
 	// Server flags
 	serverCommand             = app.Command("server", "Server mode (TLS listener -> plain TCP/UNIX target).")
 	serverListenAddress       = serverCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, unix:PATH, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
-	serverForwardAddress      = serverCommand.Flag("target", "Address to forward connections to (can be HOST:PORT or unix:PATH).").PlaceHolder("ADDR").Required().String()
+	serverForwardAddress      = serverCommand.Flag("target", "Address to forward connections to (can be HOST:PORT, unix:PATH or udp:HOST:PORT). Can be repeated to balance connections between multiple targets.").PlaceHolder("ADDR").Required().Strings()
 	serverStatusTargetAddress = serverCommand.Flag("target-status", "Address to target for status checking downstream healthchecks. Defaults to a TCP healthcheck if this flag is not passed.").Default("").String()
-	serverProxyProtocol       = serverCommand.Flag("proxy-protocol", "Enable PROXY protocol v2 to signal connection info to backend").Bool()
+	serverTargetBalance       = serverCommand.Flag("target-balance", "Load balancing policy if multiple targets are given (round-robin, least-connections or random-of-two).").Default(backend.RoundRobin).Enum(backend.Policies...)
+	serverTargetHealthCheck   = serverCommand.Flag("target-health-interval", "Interval for active health checks if multiple targets are given (uses --target-status if set, a TCP check otherwise). Set to zero to disable.").Default("5s").Duration()
+	serverTargetMaxFails      = serverCommand.Flag("target-max-fails", "Eject a target after this many consecutive dial errors, if multiple targets are given. Set to zero to disable.").Default("3").Int()
+	serverTargetEjectionTime  = serverCommand.Flag("target-ejection-time", "Time for which a target is ejected after too many dial errors.").Default("30s").Duration()
+	serverALPN                = serverCommand.Flag("alpn", "Protocol to advertise via ALPN, in order of preference (can be repeated).").PlaceHolder("PROTOCOL").Strings()
+	serverALPNTargets         = serverCommand.Flag("alpn-target", "Forward connections that negotiated the given ALPN protocol to a different target (can be repeated).").PlaceHolder("PROTOCOL=ADDR").StringMap()
+	serverMultiplex           = serverCommand.Flag("multiplex", "Accept multiplexed sessions from clients that use --multiplex. Other clients are accepted as usual.").Bool()
+	serverQUIC                = serverCommand.Flag("quic", "Listen for QUIC connections on the UDP port of --listen instead of TLS over TCP. Clients must use --quic.").Bool()
+	serverWebSocket           = serverCommand.Flag("websocket", "Accept WebSocket upgrades from clients that use --websocket, e.g. to traverse proxies that only pass HTTP(S). Other clients are accepted as usual.").Bool()
+	serverWebSocketPath       = serverCommand.Flag("websocket-path", "Path of WebSocket upgrade requests, if --websocket is set.").Default(websocket.DefaultPath).String()
+	serverHTTP                = serverCommand.Flag("http", "Parse HTTP requests and forward them to the target as a reverse proxy, with headers that identify the client. Access control flags are checked for each request (denied requests get a 403).").Bool()
+	serverProxyProtocol       = serverCommand.Flag("proxy-protocol", "Enable PROXY protocol to signal connection info to backend").Bool()
+	serverAcceptProxyProtocol = serverCommand.Flag("accept-proxy-protocol", "Accept PROXY protocol (v1 or v2) headers from load balancers in the given CIDR range, e.g. 10.0.0.0/8 (can be repeated).").PlaceHolder("CIDR").Strings()
+	serverProxyProtocolVer    = serverCommand.Flag("proxy-protocol-version", "Version of the PROXY protocol to use with --proxy-protocol (1 or 2). Only v2 carries information about the TLS session.").Default("2").Enum("1", "2")
+	serverListenProtocol      = serverCommand.Flag("listen-protocol", "Accept in-protocol upgrades to TLS (STARTTLS) from clients that speak the given protocol (postgres, smtp or ldap), before the TLS handshake. The target gets the session after the upgrade.").PlaceHolder("PROTOCOL").Enum(starttls.ServerProtocols...)
+	serverTargetTLS           = serverCommand.Flag("target-tls", "Connect to targets with TLS, for targets that require TLS themselves. Uses the --target-* credentials, not those of the listener.").Bool()
+	serverTargetKeystore      = serverCommand.Flag("target-keystore", "Path to keystore (combined PEM with cert/key, or PKCS12 keystore) with the client certificate to present to targets, if --target-tls is set.").PlaceHolder("PATH").String()
+	serverTargetCert          = serverCommand.Flag("target-cert", "Path to certificate (PEM with certificate chain) to present to targets, if --target-tls is set.").PlaceHolder("PATH").String()
+	serverTargetKey           = serverCommand.Flag("target-key", "Path to certificate private key (PEM with private key) for --target-cert.").PlaceHolder("PATH").String()
+	serverTargetStorePass     = serverCommand.Flag("target-storepass", "Password for --target-keystore (if using PKCS keystore, optional).").PlaceHolder("PASS").String()
+	serverTargetCACert        = serverCommand.Flag("target-cacert", "Path to CA bundle file (PEM/X509) to verify targets with, if --target-tls is set. Uses system trust store by default.").PlaceHolder("PATH").String()
+	serverTargetServerName    = serverCommand.Flag("target-server-name", "If set, overrides the server name used for hostname verification of targets with --target-tls (required for unix:PATH targets).").PlaceHolder("NAME").String()
 	serverUnsafeTarget        = serverCommand.Flag("unsafe-target", "If set, does not limit target to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
 	serverAllowAll            = serverCommand.Flag("allow-all", "Allow all clients, do not check client cert subject.").Bool()
 	serverAllowedCNs          = serverCommand.Flag("allow-cn", "Allow clients with given common name (can be repeated).").PlaceHolder("CN").Strings()
@@ -84,6 +113,16 @@ var (
 	serverAllowedURIs         = serverCommand.Flag("allow-uri", "Allow clients with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
 	serverAllowPolicy         = serverCommand.Flag("allow-policy", "Allow passing the location of an OPA rego file").PlaceHolder("POLICY").String()
 	serverAllowQuery          = serverCommand.Flag("allow-query", "Allow defining a query to validate against the client certificate and the rego policy.").PlaceHolder("QUERY").String()
+	serverAllowSources        = serverCommand.Flag("allow-source", "Only accept connections from clients in the given CIDR range or IP address, checked before the TLS handshake. Use file:PATH for a file with one range per line, re-read on reload (can be repeated).").PlaceHolder("CIDR").Strings()
+	serverDenySources         = serverCommand.Flag("deny-source", "Reject connections from clients in the given CIDR range or IP address before the TLS handshake, even if allowed by --allow-source. Use file:PATH for a file with one range per line, re-read on reload (can be repeated).").PlaceHolder("CIDR").Strings()
+	serverQuotaKey            = serverCommand.Flag("quota-key", "Identify clients for quotas by their common name (cn), first URI SAN (uri), e.g. a SPIFFE ID, or the result of --quota-query (opa).").Default(auth.IdentityCN).Enum(auth.IdentityKinds...)
+	serverQuotaQuery          = serverCommand.Flag("quota-query", "Query that returns the identity of a client for quotas, evaluated against the --allow-policy file (with --quota-key=opa).").PlaceHolder("QUERY").String()
+	serverQuotaRate           = serverCommand.Flag("quota-rate", "Limit new connections per client identity to this many per second (0 means no limit).").Default("0").Float64()
+	serverQuotaBurst          = serverCommand.Flag("quota-burst", "Allow bursts of this many new connections per client identity on top of --quota-rate (defaults to the rate).").Default("0").Int()
+	serverQuotaMaxConnections = serverCommand.Flag("quota-max-connections", "Limit open connections per client identity (0 means no limit).").Default("0").Int()
+	serverQuotaReadRate       = serverCommand.Flag("quota-read-rate", "Limit the rate of data read from each client identity (all its connections together), in bytes per second with an optional burst (e.g. 1MiB:4MiB).").PlaceHolder("RATE[:BURST]").String()
+	serverQuotaWriteRate      = serverCommand.Flag("quota-write-rate", "Limit the rate of data written to each client identity (all its connections together), in bytes per second with an optional burst (e.g. 1MiB:4MiB).").PlaceHolder("RATE[:BURST]").String()
+	serverQuotaOverrides      = serverCommand.Flag("quota-override", "Replace the quota for a client identity, e.g. 'spiffe://example.com/batch=rate:5,burst:10,max-connections:20,read:1MiB' (can be repeated).").PlaceHolder("IDENTITY=QUOTA").Strings()
 	serverDisableAuth         = serverCommand.Flag("disable-authentication", "Disable client authentication, no client certificate will be required.").Default("false").Bool()
 	serverAutoACMEFQDN        = serverCommand.Flag("auto-acme-cert", "Automatically obtain a certificate via ACME for the specified FQDN").PlaceHolder("FQDN").String()
 	serverAutoACMEEmail       = serverCommand.Flag("auto-acme-email", "Email address associated with all ACME requests").PlaceHolder("EMAIL").String()
@@ -93,20 +132,71 @@ var (
 
 	// Client flags
 	clientCommand       = app.Command("client", "Client mode (plain TCP/UNIX listener -> TLS target).")
-	clientListenAddress = clientCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, unix:PATH, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
+	clientListenAddress = clientCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, unix:PATH, udp:HOST:PORT, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
 	// Note: can't use .TCP() for clientForwardAddress because we need to set the original string in tls.Config.ServerName.
-	clientForwardAddress = clientCommand.Flag("target", "Address to forward connections to (must be HOST:PORT).").PlaceHolder("ADDR").Required().String()
-	clientUnsafeListen   = clientCommand.Flag("unsafe-listen", "If set, does not limit listen to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
-	clientServerName     = clientCommand.Flag("override-server-name", "If set, overrides the server name used for hostname verification.").PlaceHolder("NAME").String()
-	clientConnectProxy   = clientCommand.Flag("connect-proxy", "If set, connect to target over given HTTP CONNECT proxy. Must be HTTP/HTTPS URL.").PlaceHolder("URL").URL()
-	clientAllowedCNs     = clientCommand.Flag("verify-cn", "Allow servers with given common name (can be repeated).").PlaceHolder("CN").Strings()
-	clientAllowedOUs     = clientCommand.Flag("verify-ou", "Allow servers with given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
-	clientAllowedDNSs    = clientCommand.Flag("verify-dns", "Allow servers with given DNS subject alternative name (can be repeated).").PlaceHolder("DNS").Strings()
-	clientAllowedIPs     = clientCommand.Flag("verify-ip", "").Hidden().PlaceHolder("SAN").IPList()
-	clientAllowedURIs    = clientCommand.Flag("verify-uri", "Allow servers with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
-	clientAllowPolicy    = clientCommand.Flag("verify-policy", "Allow passing the location of an OPA rego file").PlaceHolder("POLICY").String()
-	clientAllowQuery     = clientCommand.Flag("verify-query", "Allow defining a query to validate against the client certificate and the rego policy.").PlaceHolder("QUERY").String()
-	clientDisableAuth    = clientCommand.Flag("disable-authentication", "Disable client authentication, no certificate will be provided to the server.").Default("false").Bool()
+	clientForwardAddress   = clientCommand.Flag("target", "Address to forward connections to (must be HOST:PORT). Can be repeated to fail over between multiple targets, in order of priority.").PlaceHolder("ADDR").Strings()
+	clientForwardProxy     = clientCommand.Flag("forward-proxy", "Accept HTTP CONNECT (connect) and/or SOCKS5 (socks5) requests on the listener, and connect to the destination requested by the application instead of a fixed target (can be repeated). Requires --allow-destination.").PlaceHolder("PROTOCOL").Enums(proxy.ForwardProxyProtocols...)
+	clientAllowDestination = clientCommand.Flag("allow-destination", "Allow forward proxy requests for the given destination (HOST:PORT). HOST can be a name, a wildcard like *.example.com, an IP address, a CIDR range or *, PORT a port, a range like 8000-8999 or * (can be repeated).").PlaceHolder("HOST:PORT").Strings()
+	clientTargetBackoff    = clientCommand.Flag("target-backoff", "Time for which a target is marked down after it fails, if multiple targets are given. Doubles on every consecutive failure.").Default("1s").Duration()
+	clientTargetMaxBackoff = clientCommand.Flag("target-max-backoff", "Maximum time for which a target is marked down after repeated failures.").Default("1m").Duration()
+	clientTargetProtocol   = clientCommand.Flag("target-protocol", "Upgrade connections to the target to TLS in-protocol (STARTTLS), for targets that speak the given protocol (postgres, mysql, smtp or ldap). Applications connect without TLS.").PlaceHolder("PROTOCOL").Enum(starttls.Protocols...)
+	clientALPN             = clientCommand.Flag("alpn", "Protocol to request via ALPN, in order of preference (can be repeated).").PlaceHolder("PROTOCOL").Strings()
+	clientMultiplex        = clientCommand.Flag("multiplex", "Carry connections as streams over a few long-lived TLS connections to the server. Falls back to a TLS connection per connection if the server doesn't support it.").Bool()
+	clientMultiplexConns   = clientCommand.Flag("multiplex-connections", "Number of TLS connections to keep open to the server, if --multiplex is set.").Default("2").Int()
+	clientQUIC             = clientCommand.Flag("quic", "Carry connections as streams over a QUIC connection to each target instead of TLS over TCP, e.g. for lossy links. The server must use --quic.").Bool()
+	clientWebSocket        = clientCommand.Flag("websocket", "Carry connections to the server over WebSocket (wss://) connections, e.g. to traverse proxies that only pass HTTP(S). The server must use --websocket.").Bool()
+	clientWebSocketPath    = clientCommand.Flag("websocket-path", "Path of WebSocket upgrade requests, if --websocket is set.").Default(websocket.DefaultPath).String()
+	clientListenKeystore   = clientCommand.Flag("listen-keystore", "Path to keystore (combined PEM with cert/key, or PKCS12 keystore) to terminate TLS on the listener with.").PlaceHolder("PATH").String()
+	clientListenCert       = clientCommand.Flag("listen-cert", "Path to certificate (PEM with certificate chain) to terminate TLS on the listener with.").PlaceHolder("PATH").String()
+	clientListenKey        = clientCommand.Flag("listen-key", "Path to certificate private key (PEM with private key) for --listen-cert.").PlaceHolder("PATH").String()
+	clientListenStorePass  = clientCommand.Flag("listen-storepass", "Password for --listen-keystore (if using PKCS keystore, optional).").PlaceHolder("PASS").String()
+	clientListenCACert     = clientCommand.Flag("listen-cacert", "Path to CA bundle file (PEM/X509). If set, applications must present a certificate signed by it to the TLS listener.").PlaceHolder("PATH").String()
+	clientUnsafeListen     = clientCommand.Flag("unsafe-listen", "If set, does not limit listen to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
+	clientServerName       = clientCommand.Flag("override-server-name", "If set, overrides the server name used for hostname verification.").PlaceHolder("NAME").String()
+	clientConnectProxy     = clientCommand.Flag("connect-proxy", "If set, connect to target through the given proxy. Must be an HTTP/HTTPS (CONNECT) or SOCKS5 URL, credentials in the URL are used for authentication. Can be repeated to chain proxies, in order.").PlaceHolder("URL").URLList()
+	clientConnectProxyAuth = clientCommand.Flag("connect-proxy-auth-file", "File with credentials (user:password) for proxies that don't have any in their URL.").PlaceHolder("PATH").String()
+	clientConnectProxyEnv  = clientCommand.Flag("connect-proxy-from-env", "Connect to target through the proxy given by HTTPS_PROXY (or HTTP_PROXY), unless the target is listed in NO_PROXY.").Bool()
+	clientAllowedCNs       = clientCommand.Flag("verify-cn", "Allow servers with given common name (can be repeated).").PlaceHolder("CN").Strings()
+	clientAllowedOUs       = clientCommand.Flag("verify-ou", "Allow servers with given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
+	clientAllowedDNSs      = clientCommand.Flag("verify-dns", "Allow servers with given DNS subject alternative name (can be repeated).").PlaceHolder("DNS").Strings()
+	clientAllowedIPs       = clientCommand.Flag("verify-ip", "").Hidden().PlaceHolder("SAN").IPList()
+	clientAllowedURIs      = clientCommand.Flag("verify-uri", "Allow servers with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
+	clientAllowPolicy      = clientCommand.Flag("verify-policy", "Allow passing the location of an OPA rego file").PlaceHolder("POLICY").String()
+	clientAllowQuery       = clientCommand.Flag("verify-query", "Allow defining a query to validate against the client certificate and the rego policy.").PlaceHolder("QUERY").String()
+	clientDisableAuth      = clientCommand.Flag("disable-authentication", "Disable client authentication, no certificate will be provided to the server.").Default("false").Bool()
+
+	// Edge flags (reverse tunnels)
+	edgeCommand            = app.Command("edge", "Edge mode for reverse tunnels (plain TCP/UNIX listener -> TLS connections from agents).")
+	edgeListenAddress      = edgeCommand.Flag("listen", "Address and port to listen on for connections to forward to agents (can be HOST:PORT, unix:PATH, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
+	edgeAgentListenAddress = edgeCommand.Flag("agent-listen", "Address and port to listen on for TLS connections from agents (can be HOST:PORT, unix:PATH, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
+	edgeUnsafeListen       = edgeCommand.Flag("unsafe-listen", "If set, does not limit listen to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
+	edgeAllowAll           = edgeCommand.Flag("allow-all", "Allow all agents, do not check agent cert subject.").Bool()
+	edgeAllowedCNs         = edgeCommand.Flag("allow-cn", "Allow agents with given common name (can be repeated).").PlaceHolder("CN").Strings()
+	edgeAllowedOUs         = edgeCommand.Flag("allow-ou", "Allow agents with given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
+	edgeAllowedDNSs        = edgeCommand.Flag("allow-dns", "Allow agents with given DNS subject alternative name (can be repeated).").PlaceHolder("DNS").Strings()
+	edgeAllowedIPs         = edgeCommand.Flag("allow-ip", "").Hidden().PlaceHolder("SAN").IPList()
+	edgeAllowedURIs        = edgeCommand.Flag("allow-uri", "Allow agents with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
+	edgeAllowPolicy        = edgeCommand.Flag("allow-policy", "Allow passing the location of an OPA rego file").PlaceHolder("POLICY").String()
+	edgeAllowQuery         = edgeCommand.Flag("allow-query", "Allow defining a query to validate against the agent certificate and the rego policy.").PlaceHolder("QUERY").String()
+
+	// Agent flags (reverse tunnels)
+	agentCommand        = app.Command("agent", "Agent mode for reverse tunnels (TLS connection to an edge -> plain TCP/UNIX target).")
+	agentEdgeAddress    = agentCommand.Flag("edge", "Address of the edge to connect to (must be HOST:PORT).").PlaceHolder("ADDR").Required().String()
+	agentForwardAddress = agentCommand.Flag("target", "Address to forward connections from the edge to (can be HOST:PORT or unix:PATH).").PlaceHolder("ADDR").Required().String()
+	agentConnections    = agentCommand.Flag("edge-connections", "Number of TLS connections to keep open to the edge.").Default("1").Int()
+	agentUnsafeTarget   = agentCommand.Flag("unsafe-target", "If set, does not limit target to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
+	agentServerName     = agentCommand.Flag("override-server-name", "If set, overrides the server name used for hostname verification of the edge.").PlaceHolder("NAME").String()
+	agentAllowedCNs     = agentCommand.Flag("verify-cn", "Allow edges with given common name (can be repeated).").PlaceHolder("CN").Strings()
+	agentAllowedOUs     = agentCommand.Flag("verify-ou", "Allow edges with given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
+	agentAllowedDNSs    = agentCommand.Flag("verify-dns", "Allow edges with given DNS subject alternative name (can be repeated).").PlaceHolder("DNS").Strings()
+	agentAllowedIPs     = agentCommand.Flag("verify-ip", "").Hidden().PlaceHolder("SAN").IPList()
+	agentAllowedURIs    = agentCommand.Flag("verify-uri", "Allow edges with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
+	agentAllowPolicy    = agentCommand.Flag("verify-policy", "Allow passing the location of an OPA rego file").PlaceHolder("POLICY").String()
+	agentAllowQuery     = agentCommand.Flag("verify-query", "Allow defining a query to validate against the edge certificate and the rego policy.").PlaceHolder("QUERY").String()
+
+	// Run flags
+	runCommand    = app.Command("run", "Run multiple server and/or client tunnels declared in a config file.")
+	runConfigPath = runCommand.Flag("config", "Path to config file (YAML or JSON) declaring the tunnels to run.").PlaceHolder("PATH").Required().String()
 
 	// TLS options
 	keystorePath            = app.Flag("keystore", "Path to keystore (combined PEM with cert/key, or PKCS12 keystore).").PlaceHolder("PATH").Envar("KEYSTORE_PATH").String()
@@ -125,6 +215,17 @@ var (
 	connectTimeout         = app.Flag("connect-timeout", "Timeout for establishing connections, handshakes.").Default("10s").Duration()
 	closeTimeout           = app.Flag("close-timeout", "Timeout for closing connections when one side terminates.").Default("10s").Duration()
 	maxConnLifetime        = app.Flag("max-conn-lifetime", "Maximum lifetime for connections post handshake, no matter what. Zero means infinite.").Default("0s").Duration()
+	handshakeTimeout       = app.Flag("handshake-timeout", "Timeout for TLS handshakes (and WebSocket upgrades) with clients. Zero means --connect-timeout.").Default("0s").Duration()
+	dialTimeout            = app.Flag("dial-timeout", "Timeout for dialing the target of a connection overall, including retries or failover between targets. Zero means no limit beyond --connect-timeout per attempt.").Default("0s").Duration()
+	idleTimeout            = app.Flag("idle-timeout", "Close connections once neither side sent data for this long (reset by traffic in either direction). Zero means infinite.").Default("0s").Duration()
+	maxConnections         = app.Flag("max-connections", "Maximum number of open connections. Once reached, pause accepting connections until one is closed. Zero means no limit.").Default("0").Int()
+	maxConnectionsPerIP    = app.Flag("max-connections-per-ip", "Maximum number of open connections from a single client IP address. Further connections from it are rejected. Zero means no limit.").Default("0").Int()
+	maxHandshakes          = app.Flag("max-handshakes", "Maximum number of concurrent TLS handshakes with clients. Further connections wait for a slot until the handshake timeout. Zero means no limit.").Default("0").Int()
+	maxReadRate            = app.Flag("max-read-rate", "Maximum rate of data read from all clients together, in bytes per second with an optional burst (e.g. 10MiB:20MiB).").PlaceHolder("RATE[:BURST]").String()
+	maxWriteRate           = app.Flag("max-write-rate", "Maximum rate of data written to all clients together, in bytes per second with an optional burst (e.g. 10MiB:20MiB).").PlaceHolder("RATE[:BURST]").String()
+	maxReadRatePerConn     = app.Flag("max-read-rate-per-conn", "Maximum rate of data read from each client connection, in bytes per second with an optional burst (e.g. 1MiB:4MiB).").PlaceHolder("RATE[:BURST]").String()
+	maxWriteRatePerConn    = app.Flag("max-write-rate-per-conn", "Maximum rate of data written to each client connection, in bytes per second with an optional burst (e.g. 1MiB:4MiB).").PlaceHolder("RATE[:BURST]").String()
+	udpIdleTimeout         = app.Flag("udp-idle-timeout", "Close UDP flows after this much time without datagrams in either direction. Zero means infinite.").Default("1m").Duration()
 
 	// Metrics options
 	metricsGraphite = app.Flag("metrics-graphite", "Collect metrics and report them to the given graphite instance (raw TCP).").PlaceHolder("ADDR").TCP()
@@ -188,9 +289,14 @@ type Context struct {
 	metrics         *sqmetrics.SquareMetrics
 	tlsConfigSource certloader.TLSConfigSource
 	regoPolicy      policy.Policy
+	// Tunnel built from flags (only in server and client mode)
+	tunnel *tunnel
+	// Tunnels declared in config file (only in run mode)
+	tunnels    *tunnelGroup
+	configPath string
 }
 
-// Dialer is an interface for dialers (either net.Dialer, or http_dialer.HttpTunnel)
+// Dialer is an interface for dialers (either net.Dialer, or a dialer for upstream proxies)
 type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
@@ -245,6 +351,19 @@ func validateFlags(app *kingpin.Application) error {
 	if *connectTimeout == 0 {
 		return fmt.Errorf("--connect-timeout duration must not be zero")
 	}
+	if *maxConnections < 0 || *maxConnectionsPerIP < 0 || *maxHandshakes < 0 {
+		return fmt.Errorf("--max-connections, --max-connections-per-ip and --max-handshakes must not be negative")
+	}
+	for _, flag := range []struct{ name, value string }{
+		{"max-read-rate", *maxReadRate},
+		{"max-write-rate", *maxWriteRate},
+		{"max-read-rate-per-conn", *maxReadRatePerConn},
+		{"max-write-rate-per-conn", *maxWriteRatePerConn},
+	} {
+		if _, _, err := config.Bandwidth(flag.value).Parse(); err != nil {
+			return fmt.Errorf("--%s: %s", flag.name, err)
+		}
+	}
 	if pkcs11Module != nil && *pkcs11Module != "" && useLandlock != nil && *useLandlock {
 		return fmt.Errorf("--use-landlock is not compatible with --pkcs11-module")
 	}
@@ -260,6 +379,9 @@ func consideredSafe(addr string) bool {
 		"127.0.0.1:",
 		"[::1]:",
 		"localhost:",
+		"udp:127.0.0.1:",
+		"udp:[::1]:",
+		"udp:localhost:",
 	}
 	for _, prefix := range safePrefixes {
 		if strings.HasPrefix(addr, prefix) {
@@ -295,15 +417,6 @@ func validateCipherSuites() error {
 
 // Validate flags for server mode
 func serverValidateFlags() error {
-	// hasAccessFlags is true if access control flags (besides allow-all) were specified
-	hasAccessFlags := len(*serverAllowedCNs) > 0 ||
-		len(*serverAllowedOUs) > 0 ||
-		len(*serverAllowedDNSs) > 0 ||
-		len(*serverAllowedIPs) > 0 ||
-		len(*serverAllowedURIs) > 0
-	hasOPAFlags := len(*serverAllowPolicy) > 0 ||
-		len(*serverAllowQuery) > 0
-
 	hasValidCredentials := validateCredentials([]bool{
 		// Standard keystore
 		*keystorePath != "",
@@ -328,17 +441,12 @@ func serverValidateFlags() error {
 	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11()) {
 		return errors.New("--cert/--key must be set together, unless using PKCS11 for private key")
 	}
-	if !(*serverDisableAuth) && !(*serverAllowAll) && !hasAccessFlags && !hasOPAFlags {
-		return errors.New("at least one access control flag (--allow-{all,cn,ou,dns-san,ip-san,uri-san}, or OPA flags, or --disable-authentication) is required")
-	}
-	if !(*serverDisableAuth) && *serverAllowAll && (hasAccessFlags || hasOPAFlags) {
-		return errors.New("--allow-all is mutually exclusive with other access control flags")
-	}
-	if *serverDisableAuth && (*serverAllowAll || hasAccessFlags || hasOPAFlags) {
-		return errors.New("--disable-authentication is mutually exclusive with other access control flags")
+	tunnel, err := serverFlagsTunnel()
+	if err != nil {
+		return err
 	}
-	if !*serverUnsafeTarget && !consideredSafe(*serverForwardAddress) {
-		return errors.New("--target must be unix:PATH or localhost:PORT (unless --unsafe-target is set)")
+	if err := validateFlagsTunnel(tunnel); err != nil {
+		return err
 	}
 	if *serverAutoACMEFQDN != "" {
 		if *serverAutoACMEEmail == "" {
@@ -349,13 +457,6 @@ func serverValidateFlags() error {
 		}
 	}
 
-	if hasOPAFlags && (*serverAllowPolicy == "" || *serverAllowQuery == "") {
-		return errors.New("--allow-policy and --allow-query have to be used together")
-	}
-	if hasOPAFlags && hasAccessFlags {
-		return errors.New("--allow-policy and --allow-query are mutually exclusive with other access control flags")
-	}
-
 	if err := validateCipherSuites(); err != nil {
 		return err
 	}
@@ -387,11 +488,11 @@ func clientValidateFlags() error {
 	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11()) {
 		return errors.New("--cert/--key must be set together, unless using PKCS11 for private key")
 	}
-	if !*clientUnsafeListen && !consideredSafe(*clientListenAddress) {
-		return fmt.Errorf("--listen must be unix:PATH, localhost:PORT, systemd:NAME or launchd:NAME (unless --unsafe-listen is set)")
+	if err := validateFlagsTunnel(clientFlagsTunnel()); err != nil {
+		return err
 	}
-	if *clientConnectProxy != nil && (*clientConnectProxy).Scheme != "http" && (*clientConnectProxy).Scheme != "https" {
-		return fmt.Errorf("invalid CONNECT proxy %s, must have HTTP or HTTPS connection scheme", (*clientConnectProxy).String())
+	if *clientMultiplex && *clientMultiplexConns < 1 {
+		return errors.New("--multiplex-connections must be at least 1")
 	}
 	if err := validateCipherSuites(); err != nil {
 		return err
@@ -400,6 +501,270 @@ func clientValidateFlags() error {
 	return nil
 }
 
+// Check the flags of server and client mode as a tunnel, with the same rules
+// as tunnels in a config file.
+func validateFlagsTunnel(t config.Tunnel) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	return validateTunnel(t)
+}
+
+// Build a tunnel from the flags of server mode. Credentials and ACME aren't
+// part of it, they are checked separately.
+func serverFlagsTunnel() (config.Tunnel, error) {
+	quotas, err := serverQuotas()
+	if err != nil {
+		return config.Tunnel{}, err
+	}
+	if !quotas.Enabled() && quotas.Query == "" {
+		// --quota-key has a default, which only matters with quotas
+		quotas = config.Quotas{}
+	}
+	t := config.Tunnel{
+		Name:           "server",
+		Mode:           config.ModeServer,
+		Listen:         *serverListenAddress,
+		TargetStatus:   *serverStatusTargetAddress,
+		ALPN:           *serverALPN,
+		ALPNTargets:    *serverALPNTargets,
+		Multiplex:      config.Multiplex{Enabled: *serverMultiplex},
+		QUIC:           *serverQUIC,
+		HTTP:           config.HTTP{Enabled: *serverHTTP},
+		ListenProtocol: *serverListenProtocol,
+		TargetTLS: config.TargetTLS{
+			Enabled:     *serverTargetTLS,
+			Credentials: serverTargetCredentials(),
+			ServerName:  *serverTargetServerName,
+		},
+		UnsafeTarget:          *serverUnsafeTarget,
+		AcceptProxyProtocol:   *serverAcceptProxyProtocol,
+		ProxyProtocol:         *serverProxyProtocol,
+		DisableAuthentication: *serverDisableAuth,
+		Access: config.Access{
+			All:    *serverAllowAll,
+			CNs:    *serverAllowedCNs,
+			OUs:    *serverAllowedOUs,
+			DNSs:   *serverAllowedDNSs,
+			IPs:    *serverAllowedIPs,
+			URIs:   *serverAllowedURIs,
+			Policy: *serverAllowPolicy,
+			Query:  *serverAllowQuery,
+		},
+		Quotas:  quotas,
+		Sources: config.Sources{Allow: *serverAllowSources, Deny: *serverDenySources},
+	}
+	setFlagsTargets(&t, *serverForwardAddress)
+	if *serverProxyProtocol {
+		t.ProxyProtocolVersion = proxyProtocolVersion(*serverProxyProtocolVer)
+	}
+	if *serverWebSocket {
+		t.WebSocket = config.WebSocket{Enabled: true, Path: *serverWebSocketPath}
+	}
+	return t, nil
+}
+
+// Build a tunnel from the flags of client mode. Credentials aren't part of
+// it, they are checked separately.
+func clientFlagsTunnel() config.Tunnel {
+	t := config.Tunnel{
+		Name:           "client",
+		Mode:           config.ModeClient,
+		Listen:         *clientListenAddress,
+		ALPN:           *clientALPN,
+		QUIC:           *clientQUIC,
+		TargetProtocol: *clientTargetProtocol,
+		UnsafeListen:   *clientUnsafeListen,
+		ServerName:     *clientServerName,
+		ForwardProxy: config.ForwardProxy{
+			Protocols: *clientForwardProxy,
+			Allow:     *clientAllowDestination,
+		},
+		ListenTLS:             config.ListenTLS{Credentials: clientListenCredentials()},
+		ConnectProxyAuthFile:  *clientConnectProxyAuth,
+		ConnectProxyFromEnv:   *clientConnectProxyEnv,
+		DisableAuthentication: *clientDisableAuth,
+		Access: config.Access{
+			CNs:    *clientAllowedCNs,
+			OUs:    *clientAllowedOUs,
+			DNSs:   *clientAllowedDNSs,
+			IPs:    *clientAllowedIPs,
+			URIs:   *clientAllowedURIs,
+			Policy: *clientAllowPolicy,
+			Query:  *clientAllowQuery,
+		},
+	}
+	setFlagsTargets(&t, *clientForwardAddress)
+	if *clientMultiplex {
+		t.Multiplex = config.Multiplex{Enabled: true, Connections: *clientMultiplexConns}
+	}
+	if *clientWebSocket {
+		t.WebSocket = config.WebSocket{Enabled: true, Path: *clientWebSocketPath}
+	}
+	for _, u := range *clientConnectProxy {
+		t.ConnectProxies = append(t.ConnectProxies, u.String())
+	}
+	return t
+}
+
+// Set the targets of a tunnel from a --target flag, which can be repeated.
+func setFlagsTargets(t *config.Tunnel, targets []string) {
+	if len(targets) == 1 {
+		t.Target = targets[0]
+	} else {
+		t.Targets = targets
+	}
+}
+
+// Get the quotas given via flags in server mode.
+func serverQuotas() (config.Quotas, error) {
+	quotas := config.Quotas{
+		Key:   *serverQuotaKey,
+		Query: *serverQuotaQuery,
+		Default: config.Quota{
+			Rate:           *serverQuotaRate,
+			Burst:          *serverQuotaBurst,
+			MaxConnections: *serverQuotaMaxConnections,
+			Read:           config.Bandwidth(*serverQuotaReadRate),
+			Write:          config.Bandwidth(*serverQuotaWriteRate),
+		},
+	}
+	for _, override := range *serverQuotaOverrides {
+		identity, quota, err := parseQuotaOverride(override)
+		if err != nil {
+			return quotas, err
+		}
+		if quotas.Overrides == nil {
+			quotas.Overrides = map[string]config.Quota{}
+		}
+		quotas.Overrides[identity] = quota
+	}
+	return quotas, nil
+}
+
+// Parse a quota override of the form IDENTITY=QUOTA, where QUOTA is a comma
+// separated list of rate:N, burst:N, max-connections:N, read:RATE[:BURST] and
+// write:RATE[:BURST]. Settings that are
+// left out mean no limit, e.g. "IDENTITY=" exempts an identity from quotas.
+func parseQuotaOverride(override string) (string, config.Quota, error) {
+	var quota config.Quota
+	i := strings.LastIndex(override, "=")
+	if i <= 0 {
+		return "", quota, fmt.Errorf("invalid --quota-override '%s' (must be IDENTITY=QUOTA)", override)
+	}
+	identity, settings := override[:i], override[i+1:]
+	for _, setting := range strings.Split(settings, ",") {
+		if setting == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(setting, ":")
+		var err error
+		switch name {
+		case "rate":
+			quota.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			quota.Burst, err = strconv.Atoi(value)
+		case "max-connections":
+			quota.MaxConnections, err = strconv.Atoi(value)
+		case "read":
+			quota.Read = config.Bandwidth(value)
+			_, _, err = quota.Read.Parse()
+		case "write":
+			quota.Write = config.Bandwidth(value)
+			_, _, err = quota.Write.Parse()
+		default:
+			return "", quota, fmt.Errorf("invalid --quota-override '%s' (unknown setting '%s')", override, name)
+		}
+		if err != nil {
+			return "", quota, fmt.Errorf("invalid --quota-override '%s' (invalid %s '%s')", override, name, value)
+		}
+	}
+	if quota.Rate < 0 || quota.Burst < 0 || quota.MaxConnections < 0 {
+		return "", quota, fmt.Errorf("invalid --quota-override '%s' (must not be negative)", override)
+	}
+	if quota.Burst > 0 && quota.Rate == 0 {
+		return "", quota, fmt.Errorf("invalid --quota-override '%s' (burst requires a rate)", override)
+	}
+	return identity, quota, nil
+}
+
+// Validate credentials for edge and agent mode. Both ends of a reverse
+// tunnel authenticate with certificates, so there is no --disable-authentication.
+func reverseValidateCredentials() error {
+	hasValidCredentials := validateCredentials([]bool{
+		// Standard keystore
+		*keystorePath != "",
+		// macOS keychain identity
+		hasKeychainIdentity(),
+		// A certificate and a key, in separate files
+		(*certPath != "" && *keyPath != ""),
+		// A certificate, with the key in a PKCS#11 module
+		(*certPath != "" && hasPKCS11()),
+		// SPIFFE Workload API
+		*useWorkloadAPI,
+	})
+
+	if hasValidCredentials == 0 {
+		return errors.New("at least one of --keystore, --cert/--key, --use-workload-api or --keychain-identity/issuer (if supported) flags is required")
+	}
+	if hasValidCredentials > 1 {
+		return errors.New("--keystore, --cert/--key, --use-workload-api and --keychain-identity/issuer flags are mutually exclusive")
+	}
+	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11()) {
+		return errors.New("--cert/--key must be set together, unless using PKCS11 for private key")
+	}
+	return validateCipherSuites()
+}
+
+// Validate flags for edge mode
+func edgeValidateFlags() error {
+	hasAccessFlags := len(*edgeAllowedCNs) > 0 ||
+		len(*edgeAllowedOUs) > 0 ||
+		len(*edgeAllowedDNSs) > 0 ||
+		len(*edgeAllowedIPs) > 0 ||
+		len(*edgeAllowedURIs) > 0
+	hasOPAFlags := len(*edgeAllowPolicy) > 0 ||
+		len(*edgeAllowQuery) > 0
+
+	if err := reverseValidateCredentials(); err != nil {
+		return err
+	}
+	if !*edgeAllowAll && !hasAccessFlags && !hasOPAFlags {
+		return errors.New("at least one access control flag (--allow-{all,cn,ou,dns,ip,uri}, or OPA flags) is required")
+	}
+	if *edgeAllowAll && (hasAccessFlags || hasOPAFlags) {
+		return errors.New("--allow-all is mutually exclusive with other access control flags")
+	}
+	if hasOPAFlags && (*edgeAllowPolicy == "" || *edgeAllowQuery == "") {
+		return errors.New("--allow-policy and --allow-query have to be used together")
+	}
+	if hasOPAFlags && hasAccessFlags {
+		return errors.New("--allow-policy and --allow-query are mutually exclusive with other access control flags")
+	}
+	if !*edgeUnsafeListen && !consideredSafe(*edgeListenAddress) {
+		return errors.New("--listen must be unix:PATH, localhost:PORT, systemd:NAME or launchd:NAME (unless --unsafe-listen is set)")
+	}
+	return nil
+}
+
+// Validate flags for agent mode
+func agentValidateFlags() error {
+	if err := reverseValidateCredentials(); err != nil {
+		return err
+	}
+	hasOPAFlags := len(*agentAllowPolicy) > 0 || len(*agentAllowQuery) > 0
+	if hasOPAFlags && (*agentAllowPolicy == "" || *agentAllowQuery == "") {
+		return errors.New("--verify-policy and --verify-query have to be used together")
+	}
+	if !*agentUnsafeTarget && !consideredSafe(*agentForwardAddress) {
+		return errors.New("--target must be unix:PATH or localhost:PORT (unless --unsafe-target is set)")
+	}
+	if *agentConnections < 1 {
+		return errors.New("--edge-connections must be at least 1")
+	}
+	return nil
+}
+
 func main() {
 	err := run(os.Args[1:])
 	if err != nil {
@@ -431,6 +796,17 @@ func run(args []string) error {
 	logger.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
 	logger.Printf("starting ghostunnel in %s mode", command)
 
+	// Config file (run mode). We load this early so that we can generate the
+	// landlock rules for the addresses and files referenced in the config.
+	var cfg *config.Config
+	if command == runCommand.FullCommand() {
+		cfg, err = config.Load(*runConfigPath)
+		if err != nil {
+			logger.Printf("error: unable to load config: %s\n", err)
+			return err
+		}
+	}
+
 	// Landlock
 	if useLandlock != nil && *useLandlock {
 		logger.Printf("setting up landlock rules to limit process privileges")
@@ -439,7 +815,7 @@ func run(args []string) error {
 		// and not supported on older kernels (net rules were added in v6.7, Jan
 		// 2024). We may change this in a future version of Ghostunnel as we get
 		// more comfortable with Landlock.
-		_ = setupLandlock(logger)
+		_ = setupLandlock(logger, cfg)
 	}
 
 	// Metrics
@@ -478,74 +854,86 @@ func run(args []string) error {
 			logger.Printf("error: %s\n", err)
 			return err
 		}
+		tunnel, err := serverFlagsTunnel()
+		if err != nil {
+			logger.Printf("error: %s\n", err)
+			return err
+		}
+
+		err = flagsListen(command, tunnel, metrics)
+		if err != nil {
+			logger.Printf("error from server listen: %s\n", err)
+		}
+		return err
+
+	case clientCommand.FullCommand():
+		if err := clientValidateFlags(); err != nil {
+			logger.Printf("error: %s\n", err)
+			return err
+		}
 
-		// Duplicating this call to getTLSConfigSource() in all switch cases
-		// because we need to complete the validation of the command flags first.
-		tlsConfigSource, err := getTLSConfigSource(*serverDisableAuth)
+		err = flagsListen(command, clientFlagsTunnel(), metrics)
 		if err != nil {
+			logger.Printf("error from client listen: %s\n", err)
+		}
+		return err
+
+	case edgeCommand.FullCommand():
+		if err := edgeValidateFlags(); err != nil {
+			logger.Printf("error: %s\n", err)
 			return err
 		}
 
-		dial, err := serverBackendDialer()
+		tlsConfigSource, err := getTLSConfigSource(false)
 		if err != nil {
-			logger.Printf("error: invalid target address: %s\n", err)
 			return err
 		}
-		logger.Printf("using target address %s", *serverForwardAddress)
 
-		status := newStatusHandler(dial, command, *serverListenAddress, *serverForwardAddress, *serverStatusTargetAddress)
+		// The status check opens a stream to one of the agents, so the edge
+		// is only considered healthy while at least one agent is connected.
+		agents := newAgentRegistry(logger)
+		status := newStatusHandler(agents.dial, command, *edgeListenAddress, *edgeAgentListenAddress, "")
 		context := &Context{
 			status:          status,
 			shutdownChannel: make(chan bool, 1),
 			shutdownTimeout: *processShutdownTimeout,
-			dial:            dial,
+			dial:            agents.dial,
 			metrics:         metrics,
 			tlsConfigSource: tlsConfigSource,
 		}
 		go context.reloadHandler(*timedReload)
 
-		// Start listening
-		err = serverListen(context)
+		err = edgeListen(context, agents)
 		if err != nil {
-			logger.Printf("error from server listen: %s\n", err)
+			logger.Printf("error from edge listen: %s\n", err)
 		}
 		return err
 
-	case clientCommand.FullCommand():
-		if err := clientValidateFlags(); err != nil {
+	case agentCommand.FullCommand():
+		if err := agentValidateFlags(); err != nil {
 			logger.Printf("error: %s\n", err)
 			return err
 		}
 
-		// Duplicating this call to getTLSConfigSource() in all switch cases
-		// because we need to complete the validation of the command flags first.
-		tlsConfigSource, err := getTLSConfigSource(*clientDisableAuth)
+		tlsConfigSource, err := getTLSConfigSource(false)
 		if err != nil {
 			return err
 		}
 
-		// Note: A target address given on the command line may not be resolvable
-		// on our side if the connection is forwarded through a CONNECT proxy. Hence,
-		// we ignore "no such host" errors when a proxy is set and trust that the
-		// proxy will be able to find the target for us.
-		skipResolve := *clientConnectProxy != nil
-		network, address, host, err := socket.ParseAddress(*clientForwardAddress, skipResolve)
+		dial, err := backendDialer(*agentForwardAddress, *connectTimeout, nil)
 		if err != nil {
 			logger.Printf("error: invalid target address: %s\n", err)
 			return err
 		}
-		logger.Printf("using target address %s", *clientForwardAddress)
+		logger.Printf("using target address %s", *agentForwardAddress)
 
-		dial, policy, err := clientBackendDialer(tlsConfigSource, network, address, host)
+		edgeDial, policy, err := agentEdgeDialer(tlsConfigSource)
 		if err != nil {
 			logger.Printf("error: unable to build dialer: %s\n", err)
 			return err
 		}
 
-		// NOTE: We don't provide a target status address here because this handler
-		// is for the client /_status endpoint, its target will be a Ghostunnel in
-		// server mode, and thus this should be a (default) TCP check.
-		status := newStatusHandler(dial, command, *clientListenAddress, *clientForwardAddress, "")
+		status := newStatusHandler(dial, command, *agentEdgeAddress, *agentForwardAddress, "")
 		context := &Context{
 			status:          status,
 			shutdownChannel: make(chan bool, 1),
@@ -557,10 +945,49 @@ func run(args []string) error {
 		}
 		go context.reloadHandler(*timedReload)
 
-		// Start listening
-		err = clientListen(context)
+		err = agentListen(context, edgeDial)
 		if err != nil {
-			logger.Printf("error from client listen: %s\n", err)
+			logger.Printf("error from agent: %s\n", err)
+		}
+		return err
+
+	case runCommand.FullCommand():
+		if err := validateConfig(cfg); err != nil {
+			logger.Printf("error: %s\n", err)
+			return err
+		}
+
+		// Credentials given via global flags are used for the status port, and
+		// as a fallback for tunnels that don't declare their own credentials.
+		tlsConfigSource, err := getTLSConfigSource(true)
+		if err != nil {
+			return err
+		}
+
+		tunnels, err := newTunnelGroup(cfg)
+		if err != nil {
+			logger.Printf("error: %s\n", err)
+			return err
+		}
+		logger.Printf("loaded %d tunnel(s) from %s", len(cfg.Tunnels), *runConfigPath)
+
+		status := newStatusHandler(nil, command, "", "", "")
+		status.configPath = *runConfigPath
+		status.tunnels = tunnels.status
+		context := &Context{
+			status:          status,
+			shutdownChannel: make(chan bool, 1),
+			shutdownTimeout: *processShutdownTimeout,
+			metrics:         metrics,
+			tlsConfigSource: tlsConfigSource,
+			tunnels:         tunnels,
+			configPath:      *runConfigPath,
+		}
+		go context.reloadHandler(*timedReload)
+
+		err = runListen(context)
+		if err != nil {
+			logger.Printf("error from run: %s\n", err)
 		}
 		return err
 	}
@@ -568,71 +995,118 @@ func run(args []string) error {
 	return errors.New("unknown command")
 }
 
-// Open listening socket in server mode. Take note that we create a
-// "reusable port listener", meaning we pass SO_REUSEPORT to the kernel. This
-// allows us to have multiple sockets listening on the same port and accept
-// connections. This is useful for the purpose of replacing certificates
-// in-place without having to take downtime, e.g. if a certificate is expiring.
-func serverListen(context *Context) error {
-	config, err := buildServerConfig(*enabledCipherSuites)
+// Open listening socket in server or client mode, for the tunnel built from
+// the flags (see serverFlagsTunnel and clientFlagsTunnel). Take note that we
+// create a "reusable port listener", meaning we pass SO_REUSEPORT to the
+// kernel. This allows us to have multiple sockets listening on the same port
+// and accept connections. This is useful for the purpose of replacing
+// certificates in-place without having to take downtime, e.g. if a
+// certificate is expiring.
+func flagsListen(command string, cfg config.Tunnel, metrics *sqmetrics.SquareMetrics) error {
+	t, err := newTunnel(cfg)
 	if err != nil {
-		logger.Printf("error trying to read CA bundle: %s", err)
 		return err
 	}
+	state := t.state.Load()
 
-	allowedURIs, err := wildcard.CompileList(*serverAllowedURIs)
-	if err != nil {
-		logger.Printf("invalid URI pattern in --allow-uri flag (%s)", err)
-		return err
+	// NOTE: We don't provide a target status address in client mode, because
+	// its target will be a Ghostunnel in server mode, and thus this should be
+	// a (default) TCP check. There's no check for forward proxies, as they
+	// have no fixed target.
+	status := newStatusHandler(state.dial, command, cfg.Listen, strings.Join(cfg.AllTargets(), ", "), cfg.TargetStatus)
+	if state.pool != nil {
+		status.backends = state.pool.Status
+	}
+	if state.failover != nil {
+		status.backends = state.failover.Status
+		status.activeTarget = state.failover.Active
+	}
+	context := &Context{
+		status:          status,
+		shutdownChannel: make(chan bool, 1),
+		shutdownTimeout: *processShutdownTimeout,
+		dial:            state.dial,
+		metrics:         metrics,
+		tlsConfigSource: state.tlsConfigSource,
+		tunnel:          t,
 	}
+	go context.reloadHandler(*timedReload)
 
-	// Compile the rego policy
-	var regoPolicy policy.Policy
-	if len(*serverAllowPolicy) > 0 && len(*serverAllowQuery) > 0 {
-		regoPolicy, err = policy.LoadFromFile(*serverAllowPolicy, *serverAllowQuery)
+	if *statusAddress != "" {
+		err := context.serveStatus()
 		if err != nil {
-			logger.Printf("Invalid rego policy or query: %s", err)
+			logger.Printf("error serving /_status: %s", err)
+			t.stop()
 			return err
 		}
+	}
+
+	t.start()
+
+	context.status.Listening()
+	context.status.HandleWatchdog()
+	context.signalHandler(t.proxy)
+	t.proxy.Wait()
+
+	return nil
+}
 
-		context.regoPolicy = regoPolicy
+// Accept connections in edge mode, and forward them to agents. Agents
+// connect to a separate TLS listener, and register with the edge.
+func edgeListen(context *Context, agents *agentRegistry) error {
+	tlsConfig, err := buildServerConfig(*enabledCipherSuites)
+	if err != nil {
+		logger.Printf("error trying to read CA bundle: %s", err)
+		return err
 	}
 
-	serverACL := auth.ACL{
-		AllowAll:        *serverAllowAll,
-		AllowedCNs:      *serverAllowedCNs,
-		AllowedOUs:      *serverAllowedOUs,
-		AllowedDNSs:     *serverAllowedDNSs,
-		AllowedIPs:      *serverAllowedIPs,
-		AllowOPAQuery:   regoPolicy,
-		AllowedURIs:     allowedURIs,
-		OPAQueryTimeout: *connectTimeout,
+	edgeACL, regoPolicy, err := buildACL(config.Access{
+		All:    *edgeAllowAll,
+		CNs:    *edgeAllowedCNs,
+		OUs:    *edgeAllowedOUs,
+		DNSs:   *edgeAllowedDNSs,
+		IPs:    *edgeAllowedIPs,
+		URIs:   *edgeAllowedURIs,
+		Policy: *edgeAllowPolicy,
+		Query:  *edgeAllowQuery,
+	}, *connectTimeout)
+	if err != nil {
+		logger.Printf("invalid access control flags: %s", err)
+		return err
 	}
+	context.regoPolicy = regoPolicy
+	tlsConfig.VerifyPeerCertificate = edgeACL.VerifyPeerCertificateServer
+	tlsConfig.NextProtos = []string{mux.ReverseProtocol}
 
-	if *serverDisableAuth {
-		config.ClientAuth = tls.NoClientCert
-	} else {
-		config.VerifyPeerCertificate = serverACL.VerifyPeerCertificateServer
+	agentListener, err := socket.ParseAndOpen(*edgeAgentListenAddress)
+	if err != nil {
+		logger.Printf("error trying to listen for agents: %s", err)
+		return err
 	}
 
-	listener, err := socket.ParseAndOpen(*serverListenAddress)
+	listener, err := socket.ParseAndOpen(*edgeListenAddress)
 	if err != nil {
+		agentListener.Close()
 		logger.Printf("error trying to listen: %s", err)
 		return err
 	}
-
-	serverConfig := mustGetServerConfig(context.tlsConfigSource, config)
+	if ul, ok := listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
 
 	p := proxy.New(
-		certloader.NewListener(listener, serverConfig),
+		listener,
 		*connectTimeout,
 		*closeTimeout,
 		*maxConnLifetime,
 		context.dial,
 		logger,
 		proxyLoggerFlags(*quiet),
-		*serverProxyProtocol,
+		false,
 	)
+	p.SetConnTimeouts(*handshakeTimeout, *dialTimeout, *idleTimeout)
+	p.SetLimiters(globalLimiter())
+	p.SetRateLimits(globalRateLimits())
 
 	if *statusAddress != "" {
 		err := context.serveStatus()
@@ -642,30 +1116,24 @@ func serverListen(context *Context) error {
 		}
 	}
 
-	logger.Printf("listening for connections on %s", *serverListenAddress)
+	logger.Printf("listening for agents on %s", *edgeAgentListenAddress)
+	go agents.serve(certloader.NewListener(agentListener, mustGetServerConfig(context.tlsConfigSource, tlsConfig)), *connectTimeout)
 
+	logger.Printf("listening for connections on %s", *edgeListenAddress)
 	go p.Accept()
 
 	context.status.Listening()
 	context.status.HandleWatchdog()
-	context.signalHandler(p)
+	context.signalHandler(shutdowners{p, agents})
 	p.Wait()
 
 	return nil
 }
 
-// Open listening socket in client mode.
-func clientListen(context *Context) error {
-	listener, err := socket.ParseAndOpen(*clientListenAddress)
-	if err != nil {
-		logger.Printf("error opening socket: %s", err)
-		return err
-	}
-
-	// If this is a UNIX socket, make sure we cleanup files on close.
-	if ul, ok := listener.(*net.UnixListener); ok {
-		ul.SetUnlinkOnClose(true)
-	}
+// Connect to the edge in agent mode, and forward connections from the edge
+// to the target.
+func agentListen(context *Context, edgeDial func() (net.Conn, error)) error {
+	listener := newReverseListener(edgeDial, *agentEdgeAddress, *agentConnections, logger)
 
 	p := proxy.New(
 		listener,
@@ -677,6 +1145,9 @@ func clientListen(context *Context) error {
 		proxyLoggerFlags(*quiet),
 		false,
 	)
+	p.SetConnTimeouts(*handshakeTimeout, *dialTimeout, *idleTimeout)
+	p.SetLimiters(globalLimiter())
+	p.SetRateLimits(globalRateLimits())
 
 	if *statusAddress != "" {
 		err := context.serveStatus()
@@ -686,8 +1157,8 @@ func clientListen(context *Context) error {
 		}
 	}
 
-	logger.Printf("listening for connections on %s", *clientListenAddress)
-
+	logger.Printf("connecting to edge %s", *agentEdgeAddress)
+	listener.start()
 	go p.Accept()
 
 	context.status.Listening()
@@ -757,13 +1228,13 @@ func (context *Context) serveStatus() error {
 	}
 
 	if network != "unix" && https && context.tlsConfigSource.CanServe() {
-		config, err := buildServerConfig(*enabledCipherSuites)
+		tlsConfig, err := buildServerConfig(*enabledCipherSuites)
 		if err != nil {
 			return err
 		}
-		config.ClientAuth = tls.NoClientCert
+		tlsConfig.ClientAuth = tls.NoClientCert
 
-		serverConfig := mustGetServerConfig(context.tlsConfigSource, config)
+		serverConfig := mustGetServerConfig(context.tlsConfigSource, tlsConfig)
 		listener = certloader.NewListener(listener, serverConfig)
 	}
 
@@ -783,88 +1254,244 @@ func (context *Context) serveStatus() error {
 	return nil
 }
 
-// Get backend dialer function in server mode (connecting to a unix socket or tcp port)
-func serverBackendDialer() (func() (net.Conn, error), error) {
-	backendNet, backendAddr, _, err := socket.ParseAddress(*serverForwardAddress, false)
+// Get dialer function for a TCP/UNIX backend with the given timeout. The
+// connection is plain, unless TLS to targets is given.
+func backendDialer(target string, timeout time.Duration, withTLS *targetTLS) (func() (net.Conn, error), error) {
+	backendNet, backendAddr, _, err := socket.ParseAddress(target, false)
 	if err != nil {
 		return nil, err
 	}
+	if backendNet == "udp" {
+		return nil, errUDPTarget
+	}
 
 	return func() (net.Conn, error) {
-		return net.DialTimeout(backendNet, backendAddr, *connectTimeout)
+		return withTLS.dial(backendNet, backendAddr, timeout)
 	}, nil
 }
 
-// Get backend dialer function in client mode (connecting to a TLS port)
-func clientBackendDialer(tlsConfigSource certloader.TLSConfigSource, network, address, host string) (func() (net.Conn, error), policy.Policy, error) {
-	config, err := buildClientConfig(*enabledCipherSuites)
-	if err != nil {
-		return nil, nil, err
+// Wrap the dialer for targets of clients that upgrade to TLS in-protocol, if
+// a listen protocol is given (see starttls.Target).
+func listenProtocolDialer(protocol string, dial func() (net.Conn, error), timeout time.Duration) func() (net.Conn, error) {
+	if protocol == "" {
+		return dial
+	}
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		upgraded, err := starttls.Target(conn, protocol, timeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return upgraded, nil
 	}
+}
 
-	if *clientServerName == "" {
-		config.ServerName = host
-	} else {
-		config.ServerName = *clientServerName
+// Build a pool that balances connections between multiple targets. Active
+// health checks use the same logic as the status endpoint, i.e. an HTTP check
+// against statusTarget if given, or a TCP check otherwise (which includes the
+// TLS handshake with TLS to targets).
+func backendPool(targets []string, statusTarget string, balance config.Balance, timeout time.Duration, withTLS *targetTLS) (*backend.Pool, error) {
+	parse := func(target string) (string, string, error) {
+		network, address, _, err := socket.ParseAddress(target, false)
+		if err == nil && network == "udp" {
+			err = errUDPTarget
+		}
+		return network, address, err
 	}
+	return backend.New(targets, parse, backend.Options{
+		Policy:      balance.Policy,
+		DialTimeout: timeout,
+		Dial: func(network, address string) (net.Conn, error) {
+			return withTLS.dial(network, address, timeout)
+		},
+		HealthCheck: func(dial backend.Dialer) func() error {
+			return newStatusHandler(dial, "", "", "", statusTarget).checkBackendStatus
+		},
+		HealthCheckInterval: balance.HealthCheckInterval,
+		MaxFailures:         balance.MaxFailures,
+		EjectionTime:        balance.EjectionTime,
+		Logger:              logger,
+	})
+}
 
-	allowedURIs, err := wildcard.CompileList(*clientAllowedURIs)
+// Build an ACL from the given access control settings, compiling URI
+// patterns and loading the rego policy (if any).
+func buildACL(access config.Access, timeout time.Duration) (auth.ACL, policy.Policy, error) {
+	allowedURIs, err := wildcard.CompileList(access.URIs)
 	if err != nil {
-		logger.Printf("invalid URI pattern in --verify-uri flag (%s)", err)
-		return nil, nil, err
+		return auth.ACL{}, nil, fmt.Errorf("invalid URI pattern (%s)", err)
 	}
 
-	// Compile the rego policy
 	var regoPolicy policy.Policy
-	if len(*clientAllowPolicy) > 0 && len(*clientAllowQuery) > 0 {
-		regoPolicy, err = policy.LoadFromFile(*clientAllowPolicy, *clientAllowQuery)
+	if len(access.Policy) > 0 && len(access.Query) > 0 {
+		regoPolicy, err = policy.LoadFromFile(access.Policy, access.Query)
 		if err != nil {
-			logger.Printf("Invalid rego policy or query: %s", err)
-			return nil, nil, err
+			return auth.ACL{}, nil, fmt.Errorf("invalid rego policy or query: %s", err)
 		}
 	}
 
-	clientACL := auth.ACL{
-		AllowedCNs:      *clientAllowedCNs,
-		AllowedOUs:      *clientAllowedOUs,
-		AllowedDNSs:     *clientAllowedDNSs,
-		AllowedIPs:      *clientAllowedIPs,
+	return auth.ACL{
+		AllowAll:        access.All,
+		AllowedCNs:      access.CNs,
+		AllowedOUs:      access.OUs,
+		AllowedDNSs:     access.DNSs,
+		AllowedIPs:      access.IPs,
 		AllowedURIs:     allowedURIs,
 		AllowOPAQuery:   regoPolicy,
-		OPAQueryTimeout: *connectTimeout,
+		OPAQueryTimeout: timeout,
+	}, regoPolicy, nil
+}
+
+// Build options for connecting to targets through upstream proxies, with
+// the given chain of proxies (or the proxy from the environment), and the
+// credentials from the given file, if any. HTTPS proxies are verified against
+// the given CA bundle (or the system trust store, if empty).
+func newUpstreamProxyOptions(chain []*url.URL, fromEnv bool, credentialsFile, caBundle string) (upstreamProxyOptions, error) {
+	options := upstreamProxyOptions{chain: chain, fromEnv: fromEnv}
+	if !options.enabled() {
+		return options, nil
 	}
 
-	config.VerifyPeerCertificate = clientACL.VerifyPeerCertificateClient
+	var err error
+	options.tlsConfig, err = buildClientConfig(*enabledCipherSuites)
+	if err != nil {
+		return options, err
+	}
+	options.tlsConfig.RootCAs, err = certloader.LoadTrustStore(caBundle)
+	if err != nil {
+		return options, fmt.Errorf("unable to read CA bundle for proxies: %w", err)
+	}
+	options.credentials, err = readProxyCredentials(credentialsFile)
+	return options, err
+}
+
+// Get the TLS dialer for the edge in agent mode.
+func agentEdgeDialer(tlsConfigSource certloader.TLSConfigSource) (func() (net.Conn, error), policy.Policy, error) {
+	tlsConfig, err := buildClientConfig(*enabledCipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	agentACL, regoPolicy, err := buildACL(config.Access{
+		CNs:    *agentAllowedCNs,
+		OUs:    *agentAllowedOUs,
+		DNSs:   *agentAllowedDNSs,
+		IPs:    *agentAllowedIPs,
+		URIs:   *agentAllowedURIs,
+		Policy: *agentAllowPolicy,
+		Query:  *agentAllowQuery,
+	}, *connectTimeout)
+	if err != nil {
+		logger.Printf("invalid access control flags: %s", err)
+		return nil, nil, err
+	}
+	tlsConfig.VerifyPeerCertificate = agentACL.VerifyPeerCertificateClient
+	tlsConfig.NextProtos = []string{mux.ReverseProtocol}
 
-	var dialer Dialer = &net.Dialer{Timeout: *connectTimeout}
+	dial, _, err := clientTargetsDialer(tlsConfigSource, tlsConfig, &net.Dialer{Timeout: *connectTimeout}, []string{*agentEdgeAddress}, clientTargetOptions{
+		serverName: *agentServerName,
+		timeout:    *connectTimeout,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dial, regoPolicy, nil
+}
 
-	if *clientConnectProxy != nil {
-		logger.Printf("using HTTP(S) CONNECT proxy %s", (*clientConnectProxy).String())
+// Options for clientTargetsDialer.
+type clientTargetOptions struct {
+	// Overrides the name used for hostname verification, if set
+	serverName string
+	// Don't fail on addresses that can't be resolved (e.g. when a CONNECT
+	// proxy is used, as the proxy may be able to resolve them for us).
+	skipResolve bool
+	// Protocol to upgrade to TLS with STARTTLS first, if set
+	protocol string
+	timeout  time.Duration
+	failover config.Failover
+	// Client to open streams over QUIC with, instead of dialing TLS over TCP
+	quic *quic.Client
+	// Path to upgrade connections to WebSocket connections on, if set
+	websocket string
+}
 
-		// Use HTTP CONNECT proxy to connect to target.
-		proxyConfig, err := buildClientConfig(*enabledCipherSuites)
+// Build a TLS dialer for the given targets. If there are multiple targets,
+// the dialer fails over between them in order of priority, and returns the
+// failover state for the status endpoint.
+func clientTargetsDialer(tlsConfigSource certloader.TLSConfigSource, tlsConfig *tls.Config, dialer Dialer, targets []string, options clientTargetOptions) (func() (net.Conn, error), *backend.Failover, error) {
+	dialers := []backend.Dialer{}
+	for _, target := range targets {
+		network, address, host, err := socket.ParseAddress(target, options.skipResolve)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, fmt.Errorf("invalid target address: %w", err)
+		}
+
+		targetConfig := tlsConfig.Clone()
+		targetConfig.ServerName = host
+		if options.serverName != "" {
+			targetConfig.ServerName = options.serverName
 		}
-		config.ClientAuth = tls.NoClientCert
 
-		// Read CA bundle for passing to proxy library
-		ca, err := certloader.LoadTrustStore(*caBundlePath)
+		clientConfig, err := tlsConfigSource.GetClientConfig(targetConfig)
 		if err != nil {
-			logger.Printf("error: unable to build TLS config: %s\n", err)
 			return nil, nil, err
 		}
-		config.RootCAs = ca
+		if options.quic != nil {
+			if network != "tcp" {
+				return nil, nil, fmt.Errorf("invalid target address: QUIC targets must be HOST:PORT, not '%s'", target)
+			}
+			dialers = append(dialers, options.quic.Dialer(address, clientConfig))
+			continue
+		}
+		if options.websocket != "" {
+			d := certloader.DialerWithCertificate(clientConfig, options.timeout, dialer)
+			wsOptions := websocket.Options{Path: options.websocket}
+			dialers = append(dialers, func() (net.Conn, error) {
+				conn, err := d.Dial(network, address)
+				if err != nil {
+					return nil, err
+				}
+				ws, err := websocket.Client(conn, target, wsOptions, options.timeout)
+				if err != nil {
+					return nil, err
+				}
+				return ws, nil
+			})
+			continue
+		}
+		if options.protocol == "" {
+			d := certloader.DialerWithCertificate(clientConfig, options.timeout, dialer)
+			dialers = append(dialers, func() (net.Conn, error) { return d.Dial(network, address) })
+			continue
+		}
+		d := certloader.DialerWithCertificate(clientConfig, options.timeout, starttls.NewDialer(options.protocol, dialer, options.timeout))
+		dialers = append(dialers, func() (net.Conn, error) {
+			conn, err := d.Dial(network, address)
+			if err != nil {
+				return nil, err
+			}
+			return starttls.Upgraded(conn), nil
+		})
+	}
 
-		dialer = http_dialer.New(
-			*clientConnectProxy,
-			http_dialer.WithDialer(dialer.(*net.Dialer)),
-			http_dialer.WithTls(proxyConfig))
+	if len(dialers) == 1 {
+		return dialers[0], nil, nil
 	}
 
-	clientConfig := mustGetClientConfig(tlsConfigSource, config)
-	d := certloader.DialerWithCertificate(clientConfig, *connectTimeout, dialer)
-	return func() (net.Conn, error) { return d.Dial(network, address) }, regoPolicy, nil
+	failover, err := backend.NewFailover(targets, dialers, backend.FailoverOptions{
+		Timeout:    options.timeout,
+		Backoff:    options.failover.Backoff,
+		MaxBackoff: options.failover.MaxBackoff,
+		Logger:     logger,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return failover.Dial, failover, nil
 }
 
 func proxyLoggerFlags(flags []string) int {
@@ -888,6 +1515,180 @@ func proxyLoggerFlags(flags []string) int {
 	return out
 }
 
+// Limiter for the --max-connections, --max-connections-per-ip and
+// --max-handshakes flags. It's shared by all proxies, so in run mode the
+// limits apply to all tunnels together.
+var globalLimiter = sync.OnceValue(func() *proxy.Limiter {
+	limits := proxy.Limits{
+		MaxConnections:      *maxConnections,
+		MaxConnectionsPerIP: *maxConnectionsPerIP,
+		MaxHandshakes:       *maxHandshakes,
+	}
+	logLimits(logger, limits)
+	return proxy.NewLimiter("global", limits)
+})
+
+// Rate limits of the --max-*-rate flags. In run mode, they are the defaults
+// for the rate limits of each tunnel.
+var globalRateLimits = sync.OnceValue(func() proxy.RateLimits {
+	limits := flagRateLimits()
+	logRateLimits(logger, limits)
+	return proxyRateLimits(limits)
+})
+
+func flagRateLimits() config.RateLimits {
+	return config.RateLimits{
+		Read:         config.Bandwidth(*maxReadRate),
+		Write:        config.Bandwidth(*maxWriteRate),
+		ReadPerConn:  config.Bandwidth(*maxReadRatePerConn),
+		WritePerConn: config.Bandwidth(*maxWriteRatePerConn),
+	}
+}
+
+// Convert rate limits from flags or the config file, which were validated
+// already.
+func proxyRateLimits(limits config.RateLimits) proxy.RateLimits {
+	return proxy.RateLimits{
+		Read:         proxyBandwidth(limits.Read),
+		Write:        proxyBandwidth(limits.Write),
+		ReadPerConn:  proxyBandwidth(limits.ReadPerConn),
+		WritePerConn: proxyBandwidth(limits.WritePerConn),
+	}
+}
+
+func proxyBandwidth(bandwidth config.Bandwidth) proxy.Bandwidth {
+	rate, burst, _ := bandwidth.Parse()
+	return proxy.Bandwidth{Rate: rate, Burst: burst}
+}
+
+// Log the rate limits that are set, if any.
+func logRateLimits(logger proxy.Logger, limits config.RateLimits) {
+	for _, limit := range []struct {
+		description string
+		bandwidth   config.Bandwidth
+	}{
+		{"reads from all clients", limits.Read},
+		{"writes to all clients", limits.Write},
+		{"reads from each connection", limits.ReadPerConn},
+		{"writes to each connection", limits.WritePerConn},
+	} {
+		if limit.bandwidth != "" {
+			logger.Printf("limiting %s to %s per second", limit.description, limit.bandwidth)
+		}
+	}
+}
+
+// Log the connection limits that are set, if any.
+func logLimits(logger proxy.Logger, limits proxy.Limits) {
+	if limits.MaxConnections > 0 {
+		logger.Printf("limiting to %d open connection(s)", limits.MaxConnections)
+	}
+	if limits.MaxConnectionsPerIP > 0 {
+		logger.Printf("limiting to %d open connection(s) per client IP", limits.MaxConnectionsPerIP)
+	}
+	if limits.MaxHandshakes > 0 {
+		logger.Printf("limiting to %d concurrent handshake(s)", limits.MaxHandshakes)
+	}
+}
+
+// Build quotas per client identity from the given settings, loading the
+// query that returns identities from the access policy for key "opa". Returns
+// nil (and no policy) if no quota is set.
+func buildQuotas(quotas config.Quotas, access config.Access, timeout time.Duration) (*proxy.Quotas, policy.Policy, error) {
+	if !quotas.Enabled() {
+		return nil, nil, nil
+	}
+	key := quotas.Key
+	if key == "" {
+		key = auth.IdentityCN
+	}
+
+	var identityPolicy policy.Policy
+	if key == auth.IdentityPolicy {
+		var err error
+		identityPolicy, err = policy.LoadFromFile(access.Policy, quotas.Query)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rego policy or query for quotas: %s", err)
+		}
+	}
+	identity, err := auth.NewIdentity(key, identityPolicy, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &proxy.Quotas{
+		Identity:  identity,
+		Default:   proxyQuota(quotas.Default),
+		Overrides: map[string]proxy.Quota{},
+	}
+	for identity, quota := range quotas.Overrides {
+		result.Overrides[identity] = proxyQuota(quota)
+	}
+	return result, identityPolicy, nil
+}
+
+// Convert a quota from flags or the config file, which was validated already.
+func proxyQuota(quota config.Quota) proxy.Quota {
+	return proxy.Quota{
+		Rate:           quota.Rate,
+		Burst:          quota.Burst,
+		MaxConnections: quota.MaxConnections,
+		Read:           proxyBandwidth(quota.Read),
+		Write:          proxyBandwidth(quota.Write),
+	}
+}
+
+func logQuotas(logger proxy.Logger, quotas config.Quotas) {
+	if !quotas.Enabled() {
+		return
+	}
+	key := quotas.Key
+	if key == "" {
+		key = auth.IdentityCN
+	}
+	logger.Printf("applying quotas per client identity (%s): %s, with %d override(s)", key, quotaString(quotas.Default), len(quotas.Overrides))
+}
+
+// Describe a quota for logs.
+func quotaString(quota config.Quota) string {
+	var limits []string
+	if quota.Rate > 0 && quota.Burst > 0 {
+		limits = append(limits, fmt.Sprintf("%g new connection(s) per second (burst %d)", quota.Rate, quota.Burst))
+	} else if quota.Rate > 0 {
+		limits = append(limits, fmt.Sprintf("%g new connection(s) per second", quota.Rate))
+	}
+	if quota.MaxConnections > 0 {
+		limits = append(limits, fmt.Sprintf("%d open connection(s)", quota.MaxConnections))
+	}
+	if quota.Read != "" {
+		limits = append(limits, fmt.Sprintf("reads at %s per second", quota.Read))
+	}
+	if quota.Write != "" {
+		limits = append(limits, fmt.Sprintf("writes at %s per second", quota.Write))
+	}
+	if len(limits) == 0 {
+		return "no limits by default"
+	}
+	return strings.Join(limits, " and ")
+}
+
+// Timeout for handshakes with clients, falling back to the connect timeout
+// if not set (like the proxy does).
+func handshakeTimeoutOrDefault(handshake, connect time.Duration) time.Duration {
+	if handshake > 0 {
+		return handshake
+	}
+	return connect
+}
+
+// Version of the PROXY protocol for the --proxy-protocol-version flag.
+func proxyProtocolVersion(flag string) int {
+	if flag == "1" {
+		return proxy.ProxyProtocolV1
+	}
+	return proxy.ProxyProtocolV2
+}
+
 func getTLSConfigSource(disableAuth bool) (certloader.TLSConfigSource, error) {
 	if *useWorkloadAPI {
 		logger.Printf("using SPIFFE Workload API as certificate source")
@@ -931,11 +1732,3 @@ func mustGetServerConfig(source certloader.TLSConfigSource, config *tls.Config)
 	}
 	return serverConfig
 }
-
-func mustGetClientConfig(source certloader.TLSConfigSource, config *tls.Config) certloader.TLSClientConfig {
-	clientConfig, err := source.GetClientConfig(config)
-	if err != nil {
-		panic(err)
-	}
-	return clientConfig
-}
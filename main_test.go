@@ -17,8 +17,11 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"net/url"
 	"os"
@@ -28,7 +31,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
 	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/starttls"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -151,6 +157,16 @@ func TestFlagValidation(t *testing.T) {
 	assert.NotNil(t, err, "invalid --connect-timeout should be rejected")
 	*connectTimeout = 10 * time.Second
 
+	*maxConnectionsPerIP = -1
+	err = validateFlags(nil)
+	assert.NotNil(t, err, "negative --max-connections-per-ip should be rejected")
+	*maxConnectionsPerIP = 0
+
+	*maxWriteRatePerConn = "1MiB:"
+	err = validateFlags(nil)
+	assert.NotNil(t, err, "invalid --max-write-rate-per-conn should be rejected")
+	*maxWriteRatePerConn = ""
+
 	isTrue := true
 	somePath := "/tmp/test"
 	useLandlock = &isTrue
@@ -255,7 +271,7 @@ func TestServerFlagValidation(t *testing.T) {
 
 	*serverAllowAll = false
 	*serverUnsafeTarget = false
-	*serverForwardAddress = "foo.com"
+	*serverForwardAddress = []string{"foo.com"}
 	err = serverValidateFlags()
 	assert.NotNil(t, err, "unsafe target should be rejected")
 
@@ -293,22 +309,112 @@ func TestServerFlagValidation(t *testing.T) {
 	assert.NotNil(t, err, "can't use access control flags if auth is disabled")
 	*serverDisableAuth = false
 
-	*serverForwardAddress = "example.com:443"
+	*serverForwardAddress = []string{"example.com:443"}
 	err = serverValidateFlags()
 	assert.NotNil(t, err, "should reject non-local address if unsafe flag not set")
 
+	*serverForwardAddress = []string{"localhost:8080"}
+	*serverAllowAll = true
+	*serverALPNTargets = map[string]string{"h2": "localhost:8081"}
+	err = serverValidateFlags()
+	assert.NotNil(t, err, "--alpn-target protocol must be advertised with --alpn")
+
+	*serverALPN = []string{"h2"}
+	*serverALPNTargets = map[string]string{"h2": "example.com:443"}
+	err = serverValidateFlags()
+	assert.NotNil(t, err, "should reject non-local ALPN target if unsafe flag not set")
+	*serverALPN = nil
+	*serverALPNTargets = nil
+
+	*serverForwardAddress = []string{"localhost:8080"}
+	*serverAcceptProxyProtocol = []string{"10.0.0.0/8", "10.0.0.0/33"}
+	err = serverValidateFlags()
+	assert.NotNil(t, err, "should reject invalid --accept-proxy-protocol range")
+	*serverAcceptProxyProtocol = nil
+
+	*serverHTTP = true
+	*serverProxyProtocol = true
+	err = serverValidateFlags()
+	assert.NotNil(t, err, "--http and --proxy-protocol are mutually exclusive")
+	*serverHTTP = false
+	*serverProxyProtocol = false
+	*serverAllowAll = false
+
 	*enabledCipherSuites = "ABC"
-	*serverForwardAddress = "127.0.0.1:8080"
+	*serverForwardAddress = []string{"127.0.0.1:8080"}
 	err = serverValidateFlags()
 	assert.NotNil(t, err, "invalid cipher suite option should be rejected")
 
 	*enabledCipherSuites = "AES,CHACHA"
-	*serverForwardAddress = ""
+	*serverForwardAddress = nil
 	*serverAllowAll = false
 	*keystorePath = ""
 }
 
+func TestEdgeFlagValidation(t *testing.T) {
+	*keystorePath = ""
+	*certPath = ""
+	*keyPath = ""
+	*edgeListenAddress = "localhost:8080"
+	err := edgeValidateFlags()
+	assert.NotNil(t, err, "credentials are required")
+
+	*keystorePath = "file"
+	err = edgeValidateFlags()
+	assert.NotNil(t, err, "access control flags are required")
+
+	*edgeAllowAll = true
+	*edgeAllowedCNs = []string{"agent"}
+	err = edgeValidateFlags()
+	assert.NotNil(t, err, "--allow-all is mutually exclusive with other access control flags")
+	*edgeAllowAll = false
+
+	*edgeListenAddress = "0.0.0.0:8080"
+	err = edgeValidateFlags()
+	assert.NotNil(t, err, "unsafe listen should be rejected")
+
+	*edgeListenAddress = "localhost:8080"
+	err = edgeValidateFlags()
+	assert.Nil(t, err, "valid edge flags should be accepted")
+
+	*edgeAllowedCNs = nil
+	*keystorePath = ""
+}
+
+func TestAgentFlagValidation(t *testing.T) {
+	*keystorePath = ""
+	*certPath = ""
+	*keyPath = ""
+	*agentForwardAddress = "localhost:8080"
+	*agentConnections = 1
+	err := agentValidateFlags()
+	assert.NotNil(t, err, "credentials are required")
+
+	*keystorePath = "file"
+	*agentForwardAddress = "example.com:8080"
+	err = agentValidateFlags()
+	assert.NotNil(t, err, "unsafe target should be rejected")
+
+	*agentForwardAddress = "localhost:8080"
+	*agentConnections = 0
+	err = agentValidateFlags()
+	assert.NotNil(t, err, "--edge-connections must be at least 1")
+
+	*agentConnections = 1
+	*agentAllowPolicy = "policy.rego"
+	err = agentValidateFlags()
+	assert.NotNil(t, err, "--verify-policy requires --verify-query")
+	*agentAllowPolicy = ""
+
+	err = agentValidateFlags()
+	assert.Nil(t, err, "valid agent flags should be accepted")
+
+	*keystorePath = ""
+}
+
 func TestClientFlagValidation(t *testing.T) {
+	*clientForwardAddress = []string{"localhost:8443"}
+	defer func() { *clientForwardAddress = nil }()
 	*keystorePath = "file"
 	*clientUnsafeListen = false
 	*clientListenAddress = "0.0.0.0:8080"
@@ -347,16 +453,250 @@ func TestClientFlagValidation(t *testing.T) {
 
 	invalidURL, _ := url.Parse("ftp://invalid")
 	*enabledCipherSuites = "AES"
-	*clientConnectProxy = invalidURL
+	*clientConnectProxy = []*url.URL{invalidURL}
 	err = clientValidateFlags()
 	assert.NotNil(t, err, "invalid connect proxy option should be rejected")
 
+	validURL, _ := url.Parse("socks5://localhost:1080")
+	*clientConnectProxy = []*url.URL{validURL}
+	*clientConnectProxyEnv = true
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--connect-proxy and --connect-proxy-from-env are mutually exclusive")
+	*clientConnectProxy = nil
+	*clientConnectProxyEnv = false
+
+	*clientConnectProxyAuth = "credentials"
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--connect-proxy-auth-file requires a proxy")
+	*clientConnectProxyAuth = ""
+
+	*clientMultiplex = true
+	*clientALPN = []string{"h2"}
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--multiplex can't be used with --alpn")
+	*clientALPN = nil
+
+	*clientMultiplexConns = 0
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--multiplex-connections must be at least 1")
+	*clientMultiplexConns = 2
+	*clientMultiplex = false
+	*clientConnectProxy = []*url.URL{invalidURL}
+
 	*clientDisableAuth = false
 	*keystorePath = ""
 	err = clientValidateFlags()
 	assert.NotNil(t, err, "one of --keystore or --disable-authentication is required")
 }
 
+func TestClientForwardProxyFlagValidation(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*keystorePath = "file"
+	*clientListenAddress = "localhost:8080"
+	*clientConnectProxy = nil
+	defer func() {
+		*keystorePath = ""
+		*clientForwardAddress = nil
+		*clientForwardProxy = nil
+		*clientAllowDestination = nil
+		*clientMultiplex = false
+		*clientServerName = ""
+	}()
+
+	err := clientValidateFlags()
+	assert.NotNil(t, err, "--target should be required without --forward-proxy")
+
+	*clientForwardProxy = []string{"connect", "socks5"}
+	*clientAllowDestination = []string{"*.example.com:443"}
+	err = clientValidateFlags()
+	assert.Nil(t, err, "--forward-proxy with --allow-destination should be valid")
+
+	*clientForwardAddress = []string{"localhost:8443"}
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--target and --forward-proxy are mutually exclusive")
+	*clientForwardAddress = nil
+
+	*clientMultiplex = true
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--forward-proxy and --multiplex are mutually exclusive")
+	*clientMultiplex = false
+
+	*clientServerName = "server"
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--forward-proxy and --override-server-name are mutually exclusive")
+	*clientServerName = ""
+
+	*clientAllowDestination = []string{"example.com"}
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "invalid --allow-destination should be rejected")
+
+	*clientAllowDestination = nil
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--forward-proxy requires --allow-destination")
+
+	*clientForwardProxy = nil
+	*clientForwardAddress = []string{"localhost:8443"}
+	*clientAllowDestination = []string{"example.com:443"}
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--allow-destination requires --forward-proxy")
+}
+
+// Set the flags of a valid server, so that tests only have to set the flags
+// they check.
+func setValidServerFlags(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*keystorePath = "file"
+	*serverListenAddress = "localhost:8443"
+	*serverForwardAddress = []string{"localhost:8080"}
+	*serverAllowAll = true
+	*serverAllowedCNs, *serverAllowedOUs, *serverAllowedDNSs, *serverAllowedURIs = nil, nil, nil, nil
+	*serverAllowedIPs = nil
+	*serverAllowPolicy, *serverAllowQuery = "", ""
+	*serverDisableAuth = false
+	t.Cleanup(func() {
+		*keystorePath = ""
+		*serverListenAddress = ""
+		*serverForwardAddress = nil
+		*serverAllowAll = false
+	})
+}
+
+// Set the flags of a valid client, so that tests only have to set the flags
+// they check.
+func setValidClientFlags(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*keystorePath = "file"
+	*clientListenAddress = "localhost:8080"
+	*clientForwardAddress = []string{"localhost:8443"}
+	*clientConnectProxy = nil
+	*clientAllowPolicy, *clientAllowQuery = "", ""
+	*clientDisableAuth = false
+	t.Cleanup(func() {
+		*keystorePath = ""
+		*clientListenAddress = ""
+		*clientForwardAddress = nil
+	})
+}
+
+func TestServerListenProtocolFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	*serverListenProtocol = "postgres"
+	defer func() {
+		*serverListenProtocol = ""
+		*serverHTTP = false
+		*serverMultiplex = false
+		*serverALPNTargets = map[string]string{}
+		*serverProxyProtocol = false
+	}()
+
+	assert.Nil(t, serverValidateFlags(), "--listen-protocol should be valid")
+
+	*serverHTTP = true
+	assert.NotNil(t, serverValidateFlags(), "--listen-protocol and --http are mutually exclusive")
+	*serverHTTP = false
+
+	*serverMultiplex = true
+	assert.NotNil(t, serverValidateFlags(), "--listen-protocol and --multiplex are mutually exclusive")
+	*serverMultiplex = false
+
+	*serverALPNTargets = map[string]string{"h2": "localhost:8080"}
+	assert.NotNil(t, serverValidateFlags(), "--listen-protocol and --alpn-target are mutually exclusive")
+	*serverALPNTargets = map[string]string{}
+
+	*serverProxyProtocol = true
+	assert.Nil(t, serverValidateFlags(), "--listen-protocol=postgres can be used with --proxy-protocol")
+	*serverListenProtocol = "smtp"
+	assert.NotNil(t, serverValidateFlags(), "--listen-protocol=smtp and --proxy-protocol are mutually exclusive")
+}
+
+func TestClientTargetProtocolFlagValidation(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*keystorePath = "file"
+	*clientListenAddress = "localhost:8080"
+	*clientConnectProxy = nil
+	*clientForwardAddress = []string{"localhost:8443"}
+	*clientTargetProtocol = "postgres"
+	defer func() {
+		*keystorePath = ""
+		*clientForwardAddress = nil
+		*clientForwardProxy = nil
+		*clientAllowDestination = nil
+		*clientMultiplex = false
+		*clientALPN = nil
+		*clientTargetProtocol = ""
+	}()
+
+	err := clientValidateFlags()
+	assert.Nil(t, err, "--target-protocol should be valid")
+
+	*clientMultiplex = true
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--target-protocol and --multiplex are mutually exclusive")
+	*clientMultiplex = false
+
+	*clientALPN = []string{"h2"}
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--target-protocol and --alpn are mutually exclusive")
+	*clientALPN = nil
+
+	*clientForwardAddress = nil
+	*clientForwardProxy = []string{"connect"}
+	*clientAllowDestination = []string{"*.example.com:443"}
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "--target-protocol and --forward-proxy are mutually exclusive")
+}
+
+func TestClientTargetsDialerWithProtocol(t *testing.T) {
+	serverCert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-key.pem")
+	assert.Nil(t, err, "should load server certificate")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	// Fake SMTP server that only speaks TLS after STARTTLS.
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "220 ready\r\n")
+		reader := bufio.NewReader(conn)
+		_, _ = reader.ReadString('\n')
+		_, _ = io.WriteString(conn, "250-localhost\r\n250 STARTTLS\r\n")
+		_, _ = reader.ReadString('\n')
+		_, _ = io.WriteString(conn, "220 go ahead\r\n")
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+		_, _ = io.Copy(tlsConn, tlsConn)
+	}()
+
+	cert, err := certloader.NoCertificate("test-keys/cacert.pem")
+	assert.Nil(t, err, "should load CA")
+	source := certloader.TLSConfigSourceFromCertificate(cert, logger)
+
+	dial, _, err := clientTargetsDialer(source, &tls.Config{}, &net.Dialer{}, []string{target.Addr().String()}, clientTargetOptions{
+		serverName: "localhost",
+		protocol:   starttls.SMTP,
+		timeout:    5 * time.Second,
+	})
+	assert.Nil(t, err, "should build dialer")
+
+	conn, err := dial()
+	assert.Nil(t, err, "should upgrade connection to target")
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	assert.Nil(t, err, "should read replayed greeting")
+	assert.Equal(t, "220 ready\r\n", greeting)
+
+	_, err = io.WriteString(conn, "EHLO app\r\n")
+	assert.Nil(t, err, "should write over TLS")
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err, "should read echo over TLS")
+	assert.Equal(t, "EHLO app\r\n", line)
+}
+
 func TestAllowsLocalhost(t *testing.T) {
 	*serverUnsafeTarget = false
 	assert.True(t, consideredSafe("localhost:1234"), "localhost should be allowed")
@@ -375,12 +715,6 @@ func TestDisallowsFooDotCom(t *testing.T) {
 	assert.False(t, consideredSafe("74.122.190.83:1234"), "random ip address should be disallowed")
 }
 
-func TestServerBackendDialerError(t *testing.T) {
-	*serverForwardAddress = "invalid"
-	_, err := serverBackendDialer()
-	assert.NotNil(t, err, "invalid forward address should not have dialer")
-}
-
 func TestInvalidCABundle(t *testing.T) {
 	err := run([]string{
 		"server",
@@ -401,3 +735,332 @@ func TestProxyLoggingFlags(t *testing.T) {
 	assert.Equal(t, proxyLoggerFlags([]string{"conn-errs", "handshake-errs"}), proxy.LogConnections)
 	assert.Equal(t, proxyLoggerFlags([]string{"conns", "conn-errs"}), proxy.LogHandshakeErrors)
 }
+
+func TestServerFlagsTunnel(t *testing.T) {
+	setValidServerFlags(t)
+	*serverProxyProtocol = true
+	*serverProxyProtocolVer = "1"
+	defer func() {
+		*serverProxyProtocol = false
+		*serverProxyProtocolVer = "2"
+	}()
+
+	tunnel, err := serverFlagsTunnel()
+	assert.Nil(t, err, "should build tunnel from flags")
+	assert.Equal(t, config.ModeServer, tunnel.Mode)
+	assert.Equal(t, "localhost:8443", tunnel.Listen)
+	assert.Equal(t, "localhost:8080", tunnel.Target)
+	assert.True(t, tunnel.Access.All)
+	assert.Equal(t, proxy.ProxyProtocolV1, tunnel.ProxyProtocolVersion, "should set PROXY protocol version")
+	assert.Nil(t, validateFlagsTunnel(tunnel), "tunnel from flags should be valid")
+
+	*serverProxyProtocol = false
+	tunnel, err = serverFlagsTunnel()
+	assert.Nil(t, err, "should build tunnel from flags")
+	assert.Zero(t, tunnel.ProxyProtocolVersion, "should ignore PROXY protocol version without --proxy-protocol")
+}
+
+func TestProxyProtocolVersionFlag(t *testing.T) {
+	assert.Equal(t, proxy.ProxyProtocolV1, proxyProtocolVersion("1"))
+	assert.Equal(t, proxy.ProxyProtocolV2, proxyProtocolVersion("2"))
+	assert.Equal(t, proxy.ProxyProtocolV2, proxyProtocolVersion(""))
+}
+
+func TestServerUDPFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	*serverListenAddress = "localhost:8443"
+	*serverForwardAddress = []string{"udp:localhost:53"}
+	defer func() {
+		*serverListenAddress = ""
+		*serverForwardAddress = nil
+		*serverHTTP = false
+		*serverTargetTLS = false
+		*serverALPN = nil
+	}()
+
+	assert.Nil(t, serverValidateFlags(), "UDP target should be valid")
+	assert.True(t, consideredSafe((*serverForwardAddress)[0]), "UDP target on localhost should be safe")
+
+	*serverForwardAddress = []string{"udp:localhost:53", "udp:localhost:54"}
+	assert.NotNil(t, serverValidateFlags(), "UDP target can't be repeated")
+	*serverForwardAddress = []string{"udp:localhost:53"}
+
+	*serverHTTP = true
+	assert.NotNil(t, serverValidateFlags(), "UDP target can't be used with --http")
+	*serverHTTP = false
+
+	*serverTargetTLS = true
+	assert.NotNil(t, serverValidateFlags(), "UDP target can't be used with --target-tls")
+	*serverTargetTLS = false
+
+	*serverALPN = []string{"h2"}
+	assert.NotNil(t, serverValidateFlags(), "UDP target can't be used with --alpn")
+	*serverALPN = nil
+
+	*serverListenAddress = "udp:localhost:8443"
+	assert.NotNil(t, serverValidateFlags(), "server can't listen on UDP address")
+}
+
+func TestClientUDPFlagValidation(t *testing.T) {
+	setValidClientFlags(t)
+	*clientListenAddress = "udp:localhost:5353"
+	*clientForwardAddress = []string{"localhost:8443"}
+	defer func() {
+		*clientListenAddress = ""
+		*clientForwardAddress = nil
+		*clientMultiplex = false
+		*clientTargetProtocol = ""
+	}()
+
+	assert.Nil(t, clientValidateFlags(), "UDP listener should be valid")
+	assert.True(t, consideredSafe(*clientListenAddress), "UDP listener on localhost should be safe")
+	assert.False(t, consideredSafe("udp:0.0.0.0:5353"), "UDP listener on all interfaces should be unsafe")
+
+	*clientMultiplex = true
+	assert.NotNil(t, clientValidateFlags(), "UDP listener can't be used with --multiplex")
+	*clientMultiplex = false
+
+	*clientTargetProtocol = "postgres"
+	assert.NotNil(t, clientValidateFlags(), "UDP listener can't be used with --target-protocol")
+	*clientTargetProtocol = ""
+
+	*clientForwardAddress = []string{"udp:localhost:8443"}
+	assert.NotNil(t, clientValidateFlags(), "client target can't be a UDP address")
+}
+
+func TestBackendDialerRejectsUDP(t *testing.T) {
+	_, err := backendDialer("udp:localhost:53", time.Second, nil)
+	assert.NotNil(t, err, "should reject UDP target")
+}
+
+func TestServerQUICFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	*serverQUIC = true
+	*serverListenAddress = "localhost:8443"
+	*serverForwardAddress = []string{"localhost:8080"}
+	defer func() {
+		*serverQUIC = false
+		*serverListenAddress = ""
+		*serverForwardAddress = nil
+		*serverMultiplex = false
+		*serverAcceptProxyProtocol = nil
+	}()
+
+	assert.Nil(t, serverValidateFlags(), "QUIC listener should be valid")
+
+	*serverMultiplex = true
+	assert.NotNil(t, serverValidateFlags(), "--quic can't be used with --multiplex")
+	*serverMultiplex = false
+
+	*serverAcceptProxyProtocol = []string{"10.0.0.0/8"}
+	assert.NotNil(t, serverValidateFlags(), "--quic can't be used with --accept-proxy-protocol")
+	*serverAcceptProxyProtocol = nil
+
+	*serverForwardAddress = []string{"udp:localhost:53"}
+	assert.NotNil(t, serverValidateFlags(), "--quic can't be used with a UDP target")
+	*serverForwardAddress = []string{"localhost:8080"}
+
+	*serverListenAddress = "unix:/tmp/ghostunnel.sock"
+	assert.NotNil(t, serverValidateFlags(), "--quic requires a HOST:PORT listener")
+}
+
+func TestClientQUICFlagValidation(t *testing.T) {
+	setValidClientFlags(t)
+	*clientQUIC = true
+	*clientListenAddress = "localhost:8080"
+	*clientForwardAddress = []string{"localhost:8443"}
+	defer func() {
+		*clientQUIC = false
+		*clientListenAddress = ""
+		*clientForwardAddress = nil
+		*clientALPN = nil
+		*clientConnectProxyEnv = false
+	}()
+
+	assert.Nil(t, clientValidateFlags(), "QUIC client should be valid")
+
+	*clientALPN = []string{"h2"}
+	assert.NotNil(t, clientValidateFlags(), "--quic can't be used with --alpn")
+	*clientALPN = nil
+
+	*clientConnectProxyEnv = true
+	assert.NotNil(t, clientValidateFlags(), "--quic can't be used with --connect-proxy-from-env")
+	*clientConnectProxyEnv = false
+
+	*clientListenAddress = "udp:localhost:5353"
+	assert.NotNil(t, clientValidateFlags(), "--quic can't be used with a UDP listener")
+	*clientListenAddress = "localhost:8080"
+
+	*clientForwardAddress = []string{"unix:/tmp/ghostunnel.sock"}
+	assert.NotNil(t, clientValidateFlags(), "--quic requires HOST:PORT targets")
+}
+
+func TestServerWebSocketFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	*serverWebSocket = true
+	*serverWebSocketPath = "/tunnel"
+	*serverForwardAddress = []string{"localhost:8080"}
+	defer func() {
+		*serverWebSocket = false
+		*serverWebSocketPath = "/"
+		*serverForwardAddress = nil
+		*serverMultiplex = false
+		*serverHTTP = false
+	}()
+
+	assert.Nil(t, serverValidateFlags(), "WebSocket listener should be valid")
+
+	*serverMultiplex = true
+	assert.NotNil(t, serverValidateFlags(), "--websocket can't be used with --multiplex")
+	*serverMultiplex = false
+
+	*serverHTTP = true
+	assert.NotNil(t, serverValidateFlags(), "--websocket can't be used with --http")
+	*serverHTTP = false
+
+	*serverForwardAddress = []string{"udp:localhost:53"}
+	assert.NotNil(t, serverValidateFlags(), "--websocket can't be used with a UDP target")
+	*serverForwardAddress = []string{"localhost:8080"}
+
+	*serverWebSocketPath = "tunnel"
+	assert.NotNil(t, serverValidateFlags(), "--websocket-path must be absolute")
+}
+
+func TestClientWebSocketFlagValidation(t *testing.T) {
+	setValidClientFlags(t)
+	*clientWebSocket = true
+	*clientWebSocketPath = "/"
+	*clientListenAddress = "localhost:8080"
+	*clientForwardAddress = []string{"localhost:8443"}
+	defer func() {
+		*clientWebSocket = false
+		*clientListenAddress = ""
+		*clientForwardAddress = nil
+		*clientQUIC = false
+		*clientConnectProxyEnv = false
+	}()
+
+	assert.Nil(t, clientValidateFlags(), "WebSocket client should be valid")
+
+	*clientConnectProxyEnv = true
+	assert.Nil(t, clientValidateFlags(), "--websocket can be used with --connect-proxy-from-env")
+	*clientConnectProxyEnv = false
+
+	*clientQUIC = true
+	assert.NotNil(t, clientValidateFlags(), "--websocket can't be used with --quic")
+	*clientQUIC = false
+
+	*clientListenAddress = "udp:localhost:5353"
+	assert.NotNil(t, clientValidateFlags(), "--websocket can't be used with a UDP listener")
+	*clientListenAddress = "localhost:8080"
+
+	*clientForwardAddress = []string{"unix:/tmp/ghostunnel.sock"}
+	assert.NotNil(t, clientValidateFlags(), "--websocket requires HOST:PORT targets")
+}
+
+func TestServerQuotaFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	*serverQuotaMaxConnections = 10
+	*serverAllowPolicy = ""
+	defer func() {
+		*serverQuotaKey = "cn"
+		*serverQuotaQuery = ""
+		*serverQuotaRate = 0
+		*serverQuotaBurst = 0
+		*serverQuotaMaxConnections = 0
+		*serverQuotaOverrides = nil
+		*serverAllowPolicy = ""
+		*serverAllowQuery = ""
+		*serverDisableAuth = false
+	}()
+
+	assert.Nil(t, serverValidateFlags(), "quotas should be valid")
+
+	*serverQuotaMaxConnections = -1
+	assert.NotNil(t, serverValidateFlags(), "negative --quota-max-connections should be rejected")
+	*serverQuotaMaxConnections = 10
+
+	*serverQuotaBurst = 5
+	assert.NotNil(t, serverValidateFlags(), "--quota-burst without --quota-rate should be rejected")
+	*serverQuotaBurst = 0
+
+	*serverQuotaReadRate = "1MiB:4MiB"
+	assert.Nil(t, serverValidateFlags(), "--quota-read-rate should be valid")
+	*serverQuotaWriteRate = "fast"
+	assert.NotNil(t, serverValidateFlags(), "invalid --quota-write-rate should be rejected")
+	*serverQuotaReadRate = ""
+	*serverQuotaWriteRate = ""
+
+	*serverQuotaOverrides = []string{"client=rate:fast"}
+	assert.NotNil(t, serverValidateFlags(), "invalid --quota-override should be rejected")
+	*serverQuotaOverrides = nil
+
+	*serverAllowAll = false
+	*serverDisableAuth = true
+	assert.NotNil(t, serverValidateFlags(), "quotas can't be used with --disable-authentication")
+	*serverDisableAuth = false
+	*serverAllowAll = true
+
+	*serverQuotaKey = "opa"
+	assert.NotNil(t, serverValidateFlags(), "--quota-key=opa without --quota-query should be rejected")
+	*serverQuotaQuery = "data.policy.key"
+	assert.NotNil(t, serverValidateFlags(), "--quota-key=opa without --allow-policy should be rejected")
+	*serverAllowAll = false
+	*serverAllowPolicy = "policy.rego"
+	*serverAllowQuery = "data.policy.allow"
+	assert.Nil(t, serverValidateFlags(), "--quota-key=opa with query and policy should be valid")
+
+	*serverQuotaKey = "cn"
+	assert.NotNil(t, serverValidateFlags(), "--quota-query without --quota-key=opa should be rejected")
+}
+
+func TestServerSourceFlagValidation(t *testing.T) {
+	setValidServerFlags(t)
+	defer func() {
+		*serverAllowSources = nil
+		*serverDenySources = nil
+		*serverQUIC = false
+	}()
+
+	*serverAllowSources = []string{"10.0.0.0/8", "192.168.1.1"}
+	*serverDenySources = []string{"10.1.0.0/16"}
+	assert.Nil(t, serverValidateFlags(), "sources should be valid")
+
+	*serverDenySources = []string{"10.1.0.0/33"}
+	assert.NotNil(t, serverValidateFlags(), "invalid --deny-source should be rejected")
+	*serverDenySources = nil
+
+	*serverAllowSources = []string{"file:" + filepath.Join(t.TempDir(), "missing.txt")}
+	assert.NotNil(t, serverValidateFlags(), "missing --allow-source file should be rejected")
+	*serverAllowSources = []string{"10.0.0.0/8"}
+
+	*serverQUIC = true
+	assert.NotNil(t, serverValidateFlags(), "sources can't be used with --quic")
+}
+
+func TestParseQuotaOverride(t *testing.T) {
+	identity, quota, err := parseQuotaOverride("spiffe://example.com/batch=rate:5,burst:10,max-connections:20")
+	assert.Nil(t, err)
+	assert.Equal(t, "spiffe://example.com/batch", identity)
+	assert.Equal(t, config.Quota{Rate: 5, Burst: 10, MaxConnections: 20}, quota)
+
+	identity, quota, err = parseQuotaOverride("batch=read:1MiB:4MiB,write:100KB")
+	assert.Nil(t, err)
+	assert.Equal(t, "batch", identity)
+	assert.Equal(t, config.Quota{Read: "1MiB:4MiB", Write: "100KB"}, quota, "bandwidth may contain ':'")
+
+	identity, quota, err = parseQuotaOverride("CN=a=b=max-connections:1")
+	assert.Nil(t, err)
+	assert.Equal(t, "CN=a=b", identity, "identity may contain '='")
+	assert.Equal(t, config.Quota{MaxConnections: 1}, quota)
+
+	identity, quota, err = parseQuotaOverride("admin=")
+	assert.Nil(t, err, "empty quota should exempt identity")
+	assert.Equal(t, "admin", identity)
+	assert.Equal(t, config.Quota{}, quota)
+
+	for _, invalid := range []string{"admin", "=rate:1", "a=rate:x", "a=size:1", "a=max-connections:-1", "a=burst:5", "a=read:1XB"} {
+		_, _, err = parseQuotaOverride(invalid)
+		assert.NotNil(t, err, "'%s' should be rejected", invalid)
+	}
+}
@@ -0,0 +1,4 @@
+// Package mux carries many connections as streams over a few long-lived TLS
+// connections between a Ghostunnel client and server, with per-stream flow
+// control (based on yamux). Peers signal support via ALPN.
+package mux
@@ -0,0 +1,286 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/hashicorp/yamux"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Protocol is negotiated via ALPN to signal that a connection carries
+// multiplexed streams.
+const Protocol = "ghostunnel-mux/1"
+
+// ReverseProtocol is negotiated via ALPN by reverse tunnel agents, which dial
+// out to an edge and then accept streams opened by the edge.
+const ReverseProtocol = "ghostunnel-reverse/1"
+
+var (
+	sessionsOpen  = metrics.GetOrRegisterCounter("mux.sessions.open", metrics.DefaultRegistry)
+	sessionsTotal = metrics.GetOrRegisterCounter("mux.sessions.total", metrics.DefaultRegistry)
+	streamsOpen   = metrics.GetOrRegisterCounter("mux.streams.open", metrics.DefaultRegistry)
+	streamsTotal  = metrics.GetOrRegisterCounter("mux.streams.total", metrics.DefaultRegistry)
+	fallbackTotal = metrics.GetOrRegisterCounter("mux.fallback", metrics.DefaultRegistry)
+	streamTimer   = metrics.GetOrRegisterTimer("mux.streams.lifetime", metrics.DefaultRegistry)
+)
+
+// How often draining sessions check whether all streams are done.
+const drainInterval = 100 * time.Millisecond
+
+// Logger is used by this package to log messages.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options for multiplexed sessions. Zero values use yamux defaults.
+type Options struct {
+	// WindowSize is the maximum flow control window of each stream, i.e.
+	// how much data may be in flight on a stream before the receiver reads.
+	WindowSize uint32
+	// KeepAliveInterval is the interval for pings on a session.
+	KeepAliveInterval time.Duration
+}
+
+func (o Options) config() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	if o.WindowSize > 0 {
+		config.MaxStreamWindowSize = o.WindowSize
+	}
+	if o.KeepAliveInterval > 0 {
+		config.KeepAliveInterval = o.KeepAliveInterval
+	}
+	return config
+}
+
+// Negotiated returns true if the peer of a TLS connection (or a connection
+// wrapping one) agreed to carry multiplexed streams.
+func Negotiated(conn net.Conn) bool {
+	return NegotiatedProtocol(conn) == Protocol
+}
+
+// NegotiatedProtocol returns the protocol negotiated via ALPN on a TLS
+// connection (or a connection wrapping one), if any.
+func NegotiatedProtocol(conn net.Conn) string {
+	state, _ := connectionState(conn)
+	return state.NegotiatedProtocol
+}
+
+// Get the state of a TLS connection, unwrapping connections that wrap one
+// (e.g. to keep track of open connections to a backend).
+func connectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c.ConnectionState(), true
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+}
+
+// Stream is a connection carried over a multiplexed session. It exposes the
+// TLS connection state of the session, so that it can be used like a
+// *tls.Conn for logging and routing.
+type Stream struct {
+	*yamux.Stream
+	state   tls.ConnectionState
+	opened  time.Time
+	closing sync.Once
+}
+
+func newStream(stream *yamux.Stream, state tls.ConnectionState) *Stream {
+	streamsOpen.Inc(1)
+	streamsTotal.Inc(1)
+	return &Stream{Stream: stream, state: state, opened: time.Now()}
+}
+
+// ConnectionState returns the state of the TLS connection of the session.
+func (s *Stream) ConnectionState() tls.ConnectionState {
+	return s.state
+}
+
+// Close closes the stream for writing. The stream is fully closed once the
+// peer closed it as well.
+func (s *Stream) Close() error {
+	s.closing.Do(func() {
+		streamsOpen.Dec(1)
+		streamTimer.UpdateSince(s.opened)
+	})
+	return s.Stream.Close()
+}
+
+// CloseWrite closes the stream for writing, like Close.
+func (s *Stream) CloseWrite() error {
+	return s.Close()
+}
+
+// CloseRead is a no-op: streams can't be closed for reading only, but the
+// peer can't send more data once it closed the stream for writing anyway.
+func (s *Stream) CloseRead() error {
+	return nil
+}
+
+// Session is a multiplexed TLS connection. Streams are opened by the client
+// side, and accepted by the server side.
+type Session struct {
+	session *yamux.Session
+	state   tls.ConnectionState
+}
+
+// Server starts the server side of a session on a TLS connection that
+// negotiated Protocol (or ReverseProtocol, with the roles reversed).
+func Server(conn net.Conn, options Options) (*Session, error) {
+	state, _ := connectionState(conn)
+	session, err := yamux.Server(conn, options.config())
+	if err != nil {
+		return nil, err
+	}
+	trackSession(session)
+	return &Session{session: session, state: state}, nil
+}
+
+// Client starts the client side of a session on a TLS connection that
+// negotiated Protocol (or ReverseProtocol, with the roles reversed).
+func Client(conn net.Conn, options Options) (*Session, error) {
+	state, _ := connectionState(conn)
+	session, err := yamux.Client(conn, options.config())
+	if err != nil {
+		return nil, err
+	}
+	trackSession(session)
+	return &Session{session: session, state: state}, nil
+}
+
+// Open opens a new stream to the server side.
+func (s *Session) Open() (*Stream, error) {
+	stream, err := s.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return newStream(stream, s.state), nil
+}
+
+// Done returns a channel that is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.session.CloseChan()
+}
+
+// RemoteAddr returns the address of the peer.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+// ConnectionState returns the state of the TLS connection of the session.
+func (s *Session) ConnectionState() tls.ConnectionState {
+	return s.state
+}
+
+// Accept waits for the next stream opened by the client. Returns an error
+// once the session is closed.
+func (s *Session) Accept() (*Stream, error) {
+	stream, err := s.session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return newStream(stream, s.state), nil
+}
+
+// Drain stops the client from opening new streams, and closes the session
+// once all open streams are done.
+func (s *Session) Drain() {
+	_ = s.session.GoAway()
+	go closeWhenIdle(s.session)
+}
+
+// Close closes the session, and all of its streams.
+func (s *Session) Close() error {
+	return s.session.Close()
+}
+
+func trackSession(session *yamux.Session) {
+	sessionsOpen.Inc(1)
+	sessionsTotal.Inc(1)
+	go func() {
+		<-session.CloseChan()
+		sessionsOpen.Dec(1)
+	}()
+}
+
+func closeWhenIdle(session *yamux.Session) {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+			if session.NumStreams() == 0 {
+				_ = session.Close()
+				return
+			}
+		}
+	}
+}
+
+// ServerConfig wraps the TLS config of a server, so that it negotiates
+// Protocol with clients that offer it. Other clients see the unmodified
+// config, so that e.g. a client that offers "h2" isn't rejected because the
+// server only advertises Protocol.
+func ServerConfig(inner certloader.TLSServerConfig) certloader.TLSServerConfig {
+	return serverConfig{inner}
+}
+
+type serverConfig struct {
+	inner certloader.TLSServerConfig
+}
+
+func (c serverConfig) GetServerConfig() *tls.Config {
+	base := c.inner.GetServerConfig()
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		selected := base
+		if base.GetConfigForClient != nil {
+			routed, err := base.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if routed != nil {
+				selected = routed
+			}
+		}
+		if !slices.Contains(hello.SupportedProtos, Protocol) {
+			if selected == base {
+				return nil, nil
+			}
+			return selected, nil
+		}
+		selected = selected.Clone()
+		selected.GetConfigForClient = nil
+		selected.NextProtos = append([]string{Protocol}, selected.NextProtos...)
+		return selected, nil
+	}
+	return config
+}
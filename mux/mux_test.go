@@ -0,0 +1,198 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticServerConfig struct {
+	config *tls.Config
+}
+
+func (c staticServerConfig) GetServerConfig() *tls.Config {
+	return c.config
+}
+
+// Start a TLS server that echoes data on plain connections, and on every
+// stream of multiplexed sessions.
+func echoServer(t *testing.T, config *tls.Config) net.Listener {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				if !Negotiated(conn) {
+					_, _ = io.Copy(conn, conn)
+					return
+				}
+				session, err := Server(conn, Options{})
+				if err != nil {
+					return
+				}
+				defer session.Close()
+				for {
+					stream, err := session.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						_, _ = io.Copy(stream, stream)
+					}()
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func testDialer(addr string, protocols ...string) Dialer {
+	return func() (net.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         protocols,
+		})
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn, message string) {
+	_, err := conn.Write([]byte(message))
+	assert.Nil(t, err, "should be able to write")
+
+	received := make([]byte, len(message))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should be able to read echo")
+	assert.Equal(t, message, string(received))
+}
+
+func TestServerConfig(t *testing.T) {
+	listener := echoServer(t, ServerConfig(staticServerConfig{&tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{"h2"},
+	}}).GetServerConfig())
+	defer listener.Close()
+
+	for _, c := range []struct {
+		offered  []string
+		expected string
+	}{
+		{[]string{Protocol}, Protocol},
+		{[]string{"h2", Protocol}, Protocol},
+		{[]string{"h2"}, "h2"},
+		{nil, ""},
+	} {
+		conn, err := testDialer(listener.Addr().String(), c.offered...)()
+		assert.Nil(t, err, "should be able to connect offering %v", c.offered)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, c.expected, conn.(*tls.Conn).ConnectionState().NegotiatedProtocol, "offered %v", c.offered)
+		conn.Close()
+	}
+}
+
+func TestPool(t *testing.T) {
+	listener := echoServer(t, ServerConfig(staticServerConfig{&tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+	}}).GetServerConfig())
+	defer listener.Close()
+
+	pool := NewPool(testDialer(listener.Addr().String(), Protocol), PoolOptions{Size: 2})
+	defer pool.Close()
+
+	streams := []net.Conn{}
+	for i := 0; i < 5; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should be able to open stream")
+		if err != nil {
+			return
+		}
+		assert.IsType(t, &Stream{}, conn, "should get a stream")
+		assert.Equal(t, Protocol, conn.(*Stream).ConnectionState().NegotiatedProtocol)
+		streams = append(streams, conn)
+	}
+	assert.Equal(t, 2, pool.Sessions(), "should not open more sessions than the pool size")
+
+	for i, conn := range streams {
+		assertEcho(t, conn, "hello "+string(rune('a'+i)))
+		conn.Close()
+	}
+
+	pool.Close()
+	_, err := pool.Dial()
+	assert.NotNil(t, err, "should not be able to open stream on closed pool")
+}
+
+func TestPoolFallback(t *testing.T) {
+	// Server doesn't know about multiplexing
+	listener := echoServer(t, &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+	})
+	defer listener.Close()
+
+	pool := NewPool(testDialer(listener.Addr().String(), Protocol), PoolOptions{})
+	defer pool.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should be able to connect")
+		if err != nil {
+			return
+		}
+		assert.IsType(t, &tls.Conn{}, conn, "should fall back to plain connection")
+		assertEcho(t, conn, "hello")
+		conn.Close()
+	}
+	assert.Equal(t, 0, pool.Sessions(), "should not open sessions")
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,233 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Dialer dials a TLS connection to the server. To negotiate multiplexing,
+// its TLS config must offer Protocol via ALPN.
+type Dialer func() (net.Conn, error)
+
+// PoolOptions for a client pool.
+type PoolOptions struct {
+	Options
+	// Size is the maximum number of sessions (i.e. TLS connections) to keep
+	// open to the server. Defaults to one.
+	Size int
+	// FallbackTime is the time for which the pool dials plain connections
+	// after the server didn't negotiate multiplexing, before trying again.
+	// Defaults to one minute.
+	FallbackTime time.Duration
+	// Logger is used to log when sessions are opened or the pool falls back.
+	Logger Logger
+}
+
+// Pool keeps a small number of long-lived sessions to a server, and opens a
+// stream on one of them for each call to Dial. If the server doesn't
+// negotiate multiplexing, Dial returns plain connections instead.
+type Pool struct {
+	dial    Dialer
+	options PoolOptions
+
+	mu       sync.Mutex
+	sessions []*clientSession
+	pending  int
+	next     int
+	closed   bool
+	// Until when to dial plain connections, after the server didn't
+	// negotiate multiplexing.
+	fallbackUntil time.Time
+}
+
+type clientSession struct {
+	session *yamux.Session
+	state   tls.ConnectionState
+}
+
+// NewPool creates a pool. Sessions are opened lazily, on calls to Dial.
+func NewPool(dial Dialer, options PoolOptions) *Pool {
+	if options.Size <= 0 {
+		options.Size = 1
+	}
+	if options.FallbackTime <= 0 {
+		options.FallbackTime = time.Minute
+	}
+	return &Pool{dial: dial, options: options}
+}
+
+// Dial opens a stream to the server, on an existing session if possible.
+// New sessions are opened until the pool is full.
+func (p *Pool) Dial() (net.Conn, error) {
+	// If an existing session fails to open a stream (e.g. because the
+	// server is shutting down), we drop it and try again once.
+	for attempt := 0; attempt < 2; attempt++ {
+		session, grow, fallback, err := p.pick()
+		if err != nil {
+			return nil, err
+		}
+		if fallback {
+			fallbackTotal.Inc(1)
+			return p.dial()
+		}
+		if grow {
+			return p.open()
+		}
+
+		stream, err := session.session.OpenStream()
+		if err == nil {
+			return newStream(stream, session.state), nil
+		}
+		p.logf("dropping multiplexed session to %s: %s", session.session.RemoteAddr(), err)
+		p.remove(session)
+		go closeWhenIdle(session.session)
+	}
+	return p.open()
+}
+
+// Pick an existing session (round-robin), or signal that we should open a
+// new session or fall back to a plain connection.
+func (p *Pool) pick() (session *clientSession, grow, fallback bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, false, false, errors.New("multiplexed connection pool is closed")
+	}
+	if time.Now().Before(p.fallbackUntil) {
+		return nil, false, true, nil
+	}
+
+	// Drop sessions that were closed, e.g. due to a network error.
+	open := p.sessions[:0]
+	for _, s := range p.sessions {
+		if !s.session.IsClosed() {
+			open = append(open, s)
+		}
+	}
+	p.sessions = open
+
+	if len(p.sessions)+p.pending < p.options.Size || len(p.sessions) == 0 {
+		p.pending++
+		return nil, true, false, nil
+	}
+	p.next++
+	return p.sessions[p.next%len(p.sessions)], false, false, nil
+}
+
+// Open a new session, and the first stream on it. If the server doesn't
+// negotiate multiplexing, return the connection as a plain one.
+func (p *Pool) open() (net.Conn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		p.mu.Lock()
+		p.pending--
+		p.mu.Unlock()
+		return nil, err
+	}
+
+	state, _ := connectionState(conn)
+	if state.NegotiatedProtocol != Protocol {
+		p.mu.Lock()
+		p.pending--
+		p.fallbackUntil = time.Now().Add(p.options.FallbackTime)
+		p.mu.Unlock()
+		p.logf("server %s didn't negotiate multiplexing, using plain connections", conn.RemoteAddr())
+		fallbackTotal.Inc(1)
+		return conn, nil
+	}
+
+	session, err := yamux.Client(conn, p.options.config())
+	if err != nil {
+		p.mu.Lock()
+		p.pending--
+		p.mu.Unlock()
+		_ = conn.Close()
+		return nil, err
+	}
+	trackSession(session)
+	cs := &clientSession{session: session, state: state}
+
+	p.mu.Lock()
+	p.pending--
+	closed := p.closed
+	if !closed {
+		p.sessions = append(p.sessions, cs)
+	}
+	p.mu.Unlock()
+	if closed {
+		_ = session.Close()
+		return nil, errors.New("multiplexed connection pool is closed")
+	}
+	p.logf("opened multiplexed session to %s", conn.RemoteAddr())
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return newStream(stream, cs.state), nil
+}
+
+func (p *Pool) remove(session *clientSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.sessions {
+		if s == session {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sessions returns the number of open sessions.
+func (p *Pool) Sessions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, s := range p.sessions {
+		if !s.session.IsClosed() {
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the pool from opening new streams. Sessions are closed once
+// their open streams are done.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, s := range p.sessions {
+		go closeWhenIdle(s.session)
+	}
+	p.sessions = nil
+}
+
+func (p *Pool) logf(format string, v ...interface{}) {
+	if p.options.Logger != nil {
+		p.options.Logger.Printf(format, v...)
+	}
+}
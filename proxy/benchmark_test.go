@@ -53,6 +53,6 @@ func benchmarkCopyData(b *testing.B, proxy *Proxy, size int) {
 			}
 		}()
 
-		proxy.copyData(dstIn, srcOut)
+		proxy.copyData(dstIn, srcOut, nil)
 	}
 }
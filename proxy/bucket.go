@@ -0,0 +1,67 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"math"
+	"time"
+)
+
+// tokenBucket allows events at a steady rate (tokens per second), with bursts
+// of up to a number of tokens. The rate and burst are passed on each call, so
+// that they can change at runtime. A new bucket is full. It is not safe for
+// concurrent use.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Add the tokens that accrued since the last call, up to the burst.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+	}
+	b.last = now
+}
+
+// Take n tokens, if there are enough of them.
+func (b *tokenBucket) take(now time.Time, rate, burst, n float64) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Returns true if the bucket would be full at the given time, i.e. dropping
+// it makes no difference.
+func (b *tokenBucket) full(now time.Time, rate, burst float64) bool {
+	b.refill(now, rate, burst)
+	return b.tokens >= burst
+}
+
+// Take n tokens, going into debt if there aren't enough of them, and return
+// how long to wait until the debt is paid off.
+func (b *tokenBucket) reserve(now time.Time, rate, burst, n float64) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
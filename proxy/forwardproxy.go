@@ -0,0 +1,320 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Protocols spoken by forward proxy listeners.
+const (
+	ForwardProxyConnect = "connect"
+	ForwardProxySOCKS5  = "socks5"
+)
+
+// ForwardProxyProtocols lists the supported forward proxy protocols.
+var ForwardProxyProtocols = []string{ForwardProxyConnect, ForwardProxySOCKS5}
+
+// ErrDestinationNotAllowed is passed to ForwardProxyConn.Reply to reject a
+// destination that isn't allowed.
+var ErrDestinationNotAllowed = errors.New("destination not allowed")
+
+// Max size of a CONNECT request (with headers) or SOCKS5 request.
+const maxForwardProxyRequest = 8192
+
+var (
+	forwardProxyRequestCounter = metrics.GetOrRegisterCounter("forward-proxy.requests", metrics.DefaultRegistry)
+	forwardProxyDeniedCounter  = metrics.GetOrRegisterCounter("forward-proxy.denied", metrics.DefaultRegistry)
+	forwardProxyErrorCounter   = metrics.GetOrRegisterCounter("forward-proxy.error", metrics.DefaultRegistry)
+)
+
+// SOCKS5 constants (RFC 1928).
+const (
+	socks5Version             = 0x05
+	socks5NoAuth              = 0x00
+	socks5NoMethods           = 0xff
+	socks5Connect             = 0x01
+	socks5AddrIPv4            = 0x01
+	socks5AddrDomain          = 0x03
+	socks5AddrIPv6            = 0x04
+	socks5Succeeded           = 0x00
+	socks5Failure             = 0x01
+	socks5NotAllowed          = 0x02
+	socks5CommandNotSupported = 0x07
+	socks5AddressNotSupported = 0x08
+	socks5ReplyTemplate       = "\x05\x00\x00\x01\x00\x00\x00\x00\x00\x00"
+)
+
+// ForwardProxyConn is a connection on which the client asks for a
+// destination with an HTTP CONNECT or a SOCKS5 request, before the tunnel to
+// that destination is established. Once the destination was dialed (or
+// rejected), Reply must be called to tell the client.
+type ForwardProxyConn struct {
+	net.Conn
+
+	protocols   []string
+	once        sync.Once
+	err         error
+	limit       *io.LimitedReader
+	reader      *bufio.Reader
+	protocol    string
+	destination string
+
+	replyOnce sync.Once
+	replyErr  error
+}
+
+// NewForwardProxyConn wraps a connection, accepting requests in the given
+// protocols. The request is read on the first call to Handshake (or Read).
+func NewForwardProxyConn(conn net.Conn, protocols []string) *ForwardProxyConn {
+	limit := &io.LimitedReader{R: conn, N: maxForwardProxyRequest}
+	return &ForwardProxyConn{
+		Conn:      conn,
+		protocols: protocols,
+		limit:     limit,
+		reader:    bufio.NewReader(limit),
+	}
+}
+
+// Handshake reads the request from the client. Malformed or unsupported
+// requests are answered with an error, and the connection should be closed.
+// The Proxy calls this with a deadline, like for TLS handshakes.
+func (c *ForwardProxyConn) Handshake() error {
+	c.once.Do(func() {
+		c.err = c.readRequest()
+		if c.err != nil {
+			forwardProxyErrorCounter.Inc(1)
+			return
+		}
+		forwardProxyRequestCounter.Inc(1)
+		// Lift the limit, the rest of the stream belongs to the tunnel.
+		c.limit.N = math.MaxInt64
+	})
+	return c.err
+}
+
+func (c *ForwardProxyConn) readRequest() error {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return fmt.Errorf("unable to read forward proxy request: %w", err)
+	}
+	if first[0] == socks5Version {
+		if !slices.Contains(c.protocols, ForwardProxySOCKS5) {
+			return errors.New("SOCKS5 is not enabled")
+		}
+		c.protocol = ForwardProxySOCKS5
+		return c.readSOCKS5()
+	}
+	if !slices.Contains(c.protocols, ForwardProxyConnect) {
+		return errors.New("unsupported forward proxy protocol")
+	}
+	c.protocol = ForwardProxyConnect
+	return c.readConnect()
+}
+
+// Read an HTTP CONNECT request. Requests for other methods (e.g. plain HTTP
+// proxy requests) are rejected.
+func (c *ForwardProxyConn) readConnect() error {
+	req, err := http.ReadRequest(c.reader)
+	if err != nil {
+		_ = c.writeStatus(http.StatusBadRequest)
+		return fmt.Errorf("unable to read CONNECT request: %w", err)
+	}
+	if req.Method != http.MethodConnect {
+		_ = c.writeStatus(http.StatusMethodNotAllowed)
+		return fmt.Errorf("unsupported method %s, only CONNECT is allowed", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		_ = c.writeStatus(http.StatusBadRequest)
+		return fmt.Errorf("invalid CONNECT destination '%s': %w", req.Host, err)
+	}
+	c.destination = req.Host
+	return nil
+}
+
+// Read a SOCKS5 greeting and CONNECT request. Only the "no authentication"
+// method is supported, as the listener is meant to be local.
+func (c *ForwardProxyConn) readSOCKS5() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return fmt.Errorf("unable to read SOCKS5 greeting: %w", err)
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(c.reader, methods); err != nil {
+		return fmt.Errorf("unable to read SOCKS5 greeting: %w", err)
+	}
+	if !slices.Contains(methods, socks5NoAuth) {
+		_, _ = c.Conn.Write([]byte{socks5Version, socks5NoMethods})
+		return errors.New("SOCKS5 client doesn't support 'no authentication' method")
+	}
+	if _, err := c.Conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, request); err != nil {
+		return fmt.Errorf("unable to read SOCKS5 request: %w", err)
+	}
+	if request[0] != socks5Version {
+		return fmt.Errorf("invalid SOCKS5 request version %d", request[0])
+	}
+	if request[1] != socks5Connect {
+		_ = c.writeSOCKS5(socks5CommandNotSupported)
+		return fmt.Errorf("unsupported SOCKS5 command %d, only CONNECT is allowed", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c.reader, ip); err != nil {
+			return fmt.Errorf("unable to read SOCKS5 request: %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length, err := c.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("unable to read SOCKS5 request: %w", err)
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, name); err != nil {
+			return fmt.Errorf("unable to read SOCKS5 request: %w", err)
+		}
+		host = string(name)
+	default:
+		_ = c.writeSOCKS5(socks5AddressNotSupported)
+		return fmt.Errorf("unsupported SOCKS5 address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, port); err != nil {
+		return fmt.Errorf("unable to read SOCKS5 request: %w", err)
+	}
+	c.destination = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return nil
+}
+
+// Reply tells the client whether the tunnel to the destination was
+// established. A nil error means success; ErrDestinationNotAllowed is
+// reported as such (403 Forbidden, or "connection not allowed by ruleset"),
+// other errors as a generic failure. Only the first call has an effect.
+func (c *ForwardProxyConn) Reply(dialErr error) error {
+	c.replyOnce.Do(func() {
+		switch {
+		case errors.Is(dialErr, ErrDestinationNotAllowed):
+			forwardProxyDeniedCounter.Inc(1)
+		case dialErr != nil:
+			forwardProxyErrorCounter.Inc(1)
+		}
+
+		if c.protocol == ForwardProxySOCKS5 {
+			code := byte(socks5Succeeded)
+			switch {
+			case errors.Is(dialErr, ErrDestinationNotAllowed):
+				code = socks5NotAllowed
+			case dialErr != nil:
+				code = socks5Failure
+			}
+			c.replyErr = c.writeSOCKS5(code)
+			return
+		}
+
+		status := http.StatusOK
+		switch {
+		case errors.Is(dialErr, ErrDestinationNotAllowed):
+			status = http.StatusForbidden
+		case dialErr != nil:
+			status = http.StatusBadGateway
+		}
+		c.replyErr = c.writeStatus(status)
+	})
+	return c.replyErr
+}
+
+func (c *ForwardProxyConn) writeStatus(status int) error {
+	text := http.StatusText(status)
+	if status == http.StatusOK {
+		text = "Connection established"
+	}
+	_, err := fmt.Fprintf(c.Conn, "HTTP/1.1 %d %s\r\n\r\n", status, text)
+	return err
+}
+
+// Write a SOCKS5 reply. We don't report the bound address, as clients don't
+// need it for CONNECT.
+func (c *ForwardProxyConn) writeSOCKS5(code byte) error {
+	reply := []byte(socks5ReplyTemplate)
+	reply[1] = code
+	_, err := c.Conn.Write(reply)
+	return err
+}
+
+// Read reads from the connection, after the request.
+func (c *ForwardProxyConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// Destination returns the address (host:port) requested by the client.
+func (c *ForwardProxyConn) Destination() string {
+	return c.destination
+}
+
+// Protocol returns the protocol of the request, ForwardProxyConnect or
+// ForwardProxySOCKS5.
+func (c *ForwardProxyConn) Protocol() string {
+	return c.protocol
+}
+
+// Unwrap returns the underlying connection, e.g. for half-closing it.
+func (c *ForwardProxyConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+type forwardProxyListener struct {
+	net.Listener
+	protocols []string
+}
+
+// NewForwardProxyListener wraps a listener, so that accepted connections are
+// ForwardProxyConns accepting requests in the given protocols.
+func NewForwardProxyListener(listener net.Listener, protocols []string) net.Listener {
+	return forwardProxyListener{listener, protocols}
+}
+
+func (l forwardProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewForwardProxyConn(conn, l.protocols), nil
+}
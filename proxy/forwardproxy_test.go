@@ -0,0 +1,182 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	netproxy "golang.org/x/net/proxy"
+)
+
+func TestForwardProxyConnConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = io.WriteString(client, "CONNECT backend.example.com:8443 HTTP/1.1\r\nHost: backend.example.com:8443\r\n\r\nhello")
+	}()
+
+	conn := NewForwardProxyConn(server, ForwardProxyProtocols)
+	assert.Nil(t, conn.Handshake(), "should be able to read CONNECT request")
+	assert.Equal(t, ForwardProxyConnect, conn.Protocol())
+	assert.Equal(t, "backend.example.com:8443", conn.Destination())
+	assert.Equal(t, "forward proxy (connect), destination backend.example.com:8443", peerInfoString(conn))
+
+	// Data sent after the request is part of the tunnel.
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read after request")
+	assert.Equal(t, "hello", string(buf))
+
+	go func() { _ = conn.Reply(nil) }()
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	assert.Nil(t, err, "should get a response")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestForwardProxyConnConnectDenied(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = io.WriteString(client, "CONNECT evil.example.com:22 HTTP/1.1\r\n\r\n")
+	}()
+
+	conn := NewForwardProxyConn(server, ForwardProxyProtocols)
+	assert.Nil(t, conn.Handshake(), "should be able to read CONNECT request")
+
+	go func() {
+		_ = conn.Reply(ErrDestinationNotAllowed)
+		// Only the first reply is sent.
+		_ = conn.Reply(nil)
+		server.Close()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	assert.Nil(t, err, "should get a response")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestForwardProxyConnRejectsOtherMethods(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = io.WriteString(client, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}()
+
+	conn := NewForwardProxyConn(server, ForwardProxyProtocols)
+	errs := make(chan error, 1)
+	go func() { errs <- conn.Handshake() }()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	assert.Nil(t, err, "should get a response")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.NotNil(t, <-errs, "should reject plain HTTP proxy requests")
+}
+
+func TestForwardProxyConnProtocolDisabled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{socks5Version, 1, socks5NoAuth})
+	}()
+
+	conn := NewForwardProxyConn(server, []string{ForwardProxyConnect})
+	assert.NotNil(t, conn.Handshake(), "should reject SOCKS5 if only CONNECT is enabled")
+}
+
+func TestForwardProxyConnRequestTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\n")
+		for {
+			if _, err := io.WriteString(client, "X-Padding: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\r\n"); err != nil {
+				return
+			}
+		}
+	}()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+
+	conn := NewForwardProxyConn(server, ForwardProxyProtocols)
+	assert.NotNil(t, conn.Handshake(), "should reject requests that are too large")
+}
+
+func TestProxyForwardProxy(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	p := New(NewForwardProxyListener(incoming, ForwardProxyProtocols), 10*time.Second, 10*time.Second, 10*time.Second, nil, &testLogger{}, LogEverything, false)
+	p.Route = func(conn net.Conn) (Dialer, error) {
+		fc := conn.(*ForwardProxyConn)
+		if fc.Destination() != target.Addr().String() {
+			_ = fc.Reply(ErrDestinationNotAllowed)
+			return nil, errors.New("destination not allowed")
+		}
+		return func() (net.Conn, error) {
+			backend, err := net.Dial("tcp", fc.Destination())
+			_ = fc.Reply(err)
+			return backend, err
+		}, nil
+	}
+	go p.Accept()
+	defer p.Shutdown()
+
+	dialer, err := netproxy.SOCKS5("tcp", incoming.Addr().String(), nil, netproxy.Direct)
+	assert.Nil(t, err, "should be able to build SOCKS5 dialer")
+
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	assert.Nil(t, err, "should be able to connect through SOCKS5")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write through proxy")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read through proxy")
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = dialer.Dial("tcp", "127.0.0.1:1")
+	assert.ErrorContains(t, err, "not allowed", "should be denied by the route")
+}
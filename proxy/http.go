@@ -0,0 +1,305 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	httpRequestCounter = metrics.GetOrRegisterCounter("http.requests", metrics.DefaultRegistry)
+	httpDeniedCounter  = metrics.GetOrRegisterCounter("http.requests.denied", metrics.DefaultRegistry)
+	httpErrorCounter   = metrics.GetOrRegisterCounter("http.requests.error", metrics.DefaultRegistry)
+)
+
+const (
+	// HeaderClientCert carries the identity of the client, in the format of
+	// Envoy's X-Forwarded-Client-Cert header: the SHA-256 hash of the client
+	// certificate, its subject, and its URI and DNS SANs.
+	HeaderClientCert = "X-Forwarded-Client-Cert"
+	// HeaderClientSPIFFEID carries the SPIFFE ID of the client, i.e. the
+	// first spiffe:// URI SAN of its certificate.
+	HeaderClientSPIFFEID = "X-Forwarded-Client-Spiffe-Id"
+)
+
+// HTTPAuthorizer checks whether a request is allowed, given the TLS state of
+// the connection it was received on. Returning an error rejects the request
+// with 403 Forbidden.
+type HTTPAuthorizer func(r *http.Request, state tls.ConnectionState) error
+
+// HTTPOptions for proxying HTTP requests, see SetHTTP.
+type HTTPOptions struct {
+	// Authorize is called for each request, if set.
+	Authorize HTTPAuthorizer
+}
+
+// SetHTTP enables (or, if nil, disables) HTTP mode for new connections. In
+// HTTP mode, the proxy parses HTTP requests on incoming connections, and
+// forwards them to the backend as a reverse proxy, instead of copying bytes.
+// Identity headers (see HeaderClientCert) are removed from incoming requests,
+// and set from the client certificate. It is safe to call while the proxy is
+// running.
+func (p *Proxy) SetHTTP(options *HTTPOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.httpOpts = options
+}
+
+func (p *Proxy) httpOptions() *HTTPOptions {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.httpOpts
+}
+
+// Serve HTTP requests on a connection until it's closed (or the proxy is
+// shut down), forwarding them to backend connections from the given dialer.
+func (p *Proxy) serveHTTP(conn net.Conn, dial Dialer, options *HTTPOptions) {
+	connectTimeout, closeTimeout, _ := p.timeouts()
+	var state tls.ConnectionState
+	if tlsConn, ok := conn.(tlsStateConn); ok {
+		state = tlsConn.ConnectionState()
+	}
+
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return dial()
+		},
+		IdleConnTimeout: closeTimeout,
+	}
+	defer transport.CloseIdleConnections()
+
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Host
+			r.SetXForwarded()
+			r.Out.Header.Set("X-Forwarded-Proto", "https")
+			setIdentityHeaders(r.Out.Header, state)
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			httpErrorCounter.Inc(1)
+			p.logConditional(LogConnectionErrors, "error forwarding request %s %s from %s: %s", r.Method, r.URL.Path, conn.RemoteAddr(), err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		ErrorLog: log.New(loggerWriter{p}, "", 0),
+	}
+
+	// Wait for handlers to return, even after the connection was hijacked
+	// (e.g. for a websocket), before closing the connection.
+	var handlers sync.WaitGroup
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		httpRequestCounter.Inc(1)
+
+		if options.Authorize != nil {
+			if err := options.Authorize(r, state); err != nil {
+				httpDeniedCounter.Inc(1)
+				p.logConditional(LogConnectionErrors, "denied request %s %s from %s [%s]: %s", r.Method, r.URL.Path, conn.RemoteAddr(), peerCertificatesString(conn), err)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		reverseProxy.ServeHTTP(w, r)
+	})
+
+	c := &httpConn{conn: conn, done: make(chan struct{})}
+	c.server = &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: connectTimeout,
+		IdleTimeout:       closeTimeout,
+		ErrorLog:          log.New(loggerWriter{p}, "", 0),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			c.setState(state)
+		},
+	}
+	if !p.trackHTTP(c) {
+		return
+	}
+	defer p.untrackHTTP(c)
+
+	p.logConditional(LogConnections, "serving HTTP requests from %s [%s]", conn.RemoteAddr(), peerInfoString(conn))
+	listener := &singleConnListener{conn: conn, closed: make(chan struct{})}
+	go func() {
+		_ = c.server.Serve(listener)
+	}()
+	<-c.done
+	handlers.Wait()
+	_ = listener.Close()
+	p.logConditional(LogConnections, "closed HTTP connection from %s", conn.RemoteAddr())
+}
+
+// httpConn is a connection served in HTTP mode, with its own server.
+type httpConn struct {
+	conn   net.Conn
+	server *http.Server
+	// Closed once the server is done with the connection.
+	done chan struct{}
+
+	mu       sync.Mutex
+	state    http.ConnState
+	draining bool
+}
+
+func (c *httpConn) setState(state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	switch state {
+	case http.StateIdle:
+		if c.draining {
+			_ = c.conn.Close()
+		}
+	case http.StateClosed, http.StateHijacked:
+		close(c.done)
+	}
+}
+
+// Stop serving requests on the connection: close it if it's idle (or no
+// request was received yet), otherwise once the active request is done.
+func (c *httpConn) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	c.server.SetKeepAlivesEnabled(false)
+	if c.state == http.StateNew || c.state == http.StateIdle {
+		_ = c.conn.Close()
+	}
+}
+
+// Keep track of connections, so that they can be drained on shutdown.
+func (p *Proxy) trackHTTP(c *httpConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.quit) == 1 {
+		return false
+	}
+	if p.httpConns == nil {
+		p.httpConns = map[*httpConn]struct{}{}
+	}
+	p.httpConns[c] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrackHTTP(c *httpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.httpConns, c)
+}
+
+// Close idle HTTP connections, and other HTTP connections once their active
+// requests are done.
+func (p *Proxy) drainHTTP() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for c := range p.httpConns {
+		c.drain()
+	}
+}
+
+// Set identity headers from the client certificate, replacing any headers
+// with the same name sent by the client.
+func setIdentityHeaders(header http.Header, state tls.ConnectionState) {
+	header.Del(HeaderClientCert)
+	header.Del(HeaderClientSPIFFEID)
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+
+	hash := sha256.Sum256(cert.Raw)
+	fields := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Subject=" + quoteClientCertValue(cert.Subject.String()),
+	}
+	spiffeID := ""
+	for _, uri := range cert.URIs {
+		if spiffeID == "" && uri.Scheme == "spiffe" {
+			spiffeID = uri.String()
+		}
+		fields = append(fields, "URI="+quoteClientCertValue(uri.String()))
+	}
+	for _, name := range cert.DNSNames {
+		fields = append(fields, "DNS="+quoteClientCertValue(name))
+	}
+	header.Set(HeaderClientCert, strings.Join(fields, ";"))
+	if spiffeID != "" {
+		header.Set(HeaderClientSPIFFEID, spiffeID)
+	}
+}
+
+// Quote a value for X-Forwarded-Client-Cert if it contains separators, as
+// done by Envoy.
+func quoteClientCertValue(value string) string {
+	if !strings.ContainsAny(value, `,;="`) {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// singleConnListener is a listener for serving a single, already accepted,
+// connection with an http.Server.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	close  sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.close.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// loggerWriter logs errors from the HTTP server and reverse proxy.
+type loggerWriter struct {
+	p *Proxy
+}
+
+func (w loggerWriter) Write(b []byte) (int, error) {
+	w.p.logConditional(LogConnectionErrors, "%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
@@ -0,0 +1,146 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHTTP(t *testing.T) {
+	clientCert, clientLeaf := testClientCertificate(t, "client", "spiffe://example.org/client")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientLeaf)
+
+	// Incoming listener, requires a client cert
+	incoming, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target, a plain HTTP server that echoes identity headers
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Echo-Client-Cert", r.Header.Get(HeaderClientCert))
+		w.Header().Set("Echo-Spiffe-Id", r.Header.Get(HeaderClientSPIFFEID))
+		w.Header().Set("Echo-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	})}
+	go func() { _ = backend.Serve(target) }()
+	defer backend.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(incoming, 10*time.Second, 10*time.Second, 0, dialer, &testLogger{}, LogEverything, false)
+	p.SetHTTP(&HTTPOptions{
+		Authorize: func(r *http.Request, state tls.ConnectionState) error {
+			if strings.HasPrefix(r.URL.Path, "/admin") {
+				return errors.New("admin is off limits")
+			}
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("no client cert")
+			}
+			return nil
+		},
+	})
+	go p.Accept()
+	defer p.Shutdown()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+		},
+	}}
+
+	// Identity headers are set from the client certificate, not the client
+	req, _ := http.NewRequest("GET", "https://"+incoming.Addr().String()+"/hello", nil)
+	req.Header.Set(HeaderClientCert, "Hash=spoofed")
+	req.Header.Set(HeaderClientSPIFFEID, "spiffe://example.org/spoofed")
+	resp, err := client.Do(req)
+	assert.Nil(t, err, "should be able to make request through proxy")
+	if err != nil {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello /hello", string(body))
+
+	hash := sha256.Sum256(clientLeaf.Raw)
+	assert.Equal(t, "Hash="+hex.EncodeToString(hash[:])+";Subject=\"CN=client\";URI=spiffe://example.org/client", resp.Header.Get("Echo-Client-Cert"))
+	assert.Equal(t, "spiffe://example.org/client", resp.Header.Get("Echo-Spiffe-Id"))
+	assert.Equal(t, "127.0.0.1", resp.Header.Get("Echo-Forwarded-For"))
+
+	// Denied requests get a 403, on the same connection
+	resp, err = client.Get("https://" + incoming.Addr().String() + "/admin")
+	assert.Nil(t, err, "should get a response for denied request")
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client.Get("https://" + incoming.Addr().String() + "/again")
+	assert.Nil(t, err, "should be able to make another request")
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Idle connections are closed on shutdown
+	p.Shutdown()
+	waited := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Error("proxy should shut down with idle HTTP connections")
+	}
+}
+
+func TestSetIdentityHeadersWithoutCert(t *testing.T) {
+	header := http.Header{}
+	header.Set(HeaderClientCert, "Hash=spoofed")
+	header.Set(HeaderClientSPIFFEID, "spiffe://example.org/spoofed")
+	setIdentityHeaders(header, tls.ConnectionState{})
+	assert.Empty(t, header.Get(HeaderClientCert), "should remove spoofed header")
+	assert.Empty(t, header.Get(HeaderClientSPIFFEID), "should remove spoofed header")
+}
+
+func TestQuoteClientCertValue(t *testing.T) {
+	assert.Equal(t, `"CN=client,OU=x"`, quoteClientCertValue("CN=client,OU=x"))
+	assert.Equal(t, `"a\"b"`, quoteClientCertValue(`a"b`))
+	assert.Equal(t, "spiffe://example.org/client", quoteClientCertValue("spiffe://example.org/client"))
+}
@@ -0,0 +1,85 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer interrupts pending reads on both sides of a connection once no
+// data was read from either side for the idle timeout, so that a connection
+// streaming data one way isn't closed because the other way is quiet. It uses
+// a timer rather than read deadlines that are pushed back on every read, so
+// that it never extends the deadlines set for the max lifetime of the
+// connection or on close.
+type idleTimer struct {
+	timeout  time.Duration
+	timer    *time.Timer
+	fired    atomic.Bool
+	reported atomic.Bool
+}
+
+func newIdleTimer(timeout time.Duration, conns ...net.Conn) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		// A read may have re-armed the timer as it fired.
+		if !t.fired.CompareAndSwap(false, true) {
+			return
+		}
+		idleTimeoutCounter.Inc(1)
+		for _, conn := range conns {
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	})
+	return t
+}
+
+// Reset the timer after data was read from either side.
+func (t *idleTimer) reset() {
+	if !t.fired.Load() {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// Returns true if reads were interrupted because the connection was idle.
+func (t *idleTimer) expired() bool {
+	return t.fired.Load()
+}
+
+// Returns true the first time it's called, to log the timeout once.
+func (t *idleTimer) report() bool {
+	return t.reported.CompareAndSwap(false, true)
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+}
+
+// idleReader reads from one side of a connection, resetting the idle timer
+// of the connection on every read.
+type idleReader struct {
+	conn  net.Conn
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.conn.Read(b)
+	if n > 0 {
+		r.timer.reset()
+	}
+	return n, err
+}
@@ -0,0 +1,329 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Limits for a Limiter. Zero values mean no limit.
+type Limits struct {
+	// MaxConnections is the number of open connections. Once reached,
+	// proxies pause accepting connections until one is closed.
+	MaxConnections int
+	// MaxConnectionsPerIP is the number of open connections from a single
+	// client IP address. Further connections from the address are rejected.
+	MaxConnectionsPerIP int
+	// MaxHandshakes is the number of concurrent handshakes. Connections wait
+	// for a slot until their handshake timeout, and are rejected after.
+	MaxHandshakes int
+}
+
+// Limiter keeps track of open connections and handshakes, and enforces
+// limits on them. It can be shared between proxies, to limit connections
+// across all of them (see Proxy.SetLimiters). Usage and limits are reported
+// as gauges prefixed with "limits.<name>".
+type Limiter struct {
+	mu         sync.Mutex
+	limits     Limits
+	conns      int
+	perIP      map[string]int
+	atLimit    int
+	handshakes int
+	// Closed (and replaced) whenever a connection or handshake is done, or
+	// the limits change, to wake up anyone waiting for a slot.
+	changed chan struct{}
+
+	connsGauge      metrics.Gauge
+	maxConnsGauge   metrics.Gauge
+	atLimitGauge    metrics.Gauge
+	maxPerIPGauge   metrics.Gauge
+	handshakesGauge metrics.Gauge
+	maxHSGauge      metrics.Gauge
+	rejectedCounter metrics.Counter
+}
+
+// NewLimiter creates a limiter with the given name (for metrics) and limits.
+func NewLimiter(name string, limits Limits) *Limiter {
+	prefix := "limits." + name + "."
+	l := &Limiter{
+		perIP:           map[string]int{},
+		changed:         make(chan struct{}),
+		connsGauge:      metrics.GetOrRegisterGauge(prefix+"connections", metrics.DefaultRegistry),
+		maxConnsGauge:   metrics.GetOrRegisterGauge(prefix+"connections.max", metrics.DefaultRegistry),
+		atLimitGauge:    metrics.GetOrRegisterGauge(prefix+"per-ip.at-limit", metrics.DefaultRegistry),
+		maxPerIPGauge:   metrics.GetOrRegisterGauge(prefix+"per-ip.max", metrics.DefaultRegistry),
+		handshakesGauge: metrics.GetOrRegisterGauge(prefix+"handshakes", metrics.DefaultRegistry),
+		maxHSGauge:      metrics.GetOrRegisterGauge(prefix+"handshakes.max", metrics.DefaultRegistry),
+		rejectedCounter: metrics.GetOrRegisterCounter(prefix+"rejected", metrics.DefaultRegistry),
+	}
+	l.connsGauge.Update(0)
+	l.atLimitGauge.Update(0)
+	l.handshakesGauge.Update(0)
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits updates the limits. Connections that are already open are kept,
+// even if they exceed the new limits. It is safe to call while the limiter
+// is in use.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.atLimit = 0
+	for _, n := range l.perIP {
+		if limits.MaxConnectionsPerIP > 0 && n >= limits.MaxConnectionsPerIP {
+			l.atLimit++
+		}
+	}
+	l.maxConnsGauge.Update(int64(limits.MaxConnections))
+	l.maxPerIPGauge.Update(int64(limits.MaxConnectionsPerIP))
+	l.maxHSGauge.Update(int64(limits.MaxHandshakes))
+	l.atLimitGauge.Update(int64(l.atLimit))
+	l.notify()
+}
+
+// Limits returns the current limits.
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// Wake up anyone waiting for a slot. Must be called with mu held.
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Wait until there is room for another connection, or stop is closed.
+// Returns false if stopped.
+func (l *Limiter) waitForConnection(stop <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		if l.limits.MaxConnections == 0 || l.conns < l.limits.MaxConnections {
+			l.mu.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// Take a slot for a connection, or return the reason the connection is
+// rejected. Slots for the address of the client are taken separately, with
+// acquireAddr, as reading it may block (e.g. on a PROXY protocol header).
+func (l *Limiter) acquireConnection() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxConnections > 0 && l.conns >= l.limits.MaxConnections {
+		l.rejectedCounter.Inc(1)
+		return fmt.Errorf("too many open connections (limit %d)", l.limits.MaxConnections)
+	}
+	l.conns++
+	l.connsGauge.Update(int64(l.conns))
+	return nil
+}
+
+func (l *Limiter) releaseConnection() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	l.connsGauge.Update(int64(l.conns))
+	l.notify()
+}
+
+// Take a slot for a connection from the given address, or return the reason
+// the connection is rejected.
+func (l *Limiter) acquireAddr(addr net.Addr) error {
+	ip := addrIP(addr)
+	if ip == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.limits.MaxConnectionsPerIP {
+		l.rejectedCounter.Inc(1)
+		return fmt.Errorf("too many open connections from %s (limit %d)", ip, l.limits.MaxConnectionsPerIP)
+	}
+	l.perIP[ip]++
+	if l.limits.MaxConnectionsPerIP > 0 && l.perIP[ip] == l.limits.MaxConnectionsPerIP {
+		l.atLimit++
+		l.atLimitGauge.Update(int64(l.atLimit))
+	}
+	return nil
+}
+
+func (l *Limiter) releaseAddr(addr net.Addr) {
+	ip := addrIP(addr)
+	if ip == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxConnectionsPerIP > 0 && l.perIP[ip] == l.limits.MaxConnectionsPerIP {
+		l.atLimit--
+		l.atLimitGauge.Update(int64(l.atLimit))
+	}
+	l.perIP[ip]--
+	if l.perIP[ip] == 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Take a slot for a handshake, waiting for one until the timeout expires.
+func (l *Limiter) acquireHandshake(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		if l.limits.MaxHandshakes == 0 || l.handshakes < l.limits.MaxHandshakes {
+			l.handshakes++
+			l.handshakesGauge.Update(int64(l.handshakes))
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			l.rejectedCounter.Inc(1)
+			return fmt.Errorf("too many concurrent handshakes (limit %d)", l.Limits().MaxHandshakes)
+		}
+	}
+}
+
+func (l *Limiter) releaseHandshake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handshakes--
+	l.handshakesGauge.Update(int64(l.handshakes))
+	l.notify()
+}
+
+// Returns the IP address of a TCP or UDP address, or an empty string for
+// other addresses (e.g. UNIX sockets), which aren't limited per IP.
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return ""
+}
+
+// SetLimiters sets the limiters that new connections are subject to, e.g.
+// one for the limits of this proxy and one shared with other proxies. It is
+// safe to call while the proxy is running.
+func (p *Proxy) SetLimiters(limiters ...*Limiter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limiters = limiters
+}
+
+func (p *Proxy) getLimiters() []*Limiter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.limiters
+}
+
+// Pause until all limiters have room for another connection. Returns false
+// if the proxy was shut down while waiting.
+func (p *Proxy) waitForLimits() bool {
+	for _, l := range p.getLimiters() {
+		if !l.waitForConnection(p.done) {
+			return false
+		}
+	}
+	return true
+}
+
+// Take a connection slot from all limiters. Returns a function to release
+// them once the connection is closed, or the reason for rejecting it.
+func (p *Proxy) acquireConnection() (func(), error) {
+	limiters := p.getLimiters()
+	for i, l := range limiters {
+		if err := l.acquireConnection(); err != nil {
+			for _, acquired := range limiters[:i] {
+				acquired.releaseConnection()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, l := range limiters {
+			l.releaseConnection()
+		}
+	}, nil
+}
+
+// Take a slot for the address of the client from all limiters. This reads
+// the remote address of the connection, which may block until a PROXY
+// protocol header is received, so it must not be called from the accept
+// loop.
+func (p *Proxy) acquireAddr(conn net.Conn) (func(), error) {
+	limiters := p.getLimiters()
+	addr := conn.RemoteAddr()
+	for i, l := range limiters {
+		if err := l.acquireAddr(addr); err != nil {
+			for _, acquired := range limiters[:i] {
+				acquired.releaseAddr(addr)
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, l := range limiters {
+			l.releaseAddr(addr)
+		}
+	}, nil
+}
+
+// Take a handshake slot from all limiters, waiting up to the timeout. Returns
+// a function to release them once the handshake is done, or the reason for
+// rejecting the connection.
+func (p *Proxy) acquireHandshake(timeout time.Duration) (func(), error) {
+	limiters := p.getLimiters()
+	for i, l := range limiters {
+		if err := l.acquireHandshake(timeout); err != nil {
+			for _, acquired := range limiters[:i] {
+				acquired.releaseHandshake()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, l := range limiters {
+			l.releaseHandshake()
+		}
+	}, nil
+}
@@ -0,0 +1,162 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterConnections(t *testing.T) {
+	l := NewLimiter("test-connections", Limits{MaxConnections: 2})
+	rejected := l.rejectedCounter.Count()
+
+	assert.Nil(t, l.acquireConnection(), "should accept first connection")
+	assert.Nil(t, l.acquireConnection(), "should accept second connection")
+	assert.NotNil(t, l.acquireConnection(), "should reject connection over limit")
+	assert.Equal(t, int64(2), l.connsGauge.Value())
+	assert.Equal(t, rejected+1, l.rejectedCounter.Count())
+
+	l.releaseConnection()
+	assert.Nil(t, l.acquireConnection(), "should accept connection after release")
+}
+
+func TestLimiterConnectionsPerIP(t *testing.T) {
+	l := NewLimiter("test-per-ip", Limits{MaxConnectionsPerIP: 2})
+	rejected := l.rejectedCounter.Count()
+	a := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	assert.Nil(t, l.acquireAddr(a), "should accept first connection")
+	assert.Nil(t, l.acquireAddr(a), "should accept second connection")
+	assert.Equal(t, int64(1), l.atLimitGauge.Value(), "address should be at its limit")
+	assert.NotNil(t, l.acquireAddr(a), "should reject third connection from same address")
+	assert.Nil(t, l.acquireAddr(b), "should accept connection from other address")
+	assert.Equal(t, rejected+1, l.rejectedCounter.Count())
+
+	l.releaseAddr(a)
+	assert.Equal(t, int64(0), l.atLimitGauge.Value(), "address should be below its limit")
+	assert.Nil(t, l.acquireAddr(a), "should accept connection after release")
+
+	// UNIX sockets aren't limited per address.
+	l.SetLimits(Limits{MaxConnectionsPerIP: 1})
+	unix := &net.UnixAddr{Name: "@", Net: "unix"}
+	assert.Nil(t, l.acquireAddr(unix))
+	assert.Nil(t, l.acquireAddr(unix))
+}
+
+func TestLimiterHandshakes(t *testing.T) {
+	l := NewLimiter("test-handshakes", Limits{MaxHandshakes: 1})
+
+	assert.Nil(t, l.acquireHandshake(time.Second), "should get handshake slot")
+	assert.NotNil(t, l.acquireHandshake(50*time.Millisecond), "should time out waiting for slot")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.releaseHandshake()
+	}()
+	assert.Nil(t, l.acquireHandshake(5*time.Second), "should get slot once released")
+	assert.Equal(t, int64(1), l.handshakesGauge.Value())
+	assert.Equal(t, int64(1), l.maxHSGauge.Value())
+}
+
+func TestProxyMaxConnections(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(incoming, 10*time.Second, 100*time.Millisecond, 0, dialer, &testLogger{}, LogEverything, false)
+	limiter := NewLimiter("test-proxy", Limits{MaxConnections: 1})
+	p.SetLimiters(limiter)
+	go p.Accept()
+	defer p.Shutdown()
+
+	first, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	firstBackend, err := target.Accept()
+	assert.Nil(t, err, "should receive first connection on target")
+
+	// The second connection waits in the backlog until the first is closed.
+	second, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer second.Close()
+	_ = target.(*net.TCPListener).SetDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = target.Accept()
+	assert.NotNil(t, err, "should not forward second connection while at limit")
+
+	first.Close()
+	_, _ = io.ReadAll(firstBackend)
+	firstBackend.Close()
+
+	_ = target.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	secondBackend, err := target.Accept()
+	assert.Nil(t, err, "should forward second connection once first is closed")
+	if err == nil {
+		secondBackend.Close()
+	}
+
+	// Shutting down stops waiting for the limit.
+	p.Shutdown()
+	p.Wait()
+}
+
+func TestProxyLimitsDontWaitForProxyHeader(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	listener := &proxyproto.Listener{Listener: incoming, ReadHeaderTimeout: 10 * time.Second}
+	p := New(listener, 10*time.Second, 100*time.Millisecond, 0, dialer, &testLogger{}, LogEverything, false)
+	p.SetLimiters(NewLimiter("test-proxy-header", Limits{MaxConnectionsPerIP: 1}))
+	go p.Accept()
+	defer p.Shutdown()
+
+	// A client that never sends its PROXY header...
+	silent, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer silent.Close()
+
+	// ...doesn't hold up other clients.
+	client, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer client.Close()
+	header := proxyproto.HeaderProxyFromAddrs(2,
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443})
+	_, err = header.WriteTo(client)
+	assert.Nil(t, err, "should be able to send PROXY header")
+
+	_ = target.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	backend, err := target.Accept()
+	assert.Nil(t, err, "should forward second connection while first is silent")
+	if err == nil {
+		backend.Close()
+	}
+}
@@ -0,0 +1,86 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/ghostunnel/ghostunnel/mux"
+)
+
+// SetMultiplex enables (or, if nil, disables) accepting multiplexed sessions
+// on new connections. Connections only carry a multiplexed session if the
+// client negotiated mux.Protocol via ALPN, see mux.ServerConfig. It is safe
+// to call while the proxy is running.
+func (p *Proxy) SetMultiplex(options *mux.Options) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.multiplex = options
+}
+
+// Start a multiplexed session on a connection, if multiplexing is enabled
+// and was negotiated by the client.
+func (p *Proxy) multiplexed(conn net.Conn) (*mux.Session, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.multiplex == nil || !mux.Negotiated(conn) || atomic.LoadInt32(&p.quit) == 1 {
+		return nil, false
+	}
+	session, err := mux.Server(conn, *p.multiplex)
+	if err != nil {
+		p.logConditional(LogConnectionErrors, "error starting multiplexed session with %s: %s", conn.RemoteAddr(), err)
+		return nil, false
+	}
+	if p.sessions == nil {
+		p.sessions = map[*mux.Session]struct{}{}
+	}
+	p.sessions[session] = struct{}{}
+	return session, true
+}
+
+// Serve streams of a multiplexed session, each like a separate connection,
+// until the session is closed.
+func (p *Proxy) serveSession(session *mux.Session, conn net.Conn) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.sessions, session)
+		p.mu.Unlock()
+		_ = session.Close()
+	}()
+
+	p.logConditional(LogConnections, "accepted multiplexed session from %s [%s]", conn.RemoteAddr(), peerInfoString(conn))
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			p.logConditional(LogConnections, "closed multiplexed session from %s", conn.RemoteAddr())
+			return
+		}
+		go connTimer.Time(func() {
+			defer stream.Close()
+			p.handle(stream)
+		})
+	}
+}
+
+// Stop clients from opening new streams on multiplexed sessions, and close
+// the sessions once their open streams are done.
+func (p *Proxy) drainSessions() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for session := range p.sessions {
+		session.Drain()
+	}
+}
@@ -0,0 +1,100 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticServerConfig struct {
+	config *tls.Config
+}
+
+func (c staticServerConfig) GetServerConfig() *tls.Config {
+	return c.config
+}
+
+func TestProxyMultiplex(t *testing.T) {
+	// Incoming listener, accepts multiplexed sessions
+	serverConfig := mux.ServerConfig(staticServerConfig{&tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+	}})
+	incoming, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig.GetServerConfig())
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener, echoes data until the client is done writing
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(incoming, 10*time.Second, 10*time.Second, 10*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.SetMultiplex(&mux.Options{})
+	go p.Accept()
+	defer p.Shutdown()
+
+	pool := mux.NewPool(func() (net.Conn, error) {
+		return tls.Dial("tcp", incoming.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{mux.Protocol},
+		})
+	}, mux.PoolOptions{Size: 1})
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		stream, err := pool.Dial()
+		assert.Nil(t, err, "should be able to open stream through proxy")
+		if err != nil {
+			return
+		}
+		assert.IsType(t, &mux.Stream{}, stream)
+
+		// Half-close the stream, the echo should still come back.
+		_, err = stream.Write([]byte("hello"))
+		assert.Nil(t, err, "should be able to write")
+		assert.Nil(t, stream.(*mux.Stream).CloseWrite(), "should be able to close stream for writing")
+
+		_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		received, err := io.ReadAll(stream)
+		assert.Nil(t, err, "should be able to read echo until EOF")
+		assert.Equal(t, "hello", string(received))
+		stream.Close()
+	}
+	assert.Equal(t, 1, pool.Sessions(), "streams should share a session")
+
+	p.Shutdown()
+	p.Wait()
+}
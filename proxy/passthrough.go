@@ -0,0 +1,134 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// errPeeked aborts the handshake once we've seen the ClientHello.
+var errPeeked = errors.New("peeked at client hello")
+
+// PassthroughConn is a connection on which we peek at the TLS ClientHello
+// (e.g. to route based on the server name), without terminating TLS. All
+// bytes read while peeking are replayed on Read, so that the backend sees
+// the original, unmodified TLS stream.
+type PassthroughConn struct {
+	net.Conn
+
+	once       sync.Once
+	err        error
+	reader     io.Reader
+	serverName string
+	protocols  []string
+}
+
+// NewPassthroughConn wraps a connection. The ClientHello is read on the
+// first call to Handshake (or Read).
+func NewPassthroughConn(conn net.Conn) *PassthroughConn {
+	return &PassthroughConn{Conn: conn}
+}
+
+// Handshake reads the ClientHello from the connection. Unlike the method
+// of the same name on tls.Conn, it doesn't write anything to the client.
+// The Proxy calls this with a deadline, like for TLS handshakes.
+func (c *PassthroughConn) Handshake() error {
+	c.once.Do(func() {
+		c.err = c.peek()
+	})
+	return c.err
+}
+
+func (c *PassthroughConn) peek() error {
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{io.TeeReader(c.Conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errPeeked
+		},
+	}).Handshake()
+	c.reader = io.MultiReader(&peeked, c.Conn)
+
+	if hello == nil {
+		return fmt.Errorf("unable to read TLS client hello: %w", err)
+	}
+	c.serverName = hello.ServerName
+	c.protocols = append([]string(nil), hello.SupportedProtos...)
+	return nil
+}
+
+// Read reads from the connection, starting with the peeked ClientHello.
+func (c *PassthroughConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// ServerName returns the server name (SNI) sent by the client, if any.
+func (c *PassthroughConn) ServerName() string {
+	return c.serverName
+}
+
+// Protocols returns the protocols offered by the client via ALPN, if any.
+func (c *PassthroughConn) Protocols() []string {
+	return c.protocols
+}
+
+// Unwrap returns the underlying connection, e.g. for half-closing it.
+func (c *PassthroughConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello from a reader, while
+// making sure nothing (e.g. an alert) is written back to the client.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type passthroughListener struct {
+	net.Listener
+}
+
+// NewPassthroughListener wraps a listener, so that accepted connections are
+// PassthroughConns.
+func NewPassthroughListener(listener net.Listener) net.Listener {
+	return passthroughListener{listener}
+}
+
+func (l passthroughListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewPassthroughConn(conn), nil
+}
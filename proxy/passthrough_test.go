@@ -0,0 +1,164 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingConn records everything written to a connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestPassthroughConnPeek(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	recorder := &recordingConn{Conn: client}
+	go func() {
+		_ = tls.Client(recorder, &tls.Config{
+			ServerName:         "example.com",
+			NextProtos:         []string{"h2", "http/1.1"},
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	conn := NewPassthroughConn(server)
+	err := conn.Handshake()
+	assert.Nil(t, err, "should be able to read client hello")
+	assert.Equal(t, "example.com", conn.ServerName())
+	assert.Equal(t, []string{"h2", "http/1.1"}, conn.Protocols())
+	assert.Equal(t, "passthrough, sni example.com, alpn offered h2 http/1.1", peerInfoString(conn))
+
+	// Everything read while peeking is replayed.
+	replayed := make([]byte, recorder.written.Len())
+	_, err = io.ReadFull(conn, replayed)
+	assert.Nil(t, err, "should be able to read peeked bytes")
+	assert.Equal(t, recorder.written.Bytes(), replayed, "should replay client hello")
+}
+
+func TestPassthroughConnNotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	}()
+
+	conn := NewPassthroughConn(server)
+	assert.NotNil(t, conn.Handshake(), "should reject non-TLS connection")
+	_, err := conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "should not be able to read after failed handshake")
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	// Incoming listener
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener, terminates TLS
+	cert := testCertificate(t)
+	target, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	p := New(NewPassthroughListener(incoming), 10*time.Second, 10*time.Second, 10*time.Second, nil, &testLogger{}, LogEverything, false)
+	p.Route = func(conn net.Conn) (Dialer, error) {
+		if conn.(*PassthroughConn).ServerName() != "backend.example.com" {
+			return nil, errors.New("unknown server name")
+		}
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", target.Addr().String())
+		}, nil
+	}
+	go p.Accept()
+	defer p.Shutdown()
+
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	// Handshake is with the target, through the proxy
+	src, err := tls.Dial("tcp", incoming.Addr().String(), &tls.Config{
+		ServerName:         "backend.example.com",
+		InsecureSkipVerify: true,
+	})
+	assert.Nil(t, err, "should be able to handshake with target through proxy")
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	assert.Equal(t, "backend", src.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	_, err = src.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write")
+	received := make([]byte, 5)
+	_ = src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(src, received)
+	assert.Nil(t, err, "should be able to read echo from target")
+	assert.Equal(t, "hello", string(received))
+
+	// Unknown server name is rejected
+	_, err = tls.Dial("tcp", incoming.Addr().String(), &tls.Config{
+		ServerName:         "other.example.com",
+		InsecureSkipVerify: true,
+	})
+	assert.NotNil(t, err, "unknown server name should be rejected")
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "backend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"backend.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -17,8 +17,8 @@
 package proxy
 
 import (
-	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strings"
@@ -26,6 +26,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/ghostunnel/ghostunnel/quic"
+	"github.com/ghostunnel/ghostunnel/websocket"
 	proxyproto "github.com/pires/go-proxyproto"
 	metrics "github.com/rcrowley/go-metrics"
 )
@@ -37,6 +40,8 @@ var (
 	successCounter          = metrics.GetOrRegisterCounter("accept.success", metrics.DefaultRegistry)
 	errorCounter            = metrics.GetOrRegisterCounter("accept.error", metrics.DefaultRegistry)
 	handshakeTimeoutCounter = metrics.GetOrRegisterCounter("accept.timeout", metrics.DefaultRegistry)
+	dialTimeoutCounter      = metrics.GetOrRegisterCounter("conn.dial.timeout", metrics.DefaultRegistry)
+	idleTimeoutCounter      = metrics.GetOrRegisterCounter("conn.idle.timeout", metrics.DefaultRegistry)
 	handshakeTimer          = metrics.GetOrRegisterTimer("conn.handshake", metrics.DefaultRegistry)
 	connTimer               = metrics.GetOrRegisterTimer("conn.lifetime", metrics.DefaultRegistry)
 )
@@ -60,6 +65,10 @@ type Logger interface {
 // Dialer represents a function that can dial a backend/destination for forwarding connections.
 type Dialer func() (net.Conn, error)
 
+// Router picks the dialer for an incoming connection after the handshake,
+// e.g. based on the TLS server name. Returning an error rejects the connection.
+type Router func(conn net.Conn) (Dialer, error)
+
 // Proxy will take incoming connections from a listener and forward them to
 // a backend through the given dialer.
 type Proxy struct {
@@ -69,32 +78,59 @@ type Proxy struct {
 	ConnectTimeout, CloseTimeout time.Duration
 	// MaxConnLifetime is the max lifetime for any connection, regardless of circumstances.
 	MaxConnLifetime time.Duration
+	// HandshakeTimeout limits the time for handshakes with clients (TLS, and
+	// WebSocket upgrades). Falls back to ConnectTimeout if zero.
+	HandshakeTimeout time.Duration
+	// DialTimeout limits the time for dialing a backend overall, if set.
+	// Dialers still apply timeouts of their own to each attempt.
+	DialTimeout time.Duration
+	// IdleTimeout closes a connection once no data was read from either side
+	// for this long, if set. The timeout resets on every read.
+	IdleTimeout time.Duration
 	// Dial function to reach backend to forward connections to.
 	Dial Dialer
+	// Route picks a dialer per connection. If set, it takes precedence over Dial.
+	Route Router
 	// Logger is used to log information messages about connections, errors.
 	Logger Logger
 
 	// Internal state to indicate that we want to shut down.
 	quit int32
+	// Closed on shutdown, to stop waiting for limits (see SetLimiters).
+	done chan struct{}
+	// Limiters for new connections and handshakes (see SetLimiters).
+	limiters []*Limiter
+	// Quotas per client identity, if set (see SetQuotas).
+	quotas *Quotas
+	// Open connections and rates per client identity, for quotas.
+	quotaState quotaState
+	// Rate limits for new connections (see SetRateLimits), and the limiters
+	// shared by all connections.
+	rateLimits                RateLimits
+	readLimiter, writeLimiter bandwidthLimiter
 	// Logging flags
 	loggerFlags int
 	// Enable HAproxy's PROXY protocol
 	// see: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 	proxyProtocol bool
+	// Version of the PROXY protocol to use (see SetProxyProtocolVersion).
+	proxyProtocolVersion int
 	// Internal wait group to keep track of outstanding handlers.
 	handlers *sync.WaitGroup
 	// Pool for buffers
 	pool sync.Pool
-}
-
-func proxyProtoHeader(c net.Conn) *proxyproto.Header {
-	return &proxyproto.Header{
-		Version:           2,
-		Command:           proxyproto.PROXY,
-		TransportProtocol: proxyproto.TCPv4,
-		SourceAddr:        c.RemoteAddr(),
-		DestinationAddr:   c.LocalAddr(),
-	}
+	// Accept multiplexed sessions, if set (see SetMultiplex).
+	multiplex *mux.Options
+	// Multiplexed sessions that are being served, drained on shutdown.
+	sessions map[*mux.Session]struct{}
+	// Serve HTTP requests rather than copying bytes, if set (see SetHTTP).
+	httpOpts *HTTPOptions
+	// Connections that are being served in HTTP mode, drained on shutdown.
+	httpConns map[*httpConn]struct{}
+	// Accept WebSocket upgrades, if set (see SetWebSocket).
+	websocket *websocket.Options
+	// Protects timeouts and settings that can be changed at runtime.
+	mu sync.RWMutex
 }
 
 // New creates a new proxy.
@@ -107,16 +143,18 @@ func New(
 	proxyProtocol bool) *Proxy {
 
 	p := &Proxy{
-		Listener:        listener,
-		ConnectTimeout:  connectTimeout,
-		CloseTimeout:    closeTimeout,
-		MaxConnLifetime: maxConnLifetime,
-		Dial:            dial,
-		Logger:          logger,
-		quit:            0,
-		loggerFlags:     loggerFlags,
-		proxyProtocol:   proxyProtocol,
-		handlers:        &sync.WaitGroup{},
+		Listener:             listener,
+		ConnectTimeout:       connectTimeout,
+		CloseTimeout:         closeTimeout,
+		MaxConnLifetime:      maxConnLifetime,
+		Dial:                 dial,
+		Logger:               logger,
+		quit:                 0,
+		done:                 make(chan struct{}),
+		loggerFlags:          loggerFlags,
+		proxyProtocol:        proxyProtocol,
+		proxyProtocolVersion: ProxyProtocolV2,
+		handlers:             &sync.WaitGroup{},
 		pool: sync.Pool{
 			New: func() any {
 				b := make([]byte, 1<<15 /* 32 KiB */)
@@ -133,13 +171,81 @@ func New(
 	return p
 }
 
+// SetTimeouts updates the connect/close timeouts and max connection lifetime.
+// It is safe to call while the proxy is running. Connections that are already
+// established keep the max lifetime they were opened with.
+func (p *Proxy) SetTimeouts(connectTimeout, closeTimeout, maxConnLifetime time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ConnectTimeout = connectTimeout
+	p.CloseTimeout = closeTimeout
+	p.MaxConnLifetime = maxConnLifetime
+}
+
+// SetProxyProtocol enables or disables the PROXY protocol for new connections.
+// It is safe to call while the proxy is running.
+func (p *Proxy) SetProxyProtocol(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proxyProtocol = enabled
+}
+
+// SetProxyProtocolVersion sets the version of the PROXY protocol to use for
+// new connections (ProxyProtocolV1 or ProxyProtocolV2, the default). Only v2
+// headers carry information about the TLS session.
+// It is safe to call while the proxy is running.
+func (p *Proxy) SetProxyProtocolVersion(version int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proxyProtocolVersion = version
+}
+
+// SetConnTimeouts updates the handshake, dial and idle timeouts. It is safe
+// to call while the proxy is running. Connections that are already
+// established keep the idle timeout they were opened with.
+func (p *Proxy) SetConnTimeouts(handshakeTimeout, dialTimeout, idleTimeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.HandshakeTimeout = handshakeTimeout
+	p.DialTimeout = dialTimeout
+	p.IdleTimeout = idleTimeout
+}
+
+func (p *Proxy) timeouts() (connectTimeout, closeTimeout, maxConnLifetime time.Duration) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ConnectTimeout, p.CloseTimeout, p.MaxConnLifetime
+}
+
+func (p *Proxy) connTimeouts() (handshakeTimeout, dialTimeout, idleTimeout time.Duration) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	handshakeTimeout = p.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = p.ConnectTimeout
+	}
+	return handshakeTimeout, p.DialTimeout, p.IdleTimeout
+}
+
+// Returns the version of the PROXY protocol to use, or zero if disabled.
+func (p *Proxy) useProxyProtocol() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.proxyProtocol {
+		return 0
+	}
+	return p.proxyProtocolVersion
+}
+
 // Shutdown tells the proxy to close the listener & stop accepting connections.
 func (p *Proxy) Shutdown() {
-	if atomic.LoadInt32(&p.quit) == 1 {
+	if !atomic.CompareAndSwapInt32(&p.quit, 0, 1) {
 		return
 	}
-	atomic.StoreInt32(&p.quit, 1)
+	close(p.done)
 	p.Listener.Close()
+	p.drainSessions()
+	p.drainHTTP()
 	p.handlers.Done()
 }
 
@@ -156,6 +262,11 @@ func (p *Proxy) Wait() {
 // Run this in a Goroutine, call Wait() to block on proxy shutdown/connection drain.
 func (p *Proxy) Accept() {
 	for {
+		// Pause while we're at the connection limit
+		if !p.waitForLimits() {
+			return
+		}
+
 		// Wait for new connection
 		conn, err := p.Listener.Accept()
 		if err != nil {
@@ -168,60 +279,162 @@ func (p *Proxy) Accept() {
 			continue
 		}
 
+		// Don't look at the remote address here: with PROXY protocol, it is
+		// only known once the header arrives, which would block the loop.
+		release, err := p.acquireConnection()
+		if err != nil {
+			p.logConditional(LogHandshakeErrors, "rejected connection: %s", err)
+			_ = conn.Close()
+			continue
+		}
+
 		openCounter.Inc(1)
 		totalCounter.Inc(1)
 
 		go connTimer.Time(func() {
+			defer release()
 			defer conn.Close()
 			defer openCounter.Dec(1)
 
-			err := forceHandshake(p.ConnectTimeout, conn)
+			releaseAddr, err := p.acquireAddr(conn)
 			if err != nil {
-				errorCounter.Inc(1)
-				p.logConditional(LogHandshakeErrors, "error on TLS handshake from %s: %s", conn.RemoteAddr(), err)
+				p.logConditional(LogHandshakeErrors, "rejected connection from %s: %s", conn.RemoteAddr(), err)
 				return
 			}
+			defer releaseAddr()
 
-			backend, err := p.Dial()
+			handshakeTimeout, _, _ := p.connTimeouts()
+			err = p.handshake(handshakeTimeout, conn)
 			if err != nil {
-				p.logConditional(LogConnectionErrors, "error on dial: %s", err)
+				errorCounter.Inc(1)
+				p.logConditional(LogHandshakeErrors, "error on TLS handshake from %s: %s", conn.RemoteAddr(), err)
 				return
 			}
 
-			if p.proxyProtocol {
-				h := proxyProtoHeader(conn)
-				_, err = h.WriteTo(backend)
-				if err != nil {
-					p.logConditional(LogConnectionErrors, "error writing proxy header: %s", err)
-					return
-				}
+			if ws, err := p.upgradeWebSocket(conn, handshakeTimeout); err != nil {
+				errorCounter.Inc(1)
+				p.logConditional(LogHandshakeErrors, "error on WebSocket upgrade from %s: %s", conn.RemoteAddr(), err)
+				return
+			} else if ws != nil {
+				defer ws.Close()
+				p.handle(ws)
+				return
 			}
 
-			successCounter.Inc(1)
-			p.handlers.Add(1)
-			defer p.handlers.Done()
-			p.fuse(conn, backend)
+			if session, ok := p.multiplexed(conn); ok {
+				p.serveSession(session, conn)
+				return
+			}
+			p.handle(conn)
 		})
 	}
 }
 
+// Route, dial and fuse a (handshaked) connection with its backend.
+func (p *Proxy) handle(conn net.Conn) {
+	client, release, err := p.acquireQuota(conn)
+	if err != nil {
+		errorCounter.Inc(1)
+		p.logConditional(LogConnectionErrors, "rejected connection from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	defer release()
+
+	dial := p.Dial
+	if p.Route != nil {
+		dial, err = p.Route(conn)
+		if err != nil {
+			errorCounter.Inc(1)
+			p.logConditional(LogConnectionErrors, "error routing connection from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	if options := p.httpOptions(); options != nil {
+		successCounter.Inc(1)
+		p.handlers.Add(1)
+		defer p.handlers.Done()
+		p.serveHTTP(conn, dial, options)
+		return
+	}
+
+	backend, err := p.dialBackend(dial)
+	if err != nil {
+		p.logConditional(LogConnectionErrors, "error on dial: %s", err)
+		return
+	}
+
+	if version := p.useProxyProtocol(); version != 0 {
+		var h *proxyproto.Header
+		h, err = proxyProtoHeader(conn, version)
+		if err == nil {
+			_, err = h.WriteTo(backend)
+		}
+		if err != nil {
+			p.logConditional(LogConnectionErrors, "error writing proxy header: %s", err)
+			return
+		}
+	}
+
+	successCounter.Inc(1)
+	countProtocol(conn, backend)
+	p.handlers.Add(1)
+	defer p.handlers.Done()
+	p.fuse(conn, backend, client)
+}
+
+// Count connections by the protocol negotiated via ALPN, on the incoming
+// connection (server mode) or the backend connection (client mode).
+func countProtocol(conn, backend net.Conn) {
+	protocol := negotiatedProtocol(conn)
+	if protocol == "" {
+		protocol = negotiatedProtocol(backend)
+	}
+	if protocol != "" {
+		metrics.GetOrRegisterCounter("conn.alpn."+protocolMetricName(protocol), metrics.DefaultRegistry).Inc(1)
+	}
+}
+
+// Force the handshake of a connection, once there is a slot for it under the
+// handshake limits.
+func (p *Proxy) handshake(timeout time.Duration, conn net.Conn) error {
+	if _, ok := conn.(handshaker); !ok {
+		return nil
+	}
+	start := time.Now()
+	release, err := p.acquireHandshake(timeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return forceHandshake(timeout-time.Since(start), conn)
+}
+
+// handshaker is implemented by *tls.Conn, *PassthroughConn and
+// *ForwardProxyConn.
+type handshaker interface {
+	net.Conn
+	Handshake() error
+}
+
 // Force handshake. Handshake usually happens on first read/write, but we want
 // to force it to make sure we can control the timeout for it. Otherwise,
 // unauthenticated clients would be able to open connections and leave them
 // hanging forever. Going through the handshake verifies that clients have a
-// valid client cert and are allowed to talk to us.
+// valid client cert and are allowed to talk to us. For passthrough
+// connections, this reads the ClientHello instead.
 func forceHandshake(timeout time.Duration, conn net.Conn) error {
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	if hsConn, ok := conn.(handshaker); ok {
 		startTime := time.Now()
 		defer handshakeTimer.UpdateSince(startTime)
 
 		// Set deadline to avoid blocking forever
-		err := tlsConn.SetDeadline(time.Now().Add(timeout))
+		err := hsConn.SetDeadline(time.Now().Add(timeout))
 		if err != nil {
 			return err
 		}
 
-		err = tlsConn.Handshake()
+		err = hsConn.Handshake()
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			// If we timed out, increment timeout metric
 			handshakeTimeoutCounter.Inc(1)
@@ -232,7 +445,7 @@ func forceHandshake(timeout time.Duration, conn net.Conn) error {
 		}
 
 		// Success: clear deadline
-		err = tlsConn.SetDeadline(time.Time{})
+		err = hsConn.SetDeadline(time.Time{})
 		if err != nil {
 			return err
 		}
@@ -241,16 +454,62 @@ func forceHandshake(timeout time.Duration, conn net.Conn) error {
 	return nil
 }
 
-// Fuse connections together
-func (p *Proxy) fuse(client, backend net.Conn) {
+// Dial a backend, giving up once the dial timeout (if set) expires. Dialers
+// have timeouts of their own for each attempt, but may make several (e.g.
+// failing over between targets). Backends that are dialed after we gave up
+// are closed.
+func (p *Proxy) dialBackend(dial Dialer) (net.Conn, error) {
+	_, dialTimeout, _ := p.connTimeouts()
+	if dialTimeout == 0 {
+		backend, err := dial()
+		countDialTimeout(err)
+		return backend, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(dialTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		countDialTimeout(r.err)
+		return r.conn, r.err
+	case <-timer.C:
+		dialTimeoutCounter.Inc(1)
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %s", dialTimeout)
+	}
+}
+
+func countDialTimeout(err error) {
+	if isTimeout(err) {
+		dialTimeoutCounter.Inc(1)
+	}
+}
+
+// Fuse connections together, with the rate limits of the proxy and the quota
+// of the client (if any).
+func (p *Proxy) fuse(client, backend net.Conn, quota *clientQuota) {
 	// Copy from client -> backend, and from backend -> client
 	start := time.Now()
 	p.logConnectionMessage("opening", client, backend, -1, -1, time.Time{})
 
 	// If set by user, set max conn lifetime for client/backend.
-	if p.MaxConnLifetime > 0 {
-		setDeadline(client, p.MaxConnLifetime)
-		setDeadline(backend, p.MaxConnLifetime)
+	if _, _, maxConnLifetime := p.timeouts(); maxConnLifetime > 0 {
+		setDeadline(client, maxConnLifetime)
+		setDeadline(backend, maxConnLifetime)
 	}
 
 	// For TCP and UNIX sockets, copyData calls closeRead and closeWrite for the
@@ -262,18 +521,28 @@ func (p *Proxy) fuse(client, backend net.Conn) {
 		_ = backend.Close()
 	}()
 
+	// If set, interrupt reads once no data was read from either side for
+	// the idle timeout.
+	var idle *idleTimer
+	if _, _, idleTimeout := p.connTimeouts(); idleTimeout > 0 {
+		idle = newIdleTimer(idleTimeout, client, backend)
+		defer idle.stop()
+	}
+
+	read, write := p.connRateLimits(quota)
 	returnedC := make(chan int64)
 	go func() {
-		returnedC <- p.copyData(client, backend)
+		returnedC <- p.copyData(client, backend, idle, write...)
 	}()
-	forwarded := p.copyData(backend, client)
+	forwarded := p.copyData(backend, client, idle, read...)
 	returned := <-returnedC
 
 	p.logConnectionMessage("closed", client, backend, forwarded, returned, start)
 }
 
-// Copy data between two connections
-func (p *Proxy) copyData(dst net.Conn, src net.Conn) (written int64) {
+// Copy data between two connections, reading from src no faster than the
+// given limits allow. Reads reset the idle timer of the connection, if any.
+func (p *Proxy) copyData(dst net.Conn, src net.Conn, idle *idleTimer, limits ...bandwidthLimit) (written int64) {
 	// When we're done copying the data, we close the read/write sides of the
 	// src/dst respectively. This uses the shutdown system call to send a FIN
 	// packet to the other end of the connection. By only closing the read/write
@@ -290,16 +559,25 @@ func (p *Proxy) copyData(dst net.Conn, src net.Conn) (written int64) {
 	//
 	// See: https://github.com/golang/go/issues/67337#issuecomment-2123352634
 	defer func() {
+		_, closeTimeout, _ := p.timeouts()
 		closeRead(src)
 		closeWrite(dst)
-		setDeadline(src, p.CloseTimeout)
-		setDeadline(dst, p.CloseTimeout)
+		setDeadline(src, closeTimeout)
+		setDeadline(dst, closeTimeout)
 	}()
 
 	// Get a buffer for copy from the pool of shared buffers, to reduce allocs.
 	buf := p.pool.Get().(*[]byte)
 	defer p.pool.Put(buf)
 
+	var reader io.Reader = src
+	if idle != nil {
+		reader = &idleReader{conn: src, timer: idle}
+	}
+
+	// If set, pace reads to the rate limits.
+	reader = newRateLimitedReader(reader, limits...)
+
 	// Note: We wrap src and dst in io.Writer and io.Reader structs respectively,
 	// to hide the WriteTo and ReadFrom functions on TCPConn and UnixConn.
 	//
@@ -322,13 +600,18 @@ func (p *Proxy) copyData(dst net.Conn, src net.Conn) (written int64) {
 	// See: https://github.com/golang/go/issues/67074
 	written, err := io.CopyBuffer(
 		struct{ io.Writer }{dst},
-		struct{ io.Reader }{src},
+		struct{ io.Reader }{reader},
 		*buf)
 
-	if err != nil && !isClosedConnectionError(err) {
+	if idle != nil && idle.expired() && isTimeout(err) {
+		// Both directions time out, log the connection once.
+		if idle.report() {
+			p.logConditional(LogConnectionErrors, "closing connection from %s: idle for %s", src.RemoteAddr(), idle.timeout)
+		}
+	} else if err != nil && !isClosedConnectionError(err) {
 		// We don't log individual "read from closed connection" errors, because
 		// we already have a log statement showing that a pipe has been closed.
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if isTimeout(err) {
 			connTimeoutCounter.Inc(1)
 		}
 		p.logConditional(LogConnectionErrors, "error during copy: %s", err)
@@ -347,10 +630,10 @@ func (p *Proxy) logConnectionMessage(action string, dst net.Conn, src net.Conn,
 		action,
 		dst.RemoteAddr().Network(),
 		dst.RemoteAddr().String(),
-		peerCertificatesString(dst),
+		peerInfoString(dst),
 		src.RemoteAddr().Network(),
 		src.RemoteAddr().String(),
-		peerCertificatesString(src),
+		peerInfoString(src),
 		connStatsString(forwarded, returned, time.Since(start)),
 	)
 }
@@ -361,6 +644,11 @@ func (p *Proxy) logConditional(flag int, msg string, args ...interface{}) {
 	}
 }
 
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func isClosedConnectionError(err error) bool {
 	opErr := &net.OpError{}
 	if errors.As(err, &opErr) {
@@ -370,8 +658,23 @@ func isClosedConnectionError(err error) bool {
 	return strings.Contains(err.Error(), "closed pipe")
 }
 
+// wrappedConn is implemented by connections that wrap another connection
+// (e.g. to keep track of open backend connections), so that we can still
+// half-close the underlying socket.
+type wrappedConn interface {
+	Unwrap() net.Conn
+}
+
 func closeRead(conn net.Conn) {
 	switch c := conn.(type) {
+	case wrappedConn:
+		closeRead(c.Unwrap())
+	case *proxyproto.Conn:
+		closeRead(c.Raw())
+	case *mux.Stream:
+		_ = c.CloseRead()
+	case *quic.Stream:
+		_ = c.CloseRead()
 	case *net.TCPConn:
 		_ = c.CloseRead()
 	case *net.UnixConn:
@@ -383,6 +686,14 @@ func closeRead(conn net.Conn) {
 
 func closeWrite(conn net.Conn) {
 	switch c := conn.(type) {
+	case wrappedConn:
+		closeWrite(c.Unwrap())
+	case *proxyproto.Conn:
+		closeWrite(c.Raw())
+	case *mux.Stream:
+		_ = c.CloseWrite()
+	case *quic.Stream:
+		_ = c.CloseWrite()
 	case *net.TCPConn:
 		_ = c.CloseWrite()
 	case *net.UnixConn:
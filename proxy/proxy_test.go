@@ -24,6 +24,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -98,6 +99,51 @@ func TestProxySuccess(t *testing.T) {
 	p.Wait()
 }
 
+func TestProxyRoute(t *testing.T) {
+	// Incoming listener
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dialer := func() (net.Conn, error) {
+		return nil, errors.New("should use dialer from router")
+	}
+
+	var routed int32
+	p := New(incoming, 10*time.Second, 10*time.Second, 10*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.Route = func(conn net.Conn) (Dialer, error) {
+		if atomic.AddInt32(&routed, 1) > 1 {
+			return nil, errors.New("rejected")
+		}
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", target.Addr().String())
+		}, nil
+	}
+	go p.Accept()
+	defer p.Shutdown()
+
+	// First connection is routed to target
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	// Second connection is rejected by router
+	rejected, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer rejected.Close()
+
+	_ = rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = rejected.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "rejected connection should be closed")
+}
+
 func TestProxyProtocolSuccess(t *testing.T) {
 	// Incoming listener
 	incoming, err := net.Listen("tcp", "127.0.0.1:0")
@@ -205,7 +251,7 @@ func TestCopyData(t *testing.T) {
 	}()
 
 	go func() {
-		proxy.copyData(dstIn, srcOut)
+		proxy.copyData(dstIn, srcOut, nil)
 	}()
 
 	input := make([]byte, size)
@@ -228,3 +274,145 @@ func TestCopyData(t *testing.T) {
 		t.Fatalf("input and output were different after copy")
 	}
 }
+
+func TestBackendDialTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Backend that never finishes dialing in time
+	dialed := make(chan net.Conn, 1)
+	dialer := func() (net.Conn, error) {
+		time.Sleep(time.Second)
+		in, out := net.Pipe()
+		dialed <- out
+		return in, nil
+	}
+
+	p := New(ln, 10*time.Second, 10*time.Second, 0, dialer, &testLogger{}, LogEverything, false)
+	p.SetConnTimeouts(0, 100*time.Millisecond, 0)
+	go p.Accept()
+	defer p.Shutdown()
+
+	before := dialTimeoutCounter.Count()
+	src, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	_ = src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = src.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "should close connection once dial times out")
+	assert.Equal(t, before+1, dialTimeoutCounter.Count(), "should count dial timeout")
+
+	// The backend dialed after the timeout is closed.
+	backend := <-dialed
+	_ = backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = backend.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "should close backend dialed after timeout")
+
+	p.Shutdown()
+	p.Wait()
+}
+
+func TestIdleTimeoutOneWay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(ln, 10*time.Second, 100*time.Millisecond, 0, dialer, &testLogger{}, LogEverything, false)
+	p.SetConnTimeouts(0, 0, 300*time.Millisecond)
+	go p.Accept()
+	defer p.Shutdown()
+
+	before := idleTimeoutCounter.Count()
+	src, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	// The target streams data for longer than the idle timeout, while the
+	// client doesn't send anything.
+	received := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		_, err = dst.Write([]byte("B"))
+		assert.Nil(t, err, "should be able to write to target")
+		_ = src.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(src, received)
+		assert.Nil(t, err, "should receive data from proxy while streaming")
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, before, idleTimeoutCounter.Count(), "should not time out while one side streams")
+
+	// The client can still send once the stream is done.
+	_, err = src.Write([]byte("A"))
+	assert.Nil(t, err, "should be able to write to proxy")
+	_ = dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(dst, received)
+	assert.Nil(t, err, "should receive data on target after stream")
+
+	// Without traffic either way, the connection is closed.
+	_ = src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(src)
+	assert.Nil(t, err, "should close idle connection")
+	assert.Equal(t, before+1, idleTimeoutCounter.Count(), "should count idle timeout once")
+
+	p.Shutdown()
+	p.Wait()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(ln, 10*time.Second, 100*time.Millisecond, 0, dialer, &testLogger{}, LogEverything, false)
+	p.SetConnTimeouts(0, 0, 300*time.Millisecond)
+	go p.Accept()
+	defer p.Shutdown()
+
+	before := idleTimeoutCounter.Count()
+	src, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	// Traffic resets the timeout.
+	received := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		_, err = src.Write([]byte("A"))
+		assert.Nil(t, err, "should be able to write to proxy")
+		_ = dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(dst, received)
+		assert.Nil(t, err, "should receive data on target")
+
+		_, err = dst.Write([]byte("B"))
+		assert.Nil(t, err, "should be able to write to target")
+		_ = src.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(src, received)
+		assert.Nil(t, err, "should receive data from proxy")
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, before, idleTimeoutCounter.Count(), "should not time out while there is traffic")
+
+	// Without traffic, the connection is closed.
+	_ = src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(src)
+	assert.Nil(t, err, "should close idle connection")
+	assert.Less(t, before, idleTimeoutCounter.Count(), "should count idle timeout")
+
+	p.Shutdown()
+	p.Wait()
+}
@@ -0,0 +1,139 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/ghostunnel/ghostunnel/quic"
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+)
+
+const (
+	// TLVTypeSPIFFEID is the custom PROXY protocol v2 TLV type that carries
+	// the SPIFFE ID of the client (i.e. its first spiffe:// URI SAN).
+	TLVTypeSPIFFEID proxyproto.PP2Type = 0xE0
+	// TLVTypeURISAN is the custom PROXY protocol v2 TLV type that carries a
+	// URI SAN of the client certificate. There's one TLV per URI SAN.
+	TLVTypeURISAN proxyproto.PP2Type = 0xE1
+)
+
+// Versions of the PROXY protocol.
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+// Build the PROXY protocol header for a connection. The address family is
+// derived from the addresses of the connection, connections over other
+// transports get a LOCAL (v2) or UNKNOWN (v1) header. For TLS connections,
+// v2 headers carry information about the TLS session and client certificate
+// as TLVs. Streams of QUIC connections are reported as TCP connections, as
+// they are streams to the target.
+func proxyProtoHeader(c net.Conn, version int) (*proxyproto.Header, error) {
+	source, destination := c.RemoteAddr(), c.LocalAddr()
+	if _, ok := c.(*quic.Stream); ok {
+		source, destination = streamAddr(source), streamAddr(destination)
+	}
+	h := proxyproto.HeaderProxyFromAddrs(byte(version), source, destination)
+	if h.Version != ProxyProtocolV2 {
+		return h, nil
+	}
+
+	tlsConn, ok := c.(tlsStateConn)
+	if !ok {
+		return h, nil
+	}
+	tlvs, err := tlsTLVs(tlsConn.ConnectionState())
+	if err != nil {
+		return nil, err
+	}
+	if err := h.SetTLVs(tlvs); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func streamAddr(addr net.Addr) net.Addr {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: udp.IP, Port: udp.Port, Zone: udp.Zone}
+	}
+	return addr
+}
+
+// TLVs describing a TLS session: a PP2_TYPE_SSL TLV with the version, cipher
+// suite and client certificate CN, and custom TLVs with the URI SANs of the
+// client certificate.
+func tlsTLVs(state tls.ConnectionState) ([]proxyproto.TLV, error) {
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		// Non-zero unless the client presented a certificate that was
+		// verified. We only get here after a successful handshake, so any
+		// certificate presented by the client passed verification.
+		Verify: 1,
+		TLV: []proxyproto.TLV{
+			{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte(tlsVersionName(state.Version))},
+			{Type: proxyproto.PP2_SUBTYPE_SSL_CIPHER, Value: []byte(tls.CipherSuiteName(state.CipherSuite))},
+		},
+	}
+
+	var tlvs []proxyproto.TLV
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		ssl.Verify = 0
+		ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_SESS
+		if !state.DidResume {
+			ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN
+		}
+		if cert.Subject.CommonName != "" {
+			ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_CN, Value: []byte(cert.Subject.CommonName)})
+		}
+
+		spiffeID := ""
+		for _, uri := range cert.URIs {
+			if spiffeID == "" && uri.Scheme == "spiffe" {
+				spiffeID = uri.String()
+			}
+			tlvs = append(tlvs, proxyproto.TLV{Type: TLVTypeURISAN, Value: []byte(uri.String())})
+		}
+		if spiffeID != "" {
+			tlvs = append([]proxyproto.TLV{{Type: TLVTypeSPIFFEID, Value: []byte(spiffeID)}}, tlvs...)
+		}
+	}
+
+	sslTLV, err := ssl.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]proxyproto.TLV{sslTLV}, tlvs...), nil
+}
+
+// Name of a TLS version, in the format used by OpenSSL (and HAProxy).
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return tls.VersionName(version)
+	}
+}
@@ -0,0 +1,236 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+	"github.com/stretchr/testify/assert"
+)
+
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestProxyProtoHeaderFamilies(t *testing.T) {
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+
+	for _, c := range []struct {
+		name          string
+		local, remote net.Addr
+		transport     proxyproto.AddressFamilyAndProtocol
+		command       proxyproto.ProtocolVersionAndCommand
+		v1            string
+	}{
+		{
+			name:      "tcp4",
+			local:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8443},
+			remote:    &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234},
+			transport: proxyproto.TCPv4,
+			command:   proxyproto.PROXY,
+			v1:        "PROXY TCP4 10.0.0.2 10.0.0.1 1234 8443\r\n",
+		},
+		{
+			name:      "tcp6",
+			local:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8443},
+			remote:    &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1234},
+			transport: proxyproto.TCPv6,
+			command:   proxyproto.PROXY,
+			v1:        "PROXY TCP6 2001:db8::2 2001:db8::1 1234 8443\r\n",
+		},
+		{
+			name:      "unix",
+			local:     &net.UnixAddr{Name: "/tmp/ghostunnel.sock", Net: "unix"},
+			remote:    &net.UnixAddr{Name: "", Net: "unix"},
+			transport: proxyproto.UnixStream,
+			command:   proxyproto.PROXY,
+			v1:        "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:      "unknown",
+			local:     pipe.LocalAddr(),
+			remote:    pipe.RemoteAddr(),
+			transport: proxyproto.UNSPEC,
+			command:   proxyproto.LOCAL,
+			v1:        "PROXY UNKNOWN\r\n",
+		},
+	} {
+		conn := addrConn{Conn: pipe, local: c.local, remote: c.remote}
+
+		h, err := proxyProtoHeader(conn, ProxyProtocolV2)
+		assert.Nil(t, err, "%s: should be able to build v2 header", c.name)
+		assert.Equal(t, c.transport, h.TransportProtocol, c.name)
+		assert.Equal(t, c.command, h.Command, c.name)
+		_, err = h.Format()
+		assert.Nil(t, err, "%s: should be able to format v2 header", c.name)
+
+		h, err = proxyProtoHeader(conn, ProxyProtocolV1)
+		assert.Nil(t, err, "%s: should be able to build v1 header", c.name)
+		formatted, err := h.Format()
+		assert.Nil(t, err, "%s: should be able to format v1 header", c.name)
+		assert.Equal(t, c.v1, string(formatted), c.name)
+	}
+}
+
+func TestStreamAddr(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8443}
+	assert.Equal(t, &net.TCPAddr{IP: udp.IP, Port: 8443}, streamAddr(udp), "should report QUIC peers as TCP")
+
+	unix := &net.UnixAddr{Name: "/tmp/ghostunnel.sock", Net: "unix"}
+	assert.Equal(t, unix, streamAddr(unix), "should keep other addresses")
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	serverCert := testCertificate(t)
+	clientCert, clientLeaf := testClientCertificate(t, "client",
+		"spiffe://example.org/client", "https://example.org/client")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientLeaf)
+
+	// Incoming listener, requires a client cert
+	incoming, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(incoming, 10*time.Second, 10*time.Second, 10*time.Second, dialer, &testLogger{}, LogEverything, true)
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := tls.Dial("tcp", incoming.Addr().String(), &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	assert.Nil(t, err, "should be able to dial into proxy")
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+	_ = dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	header, err := proxyproto.Read(bufio.NewReader(dst))
+	assert.Nil(t, err, "should be able to read header")
+	if err != nil {
+		return
+	}
+	assert.Equal(t, uint8(2), header.Version)
+	assert.Equal(t, proxyproto.TCPv4, header.TransportProtocol)
+
+	tlvs, err := header.TLVs()
+	assert.Nil(t, err, "should be able to parse TLVs")
+
+	ssl, ok := tlvparse.FindSSL(tlvs)
+	assert.True(t, ok, "should have PP2_TYPE_SSL TLV")
+	assert.True(t, ssl.ClientSSL(), "client should be marked as TLS")
+	assert.True(t, ssl.ClientCertConn(), "client should be marked as having presented a cert")
+	assert.True(t, ssl.Verified(), "client cert should be marked as verified")
+	version, _ := ssl.SSLVersion()
+	assert.Equal(t, "TLSv1.2", version)
+	cipher, _ := ssl.SSLCipher()
+	assert.Equal(t, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", cipher)
+	cn, _ := ssl.ClientCN()
+	assert.Equal(t, "client", cn)
+
+	custom := map[proxyproto.PP2Type][]string{}
+	for _, tlv := range tlvs {
+		if tlv.Type.App() {
+			custom[tlv.Type] = append(custom[tlv.Type], string(tlv.Value))
+		}
+	}
+	assert.Equal(t, []string{"spiffe://example.org/client"}, custom[TLVTypeSPIFFEID])
+	assert.Equal(t, []string{"spiffe://example.org/client", "https://example.org/client"}, custom[TLVTypeURISAN])
+}
+
+func TestTLSTLVsWithoutClientCert(t *testing.T) {
+	tlvs, err := tlsTLVs(tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+	})
+	assert.Nil(t, err, "should be able to build TLVs")
+
+	ssl, ok := tlvparse.FindSSL(tlvs)
+	assert.True(t, ok, "should have PP2_TYPE_SSL TLV")
+	assert.True(t, ssl.ClientSSL(), "client should be marked as TLS")
+	assert.False(t, ssl.ClientCertConn(), "client should not be marked as having presented a cert")
+	assert.False(t, ssl.Verified(), "client should not be marked as verified")
+	version, _ := ssl.SSLVersion()
+	assert.Equal(t, "TLSv1.3", version)
+	_, ok = ssl.ClientCN()
+	assert.False(t, ok, "should not have a client CN")
+	assert.Len(t, tlvs, 1, "should not have custom TLVs")
+}
+
+func testClientCertificate(t *testing.T, cn string, uris ...string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		assert.Nil(t, err, "should be able to parse URI")
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+	leaf, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "should be able to parse certificate")
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, leaf
+}
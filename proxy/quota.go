@@ -0,0 +1,198 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	quotaRateCounter        = metrics.GetOrRegisterCounter("quota.rejected.rate", metrics.DefaultRegistry)
+	quotaConnectionsCounter = metrics.GetOrRegisterCounter("quota.rejected.connections", metrics.DefaultRegistry)
+	quotaErrorCounter       = metrics.GetOrRegisterCounter("quota.rejected.error", metrics.DefaultRegistry)
+)
+
+// Identities without open connections are dropped once their token bucket
+// is full again, at most this often.
+const quotaSweepInterval = time.Minute
+
+// Quota limits the connections of a single client identity. Zero values mean
+// no limit.
+type Quota struct {
+	// Rate of new connections per second. Bursts of up to Burst connections
+	// are allowed on top of it.
+	Rate float64
+	// Burst defaults to the rate (rounded up), if zero.
+	Burst int
+	// MaxConnections is the number of concurrently open connections.
+	MaxConnections int
+	// Read and Write limit the data read from and written to all
+	// connections of the identity together.
+	Read, Write Bandwidth
+}
+
+func (q Quota) burst() float64 {
+	if q.Burst > 0 {
+		return float64(q.Burst)
+	}
+	return math.Max(1, math.Ceil(q.Rate))
+}
+
+// Quotas limit connections per client identity, once the client has been
+// authenticated. Connections without an identity (e.g. without a client
+// certificate) aren't subject to quotas.
+type Quotas struct {
+	// Identity returns the key to apply quotas by for the certificate of a
+	// client, e.g. its CN or SPIFFE ID. An empty key means no identity, an
+	// error rejects the connection.
+	Identity func(cert *x509.Certificate) (string, error)
+	// Default quota for identities without an override.
+	Default Quota
+	// Overrides replace the default quota for specific identities.
+	Overrides map[string]Quota
+}
+
+func (q *Quotas) quota(identity string) Quota {
+	if quota, ok := q.Overrides[identity]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+// State of the quotas of all identities, kept when quotas change.
+type quotaState struct {
+	mu         sync.Mutex
+	identities map[string]*identityState
+	swept      time.Time
+}
+
+type identityState struct {
+	open   int
+	bucket tokenBucket
+	// Quota the bucket was last used with, to tell when it's full.
+	quota Quota
+	// Bandwidth limiters shared by the connections of the identity.
+	read, write bandwidthLimiter
+}
+
+// Take a slot for a connection of the identity, or return the reason the
+// quota rejects it.
+func (s *quotaState) acquire(identity string, quota Quota, now time.Time) (*identityState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.identities == nil {
+		s.identities = map[string]*identityState{}
+	}
+	s.sweep(now)
+
+	state, ok := s.identities[identity]
+	if !ok {
+		state = &identityState{}
+		s.identities[identity] = state
+	}
+	state.quota = quota
+
+	if quota.MaxConnections > 0 && state.open >= quota.MaxConnections {
+		quotaConnectionsCounter.Inc(1)
+		return nil, fmt.Errorf("quota exceeded for %s: too many open connections (limit %d)", identity, quota.MaxConnections)
+	}
+	if quota.Rate > 0 && !state.bucket.take(now, quota.Rate, quota.burst(), 1) {
+		quotaRateCounter.Inc(1)
+		return nil, fmt.Errorf("quota exceeded for %s: too many new connections (rate %g/s, burst %g)", identity, quota.Rate, quota.burst())
+	}
+	state.open++
+	return state, nil
+}
+
+func (s *quotaState) release(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.identities[identity]; ok {
+		state.open--
+	}
+}
+
+// Drop identities that have no open connections and a full bucket, so that
+// clients that went away don't take up memory. Must be called with mu held.
+func (s *quotaState) sweep(now time.Time) {
+	if now.Sub(s.swept) < quotaSweepInterval {
+		return
+	}
+	s.swept = now
+	for identity, state := range s.identities {
+		if state.open > 0 {
+			continue
+		}
+		if state.quota.Rate == 0 || state.bucket.full(now, state.quota.Rate, state.quota.burst()) {
+			delete(s.identities, identity)
+		}
+	}
+}
+
+// SetQuotas sets the quotas per client identity for new connections, or
+// disables them if nil. Connections and rates of identities are tracked
+// across changes. It is safe to call while the proxy is running.
+func (p *Proxy) SetQuotas(quotas *Quotas) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quotas = quotas
+}
+
+func (p *Proxy) getQuotas() *Quotas {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.quotas
+}
+
+// Quota of the client of a connection, and the state of its identity.
+type clientQuota struct {
+	quota Quota
+	state *identityState
+}
+
+// Take a slot for a (handshaked) connection under the quota of its client.
+// Returns the quota (nil if none applies) and a function to release it once
+// the connection is closed, or the reason for rejecting the connection.
+func (p *Proxy) acquireQuota(conn net.Conn) (*clientQuota, func(), error) {
+	quotas := p.getQuotas()
+	if quotas == nil || quotas.Identity == nil {
+		return nil, func() {}, nil
+	}
+	cert := peerCertificate(conn)
+	if cert == nil {
+		return nil, func() {}, nil
+	}
+	identity, err := quotas.Identity(cert)
+	if err != nil {
+		quotaErrorCounter.Inc(1)
+		return nil, nil, fmt.Errorf("unable to determine identity for quotas: %w", err)
+	}
+	if identity == "" {
+		return nil, func() {}, nil
+	}
+	quota := quotas.quota(identity)
+	state, err := p.quotaState.acquire(identity, quota, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	return &clientQuota{quota, state}, func() { p.quotaState.release(identity) }, nil
+}
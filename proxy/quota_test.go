@@ -0,0 +1,111 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Take a slot and return the error only.
+func tryAcquire(state *quotaState, identity string, quota Quota, now time.Time) error {
+	_, err := state.acquire(identity, quota, now)
+	return err
+}
+
+func TestQuotaMaxConnections(t *testing.T) {
+	var state quotaState
+	quota := Quota{MaxConnections: 2}
+	now := time.Now()
+	rejected := quotaConnectionsCounter.Count()
+
+	assert.Nil(t, tryAcquire(&state, "a", quota, now))
+	assert.Nil(t, tryAcquire(&state, "a", quota, now))
+	assert.NotNil(t, tryAcquire(&state, "a", quota, now), "third connection should be rejected")
+	assert.Nil(t, tryAcquire(&state, "b", quota, now), "other identities have quotas of their own")
+	assert.Equal(t, rejected+1, quotaConnectionsCounter.Count())
+
+	state.release("a")
+	assert.Nil(t, tryAcquire(&state, "a", quota, now), "should accept connection once one is closed")
+}
+
+func TestQuotaRate(t *testing.T) {
+	var state quotaState
+	quota := Quota{Rate: 2, Burst: 3}
+	now := time.Now()
+	rejected := quotaRateCounter.Count()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, tryAcquire(&state, "a", quota, now), "should allow burst")
+		state.release("a")
+	}
+	assert.NotNil(t, tryAcquire(&state, "a", quota, now), "should reject connections over burst")
+	assert.Equal(t, rejected+1, quotaRateCounter.Count())
+
+	// Tokens accrue at the rate, up to the burst.
+	now = now.Add(500 * time.Millisecond)
+	assert.Nil(t, tryAcquire(&state, "a", quota, now))
+	assert.NotNil(t, tryAcquire(&state, "a", quota, now))
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, tryAcquire(&state, "a", quota, now))
+	}
+	assert.NotNil(t, tryAcquire(&state, "a", quota, now))
+}
+
+func TestQuotaSweep(t *testing.T) {
+	var state quotaState
+	quota := Quota{Rate: 1}
+	now := time.Now()
+
+	assert.Nil(t, tryAcquire(&state, "idle", quota, now))
+	state.release("idle")
+	assert.Nil(t, tryAcquire(&state, "open", quota, now))
+
+	// Identities with open connections, or that are still limited, are kept.
+	now = now.Add(quotaSweepInterval)
+	state.swept = time.Time{}
+	assert.Nil(t, tryAcquire(&state, "other", quota, now))
+	assert.Len(t, state.identities, 2, "idle identity with full bucket should be dropped")
+	assert.Contains(t, state.identities, "open")
+}
+
+func TestQuotasOverrides(t *testing.T) {
+	quotas := &Quotas{
+		Default:   Quota{MaxConnections: 1},
+		Overrides: map[string]Quota{"batch": {Rate: 5}},
+	}
+	assert.Equal(t, Quota{MaxConnections: 1}, quotas.quota("other"))
+	assert.Equal(t, Quota{Rate: 5}, quotas.quota("batch"))
+	assert.Equal(t, float64(5), quotas.quota("batch").burst(), "burst should default to rate")
+	assert.Equal(t, float64(1), Quota{Rate: 0.1}.burst(), "burst should be at least one")
+}
+
+func TestQuotaBandwidthShared(t *testing.T) {
+	var state quotaState
+	quota := Quota{Read: Bandwidth{Rate: 100}}
+	now := time.Now()
+
+	first, err := state.acquire("a", quota, now)
+	assert.Nil(t, err)
+	second, err := state.acquire("a", quota, now)
+	assert.Nil(t, err)
+	assert.Same(t, first, second, "connections of an identity should share limiters")
+
+	assert.Equal(t, time.Duration(0), first.read.reserve(now, quota.Read, 100))
+	assert.Equal(t, time.Second, second.read.reserve(now, quota.Read, 100), "should wait once the shared bucket is empty")
+}
@@ -0,0 +1,155 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var throttledCounter = metrics.GetOrRegisterCounter("conn.throttled", metrics.DefaultRegistry)
+
+// Bandwidth limits a data rate, in bytes per second. Bursts of up to Burst
+// bytes are allowed on top of it. A zero rate means no limit.
+type Bandwidth struct {
+	Rate int64
+	// Burst defaults to the rate (i.e. one second worth of data), if zero.
+	Burst int64
+}
+
+func (b Bandwidth) burst() int64 {
+	if b.Burst > 0 {
+		return b.Burst
+	}
+	return b.Rate
+}
+
+// RateLimits limit the rate at which data is read from the clients of a
+// proxy (and forwarded to the backend), and written to them (after being
+// read from the backend). See Quota for limits per client identity.
+type RateLimits struct {
+	// Read and Write limit all connections of the proxy together.
+	Read, Write Bandwidth
+	// ReadPerConn and WritePerConn limit each connection.
+	ReadPerConn, WritePerConn Bandwidth
+}
+
+// bandwidthLimiter is a token bucket for a data rate that can be shared
+// between connections.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+// Take n bytes worth of tokens, and return how long to wait for them.
+func (l *bandwidthLimiter) reserve(now time.Time, bandwidth Bandwidth, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket.reserve(now, float64(bandwidth.Rate), float64(bandwidth.burst()), float64(n))
+}
+
+// A limiter, and the bandwidth to apply with it.
+type bandwidthLimit struct {
+	limiter   *bandwidthLimiter
+	bandwidth Bandwidth
+}
+
+// rateLimitedReader paces reads from a connection to the smallest of a set
+// of bandwidth limits. After each read, it waits until all limiters have
+// tokens for the data that was read. Reads are capped at the smallest burst,
+// so that a single read never waits for much more than a second's worth of
+// data.
+type rateLimitedReader struct {
+	reader io.Reader
+	limits []bandwidthLimit
+	chunk  int
+}
+
+// Wrap a reader with the given limits, skipping those without a rate. Returns
+// the reader itself if no limit applies.
+func newRateLimitedReader(reader io.Reader, limits ...bandwidthLimit) io.Reader {
+	r := &rateLimitedReader{reader: reader}
+	for _, limit := range limits {
+		if limit.bandwidth.Rate <= 0 {
+			continue
+		}
+		burst := int(min(limit.bandwidth.burst(), 1<<30))
+		if r.chunk == 0 || burst < r.chunk {
+			r.chunk = burst
+		}
+		r.limits = append(r.limits, limit)
+	}
+	if len(r.limits) == 0 {
+		return reader
+	}
+	return r
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > r.chunk {
+		b = b[:r.chunk]
+	}
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		var delay time.Duration
+		now := time.Now()
+		for _, limit := range r.limits {
+			delay = max(delay, limit.limiter.reserve(now, limit.bandwidth, n))
+		}
+		if delay > 0 {
+			throttledCounter.Inc(1)
+			time.Sleep(delay)
+		}
+	}
+	return n, err
+}
+
+// SetRateLimits sets the rate limits for new connections. Connections that
+// are already open keep the limits they were opened with, but share the
+// limiters for all connections with new ones. It is safe to call while the
+// proxy is running.
+func (p *Proxy) SetRateLimits(limits RateLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rateLimits = limits
+}
+
+func (p *Proxy) getRateLimits() RateLimits {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rateLimits
+}
+
+// Limits for the data read from a client and written to it, by the limits of
+// the proxy, the connection and its client identity (if any).
+func (p *Proxy) connRateLimits(client *clientQuota) (read, write []bandwidthLimit) {
+	limits := p.getRateLimits()
+	read = []bandwidthLimit{
+		{&p.readLimiter, limits.Read},
+		{&bandwidthLimiter{}, limits.ReadPerConn},
+	}
+	write = []bandwidthLimit{
+		{&p.writeLimiter, limits.Write},
+		{&bandwidthLimiter{}, limits.WritePerConn},
+	}
+	if client != nil {
+		read = append(read, bandwidthLimit{&client.state.read, client.quota.Read})
+		write = append(write, bandwidthLimit{&client.state.write, client.quota.Write})
+	}
+	return read, write
+}
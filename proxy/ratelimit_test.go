@@ -0,0 +1,116 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	var bucket tokenBucket
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), bucket.reserve(now, 100, 200, 150), "should allow burst")
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve(now, 100, 200, 100), "should wait for missing tokens")
+	assert.Equal(t, 1500*time.Millisecond, bucket.reserve(now, 100, 200, 100), "debt should add up")
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), bucket.reserve(now, 100, 200, 200), "should refill up to burst")
+	assert.Equal(t, 10*time.Millisecond, bucket.reserve(now, 100, 200, 1))
+}
+
+func TestRateLimitedReaderNoLimits(t *testing.T) {
+	reader := bytes.NewReader(nil)
+	assert.Equal(t, io.Reader(reader), newRateLimitedReader(reader), "should not wrap reader without limits")
+	assert.Equal(t, io.Reader(reader), newRateLimitedReader(reader, bandwidthLimit{&bandwidthLimiter{}, Bandwidth{}}))
+}
+
+func TestRateLimitedReaderChunks(t *testing.T) {
+	reader := newRateLimitedReader(bytes.NewReader(make([]byte, 1000)),
+		bandwidthLimit{&bandwidthLimiter{}, Bandwidth{Rate: 1 << 20, Burst: 100}},
+		bandwidthLimit{&bandwidthLimiter{}, Bandwidth{Rate: 1 << 20}},
+	)
+	n, err := reader.Read(make([]byte, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, n, "reads should be capped at the smallest burst")
+}
+
+func TestRateLimitedReaderPacing(t *testing.T) {
+	throttled := throttledCounter.Count()
+	reader := newRateLimitedReader(bytes.NewReader(make([]byte, 300)),
+		bandwidthLimit{&bandwidthLimiter{}, Bandwidth{Rate: 1000, Burst: 100}},
+	)
+
+	start := time.Now()
+	data, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	assert.Len(t, data, 300)
+	// The burst is free, the other 200 bytes take 200ms at 1000 bytes/s.
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Greater(t, throttledCounter.Count(), throttled)
+}
+
+func TestConnRateLimits(t *testing.T) {
+	p := &Proxy{}
+	p.SetRateLimits(RateLimits{
+		Read:        Bandwidth{Rate: 1},
+		ReadPerConn: Bandwidth{Rate: 2},
+	})
+
+	read1, write1 := p.connRateLimits(nil)
+	read2, _ := p.connRateLimits(nil)
+	require.Len(t, read1, 2)
+	require.Len(t, write1, 2)
+	assert.Same(t, read1[0].limiter, read2[0].limiter, "tunnel limiter should be shared")
+	assert.NotSame(t, read1[1].limiter, read2[1].limiter, "connection limiters should not be shared")
+	assert.Equal(t, int64(2), read1[1].bandwidth.Rate)
+
+	state := &identityState{}
+	read, write := p.connRateLimits(&clientQuota{Quota{Write: Bandwidth{Rate: 3}}, state})
+	require.Len(t, read, 3)
+	assert.Same(t, &state.write, write[2].limiter, "identity limiter should be used")
+	assert.Equal(t, int64(3), write[2].bandwidth.Rate)
+}
+
+func TestCopyDataRateLimited(t *testing.T) {
+	srcClient, src := net.Pipe()
+	dst, dstServer := net.Pipe()
+	limit := bandwidthLimit{&bandwidthLimiter{}, Bandwidth{Rate: 1000, Burst: 100}}
+
+	p := New(nil, 10*time.Second, 10*time.Second, 0, nil, &testLogger{}, LogEverything, false)
+	done := make(chan struct{})
+	go func() {
+		p.copyData(dst, src, nil, limit)
+		close(done)
+	}()
+	go func() {
+		srcClient.Write(make([]byte, 300))
+		srcClient.Close()
+	}()
+
+	start := time.Now()
+	data, err := io.ReadAll(dstServer)
+	require.Nil(t, err)
+	assert.Len(t, data, 300)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	<-done
+}
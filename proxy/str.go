@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -39,14 +41,99 @@ func connStatsString(forwarded, returned int64, open time.Duration) string {
 	return fmt.Sprintf("[forwarded %s, returned %s, open %s]", bytesWithUnit(forwarded), bytesWithUnit(returned), open.String())
 }
 
+// tlsStateConn is implemented by *tls.Conn, by WebSocket connections, and by
+// streams of multiplexed sessions and QUIC connections (which share the state
+// of the handshake of their connection).
+type tlsStateConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// peerCertificatesString describes the certificate of the peer of a TLS
+// connection (or a connection wrapping one, e.g. after STARTTLS).
 func peerCertificatesString(conn net.Conn) string {
-	if tlsConn, ok := conn.(*tls.Conn); ok {
-		if len(tlsConn.ConnectionState().PeerCertificates) > 0 {
-			return tlsConn.ConnectionState().PeerCertificates[0].Subject.String()
+	for {
+		switch c := conn.(type) {
+		case tlsStateConn:
+			if len(c.ConnectionState().PeerCertificates) > 0 {
+				return c.ConnectionState().PeerCertificates[0].Subject.String()
+			}
+			return "no cert"
+		case wrappedConn:
+			conn = c.Unwrap()
+		default:
+			return "no tls"
+		}
+	}
+}
+
+// peerCertificate returns the certificate of the peer of a TLS connection (or
+// a connection wrapping one), if any.
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	for {
+		switch c := conn.(type) {
+		case tlsStateConn:
+			if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+				return certs[0]
+			}
+			return nil
+		case wrappedConn:
+			conn = c.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// negotiatedProtocol returns the protocol negotiated via ALPN on a TLS
+// connection (or a connection wrapping one), if any.
+func negotiatedProtocol(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case tlsStateConn:
+			return c.ConnectionState().NegotiatedProtocol
+		case wrappedConn:
+			conn = c.Unwrap()
+		default:
+			return ""
 		}
+	}
+}
 
-		return "no cert"
+// peerInfoString describes the peer of a connection for logs, with the
+// negotiated protocol appended if ALPN was used. For passthrough
+// connections, it shows the server name and protocols from the ClientHello.
+func peerInfoString(conn net.Conn) string {
+	if pc, ok := conn.(*PassthroughConn); ok {
+		return passthroughString(pc)
+	}
+	if fc, ok := conn.(*ForwardProxyConn); ok {
+		return fmt.Sprintf("forward proxy (%s), destination %s", fc.Protocol(), fc.Destination())
 	}
+	info := peerCertificatesString(conn)
+	if protocol := negotiatedProtocol(conn); protocol != "" {
+		info += ", alpn " + protocol
+	}
+	return info
+}
 
-	return "no tls"
+// protocolMetricName turns a protocol name (e.g. "http/1.1") into a string
+// that can be used as part of a metric name (e.g. "http_1_1").
+func protocolMetricName(protocol string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, protocol)
+}
+
+func passthroughString(conn *PassthroughConn) string {
+	info := "passthrough, no sni"
+	if conn.ServerName() != "" {
+		info = "passthrough, sni " + conn.ServerName()
+	}
+	if protocols := conn.Protocols(); len(protocols) > 0 {
+		info += ", alpn offered " + strings.Join(protocols, " ")
+	}
+	return info
 }
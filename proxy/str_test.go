@@ -41,3 +41,22 @@ func TestBytesWithUnit(t *testing.T) {
 		}
 	}
 }
+
+func TestProtocolMetricName(t *testing.T) {
+	cases := []struct {
+		protocol string
+		expected string
+	}{
+		{"h2", "h2"},
+		{"http/1.1", "http_1_1"},
+		{"acme-tls/1", "acme-tls_1"},
+		{"x.y z", "x_y_z"},
+	}
+
+	for _, c := range cases {
+		result := protocolMetricName(c.protocol)
+		if result != c.expected {
+			t.Errorf("%s: got %s, wanted %s", c.protocol, result, c.expected)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/ghostunnel/ghostunnel/websocket"
+)
+
+// SetWebSocket enables (or, if nil, disables) accepting WebSocket upgrades
+// on new connections. Connections are only upgraded if the client negotiated
+// websocket.Protocol via ALPN, other clients are served as usual. It is safe
+// to call while the proxy is running.
+func (p *Proxy) SetWebSocket(options *websocket.Options) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.websocket = options
+}
+
+// Upgrade a connection to a WebSocket connection, if WebSocket upgrades are
+// enabled and the client negotiated them. Returns nil if the connection
+// isn't upgraded.
+func (p *Proxy) upgradeWebSocket(conn net.Conn, timeout time.Duration) (*websocket.Conn, error) {
+	p.mu.RLock()
+	options := p.websocket
+	p.mu.RUnlock()
+	if options == nil || mux.NegotiatedProtocol(conn) != websocket.Protocol {
+		return nil, nil
+	}
+	return websocket.Server(conn, *options, timeout)
+}
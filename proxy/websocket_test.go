@@ -0,0 +1,99 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyWebSocket(t *testing.T) {
+	// Incoming listener, negotiates WebSocket upgrades via ALPN
+	incoming, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{websocket.Protocol},
+	})
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener, echoes data until the client is done writing
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					_, _ = conn.Write(buf)
+				}
+			}()
+		}
+	}()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New(incoming, 10*time.Second, 10*time.Second, 10*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.SetWebSocket(&websocket.Options{Path: "/tunnel"})
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Clients that negotiate WebSocket are upgraded.
+	conn, err := tls.Dial("tcp", incoming.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{websocket.Protocol},
+	})
+	assert.Nil(t, err, "should be able to connect to proxy")
+	ws, err := websocket.Client(conn, "example.com", websocket.Options{Path: "/tunnel"}, 5*time.Second)
+	assert.Nil(t, err, "should be able to upgrade connection")
+	if err != nil {
+		return
+	}
+	assertEcho(t, ws, "hello")
+	ws.Close()
+
+	// Other clients are served as usual.
+	conn, err = tls.Dial("tcp", incoming.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	assert.Nil(t, err, "should be able to connect to proxy")
+	assertEcho(t, conn, "plain")
+	conn.Close()
+
+	p.Shutdown()
+	p.Wait()
+}
+
+func assertEcho(t *testing.T, conn net.Conn, message string) {
+	_, err := conn.Write([]byte(message))
+	assert.Nil(t, err, "should be able to write")
+
+	received := make([]byte, len(message))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should be able to read echo")
+	assert.Equal(t, message, string(received))
+}
@@ -0,0 +1,61 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/quic"
+	"github.com/ghostunnel/ghostunnel/socket"
+)
+
+// Open a QUIC listener on the UDP port of the given address (HOST:PORT) in
+// server mode. Clients are authenticated with the given TLS config during the
+// QUIC handshake, so rejected handshakes are logged by the listener rather
+// than the proxy.
+func openQUICListener(address string, serverConfig certloader.TLSServerConfig, timeout time.Duration, logger quic.Logger) (*quic.Listener, error) {
+	if !config.IsHostPort(address) {
+		return nil, fmt.Errorf("QUIC listeners must be HOST:PORT, not '%s'", address)
+	}
+	_, addr, _, err := socket.ParseAddress(address, false)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socket.OpenPacket(addr)
+	if err != nil {
+		return nil, err
+	}
+	return quic.Listen(conn, serverConfig, quicOptions(timeout, logger, proxy.LogHandshakeErrors))
+}
+
+// Create a QUIC client in client mode. New QUIC connections to targets are
+// logged like connections, unless silenced with --quiet.
+func newQUICClient(timeout time.Duration, logger quic.Logger) *quic.Client {
+	return quic.NewClient(quicOptions(timeout, logger, proxy.LogConnections))
+}
+
+// Options for QUIC listeners and clients, with the given logger if the given
+// kind of log messages isn't silenced with --quiet.
+func quicOptions(timeout time.Duration, logger quic.Logger, flag int) quic.Options {
+	options := quic.Options{HandshakeTimeout: timeout}
+	if proxyLoggerFlags(*quiet)&flag != 0 {
+		options.Logger = logger
+	}
+	return options
+}
@@ -0,0 +1,168 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+var errClientClosed = errors.New("QUIC client is closed")
+
+// Client keeps a QUIC connection to each server it dials, and opens a stream
+// on it for each connection. Connections are opened lazily, and opened again
+// if they fail (e.g. because the server restarted).
+type Client struct {
+	options Options
+
+	mu      sync.Mutex
+	targets []*target
+	closed  bool
+}
+
+// NewClient creates a client.
+func NewClient(options Options) *Client {
+	return &Client{options: options}
+}
+
+// Dialer returns a function that opens a stream to the server at the given
+// address (HOST:PORT). The TLS config is fetched for every handshake, so that
+// reloaded certificates are picked up.
+func (c *Client) Dialer(address string, config certloader.TLSClientConfig) func() (net.Conn, error) {
+	t := &target{client: c, address: address, config: config}
+	c.mu.Lock()
+	c.targets = append(c.targets, t)
+	c.mu.Unlock()
+	return t.dial
+}
+
+// Close stops the client from opening new streams. Connections are closed
+// once their open streams are done.
+func (c *Client) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	targets := c.targets
+	c.mu.Unlock()
+
+	for _, t := range targets {
+		t.drain()
+	}
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// target is a server dialed by a client, with its current connection.
+type target struct {
+	client  *Client
+	address string
+	config  certloader.TLSClientConfig
+
+	// Held while dialing, so that concurrent calls share a connection.
+	mu      sync.Mutex
+	session *session
+}
+
+// Open a stream to the server. If the connection fails to open a stream
+// (e.g. because the server went away), we drop it and try again once.
+func (t *target) dial() (net.Conn, error) {
+	options := t.client.options
+	for attempt := 0; ; attempt++ {
+		s, err := t.get()
+		if err != nil {
+			return nil, err
+		}
+		if !s.add() {
+			return nil, errClientClosed
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), options.handshakeTimeout())
+		stream, err := s.conn.OpenStreamSync(ctx)
+		cancel()
+		if err == nil {
+			_, err = stream.Write([]byte{streamHeader})
+			if err == nil {
+				return newStream(stream, s), nil
+			}
+			stream.CancelWrite(errorCodeInvalidStream)
+			stream.CancelRead(errorCodeInvalidStream)
+		}
+		s.done()
+		if attempt > 0 || !s.closed() {
+			return nil, err
+		}
+		options.logf("dropping QUIC connection to %s: %s", t.address, err)
+		t.drop(s)
+	}
+}
+
+// Get the current connection to the server, or dial a new one.
+func (t *target) get() (*session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client.isClosed() {
+		return nil, errClientClosed
+	}
+	if t.session != nil && !t.session.closed() {
+		return t.session, nil
+	}
+
+	config := t.config.GetClientConfig().Clone()
+	config.NextProtos = []string{Protocol}
+
+	options := t.client.options
+	ctx, cancel := context.WithTimeout(context.Background(), options.handshakeTimeout())
+	defer cancel()
+	conn, err := quicgo.DialAddr(ctx, t.address, config, options.config())
+	if err != nil {
+		return nil, err
+	}
+	if t.client.isClosed() {
+		_ = conn.CloseWithError(errorCodeShutdown, "")
+		return nil, errClientClosed
+	}
+	t.session = newSession(conn)
+	options.logf("opened QUIC connection to %s", conn.RemoteAddr())
+	return t.session, nil
+}
+
+func (t *target) drop(s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session == s {
+		t.session = nil
+	}
+}
+
+func (t *target) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session != nil {
+		t.session.drain()
+		t.session = nil
+	}
+}
@@ -0,0 +1,5 @@
+// Package quic carries connections as streams over QUIC connections between
+// a Ghostunnel client and server, as an alternative to TLS over TCP on lossy
+// links. Peers authenticate each other with mutual TLS during the QUIC
+// handshake, and signal support via ALPN.
+package quic
@@ -0,0 +1,236 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// Listener accepts QUIC connections, and returns each stream opened by
+// clients as a connection. Clients are authenticated during the handshake of
+// the QUIC connection, with the TLS config of the listener (including its
+// access control checks in VerifyPeerCertificate).
+type Listener struct {
+	conn      net.PacketConn
+	transport *quicgo.Transport
+	listener  *quicgo.Listener
+	options   Options
+	accept    chan net.Conn
+	done      chan struct{}
+	closing   sync.Once
+	sessions  sync.WaitGroup
+
+	mu      sync.Mutex
+	config  certloader.TLSServerConfig
+	serving map[*session]struct{}
+}
+
+// Listen accepts QUIC connections on the given socket. The TLS config is
+// fetched for every handshake, so that reloaded certificates are picked up.
+func Listen(conn net.PacketConn, config certloader.TLSServerConfig, options Options) (*Listener, error) {
+	l := &Listener{
+		conn:      conn,
+		transport: &quicgo.Transport{Conn: conn},
+		options:   options,
+		accept:    make(chan net.Conn),
+		done:      make(chan struct{}),
+		config:    config,
+		serving:   map[*session]struct{}{},
+	}
+	listener, err := l.transport.Listen(&tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		GetConfigForClient: l.getConfigForClient,
+	}, options.config())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	l.listener = listener
+	go l.serve()
+	return l, nil
+}
+
+// SetConfig replaces the TLS configuration used for new connections, e.g. to
+// apply updated access control settings. Established connections (and new
+// streams on them) are not affected.
+func (l *Listener) SetConfig(config certloader.TLSServerConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+func (l *Listener) getConfig() certloader.TLSServerConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// Get the TLS config for a handshake, offering Protocol via ALPN. Clients
+// that are rejected by the access control checks are logged, as they never
+// show up as connections.
+func (l *Listener) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	config := l.getConfig().GetServerConfig()
+	if config.GetConfigForClient != nil {
+		// The config may pick another one for the client, e.g. to pass its
+		// address to the access control policy.
+		selected, err := config.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if selected != nil {
+			config = selected
+		}
+	}
+	config = config.Clone()
+	config.GetConfigForClient = nil
+	config.NextProtos = []string{Protocol}
+	addr := hello.Conn.RemoteAddr()
+	if verify := config.VerifyPeerCertificate; verify != nil {
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			err := verify(rawCerts, chains)
+			if err != nil {
+				l.options.logf("error on QUIC handshake from %s: %s", addr, err)
+			}
+			return err
+		}
+	}
+	if verify := config.VerifyConnection; verify != nil {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			err := verify(state)
+			if err != nil {
+				l.options.logf("error on QUIC handshake from %s: %s", addr, err)
+			}
+			return err
+		}
+	}
+	return config, nil
+}
+
+// Accept waits for the next stream opened by a client.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "udp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting connections and streams. Connections are closed once
+// their open streams are done, and the socket once all connections are.
+func (l *Listener) Close() error {
+	var err error
+	l.closing.Do(func() {
+		close(l.done)
+		err = l.listener.Close()
+
+		l.mu.Lock()
+		for s := range l.serving {
+			s.drain()
+		}
+		l.mu.Unlock()
+
+		go func() {
+			l.sessions.Wait()
+			_ = l.transport.Close()
+			_ = l.conn.Close()
+		}()
+	})
+	return err
+}
+
+// Addr returns the address of the socket.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Accept QUIC connections, until the listener is closed.
+func (l *Listener) serve() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s := newSession(conn)
+
+		l.mu.Lock()
+		select {
+		case <-l.done:
+			l.mu.Unlock()
+			_ = conn.CloseWithError(errorCodeShutdown, "")
+			continue
+		default:
+		}
+		l.serving[s] = struct{}{}
+		l.sessions.Add(1)
+		l.mu.Unlock()
+
+		go l.serveSession(s)
+	}
+}
+
+// Accept streams of a QUIC connection, until it's closed.
+func (l *Listener) serveSession(s *session) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.serving, s)
+		l.mu.Unlock()
+		l.sessions.Done()
+	}()
+	for {
+		stream, err := s.conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go l.acceptStream(s, stream)
+	}
+}
+
+// Read the header of a stream, and hand it to Accept. Streams that don't
+// start with the header in time, or that are opened on a connection that's
+// draining, are reset.
+func (l *Listener) acceptStream(s *session, stream *quicgo.Stream) {
+	header := make([]byte, 1)
+	_ = stream.SetReadDeadline(time.Now().Add(l.options.handshakeTimeout()))
+	_, err := io.ReadFull(stream, header)
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil || header[0] != streamHeader {
+		stream.CancelRead(errorCodeInvalidStream)
+		stream.CancelWrite(errorCodeInvalidStream)
+		return
+	}
+	if !s.add() {
+		stream.CancelRead(errorCodeShutdown)
+		stream.CancelWrite(errorCodeShutdown)
+		return
+	}
+
+	c := newStream(stream, s)
+	select {
+	case l.accept <- c:
+	case <-l.done:
+		stream.CancelWrite(errorCodeShutdown)
+		c.Close()
+	}
+}
@@ -0,0 +1,225 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Protocol is negotiated via ALPN on QUIC connections between a Ghostunnel
+// client and server. QUIC requires ALPN, so both sides must offer it.
+const Protocol = "ghostunnel-quic/1"
+
+var (
+	connectionsOpen  = metrics.GetOrRegisterCounter("quic.connections.open", metrics.DefaultRegistry)
+	connectionsTotal = metrics.GetOrRegisterCounter("quic.connections.total", metrics.DefaultRegistry)
+	streamsOpen      = metrics.GetOrRegisterCounter("quic.streams.open", metrics.DefaultRegistry)
+	streamsTotal     = metrics.GetOrRegisterCounter("quic.streams.total", metrics.DefaultRegistry)
+	streamTimer      = metrics.GetOrRegisterTimer("quic.streams.lifetime", metrics.DefaultRegistry)
+)
+
+// Streams start with this byte, sent by the client as soon as it opens the
+// stream. QUIC only announces a stream to the peer once data is sent on it,
+// so without it the server wouldn't accept the stream (and connect to the
+// target) for protocols where the target speaks first.
+const streamHeader = 0x01
+
+// Number of streams a client may have open at once on a connection.
+const maxStreams = 1 << 14
+
+// Keep connections alive, so that connections that are idle for a while
+// (e.g. pooled database connections) aren't closed by the QUIC idle timeout.
+const keepAlivePeriod = 15 * time.Second
+
+// Delay before a drained connection is closed after its last stream, to give
+// the final frames of the stream time to be delivered.
+const closeDelay = time.Second
+
+// Error codes for connections and streams that are closed by Ghostunnel.
+const (
+	errorCodeNone          = 0x0
+	errorCodeInvalidStream = 0x1
+	errorCodeShutdown      = 0x2
+)
+
+// Logger is used by this package to log messages.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options for QUIC connections.
+type Options struct {
+	// HandshakeTimeout limits the time for the QUIC handshake, and for
+	// opening streams. Defaults to 10 seconds.
+	HandshakeTimeout time.Duration
+	// Logger is used to log rejected handshakes (server) and new
+	// connections (client), if set.
+	Logger Logger
+}
+
+func (o Options) handshakeTimeout() time.Duration {
+	if o.HandshakeTimeout > 0 {
+		return o.HandshakeTimeout
+	}
+	return 10 * time.Second
+}
+
+// 0-RTT is never allowed: data sent before the handshake completes could be
+// replayed, and would reach the target before the client is authenticated.
+func (o Options) config() *quicgo.Config {
+	return &quicgo.Config{
+		HandshakeIdleTimeout: o.handshakeTimeout(),
+		KeepAlivePeriod:      keepAlivePeriod,
+		MaxIncomingStreams:   maxStreams,
+		Allow0RTT:            false,
+	}
+}
+
+func (o Options) logf(format string, v ...interface{}) {
+	if o.Logger != nil {
+		o.Logger.Printf(format, v...)
+	}
+}
+
+// session keeps track of the streams of a QUIC connection, so that it can be
+// drained: once draining, no new streams are opened (or accepted) on it, and
+// it's closed after its last stream.
+type session struct {
+	conn *quicgo.Conn
+
+	mu       sync.Mutex
+	streams  int
+	draining bool
+}
+
+func newSession(conn *quicgo.Conn) *session {
+	connectionsOpen.Inc(1)
+	connectionsTotal.Inc(1)
+	go func() {
+		<-conn.Context().Done()
+		connectionsOpen.Dec(1)
+	}()
+	return &session{conn: conn}
+}
+
+// Returns true if the connection was closed, e.g. due to a network error or
+// because the peer went away.
+func (s *session) closed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+// Reserve a stream, unless the session is draining.
+func (s *session) add() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.streams++
+	return true
+}
+
+// Release a stream, closing the session if it was the last one of a draining
+// session.
+func (s *session) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams--
+	if s.draining && s.streams == 0 {
+		go s.close()
+	}
+}
+
+func (s *session) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return
+	}
+	s.draining = true
+	if s.streams == 0 {
+		go s.close()
+	}
+}
+
+func (s *session) close() {
+	select {
+	case <-s.conn.Context().Done():
+	case <-time.After(closeDelay):
+	}
+	_ = s.conn.CloseWithError(errorCodeShutdown, "")
+}
+
+// Stream is a connection carried over a QUIC connection. It exposes the TLS
+// connection state of the QUIC connection, so that it can be used like a
+// *tls.Conn for logging and routing.
+type Stream struct {
+	*quicgo.Stream
+	session *session
+	opened  time.Time
+	closing sync.Once
+}
+
+// Wrap a stream that was reserved on the session (see session.add).
+func newStream(stream *quicgo.Stream, session *session) *Stream {
+	streamsOpen.Inc(1)
+	streamsTotal.Inc(1)
+	return &Stream{Stream: stream, session: session, opened: time.Now()}
+}
+
+// ConnectionState returns the state of the TLS handshake of the QUIC
+// connection.
+func (s *Stream) ConnectionState() tls.ConnectionState {
+	return s.session.conn.ConnectionState().TLS
+}
+
+// LocalAddr returns the local address of the QUIC connection.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer of the QUIC connection.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+// CloseWrite closes the stream for writing, the peer reads io.EOF once it
+// read all data.
+func (s *Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// CloseRead tells the peer to stop sending data on the stream.
+func (s *Stream) CloseRead() error {
+	s.Stream.CancelRead(errorCodeNone)
+	return nil
+}
+
+// Close closes the stream in both directions.
+func (s *Stream) Close() error {
+	s.closing.Do(func() {
+		s.Stream.CancelRead(errorCodeNone)
+		streamsOpen.Dec(1)
+		streamTimer.UpdateSince(s.opened)
+		s.session.done()
+	})
+	return s.Stream.Close()
+}
@@ -0,0 +1,352 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticServerConfig struct {
+	config *tls.Config
+}
+
+func (c staticServerConfig) GetServerConfig() *tls.Config {
+	return c.config
+}
+
+type staticClientConfig struct {
+	config *tls.Config
+}
+
+func (c staticClientConfig) GetClientConfig() *tls.Config {
+	return c.config
+}
+
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) logged() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+// Start a listener on a random port that requires a client certificate with
+// the given common name.
+func listen(t *testing.T, allowedCN string, logger Logger) *Listener {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	return listenOn(t, conn, allowedCN, logger)
+}
+
+func listenOn(t *testing.T, conn net.PacketConn, allowedCN string, logger Logger) *Listener {
+	listener, err := Listen(conn, serverConfig(t, allowedCN), Options{HandshakeTimeout: 5 * time.Second, Logger: logger})
+	assert.Nil(t, err, "should be able to start QUIC listener")
+	return listener
+}
+
+// Server config that requires a client certificate with the given common
+// name.
+func serverConfig(t *testing.T, allowedCN string) staticServerConfig {
+	return staticServerConfig{&tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "server")},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if cert.Subject.CommonName != allowedCN {
+				return errors.New("access denied")
+			}
+			return nil
+		},
+	}}
+}
+
+func clientConfig(t *testing.T, cn string) staticClientConfig {
+	return staticClientConfig{&tls.Config{
+		Certificates:       []tls.Certificate{testCertificate(t, cn)},
+		InsecureSkipVerify: true,
+	}}
+}
+
+// Echo data on all streams accepted by the listener.
+func echo(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+			_ = conn.(*Stream).CloseWrite()
+		}()
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn, message string) {
+	_, err := conn.Write([]byte(message))
+	assert.Nil(t, err, "should be able to write")
+
+	received := make([]byte, len(message))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should be able to read echo")
+	assert.Equal(t, message, string(received))
+}
+
+func TestStreams(t *testing.T) {
+	listener := listen(t, "client", nil)
+	defer listener.Close()
+	go echo(listener)
+
+	client := NewClient(Options{HandshakeTimeout: 5 * time.Second})
+	defer client.Close()
+	dial := client.Dialer(listener.Addr().String(), clientConfig(t, "client"))
+
+	streams := []net.Conn{}
+	for i := 0; i < 5; i++ {
+		conn, err := dial()
+		assert.Nil(t, err, "should be able to open stream")
+		if err != nil {
+			return
+		}
+		assert.Equal(t, Protocol, conn.(*Stream).ConnectionState().NegotiatedProtocol)
+		streams = append(streams, conn)
+	}
+	for _, conn := range streams {
+		assert.Equal(t, streams[0].LocalAddr(), conn.LocalAddr(), "should carry all streams over a single connection")
+	}
+
+	for i, conn := range streams {
+		assertEcho(t, conn, fmt.Sprintf("hello %d", i))
+	}
+
+	// Half-closing a stream still lets the other side finish.
+	conn := streams[0]
+	assert.Nil(t, conn.(*Stream).CloseWrite(), "should close stream for writing")
+	rest, err := io.ReadAll(conn)
+	assert.Nil(t, err, "should read until the server closes the stream")
+	assert.Empty(t, rest)
+
+	for _, conn := range streams {
+		conn.Close()
+	}
+}
+
+func TestServerSpeaksFirst(t *testing.T) {
+	listener := listen(t, "client", nil)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("greeting"))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	client := NewClient(Options{HandshakeTimeout: 5 * time.Second})
+	defer client.Close()
+	conn, err := client.Dialer(listener.Addr().String(), clientConfig(t, "client"))()
+	assert.Nil(t, err, "should be able to open stream")
+	defer conn.Close()
+
+	// The server accepts the stream before the client sends any data.
+	greeting := make([]byte, len("greeting"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, greeting)
+	assert.Nil(t, err, "should read greeting")
+	assert.Equal(t, "greeting", string(greeting))
+}
+
+func TestRejectsUnauthorizedClient(t *testing.T) {
+	logger := &testLogger{}
+	listener := listen(t, "client", logger)
+	defer listener.Close()
+	go echo(listener)
+
+	client := NewClient(Options{HandshakeTimeout: 2 * time.Second})
+	defer client.Close()
+	// With TLS 1.3, the client only learns that it was rejected after its
+	// side of the handshake is done.
+	conn, err := client.Dialer(listener.Addr().String(), clientConfig(t, "intruder"))()
+	if err == nil {
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	assert.NotNil(t, err, "should reject client that isn't allowed")
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded), "should be rejected rather than time out")
+
+	assert.Eventually(t, func() bool {
+		return len(logger.logged()) > 0
+	}, 5*time.Second, 10*time.Millisecond, "should log rejected handshake")
+	assert.Contains(t, logger.logged()[0], "access denied")
+}
+
+func TestListenerSetConfig(t *testing.T) {
+	listener := listen(t, "client", nil)
+	defer listener.Close()
+	go echo(listener)
+
+	established := NewClient(Options{HandshakeTimeout: 2 * time.Second})
+	defer established.Close()
+	dial := established.Dialer(listener.Addr().String(), clientConfig(t, "client"))
+	conn, err := dial()
+	assert.Nil(t, err, "should be able to open stream")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "before")
+
+	listener.SetConfig(serverConfig(t, "someone-else"))
+
+	// New connections get the new config.
+	client := NewClient(Options{HandshakeTimeout: 2 * time.Second})
+	defer client.Close()
+	rejected, err := client.Dialer(listener.Addr().String(), clientConfig(t, "client"))()
+	if err == nil {
+		defer rejected.Close()
+		_ = rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = rejected.Read(make([]byte, 1))
+	}
+	assert.NotNil(t, err, "should reject client that isn't allowed anymore")
+
+	// Established connections, and new streams on them, keep working.
+	assertEcho(t, conn, "after")
+	stream, err := dial()
+	assert.Nil(t, err, "should be able to open stream on established connection")
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	assertEcho(t, stream, "new stream")
+}
+
+func TestListenerClose(t *testing.T) {
+	listener := listen(t, "client", nil)
+	go echo(listener)
+
+	client := NewClient(Options{HandshakeTimeout: 2 * time.Second})
+	defer client.Close()
+	dial := client.Dialer(listener.Addr().String(), clientConfig(t, "client"))
+
+	conn, err := dial()
+	assert.Nil(t, err, "should be able to open stream")
+	defer conn.Close()
+	assertEcho(t, conn, "before")
+
+	listener.Close()
+	_, err = listener.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed), "should not accept after close")
+
+	// Open streams are drained rather than closed.
+	assertEcho(t, conn, "after")
+}
+
+func TestClientClose(t *testing.T) {
+	listener := listen(t, "client", nil)
+	defer listener.Close()
+	go echo(listener)
+
+	client := NewClient(Options{HandshakeTimeout: 2 * time.Second})
+	dial := client.Dialer(listener.Addr().String(), clientConfig(t, "client"))
+	conn, err := dial()
+	assert.Nil(t, err, "should be able to open stream")
+	defer conn.Close()
+
+	client.Close()
+	_, err = dial()
+	assert.Equal(t, errClientClosed, err, "should not open streams after close")
+	assertEcho(t, conn, "still open")
+}
+
+func TestClientReconnects(t *testing.T) {
+	listener := listen(t, "client", nil)
+	go echo(listener)
+	address := listener.Addr().String()
+
+	client := NewClient(Options{HandshakeTimeout: 2 * time.Second})
+	defer client.Close()
+	dial := client.Dialer(address, clientConfig(t, "client"))
+	conn, err := dial()
+	assert.Nil(t, err, "should be able to open stream")
+	assertEcho(t, conn, "first")
+	conn.Close()
+
+	// Restart the server on the same port, once the old one released it.
+	listener.Close()
+	var packetConn net.PacketConn
+	assert.Eventually(t, func() bool {
+		packetConn, err = net.ListenPacket("udp", address)
+		return err == nil
+	}, 10*time.Second, 100*time.Millisecond, "old server should release its socket")
+	restarted := listenOn(t, packetConn, "client", nil)
+	defer restarted.Close()
+	go echo(restarted)
+
+	conn, err = dial()
+	assert.Nil(t, err, "should reconnect to restarted server")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "second")
+}
+
+func testCertificate(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,357 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/mux"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	agentsConnected = metrics.GetOrRegisterCounter("reverse.agents", metrics.DefaultRegistry)
+	agentsRejected  = metrics.GetOrRegisterCounter("reverse.agents.rejected", metrics.DefaultRegistry)
+)
+
+// agentRegistry keeps track of the agents connected to an edge, and forwards
+// connections to them as streams over their sessions (round-robin).
+type agentRegistry struct {
+	logger   mux.Logger
+	mu       sync.Mutex
+	sessions []*mux.Session
+	next     int
+	listener net.Listener
+	closed   bool
+}
+
+func newAgentRegistry(logger mux.Logger) *agentRegistry {
+	return &agentRegistry{logger: logger}
+}
+
+// serve accepts TLS connections from agents on the given listener, until
+// the registry is shut down.
+func (r *agentRegistry) serve(listener net.Listener, timeout time.Duration) {
+	r.mu.Lock()
+	r.listener = listener
+	r.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if r.isClosed() {
+				return
+			}
+			continue
+		}
+		go r.register(conn, timeout)
+	}
+}
+
+// Register an agent, once it completed the handshake (and passed access
+// control checks), and keep it registered until its session is closed.
+func (r *agentRegistry) register(conn net.Conn, timeout time.Duration) {
+	err := handshakeWithin(conn, timeout)
+	if err == nil && mux.NegotiatedProtocol(conn) != mux.ReverseProtocol {
+		err = errors.New("peer is not a reverse tunnel agent")
+	}
+	if err != nil {
+		agentsRejected.Inc(1)
+		r.logger.Printf("error registering agent from %s: %s", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	session, err := mux.Client(conn, mux.Options{})
+	if err != nil {
+		agentsRejected.Inc(1)
+		r.logger.Printf("error registering agent from %s: %s", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		_ = session.Close()
+		return
+	}
+	r.sessions = append(r.sessions, session)
+	r.mu.Unlock()
+	agentsConnected.Inc(1)
+	r.logger.Printf("registered agent %s [%s]", conn.RemoteAddr(), agentName(session.ConnectionState()))
+
+	<-session.Done()
+	r.remove(session)
+	agentsConnected.Dec(1)
+	r.logger.Printf("agent %s disconnected", conn.RemoteAddr())
+}
+
+func (r *agentRegistry) remove(session *mux.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range r.sessions {
+		if s == session {
+			r.sessions = append(r.sessions[:i], r.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// dial opens a stream to one of the registered agents. The agent forwards
+// it to its target.
+func (r *agentRegistry) dial() (net.Conn, error) {
+	r.mu.Lock()
+	candidates := make([]*mux.Session, len(r.sessions))
+	for i := range r.sessions {
+		candidates[i] = r.sessions[(r.next+i)%len(r.sessions)]
+	}
+	r.next++
+	r.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return nil, errors.New("no agents connected")
+	}
+	var err error
+	for _, session := range candidates {
+		var stream *mux.Stream
+		stream, err = session.Open()
+		if err == nil {
+			return stream, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to reach any agent: %w", err)
+}
+
+// agents returns the number of registered agents.
+func (r *agentRegistry) agents() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+func (r *agentRegistry) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Shutdown stops accepting agents. Sessions are closed once their open
+// streams are done.
+func (r *agentRegistry) Shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.listener != nil {
+		_ = r.listener.Close()
+	}
+	for _, session := range r.sessions {
+		session.Drain()
+	}
+}
+
+// Describe an agent for logs, by the subject of its certificate.
+func agentName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return "no cert"
+	}
+	return state.PeerCertificates[0].Subject.String()
+}
+
+// Force the handshake on a TLS connection, with a timeout.
+func handshakeWithin(conn net.Conn, timeout time.Duration) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return errors.New("not a TLS connection")
+	}
+	if err := tlsConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return tlsConn.SetDeadline(time.Time{})
+}
+
+// reverseListener dials out to an edge, and accepts the connections that the
+// edge forwards as streams over the resulting sessions. This lets an agent
+// use a regular proxy, as if it accepted connections on a listening socket.
+type reverseListener struct {
+	dial        func() (net.Conn, error)
+	edge        string
+	connections int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	logger      mux.Logger
+
+	streams chan net.Conn
+	quit    chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	sessions map[*mux.Session]struct{}
+}
+
+func newReverseListener(dial func() (net.Conn, error), edge string, connections int, logger mux.Logger) *reverseListener {
+	return &reverseListener{
+		dial:        dial,
+		edge:        edge,
+		connections: connections,
+		backoff:     time.Second,
+		maxBackoff:  time.Minute,
+		logger:      logger,
+		streams:     make(chan net.Conn),
+		quit:        make(chan struct{}),
+		sessions:    map[*mux.Session]struct{}{},
+	}
+}
+
+// start connects to the edge, and keeps reconnecting (with exponential
+// backoff) whenever a connection is lost.
+func (l *reverseListener) start() {
+	for i := 0; i < l.connections; i++ {
+		go l.connect()
+	}
+}
+
+func (l *reverseListener) connect() {
+	backoff := l.backoff
+	for {
+		registered, err := l.serve()
+		if registered {
+			backoff = l.backoff
+		}
+		select {
+		case <-l.quit:
+			return
+		default:
+		}
+		if err != nil {
+			l.logger.Printf("error connecting to edge %s: %s (retrying in %s)", l.edge, err, backoff)
+		} else {
+			l.logger.Printf("lost connection to edge %s (reconnecting in %s)", l.edge, backoff)
+		}
+
+		select {
+		case <-l.quit:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > l.maxBackoff {
+			backoff = l.maxBackoff
+		}
+	}
+}
+
+// Connect to the edge once, and accept streams until the session is closed.
+// Returns true if the agent was registered with the edge.
+func (l *reverseListener) serve() (bool, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return false, err
+	}
+	if mux.NegotiatedProtocol(conn) != mux.ReverseProtocol {
+		_ = conn.Close()
+		return false, errors.New("peer is not a reverse tunnel edge")
+	}
+	session, err := mux.Server(conn, mux.Options{})
+	if err != nil {
+		_ = conn.Close()
+		return false, err
+	}
+
+	// Once tracked, the session is drained (rather than closed) when the
+	// listener is closed, so that open streams aren't cut off.
+	if !l.track(session) {
+		_ = session.Close()
+		return true, nil
+	}
+	defer l.untrack(session)
+	l.logger.Printf("registered with edge %s", conn.RemoteAddr())
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return true, nil
+		}
+		select {
+		case l.streams <- stream:
+		case <-l.quit:
+			_ = stream.Close()
+			return true, nil
+		}
+	}
+}
+
+func (l *reverseListener) track(session *mux.Session) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.quit:
+		return false
+	default:
+	}
+	l.sessions[session] = struct{}{}
+	return true
+}
+
+func (l *reverseListener) untrack(session *mux.Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, session)
+}
+
+// Accept waits for the next connection forwarded by the edge.
+func (l *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and disconnects from the edge, once
+// open streams are done.
+func (l *reverseListener) Close() error {
+	l.once.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		close(l.quit)
+		for session := range l.sessions {
+			session.Drain()
+		}
+	})
+	return nil
+}
+
+// Addr returns the address of the edge.
+func (l *reverseListener) Addr() net.Addr {
+	return edgeAddr(l.edge)
+}
+
+type edgeAddr string
+
+func (a edgeAddr) Network() string { return "tcp" }
+func (a edgeAddr) String() string  { return string(a) }
@@ -0,0 +1,131 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	serverCert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-key.pem")
+	assert.Nil(t, err, "should be able to load server cert")
+	clientCert, err := tls.LoadX509KeyPair("test-keys/client-cert.pem", "test-keys/client-key.pem")
+	assert.Nil(t, err, "should be able to load client cert")
+	caBundle, err := os.ReadFile("test-keys/cacert.pem")
+	assert.Nil(t, err, "should be able to read CA bundle")
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caBundle)
+
+	// Edge, accepting agents
+	agentListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		NextProtos:   []string{mux.ReverseProtocol},
+	})
+	assert.Nil(t, err, "should be able to listen on random port")
+	agents := newAgentRegistry(logger)
+	go agents.serve(agentListener, 5*time.Second)
+	defer agents.Shutdown()
+
+	_, err = agents.dial()
+	assert.NotNil(t, err, "should not be able to dial without agents")
+
+	// Target of the agent, echoes data
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Agent, dialing out to the edge
+	listener := newReverseListener(func() (net.Conn, error) {
+		return tls.Dial("tcp", agentListener.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			NextProtos:   []string{mux.ReverseProtocol},
+		})
+	}, agentListener.Addr().String(), 1, logger)
+	p := proxy.New(listener, 5*time.Second, 5*time.Second, 0, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, logger, proxy.LogEverything, false)
+	listener.start()
+	go p.Accept()
+	defer p.Shutdown()
+
+	for i := 0; i < 50 && agents.agents() == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, 1, agents.agents(), "agent should register with edge")
+
+	// Connections from the edge reach the target of the agent
+	for i := 0; i < 3; i++ {
+		conn, err := agents.dial()
+		assert.Nil(t, err, "should be able to dial agent")
+		if err != nil {
+			return
+		}
+		_, err = conn.Write([]byte("hello"))
+		assert.Nil(t, err, "should be able to write")
+		received := make([]byte, 5)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(conn, received)
+		assert.Nil(t, err, "should be able to read echo from target")
+		assert.Equal(t, "hello", string(received))
+		conn.Close()
+	}
+
+	// Peers that don't negotiate the reverse protocol aren't registered
+	conn, err := tls.Dial("tcp", agentListener.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      roots,
+		ServerName:   "localhost",
+	})
+	if err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.NotNil(t, err, "edge should close connection from non-agent")
+		conn.Close()
+	}
+	assert.Equal(t, 1, agents.agents(), "non-agent should not register")
+
+	// Agent disconnects on shutdown
+	p.Shutdown()
+	for i := 0; i < 50 && agents.agents() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, 0, agents.agents(), "agent should disconnect on shutdown")
+}
@@ -0,0 +1,214 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/ghostunnel/ghostunnel/policy"
+	"github.com/ghostunnel/ghostunnel/proxy"
+)
+
+// tunnelRoute is the target (and optionally the certificate and access
+// control settings) for connections with a given TLS server name.
+type tunnelRoute struct {
+	config          config.Route
+	dial            func() (net.Conn, error)
+	tlsConfigSource certloader.TLSConfigSource
+	regoPolicy      policy.Policy
+	serverConfig    certloader.TLSServerConfig
+}
+
+// routeTable maps lower-cased server names to routes. Wildcard entries
+// (e.g. "*.example.com") match exactly one label, like in certificates.
+type routeTable map[string]*tunnelRoute
+
+// lookup finds the route for a server name. Exact matches take precedence
+// over wildcards.
+func (r routeTable) lookup(serverName string) (*tunnelRoute, bool) {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil, false
+	}
+	if route, ok := r[name]; ok {
+		return route, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		route, ok := r["*"+name[i:]]
+		return route, ok
+	}
+	return nil, false
+}
+
+// dialer picks the dialer for an established (and handshaked) connection,
+// based on the server name the client sent. Connections with an unknown
+// server name use the fallback, or are rejected if there is none.
+func (r routeTable) dialer(conn net.Conn, fallback proxy.Dialer) (proxy.Dialer, error) {
+	var serverName string
+	switch c := conn.(type) {
+	case interface{ ConnectionState() tls.ConnectionState }:
+		// *tls.Conn, or a stream of a multiplexed session
+		serverName = c.ConnectionState().ServerName
+	case *proxy.PassthroughConn:
+		serverName = c.ServerName()
+	default:
+		return nil, errors.New("not a TLS connection")
+	}
+	if route, ok := r.lookup(serverName); ok {
+		return route.dial, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, fmt.Errorf("unknown server name '%s'", serverName)
+}
+
+// check runs a TCP check against the target of every route.
+func (r routeTable) check() error {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := checkDial(r[name].dial); err != nil {
+			return fmt.Errorf("route '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkDial runs a TCP check with the given dialer.
+func checkDial(dial func() (net.Conn, error)) error {
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// reload reloads certificates and policies of routes. Routes that share
+// the TLS config source of the tunnel are skipped, the tunnel reloads it.
+func (r routeTable) reload(shared certloader.TLSConfigSource, logger tunnelLogger) {
+	for name, route := range r {
+		if route.tlsConfigSource != shared {
+			if err := route.tlsConfigSource.Reload(); err != nil {
+				logger.Printf("error reloading TLS configuration for route '%s': %s", name, err)
+			}
+		}
+		if route.regoPolicy != nil {
+			if err := route.regoPolicy.Reload(); err != nil {
+				logger.Printf("error reloading OPA policy for route '%s': %s", name, err)
+			}
+		}
+	}
+}
+
+// sniServerConfig picks the TLS config (certificate and access control)
+// for each connection based on the server name sent by the client. Clients
+// that send an unknown (or no) server name fail the handshake.
+type sniServerConfig struct {
+	base   *tls.Config
+	routes routeTable
+}
+
+func (c sniServerConfig) GetServerConfig() *tls.Config {
+	config := c.base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		route, ok := c.routes.lookup(hello.ServerName)
+		if !ok {
+			return nil, fmt.Errorf("unknown server name '%s'", hello.ServerName)
+		}
+		config := route.serverConfig.GetServerConfig()
+		if config.GetConfigForClient != nil {
+			// Let the route pick a config for the client, e.g. to pass its
+			// address to the access control policy.
+			selected, err := config.GetConfigForClient(hello)
+			if err != nil || selected != nil {
+				return selected, err
+			}
+		}
+		return config, nil
+	}
+	return config
+}
+
+// Set up dialers and TLS server configs for the routes of a server tunnel.
+// Routes without their own credentials or access control settings use the
+// ones of the tunnel.
+func (s *tunnelState) buildRoutes(timeout time.Duration, previous *tunnelState) error {
+	s.routes = routeTable{}
+	for _, cfg := range s.config.Routes {
+		route := &tunnelRoute{config: cfg}
+		name := strings.ToLower(cfg.ServerName)
+
+		var err error
+		route.dial, err = backendDialer(cfg.Target, timeout, s.target)
+		if err != nil {
+			return fmt.Errorf("invalid target address for route '%s': %w", name, err)
+		}
+		route.dial = listenProtocolDialer(s.config.ListenProtocol, route.dial, timeout)
+
+		route.tlsConfigSource = s.tlsConfigSource
+		if cfg.Credentials != (config.Credentials{}) {
+			if old, ok := previous.route(name); ok && old.config.Credentials == cfg.Credentials && old.tlsConfigSource != previous.tlsConfigSource {
+				route.tlsConfigSource = old.tlsConfigSource
+			} else {
+				route.tlsConfigSource, err = tunnelTLSConfigSource(config.Tunnel{
+					Credentials:           cfg.Credentials,
+					DisableAuthentication: s.config.DisableAuthentication,
+				})
+				if err != nil {
+					return fmt.Errorf("unable to load credentials for route '%s': %w", name, err)
+				}
+			}
+		}
+
+		access := s.config.Access
+		if !cfg.Access.IsEmpty() {
+			access = cfg.Access
+		}
+		route.serverConfig, route.regoPolicy, err = serverTLSConfig(route.tlsConfigSource, access, s.config.DisableAuthentication, s.config.ALPN, timeout)
+		if err != nil {
+			return fmt.Errorf("route '%s': %w", name, err)
+		}
+		s.routes[name] = route
+	}
+
+	base, err := buildServerConfig(*enabledCipherSuites)
+	if err != nil {
+		return err
+	}
+	base.NextProtos = s.config.ALPN
+	s.serverConfig = sniServerConfig{base: base, routes: s.routes}
+	return nil
+}
+
+// route returns the route for a (lower-cased) server name, if any.
+func (s *tunnelState) route(name string) (*tunnelRoute, bool) {
+	if s == nil {
+		return nil, false
+	}
+	route, ok := s.routes[name]
+	return route, ok
+}
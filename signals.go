@@ -21,10 +21,23 @@ import (
 	"os"
 	"os/signal"
 	"time"
-
-	"github.com/ghostunnel/ghostunnel/proxy"
 )
 
+// shutdowner is implemented by proxy.Proxy, and by tunnelGroup in run mode.
+type shutdowner interface {
+	Shutdown()
+}
+
+// shutdowners shuts down several components at once, e.g. the proxy and the
+// agent registry in edge mode.
+type shutdowners []shutdowner
+
+func (s shutdowners) Shutdown() {
+	for _, x := range s {
+		x.Shutdown()
+	}
+}
+
 // isShutdownSignal checks if the received signal is a shutdown signal
 // and returns true if that's the case. Returns false if the signal is
 // a refresh signal.
@@ -40,7 +53,7 @@ func isShutdownSignal(sig os.Signal) bool {
 // signalHandler listens for incoming shutdown or refresh signals. If we get
 // a shutdown signal, we stop listening for new connections and gracefully
 // terminate the process. If we get a refresh signal, reload certificates.
-func (context *Context) signalHandler(p *proxy.Proxy) {
+func (context *Context) signalHandler(p shutdowner) {
 	signals := make(chan os.Signal, 3)
 	signal.Notify(signals, append(shutdownSignals, refreshSignals...)...)
 	defer signal.Stop(signals)
@@ -101,7 +114,11 @@ func (context *Context) reloadHandler(interval time.Duration) {
 
 func (context *Context) reload() {
 	context.status.Reloading()
-	if err := context.tlsConfigSource.Reload(); err != nil {
+	if context.tunnel != nil {
+		// Reloads credentials, policies and source ranges of the tunnel
+		// built from flags. Its credentials are also used for the status port.
+		context.tunnel.reload()
+	} else if err := context.tlsConfigSource.Reload(); err != nil {
 		logger.Printf("error reloading TLS configuration: %s", err)
 	}
 	if context.regoPolicy != nil {
@@ -109,6 +126,14 @@ func (context *Context) reload() {
 			logger.Printf("error reloading OPA policy: %s", err)
 		}
 	}
+	if context.tunnels != nil {
+		// Apply changes to the config file, then reload credentials and
+		// policies for all tunnels (including those that didn't change).
+		result := context.tunnels.reloadConfig(context.configPath)
+		logger.Printf("reloading config file %s: %s", context.configPath, result)
+		context.status.ReloadResult(result)
+		context.tunnels.reload()
+	}
 	logger.Printf("reloading configuration complete")
 	context.status.Listening()
 }
@@ -25,9 +25,9 @@ import (
 
 // ParseAddress parses a string representing a TCP address or UNIX socket
 // for our backend target. The input can be or the form "HOST:PORT" for
-// a TCP socket, "unix:PATH" for a UNIX socket, and "systemd:NAME" or
-// "launchd:NAME" for a socket provided by launchd/systemd for socket
-// activation.
+// a TCP socket, "unix:PATH" for a UNIX socket, "udp:HOST:PORT" for a UDP
+// socket, and "systemd:NAME" or "launchd:NAME" for a socket provided by
+// launchd/systemd for socket activation.
 func ParseAddress(input string, skipResolve bool) (network, address, host string, err error) {
 	if strings.HasPrefix(input, "launchd:") {
 		network = "launchd"
@@ -47,6 +47,22 @@ func ParseAddress(input string, skipResolve bool) (network, address, host string
 		return
 	}
 
+	if strings.HasPrefix(input, "udp:") {
+		address = input[4:]
+		host, _, err = net.SplitHostPort(address)
+		if err != nil {
+			return
+		}
+		if !skipResolve {
+			_, err = net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				return
+			}
+		}
+		network = "udp"
+		return
+	}
+
 	host, _, err = net.SplitHostPort(input)
 	if err != nil {
 		return
@@ -117,6 +133,12 @@ func Open(network, address string) (net.Listener, error) {
 	}
 }
 
+// OpenPacket opens a UDP socket on the given address (as returned by
+// ParseAddress). Like listeners, it's a "reusable port" socket.
+func OpenPacket(address string) (net.PacketConn, error) {
+	return reuseport.NewReusablePortPacketConn("udp", address)
+}
+
 // ParseAndOpen combines the functionality of the ParseAddress and Open methods.
 func ParseAndOpen(address string) (net.Listener, error) {
 	net, addr, _, err := ParseAddress(address, false)
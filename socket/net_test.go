@@ -67,12 +67,26 @@ func TestParseAddress(t *testing.T) {
 		t.Errorf("unexpected host: %s", host)
 	}
 
+	network, address, host, _ = ParseAddress("udp:localhost:53", false)
+	if network != "udp" {
+		t.Errorf("unexpected network: %s", network)
+	}
+	if address != "localhost:53" {
+		t.Errorf("unexpected address: %s", address)
+	}
+	if host != "localhost" {
+		t.Errorf("unexpected host: %s", host)
+	}
+
 	_, _, _, err := ParseAddress("localhost", false)
 	assert.NotNil(t, err, "was able to parse invalid host/port")
 
 	_, _, _, err = ParseAddress("256.256.256.256:99999", false)
 	assert.NotNil(t, err, "was able to parse invalid host/port")
 
+	_, _, _, err = ParseAddress("udp:localhost", false)
+	assert.NotNil(t, err, "was able to parse invalid UDP host/port")
+
 	_, _, _, err = ParseAddress("launchdfoobar", false)
 	assert.NotNil(t, err, "was able to parse invalid host/port")
 
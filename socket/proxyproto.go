@@ -0,0 +1,81 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+// ParseCIDRs parses a list of CIDR ranges (e.g. "10.0.0.0/8"). Plain IP
+// addresses are accepted as ranges with a single address.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR range '%s'", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range '%s'", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// AcceptProxyProtocol wraps a listener to read PROXY protocol (v1 or v2)
+// headers, sent by load balancers in front of it. Connections from trusted
+// sources may send a header, and the source address from the header is then
+// returned by RemoteAddr() on the connection. Connections from other sources
+// (including UNIX socket peers) are rejected if they send a header.
+//
+// The header is read on the first read from the connection (e.g. when the TLS
+// handshake starts), and must arrive within the given timeout.
+func AcceptProxyProtocol(listener net.Listener, trusted []*net.IPNet, timeout time.Duration) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          listener,
+		ConnPolicy:        trustedSourcePolicy(trusted),
+		ReadHeaderTimeout: timeout,
+	}
+}
+
+func trustedSourcePolicy(trusted []*net.IPNet) proxyproto.ConnPolicyFunc {
+	return func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		addr, ok := options.Upstream.(*net.TCPAddr)
+		if !ok {
+			return proxyproto.REJECT, nil
+		}
+		for _, ipNet := range trusted {
+			if ipNet.Contains(addr.IP) {
+				return proxyproto.USE, nil
+			}
+		}
+		return proxyproto.REJECT, nil
+	}
+}
@@ -0,0 +1,105 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "::1"})
+	assert.Nil(t, err, "should parse valid ranges")
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "::1/128"}, []string{
+		nets[0].String(), nets[1].String(), nets[2].String(), nets[3].String(),
+	})
+
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "10.0.0", ""} {
+		_, err := ParseCIDRs([]string{invalid})
+		assert.NotNil(t, err, "should reject '%s'", invalid)
+	}
+}
+
+// Send data on a new connection to the listener, optionally preceded by a
+// PROXY header, and return the connection as accepted by the listener.
+func acceptWithHeader(t *testing.T, listener net.Listener, header *proxyproto.Header) net.Conn {
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err, "should be able to dial listener")
+	if header != nil {
+		_, err = header.WriteTo(client)
+		assert.Nil(t, err, "should be able to write header")
+	}
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write data")
+	t.Cleanup(func() { client.Close() })
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should be able to accept connection")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer raw.Close()
+
+	source := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4321}
+	header := func(version byte) *proxyproto.Header {
+		return proxyproto.HeaderProxyFromAddrs(version, source, raw.Addr())
+	}
+
+	trusted, _ := ParseCIDRs([]string{"127.0.0.0/8"})
+	listener := AcceptProxyProtocol(raw, trusted, time.Second)
+
+	// Trusted sources can send v1 or v2 headers, or none at all
+	for _, version := range []byte{1, 2} {
+		conn := acceptWithHeader(t, listener, header(version))
+		received := make([]byte, 5)
+		_, err = io.ReadFull(conn, received)
+		assert.Nil(t, err, "should read data after v%d header", version)
+		assert.Equal(t, "hello", string(received))
+		assert.Equal(t, source.String(), conn.RemoteAddr().String(), "should use source address from v%d header", version)
+		conn.Close()
+	}
+
+	conn := acceptWithHeader(t, listener, nil)
+	received := make([]byte, 5)
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should read data without header")
+	assert.Equal(t, "hello", string(received))
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	conn.Close()
+
+	// Other sources can't send headers
+	untrusted, _ := ParseCIDRs([]string{"10.0.0.0/8"})
+	listener = AcceptProxyProtocol(raw, untrusted, time.Second)
+
+	conn = acceptWithHeader(t, listener, header(2))
+	_, err = conn.Read(make([]byte, 5))
+	assert.NotNil(t, err, "should reject header from untrusted source")
+	conn.Close()
+
+	conn = acceptWithHeader(t, listener, nil)
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should read data from untrusted source without header")
+	assert.Equal(t, "hello", string(received))
+	conn.Close()
+}
@@ -0,0 +1,123 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// SourceFilter decides which clients may connect, by their IP address.
+type SourceFilter struct {
+	// Allow lists the ranges clients may connect from. If empty, clients
+	// may connect from anywhere (unless denied).
+	Allow []*net.IPNet
+	// Deny lists ranges clients may not connect from, even if allowed.
+	Deny []*net.IPNet
+}
+
+// LoadSourceFilter builds a source filter from lists of CIDR ranges or IP
+// addresses. Entries of the form file:PATH are read from a file with one
+// range per line, ignoring empty lines and comments starting with '#'.
+// Returns nil if both lists are empty.
+func LoadSourceFilter(allow, deny []string) (*SourceFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	allowed, err := loadCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := loadCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceFilter{Allow: allowed, Deny: denied}, nil
+}
+
+func loadCIDRs(entries []string) ([]*net.IPNet, error) {
+	var cidrs []string
+	for _, entry := range entries {
+		path, ok := strings.CutPrefix(entry, "file:")
+		if !ok {
+			cidrs = append(cidrs, entry)
+			continue
+		}
+		lines, err := readCIDRFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, lines...)
+	}
+	return ParseCIDRs(cidrs)
+}
+
+func readCIDRFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CIDR ranges: %w", err)
+	}
+	defer file.Close()
+
+	var cidrs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read CIDR ranges from %s: %w", path, err)
+	}
+	return cidrs, nil
+}
+
+// AddrIP returns the IP address of a TCP or UDP address, or nil for other
+// addresses (e.g. UNIX sockets).
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// Allowed returns true if a client may connect from the given address.
+// Addresses without an IP (e.g. on UNIX sockets) are always allowed.
+func (f *SourceFilter) Allowed(addr net.Addr) bool {
+	ip := AddrIP(addr)
+	if ip == nil {
+		return true
+	}
+	if containsIP(f.Deny, ip) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsIP(f.Allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestSourceFilter(t *testing.T) {
+	filter, err := LoadSourceFilter([]string{"10.0.0.0/8", "192.168.1.1"}, []string{"10.1.0.0/16"})
+	require.Nil(t, err)
+
+	assert.True(t, filter.Allowed(tcpAddr("10.2.3.4")), "allowed range should be allowed")
+	assert.True(t, filter.Allowed(tcpAddr("192.168.1.1")), "allowed address should be allowed")
+	assert.True(t, filter.Allowed(tcpAddr("::ffff:10.2.3.4")), "IPv4-mapped address should match IPv4 range")
+	assert.False(t, filter.Allowed(tcpAddr("10.1.2.3")), "deny should take precedence")
+	assert.False(t, filter.Allowed(tcpAddr("172.16.0.1")), "other addresses should be rejected")
+	assert.True(t, filter.Allowed(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}), "UNIX sockets should be allowed")
+
+	filter, err = LoadSourceFilter(nil, []string{"172.16.0.0/12"})
+	require.Nil(t, err)
+	assert.True(t, filter.Allowed(tcpAddr("10.2.3.4")), "addresses should be allowed without allow list")
+	assert.False(t, filter.Allowed(tcpAddr("172.16.0.1")))
+
+	filter, err = LoadSourceFilter(nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, filter, "should have no filter without ranges")
+
+	_, err = LoadSourceFilter([]string{"10.0.0.0/33"}, nil)
+	assert.NotNil(t, err, "invalid range should be rejected")
+}
+
+func TestSourceFilterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	require.Nil(t, os.WriteFile(path, []byte("# scanners\n198.51.100.0/24\n\n203.0.113.7 # single host\n"), 0644))
+
+	filter, err := LoadSourceFilter(nil, []string{"file:" + path, "192.0.2.1"})
+	require.Nil(t, err)
+	assert.Len(t, filter.Deny, 3)
+	assert.False(t, filter.Allowed(tcpAddr("198.51.100.10")))
+	assert.False(t, filter.Allowed(tcpAddr("203.0.113.7")))
+	assert.True(t, filter.Allowed(tcpAddr("203.0.113.8")))
+
+	_, err = LoadSourceFilter([]string{"file:" + filepath.Join(t.TempDir(), "missing.txt")}, nil)
+	assert.NotNil(t, err, "missing file should be rejected")
+
+	require.Nil(t, os.WriteFile(path, []byte("not-an-ip\n"), 0644))
+	_, err = LoadSourceFilter(nil, []string{"file:" + path})
+	assert.NotNil(t, err, "invalid range in file should be rejected")
+}
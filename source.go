@@ -0,0 +1,83 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/ghostunnel/ghostunnel/auth"
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/socket"
+)
+
+// Set up the access control checks of a TLS server config. With an OPA
+// policy, the checks run in VerifyConnection rather than
+// VerifyPeerCertificate, so that withSourceACL can pass the IP address of each
+// client to the policy. Handshakes that don't go through withSourceACL are
+// still checked, without a source in the input.
+func setServerACL(config *tls.Config, acl auth.ACL) {
+	if acl.AllowOPAQuery == nil {
+		config.VerifyPeerCertificate = acl.VerifyPeerCertificateServer
+		return
+	}
+	config.VerifyConnection = acl.VerifyConnectionServer(nil)
+}
+
+// withSourceACL wraps a TLS server config that was set up with setServerACL,
+// so that the OPA policy sees the IP address of each client as
+// input.source.ip. Configs without an OPA policy are returned as they are.
+func withSourceACL(inner certloader.TLSServerConfig, acl auth.ACL) certloader.TLSServerConfig {
+	if acl.AllowOPAQuery == nil {
+		return inner
+	}
+	return sourceServerConfig{inner, acl}
+}
+
+type sourceServerConfig struct {
+	inner certloader.TLSServerConfig
+	acl   auth.ACL
+}
+
+func (c sourceServerConfig) GetServerConfig() *tls.Config {
+	base := c.inner.GetServerConfig()
+	config := base.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// Configs picked by the inner config (e.g. for routes) have access
+		// control settings of their own.
+		if base.GetConfigForClient != nil {
+			routed, err := base.GetConfigForClient(hello)
+			if err != nil || routed != nil {
+				return routed, err
+			}
+		}
+		selected := base.Clone()
+		selected.GetConfigForClient = nil
+		selected.VerifyConnection = c.acl.VerifyConnectionServer(socket.AddrIP(hello.Conn.RemoteAddr()))
+		return selected, nil
+	}
+	return config
+}
+
+// Log the source filter that is set, if any.
+func logSourceFilter(logger proxy.Logger, allow, deny []string) {
+	if len(allow) > 0 {
+		logger.Printf("accepting connections only from %s", strings.Join(allow, ", "))
+	}
+	if len(deny) > 0 {
+		logger.Printf("rejecting connections from %s", strings.Join(deny, ", "))
+	}
+}
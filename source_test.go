@@ -0,0 +1,109 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sourceTestPolicy = `
+package policy
+import input
+default allow := false
+allow {
+    input.certificate.Subject.CommonName == "client"
+    net.cidr_contains("10.0.0.0/8", input.source.ip)
+}
+`
+
+type staticServerConfig struct {
+	config *tls.Config
+}
+
+func (c staticServerConfig) GetServerConfig() *tls.Config {
+	return c.config
+}
+
+// Fake connection, for the address of a client in a ClientHello.
+type sourceTestConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c sourceTestConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func sourceTestHello(ip string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{Conn: sourceTestConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 51234}}}
+}
+
+func TestSourceServerConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.rego")
+	require.Nil(t, os.WriteFile(path, []byte(sourceTestPolicy), 0600))
+	acl, _, err := buildACL(config.Access{Policy: path, Query: "data.policy.allow"}, 5*time.Second)
+	require.Nil(t, err, "should be able to load policy")
+
+	base := &tls.Config{}
+	setServerACL(base, acl)
+	assert.Nil(t, base.VerifyPeerCertificate, "policy should be checked in VerifyConnection")
+	require.NotNil(t, base.VerifyConnection)
+	assert.NotNil(t, base.VerifyConnection(httpTestState("client")), "policy should see no source without the wrapper")
+
+	serverConfig := withSourceACL(staticServerConfig{base}, acl).GetServerConfig()
+	require.NotNil(t, serverConfig.GetConfigForClient)
+
+	selected, err := serverConfig.GetConfigForClient(sourceTestHello("10.1.2.3"))
+	require.Nil(t, err)
+	assert.Nil(t, selected.VerifyConnection(httpTestState("client")), "policy should allow client from source")
+	assert.NotNil(t, selected.VerifyConnection(httpTestState("other")), "policy should deny other client from source")
+
+	selected, err = serverConfig.GetConfigForClient(sourceTestHello("192.168.1.1"))
+	require.Nil(t, err)
+	assert.NotNil(t, selected.VerifyConnection(httpTestState("client")), "policy should deny client from other source")
+
+	// Configs picked by the inner config are used as they are.
+	routed := &tls.Config{}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) { return routed, nil }
+	selected, err = withSourceACL(staticServerConfig{base}, acl).GetServerConfig().GetConfigForClient(sourceTestHello("10.1.2.3"))
+	assert.Nil(t, err)
+	assert.Same(t, routed, selected)
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) { return nil, errors.New("unknown server name") }
+	_, err = withSourceACL(staticServerConfig{base}, acl).GetServerConfig().GetConfigForClient(sourceTestHello("10.1.2.3"))
+	assert.NotNil(t, err)
+}
+
+func TestSourceServerConfigWithoutPolicy(t *testing.T) {
+	acl, _, err := buildACL(config.Access{CNs: []string{"client"}}, time.Second)
+	require.Nil(t, err)
+
+	base := &tls.Config{}
+	setServerACL(base, acl)
+	assert.NotNil(t, base.VerifyPeerCertificate, "ACL should be checked in VerifyPeerCertificate without policy")
+	assert.Nil(t, base.VerifyConnection)
+
+	inner := staticServerConfig{base}
+	assert.Equal(t, inner, withSourceACL(inner, acl), "config without policy should not be wrapped")
+}
@@ -0,0 +1,4 @@
+// Package starttls negotiates in-protocol upgrades to TLS ("STARTTLS") for
+// protocols that start in plain text, like PostgreSQL, MySQL, SMTP and LDAP,
+// so that Ghostunnel can wrap them in TLS without a separate TLS port.
+package starttls
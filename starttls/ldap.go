@@ -0,0 +1,205 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// OID of the StartTLS extended operation (RFC 4511, section 4.14), and of
+// the notice of disconnection (section 4.4.1).
+const (
+	ldapStartTLSOID           = "1.3.6.1.4.1.1466.20037"
+	ldapNoticeOfDisconnection = "1.3.6.1.4.1.1466.20036"
+)
+
+// LDAP result codes.
+const (
+	ldapSuccess                 = 0
+	ldapConfidentialityRequired = 13
+)
+
+// BER tags of LDAP messages.
+const (
+	berSequence          = 0x30
+	berInteger           = 0x02
+	berEnumerated        = 0x0a
+	berOctetString       = 0x04
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+	ldapRequestName      = 0x80
+	ldapResponseName     = 0x8a
+)
+
+// StartTLS extended request, with message ID 1.
+var ldapStartTLSRequest = encodeBER(berSequence,
+	encodeBER(berInteger, []byte{0x01}),
+	encodeBER(ldapExtendedRequest,
+		encodeBER(ldapRequestName, []byte(ldapStartTLSOID))))
+
+// Ask an LDAP server to upgrade to TLS with the StartTLS extended
+// operation. The server answers with an extended response, with result
+// code 0 (success) if it's willing to.
+func ldapClient(conn net.Conn, reader *bufio.Reader) error {
+	if _, err := conn.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+
+	tag, message, err := readBER(reader)
+	if err != nil {
+		return fmt.Errorf("unable to read StartTLS response: %w", err)
+	}
+	if tag != berSequence {
+		return errors.New("invalid StartTLS response")
+	}
+	r := bytes.NewReader(message)
+	tag, id, err := readBER(r)
+	if err != nil || tag != berInteger {
+		return errors.New("invalid StartTLS response")
+	}
+	tag, response, err := readBER(r)
+	if err != nil || tag != ldapExtendedResponse {
+		return errors.New("invalid StartTLS response")
+	}
+	// Unsolicited notifications (e.g. notice of disconnection) have ID 0.
+	if !bytes.Equal(id, []byte{0x01}) {
+		return errors.New("unexpected message from server")
+	}
+
+	r = bytes.NewReader(response)
+	tag, code, err := readBER(r)
+	if err != nil || tag != berEnumerated || len(code) == 0 {
+		return errors.New("invalid StartTLS response")
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	if result != ldapSuccess {
+		// Skip the matched DN, and report the diagnostic message.
+		_, _, _ = readBER(r)
+		_, message, _ := readBER(r)
+		return fmt.Errorf("StartTLS failed with result code %d (%s)", result, message)
+	}
+	return nil
+}
+
+type berReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Read a BER element, returning its tag and value. Only single-byte tags and
+// definite lengths are supported, which is all LDAP uses.
+func readBER(r berReader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPreamble {
+		return 0, nil, errors.New("BER element too large")
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return tag, value, nil
+}
+
+// Answer the StartTLS request of an LDAP client. Clients that send any other
+// operation first get a notice of disconnection, as TLS is required.
+func ldapServer(conn net.Conn, reader *bufio.Reader) error {
+	tag, message, err := readBER(reader)
+	if err != nil {
+		return fmt.Errorf("unable to read request: %w", err)
+	}
+	if tag != berSequence {
+		return errors.New("invalid request")
+	}
+	r := bytes.NewReader(message)
+	tag, id, err := readBER(r)
+	if err != nil || tag != berInteger {
+		return errors.New("invalid request")
+	}
+	tag, request, err := readBER(r)
+	if err != nil {
+		return errors.New("invalid request")
+	}
+	if tag == ldapExtendedRequest {
+		tag, name, err := readBER(bytes.NewReader(request))
+		if err == nil && tag == ldapRequestName && string(name) == ldapStartTLSOID {
+			_, err := conn.Write(ldapExtendedResult(id, ldapSuccess, "", ldapStartTLSOID))
+			return err
+		}
+	}
+
+	_, _ = conn.Write(ldapExtendedResult([]byte{0x00}, ldapConfidentialityRequired, "StartTLS is required", ldapNoticeOfDisconnection))
+	return errors.New("client didn't ask for StartTLS")
+}
+
+// Build an extended response with the given message ID, result code,
+// diagnostic message and response name.
+func ldapExtendedResult(id []byte, code byte, diagnostic, name string) []byte {
+	return encodeBER(berSequence,
+		encodeBER(berInteger, id),
+		encodeBER(ldapExtendedResponse,
+			encodeBER(berEnumerated, []byte{code}),
+			encodeBER(berOctetString, nil),
+			encodeBER(berOctetString, []byte(diagnostic)),
+			encodeBER(ldapResponseName, []byte(name))))
+}
+
+// Encode a BER element with the given tag, and the concatenation of values.
+func encodeBER(tag byte, values ...[]byte) []byte {
+	var value []byte
+	for _, v := range values {
+		value = append(value, v...)
+	}
+
+	element := []byte{tag}
+	switch {
+	case len(value) < 0x80:
+		element = append(element, byte(len(value)))
+	case len(value) <= 0xff:
+		element = append(element, 0x81, byte(len(value)))
+	default:
+		element = append(element, 0x82, byte(len(value)>>8), byte(len(value)))
+	}
+	return append(element, value...)
+}
@@ -0,0 +1,220 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// MySQL capability flags.
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+)
+
+const (
+	mysqlProtocolVersion = 10
+	mysqlMaxPacketSize   = 1<<24 - 1
+	mysqlOKPacket        = 0x00
+	mysqlErrPacket       = 0xff
+)
+
+// Ask a MySQL server to upgrade to TLS. The server sends its handshake
+// first, the client answers with an SSLRequest packet, then starts TLS. The
+// handshake of the server is returned (without CLIENT_SSL, as far as the
+// application is concerned it's a plain connection), so that it can be
+// replayed to the application.
+func mysqlClient(conn net.Conn, reader *bufio.Reader) ([]byte, error) {
+	seq, handshake, err := readMySQLPacket(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read handshake: %w", err)
+	}
+	if len(handshake) > 0 && handshake[0] == mysqlErrPacket {
+		return nil, fmt.Errorf("server error: %s", mysqlErrorMessage(handshake))
+	}
+	if len(handshake) == 0 || handshake[0] != mysqlProtocolVersion {
+		return nil, errors.New("unsupported handshake protocol version")
+	}
+
+	// Skip the server version, connection ID and first part of the auth
+	// data to get to the capability flags.
+	end := bytes.IndexByte(handshake[1:], 0)
+	if end < 0 {
+		return nil, errors.New("malformed handshake")
+	}
+	offset := 1 + end + 1 + 4 + 8 + 1
+	if len(handshake) < offset+2 {
+		return nil, errors.New("malformed handshake")
+	}
+	caps := uint32(binary.LittleEndian.Uint16(handshake[offset:]))
+	charset := byte(0x21) // utf8_general_ci
+	if len(handshake) >= offset+7 {
+		charset = handshake[offset+2]
+		caps |= uint32(binary.LittleEndian.Uint16(handshake[offset+5:])) << 16
+	}
+	if caps&mysqlClientSSL == 0 {
+		return nil, errors.New("server doesn't support TLS")
+	}
+
+	request := make([]byte, 32)
+	flags := caps & (mysqlClientLongPassword | mysqlClientProtocol41 | mysqlClientSecureConnection | mysqlClientPluginAuth)
+	binary.LittleEndian.PutUint32(request[0:4], flags|mysqlClientSSL)
+	binary.LittleEndian.PutUint32(request[4:8], mysqlMaxPacketSize)
+	request[8] = charset
+	if _, err := conn.Write(encodeMySQLPacket(seq+1, request)); err != nil {
+		return nil, err
+	}
+
+	handshake[offset+1] &^= byte(mysqlClientSSL >> 8)
+	return encodeMySQLPacket(seq, handshake), nil
+}
+
+// Read a MySQL packet, returning its sequence ID and payload.
+func readMySQLPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+func encodeMySQLPacket(seq byte, payload []byte) []byte {
+	packet := make([]byte, 4+len(payload))
+	packet[0] = byte(len(payload))
+	packet[1] = byte(len(payload) >> 8)
+	packet[2] = byte(len(payload) >> 16)
+	packet[3] = seq
+	copy(packet[4:], payload)
+	return packet
+}
+
+// Message of an ERR packet: error code, then (with CLIENT_PROTOCOL_41) a
+// SQL state marker and SQL state, then the message.
+func mysqlErrorMessage(packet []byte) string {
+	if len(packet) < 3 {
+		return "unknown error"
+	}
+	message := packet[3:]
+	if len(message) >= 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	return fmt.Sprintf("%d %s", binary.LittleEndian.Uint16(packet[1:3]), message)
+}
+
+// mysqlConn is a TLS connection to a MySQL server after an upgrade. The
+// server counted the SSLRequest packet in the sequence IDs of the connection
+// phase, but the application didn't send it, so sequence IDs are adjusted in
+// both directions until the connection phase ends (with an OK or ERR packet
+// from the server). The application also has to keep CLIENT_SSL in its
+// capabilities, as the server expects it.
+type mysqlConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// Handshake of the server, replayed to the application
+	replay []byte
+	// Packets from the server, adjusted but not read yet
+	buffer []byte
+	// Whether the connection phase is over
+	connected atomic.Bool
+
+	mu sync.Mutex
+	// Incomplete packet written by the application
+	pending []byte
+	// Whether the handshake response of the application was sent
+	responded bool
+}
+
+func newMySQLConn(conn net.Conn, handshake []byte) *mysqlConn {
+	return &mysqlConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		replay: handshake,
+	}
+}
+
+func (c *mysqlConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	if len(c.buffer) == 0 {
+		if c.connected.Load() {
+			return c.reader.Read(b)
+		}
+		seq, payload, err := readMySQLPacket(c.reader)
+		if err != nil {
+			return 0, err
+		}
+		if len(payload) > 0 && (payload[0] == mysqlOKPacket || payload[0] == mysqlErrPacket) {
+			c.connected.Store(true)
+		}
+		c.buffer = encodeMySQLPacket(seq-1, payload)
+	}
+	n := copy(b, c.buffer)
+	c.buffer = c.buffer[n:]
+	return n, nil
+}
+
+func (c *mysqlConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.connected.Load() && len(c.pending) == 0 {
+		return c.Conn.Write(b)
+	}
+
+	c.pending = append(c.pending, b...)
+	for len(c.pending) >= 4 {
+		length := int(c.pending[0]) | int(c.pending[1])<<8 | int(c.pending[2])<<16
+		if len(c.pending) < 4+length {
+			break
+		}
+		packet := c.pending[:4+length]
+		if !c.connected.Load() {
+			packet[3]++
+			if !c.responded && length >= 4 {
+				packet[5] |= byte(mysqlClientSSL >> 8)
+				c.responded = true
+			}
+		}
+		if _, err := c.Conn.Write(packet); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[4+length:]
+	}
+	return len(b), nil
+}
+
+// Unwrap returns the underlying connection, e.g. for half-closing it.
+func (c *mysqlConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,112 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Code sent instead of a protocol version in the startup message of a
+// PostgreSQL client to ask for TLS (SSLRequest).
+const postgresSSLRequestCode = 80877103
+
+// Ask a PostgreSQL server to upgrade to TLS. It answers with a single byte,
+// 'S' if it's willing to, 'N' otherwise.
+func postgresClient(conn net.Conn, reader *bufio.Reader) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], postgresSSLRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("unable to read SSLRequest response: %w", err)
+	}
+	switch response {
+	case 'S':
+		return nil
+	case 'N':
+		return errors.New("server doesn't support TLS")
+	default:
+		return fmt.Errorf("unexpected SSLRequest response 0x%02x", response)
+	}
+}
+
+// Code sent by PostgreSQL clients to ask for GSSAPI encryption, which they
+// may try before TLS.
+const postgresGSSENCRequestCode = 80877104
+
+// First byte of a TLS handshake record, sent by PostgreSQL clients that
+// start with TLS right away (sslnegotiation=direct) instead of SSLRequest.
+const tlsHandshakeRecord = 0x16
+
+// Answer the request of a PostgreSQL client to upgrade to TLS. Requests for
+// GSSAPI encryption are declined, so that clients fall back to TLS. Returns
+// true if the client starts with a TLS handshake right away.
+func postgresServer(conn net.Conn, reader *bufio.Reader) (bool, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return false, fmt.Errorf("unable to read startup message: %w", err)
+	}
+	if first[0] == tlsHandshakeRecord {
+		return true, nil
+	}
+
+	for declined := false; ; declined = true {
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return false, fmt.Errorf("unable to read startup message: %w", err)
+		}
+		length := binary.BigEndian.Uint32(request[0:4])
+		code := binary.BigEndian.Uint32(request[4:8])
+		switch {
+		case length == 8 && code == postgresSSLRequestCode:
+			_, err := conn.Write([]byte{'S'})
+			return false, err
+		case length == 8 && code == postgresGSSENCRequestCode && !declined:
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return false, err
+			}
+		default:
+			_, _ = conn.Write(postgresError("28000", "TLS is required"))
+			return false, errors.New("client didn't ask for TLS")
+		}
+	}
+}
+
+// Build a fatal ErrorResponse message, with the given SQLSTATE code.
+func postgresError(code, message string) []byte {
+	fields := []byte{}
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{{'S', "FATAL"}, {'V', "FATAL"}, {'C', code}, {'M', message}} {
+		fields = append(fields, field.kind)
+		fields = append(fields, field.value...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+
+	response := []byte{'E'}
+	response = binary.BigEndian.AppendUint32(response, uint32(4+len(fields)))
+	return append(response, fields...)
+}
@@ -0,0 +1,140 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ServerProtocols lists the protocols for which upgrades can be accepted
+// from clients. MySQL isn't supported, as the handshake of the server would
+// have to come from the target before the client is authenticated.
+var ServerProtocols = []string{Postgres, SMTP, LDAP}
+
+// Server answers the request of a client to upgrade a plain connection to
+// TLS for the given protocol. It returns the connection to do the TLS
+// handshake on, which may replay data that was read ahead (e.g. if a
+// PostgreSQL client started with a TLS handshake right away).
+func Server(conn net.Conn, protocol string) (net.Conn, error) {
+	reader := newPreambleReader(conn)
+
+	var err error
+	switch protocol {
+	case Postgres:
+		var direct bool
+		direct, err = postgresServer(conn, reader)
+		if err == nil && direct {
+			replay, _ := reader.Peek(reader.Buffered())
+			return &replayConn{Conn: conn, replay: replay}, nil
+		}
+	case SMTP:
+		err = smtpServer(conn, reader)
+	case LDAP:
+		err = ldapServer(conn, reader)
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s'", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", protocol, err)
+	}
+	if err := checkNoPendingData(reader); err != nil {
+		return nil, fmt.Errorf("%s: %w", protocol, err)
+	}
+	return conn, nil
+}
+
+type listener struct {
+	net.Listener
+	protocol string
+}
+
+// Listen wraps a listener to accept upgrades to TLS for the given protocol
+// from clients, before the TLS handshake. The upgrade happens on the first
+// read from or write to a connection (e.g. when the TLS handshake starts),
+// so that Accept doesn't block on slow clients.
+func Listen(l net.Listener, protocol string) net.Listener {
+	return &listener{Listener: l, protocol: protocol}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &serverConn{Conn: conn, protocol: l.protocol}, nil
+}
+
+// serverConn runs the upgrade on its first read or write.
+type serverConn struct {
+	net.Conn
+	protocol string
+
+	once     sync.Once
+	err      error
+	upgraded net.Conn
+}
+
+func (c *serverConn) upgrade() error {
+	c.once.Do(func() {
+		c.upgraded, c.err = Server(c.Conn, c.protocol)
+	})
+	return c.err
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	if err := c.upgrade(); err != nil {
+		return 0, err
+	}
+	return c.upgraded.Read(b)
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if err := c.upgrade(); err != nil {
+		return 0, err
+	}
+	return c.upgraded.Write(b)
+}
+
+// Unwrap returns the underlying connection, e.g. for half-closing it.
+func (c *serverConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Target prepares a plain connection to the target of clients that upgraded
+// with Server, as the target doesn't know about the upgrade. For SMTP, the
+// greeting of the target is dropped, as clients already got one before the
+// upgrade, and start their session with EHLO right away.
+func Target(conn net.Conn, protocol string, timeout time.Duration) (net.Conn, error) {
+	if protocol != SMTP {
+		return conn, nil
+	}
+	if timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	reader := bufio.NewReader(conn)
+	if _, _, err := readSMTPReply(reader, 220); err != nil {
+		return nil, fmt.Errorf("%s: target greeting: %w", protocol, err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		replay, _ := reader.Peek(reader.Buffered())
+		return &replayConn{Conn: conn, replay: replay}, nil
+	}
+	return conn, nil
+}
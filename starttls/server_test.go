@@ -0,0 +1,255 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a TLS server that accepts upgrades for the given protocol, and
+// echoes data after the handshake.
+func upgradeServer(t *testing.T, protocol string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	tlsListener := tls.NewListener(Listen(listener, protocol), serverTLSConfig(t))
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				echo(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestServerUnsupportedProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	_, err := Server(server, MySQL)
+	assert.NotNil(t, err, "should reject unsupported protocol")
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	for _, protocol := range ServerProtocols {
+		listener := upgradeServer(t, protocol)
+
+		conn, err := dialUpgraded(t, listener, protocol)
+		assert.Nil(t, err, "should upgrade %s connection", protocol)
+		if conn != nil {
+			if protocol == SMTP {
+				greeting, err := bufio.NewReader(conn).ReadString('\n')
+				assert.Nil(t, err, "should read replayed greeting")
+				assert.True(t, strings.HasPrefix(greeting, "220 "), "should replay greeting")
+			}
+			assertEcho(t, conn, "hello "+protocol)
+			conn.Close()
+		}
+		listener.Close()
+	}
+}
+
+func dialPlain(t *testing.T, listener net.Listener) net.Conn {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err, "should connect")
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestPostgresServerDirectTLS(t *testing.T) {
+	listener := upgradeServer(t, Postgres)
+	defer listener.Close()
+
+	conn := tls.Client(dialPlain(t, listener), clientTLSConfig(t))
+	defer conn.Close()
+	assertEcho(t, conn, "startup message")
+}
+
+func TestPostgresServerDeclinesGSSAPI(t *testing.T) {
+	listener := upgradeServer(t, Postgres)
+	defer listener.Close()
+
+	conn := dialPlain(t, listener)
+	defer conn.Close()
+
+	request := binary.BigEndian.AppendUint32([]byte{0, 0, 0, 8}, postgresGSSENCRequestCode)
+	_, err := conn.Write(request)
+	assert.Nil(t, err, "should write GSSENCRequest")
+	response := make([]byte, 1)
+	_, err = io.ReadFull(conn, response)
+	assert.Nil(t, err, "should read GSSENCRequest response")
+	assert.Equal(t, byte('N'), response[0], "should decline GSSAPI encryption")
+
+	upgrade, err := Client(conn, Postgres)
+	assert.Nil(t, err, "should accept SSLRequest after GSSENCRequest")
+	tlsConn := tls.Client(conn, clientTLSConfig(t))
+	assertEcho(t, upgrade.Wrap(tlsConn), "startup message")
+}
+
+func TestPostgresServerRequiresTLS(t *testing.T) {
+	listener := upgradeServer(t, Postgres)
+	defer listener.Close()
+
+	conn := dialPlain(t, listener)
+	defer conn.Close()
+
+	// StartupMessage for protocol 3.0, without SSLRequest.
+	startup := []byte{0, 0, 0, 9, 0, 3, 0, 0, 0}
+	_, err := conn.Write(startup)
+	assert.Nil(t, err, "should write startup message")
+	response, err := io.ReadAll(conn)
+	assert.Nil(t, err, "should read until connection is closed")
+	assert.Equal(t, postgresError("28000", "TLS is required"), response, "should get error response")
+}
+
+func TestSMTPServerRequiresSTARTTLS(t *testing.T) {
+	listener := upgradeServer(t, SMTP)
+	defer listener.Close()
+
+	conn := dialPlain(t, listener)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, _, err := readSMTPReply(reader, 220)
+	assert.Nil(t, err, "should read greeting")
+
+	_, err = io.WriteString(conn, "EHLO client\r\n")
+	assert.Nil(t, err, "should write EHLO")
+	_, lines, err := readSMTPReply(reader, 250)
+	assert.Nil(t, err, "should read EHLO reply")
+	assert.Contains(t, lines, "STARTTLS", "should advertise STARTTLS")
+
+	_, err = io.WriteString(conn, "MAIL FROM:<a@example.com>\r\n")
+	assert.Nil(t, err, "should write MAIL")
+	_, _, err = readSMTPReply(reader, 530)
+	assert.Nil(t, err, "should refuse MAIL before STARTTLS")
+
+	_, err = io.WriteString(conn, "QUIT\r\n")
+	assert.Nil(t, err, "should write QUIT")
+	_, _, err = readSMTPReply(reader, 221)
+	assert.Nil(t, err, "should say goodbye")
+	_, err = reader.ReadByte()
+	assert.Equal(t, io.EOF, err, "should close connection after QUIT")
+}
+
+func TestSMTPServerTooManyCommands(t *testing.T) {
+	listener := upgradeServer(t, SMTP)
+	defer listener.Close()
+
+	conn := dialPlain(t, listener)
+	defer conn.Close()
+	_, err := io.WriteString(conn, strings.Repeat("NOOP\r\n", maxSMTPCommands+1))
+	assert.Nil(t, err, "should write commands")
+
+	response, err := io.ReadAll(conn)
+	assert.Nil(t, err, "should read until connection is closed")
+	assert.True(t, strings.HasSuffix(string(response), "421 4.7.0 Too many commands before STARTTLS\r\n"), "should refuse too many commands")
+}
+
+func TestSMTPServerInjection(t *testing.T) {
+	listener := upgradeServer(t, SMTP)
+	defer listener.Close()
+
+	conn := dialPlain(t, listener)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, _, err := readSMTPReply(reader, 220)
+	assert.Nil(t, err, "should read greeting")
+
+	// Commands pipelined after STARTTLS would be treated as if they were
+	// sent over TLS.
+	_, err = io.WriteString(conn, "STARTTLS\r\nMAIL FROM:<a@example.com>\r\n")
+	assert.Nil(t, err, "should write commands")
+	_, _, err = readSMTPReply(reader, 220)
+	assert.Nil(t, err, "should accept STARTTLS")
+	_, err = reader.ReadByte()
+	assert.Equal(t, io.EOF, err, "should close connection with pipelined commands")
+}
+
+func TestLDAPServerRequiresStartTLS(t *testing.T) {
+	listener := upgradeServer(t, LDAP)
+	defer listener.Close()
+
+	conn := dialPlain(t, listener)
+	defer conn.Close()
+
+	// Anonymous simple bind request, with message ID 1.
+	bind := encodeBER(berSequence,
+		encodeBER(berInteger, []byte{0x01}),
+		encodeBER(0x60, encodeBER(berInteger, []byte{0x03}), encodeBER(berOctetString, nil), encodeBER(0x80, nil)))
+	_, err := conn.Write(bind)
+	assert.Nil(t, err, "should write bind request")
+
+	response, err := io.ReadAll(conn)
+	assert.Nil(t, err, "should read until connection is closed")
+	expected := ldapExtendedResult([]byte{0x00}, ldapConfidentialityRequired, "StartTLS is required", ldapNoticeOfDisconnection)
+	assert.Equal(t, expected, response, "should get notice of disconnection")
+}
+
+func TestEncodeBER(t *testing.T) {
+	assert.Equal(t, []byte{0x04, 0x02, 'a', 'b'}, encodeBER(berOctetString, []byte("a"), []byte("b")))
+
+	long := encodeBER(berOctetString, make([]byte, 200))
+	assert.Equal(t, []byte{0x04, 0x81, 200}, long[:3], "should use long form length")
+	tag, value, err := readBER(bufio.NewReader(strings.NewReader(string(long))))
+	assert.Nil(t, err, "should read back long form length")
+	assert.Equal(t, byte(berOctetString), tag)
+	assert.Len(t, value, 200)
+
+	longer := encodeBER(berOctetString, make([]byte, 300))
+	assert.Equal(t, []byte{0x04, 0x82, 0x01, 0x2c}, longer[:4], "should use two bytes for longer lengths")
+}
+
+func TestTarget(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn, err := Target(client, Postgres, time.Second)
+	assert.Nil(t, err, "should not touch PostgreSQL targets")
+	assert.Equal(t, client, conn)
+
+	go func() {
+		_, _ = io.WriteString(server, "220-mail.example.com ESMTP\r\n220 ready\r\n250 early\r\n")
+	}()
+	conn, err = Target(client, SMTP, time.Second)
+	assert.Nil(t, err, "should drop greeting of SMTP targets")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err, "should read data after greeting")
+	assert.Equal(t, "250 early\r\n", line)
+
+	go func() {
+		_, _ = io.WriteString(server, "554 go away\r\n")
+	}()
+	_, err = Target(client, SMTP, time.Second)
+	assert.ErrorContains(t, err, "554 go away")
+}
@@ -0,0 +1,144 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Upgrade an SMTP session with STARTTLS (RFC 3207). The greeting of the
+// server is returned, so that it can be replayed to the application, which
+// then starts its own session (with EHLO) over TLS.
+func smtpClient(conn net.Conn, reader *bufio.Reader) ([]byte, error) {
+	greeting, _, err := readSMTPReply(reader, 220)
+	if err != nil {
+		return nil, fmt.Errorf("greeting: %w", err)
+	}
+
+	if _, err := io.WriteString(conn, "EHLO localhost\r\n"); err != nil {
+		return nil, err
+	}
+	_, lines, err := readSMTPReply(reader, 250)
+	if err != nil {
+		return nil, fmt.Errorf("EHLO: %w", err)
+	}
+	// The first line holds the domain of the server, others the extensions.
+	supported := false
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.EqualFold(fields[0], "STARTTLS") {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, errors.New("server doesn't support STARTTLS")
+	}
+
+	if _, err := io.WriteString(conn, "STARTTLS\r\n"); err != nil {
+		return nil, err
+	}
+	if _, _, err := readSMTPReply(reader, 220); err != nil {
+		return nil, fmt.Errorf("STARTTLS: %w", err)
+	}
+	return greeting, nil
+}
+
+// Read a (possibly multi-line) SMTP reply, and check that it has the
+// expected code. Returns the raw reply, and the text of each line.
+func readSMTPReply(reader *bufio.Reader, expect int) ([]byte, []string, error) {
+	var raw []byte
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read reply: %w", err)
+		}
+		raw = append(raw, line...)
+
+		text := strings.TrimRight(line, "\r\n")
+		if len(text) < 3 || (len(text) > 3 && text[3] != ' ' && text[3] != '-') {
+			return nil, nil, fmt.Errorf("malformed reply '%s'", text)
+		}
+		code, err := strconv.Atoi(text[:3])
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed reply '%s'", text)
+		}
+		if code != expect {
+			return nil, nil, fmt.Errorf("unexpected reply '%s'", text)
+		}
+		if len(text) == 3 {
+			return raw, append(lines, ""), nil
+		}
+		lines = append(lines, text[4:])
+		if text[3] == ' ' {
+			return raw, lines, nil
+		}
+	}
+}
+
+// Max number of commands accepted from SMTP clients before STARTTLS.
+const maxSMTPCommands = 10
+
+// Greet an SMTP client and answer its commands until it asks for STARTTLS.
+// Other commands that would need the session of the target are refused.
+func smtpServer(conn net.Conn, reader *bufio.Reader) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if _, err := fmt.Fprintf(conn, "220 %s ESMTP\r\n", hostname); err != nil {
+		return err
+	}
+
+	for i := 0; i < maxSMTPCommands; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("unable to read command: %w", err)
+		}
+		verb := ""
+		if fields := strings.Fields(line); len(fields) > 0 {
+			verb = strings.ToUpper(fields[0])
+		}
+
+		var reply string
+		switch verb {
+		case "EHLO":
+			reply = fmt.Sprintf("250-%s\r\n250 STARTTLS\r\n", hostname)
+		case "HELO":
+			reply = fmt.Sprintf("250 %s\r\n", hostname)
+		case "STARTTLS":
+			_, err := io.WriteString(conn, "220 2.0.0 Ready to start TLS\r\n")
+			return err
+		case "NOOP", "RSET":
+			reply = "250 2.0.0 OK\r\n"
+		case "QUIT":
+			_, _ = io.WriteString(conn, "221 2.0.0 Bye\r\n")
+			return errors.New("client quit before STARTTLS")
+		default:
+			reply = "530 5.7.0 Must issue a STARTTLS command first\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return err
+		}
+	}
+	_, _ = io.WriteString(conn, "421 4.7.0 Too many commands before STARTTLS\r\n")
+	return errors.New("too many commands before STARTTLS")
+}
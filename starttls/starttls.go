@@ -0,0 +1,179 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Protocols with in-protocol upgrades to TLS.
+const (
+	Postgres = "postgres"
+	MySQL    = "mysql"
+	SMTP     = "smtp"
+	LDAP     = "ldap"
+)
+
+// Protocols lists the supported protocols.
+var Protocols = []string{Postgres, MySQL, SMTP, LDAP}
+
+// Max size of the messages exchanged before the TLS handshake.
+const maxPreamble = 64 * 1024
+
+// Dialer is an interface for dialers, e.g. a net.Dialer.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// Upgrade holds the state of an upgrade negotiated with a server that is
+// still needed once TLS is established.
+type Upgrade struct {
+	protocol string
+	// Greeting of the server, replayed to the application (if any)
+	greeting []byte
+}
+
+// Client negotiates the upgrade to TLS for the given protocol on a plain
+// connection to a server. Once the TLS handshake on conn is done, the TLS
+// connection should be passed to Wrap.
+func Client(conn net.Conn, protocol string) (*Upgrade, error) {
+	reader := newPreambleReader(conn)
+	upgrade := &Upgrade{protocol: protocol}
+
+	var err error
+	switch protocol {
+	case Postgres:
+		err = postgresClient(conn, reader)
+	case MySQL:
+		upgrade.greeting, err = mysqlClient(conn, reader)
+	case SMTP:
+		upgrade.greeting, err = smtpClient(conn, reader)
+	case LDAP:
+		err = ldapClient(conn, reader)
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s'", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", protocol, err)
+	}
+	if err := checkNoPendingData(reader); err != nil {
+		return nil, fmt.Errorf("%s: %w", protocol, err)
+	}
+	return upgrade, nil
+}
+
+// Wrap wraps the TLS connection established after the upgrade, so that the
+// application sees the protocol like it would without TLS (e.g. it gets the
+// greeting of the server that was consumed by the upgrade).
+func (u *Upgrade) Wrap(conn net.Conn) net.Conn {
+	switch u.protocol {
+	case MySQL:
+		return newMySQLConn(conn, u.greeting)
+	case SMTP:
+		return &replayConn{Conn: conn, replay: u.greeting}
+	}
+	return conn
+}
+
+// Read messages before the TLS handshake, up to maxPreamble bytes.
+func newPreambleReader(conn net.Conn) *bufio.Reader {
+	return bufio.NewReader(&io.LimitedReader{R: conn, N: maxPreamble})
+}
+
+// Data sent by the peer before the TLS handshake would be treated as if it
+// was protected by TLS (see CVE-2011-0411), so we refuse it.
+func checkNoPendingData(reader *bufio.Reader) error {
+	if reader.Buffered() > 0 {
+		return fmt.Errorf("unexpected data before TLS handshake")
+	}
+	return nil
+}
+
+type upgradeDialer struct {
+	protocol string
+	dialer   Dialer
+	timeout  time.Duration
+}
+
+// NewDialer returns a dialer that negotiates the upgrade to TLS on
+// connections from the given dialer, within the timeout. It's meant to be
+// used as the underlying dialer of a TLS dialer (e.g. from
+// certloader.DialerWithCertificate), whose connections are then passed to
+// Upgraded.
+func NewDialer(protocol string, dialer Dialer, timeout time.Duration) Dialer {
+	return &upgradeDialer{protocol: protocol, dialer: dialer, timeout: timeout}
+}
+
+func (d *upgradeDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+	upgrade, err := Client(conn, d.protocol)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &upgradedConn{Conn: conn, upgrade: upgrade}, nil
+}
+
+// upgradedConn is a plain connection on which the upgrade to TLS was
+// negotiated, returned by dialers from NewDialer.
+type upgradedConn struct {
+	net.Conn
+	upgrade *Upgrade
+}
+
+// Upgraded wraps a TLS connection established on top of a connection from
+// NewDialer (see Upgrade.Wrap). Other connections are returned as is.
+func Upgraded(conn net.Conn) net.Conn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if uc, ok := tlsConn.NetConn().(*upgradedConn); ok {
+			return uc.upgrade.Wrap(conn)
+		}
+	}
+	return conn
+}
+
+// replayConn returns data that was consumed during the upgrade (e.g. the
+// greeting of the server) on its first reads, before reading from the
+// connection.
+type replayConn struct {
+	net.Conn
+	replay []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// Unwrap returns the underlying connection, e.g. for half-closing it.
+func (c *replayConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,387 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serverTLSConfig(t *testing.T) *tls.Config {
+	cert, err := tls.LoadX509KeyPair("../test-keys/server-cert.pem", "../test-keys/server-key.pem")
+	assert.Nil(t, err, "should load test server certificate")
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func clientTLSConfig(t *testing.T) *tls.Config {
+	ca, err := os.ReadFile("../test-keys/cacert.pem")
+	assert.Nil(t, err, "should load test CA")
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	return &tls.Config{RootCAs: pool, ServerName: "localhost"}
+}
+
+// Start a server that runs the given preamble on plain connections, then
+// does a TLS handshake and runs the session on the TLS connection. If the
+// preamble returns false, the connection is closed instead.
+func fakeServer(t *testing.T, preamble func(net.Conn, *bufio.Reader) bool, session func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	config := serverTLSConfig(t)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				reader := bufio.NewReader(conn)
+				if !preamble(conn, reader) {
+					return
+				}
+				tlsConn := tls.Server(&bufferedConn{conn, reader}, config)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				session(tlsConn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// bufferedConn reads from a reader that may hold data past the preamble
+// (e.g. a MySQL client doesn't wait for anything before its ClientHello).
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func dialUpgraded(t *testing.T, listener net.Listener, protocol string) (net.Conn, error) {
+	dialer := NewDialer(protocol, &net.Dialer{}, 5*time.Second)
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, clientTLSConfig(t))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	return Upgraded(tlsConn), nil
+}
+
+func echo(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+func assertEcho(t *testing.T, conn net.Conn, message string) {
+	_, err := conn.Write([]byte(message))
+	assert.Nil(t, err, "should be able to write")
+
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should be able to read echo")
+	assert.Equal(t, message, string(received))
+}
+
+func TestUnsupportedProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	_, err := Client(client, "ftp")
+	assert.NotNil(t, err, "should reject unsupported protocol")
+}
+
+func TestUpgradedPassthrough(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	assert.Equal(t, client, Upgraded(client), "should return plain connections as is")
+	tlsConn := tls.Client(client, &tls.Config{})
+	assert.Equal(t, net.Conn(tlsConn), Upgraded(tlsConn), "should return TLS connections without upgrade as is")
+}
+
+func postgresPreamble(response byte) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return false
+		}
+		if !bytes.Equal(request, []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}) {
+			return false
+		}
+		_, _ = conn.Write([]byte{response})
+		return response == 'S'
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	listener := fakeServer(t, postgresPreamble('S'), echo)
+	defer listener.Close()
+
+	conn, err := dialUpgraded(t, listener, Postgres)
+	assert.Nil(t, err, "should upgrade connection")
+	defer conn.Close()
+
+	assertEcho(t, conn, "startup message")
+}
+
+func TestPostgresRefused(t *testing.T) {
+	listener := fakeServer(t, postgresPreamble('N'), echo)
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, Postgres)
+	assert.ErrorContains(t, err, "doesn't support TLS")
+}
+
+const smtpGreeting = "220-mail.example.com ESMTP\r\n220 ready\r\n"
+
+func smtpPreamble(capabilities, response string) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		_, _ = io.WriteString(conn, smtpGreeting)
+		if line, err := reader.ReadString('\n'); err != nil || line != "EHLO localhost\r\n" {
+			return false
+		}
+		_, _ = io.WriteString(conn, "250-mail.example.com\r\n"+capabilities)
+		if line, err := reader.ReadString('\n'); err != nil || line != "STARTTLS\r\n" {
+			return false
+		}
+		_, _ = io.WriteString(conn, response)
+		return true
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	listener := fakeServer(t, smtpPreamble("250-PIPELINING\r\n250 STARTTLS\r\n", "220 go ahead\r\n"), echo)
+	defer listener.Close()
+
+	conn, err := dialUpgraded(t, listener, SMTP)
+	assert.Nil(t, err, "should upgrade connection")
+	defer conn.Close()
+
+	greeting := make([]byte, len(smtpGreeting))
+	_, err = io.ReadFull(conn, greeting)
+	assert.Nil(t, err, "should read replayed greeting")
+	assert.Equal(t, smtpGreeting, string(greeting))
+
+	assertEcho(t, conn, "EHLO client\r\n")
+}
+
+func TestSMTPNotSupported(t *testing.T) {
+	listener := fakeServer(t, smtpPreamble("250 PIPELINING\r\n", "220 go ahead\r\n"), echo)
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, SMTP)
+	assert.ErrorContains(t, err, "doesn't support STARTTLS")
+}
+
+func TestSMTPRefused(t *testing.T) {
+	listener := fakeServer(t, smtpPreamble("250 STARTTLS\r\n", "454 TLS not available\r\n"), echo)
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, SMTP)
+	assert.ErrorContains(t, err, "454 TLS not available")
+}
+
+func TestSMTPInjection(t *testing.T) {
+	listener := fakeServer(t, smtpPreamble("250 STARTTLS\r\n", "220 go ahead\r\n250 injected\r\n"), echo)
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, SMTP)
+	assert.ErrorContains(t, err, "unexpected data before TLS handshake")
+}
+
+func ldapPreamble(response []byte) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		request := make([]byte, len(ldapStartTLSRequest))
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return false
+		}
+		if !bytes.Equal(request, ldapStartTLSRequest) {
+			return false
+		}
+		_, _ = conn.Write(response)
+		return true
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	// Extended response with message ID 1, result code 0 (success), empty
+	// matched DN and diagnostic message.
+	response := []byte{0x30, 0x0c, 0x02, 0x01, 0x01, 0x78, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00}
+	listener := fakeServer(t, ldapPreamble(response), echo)
+	defer listener.Close()
+
+	conn, err := dialUpgraded(t, listener, LDAP)
+	assert.Nil(t, err, "should upgrade connection")
+	defer conn.Close()
+
+	assertEcho(t, conn, "bind request")
+}
+
+func TestLDAPRefused(t *testing.T) {
+	// Extended response with result code 2 (protocolError), diagnostic "no".
+	response := []byte{0x30, 0x0e, 0x02, 0x01, 0x01, 0x78, 0x09, 0x0a, 0x01, 0x02, 0x04, 0x00, 0x04, 0x02, 'n', 'o'}
+	listener := fakeServer(t, ldapPreamble(response), echo)
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, LDAP)
+	assert.ErrorContains(t, err, "result code 2 (no)")
+}
+
+func TestReadBER(t *testing.T) {
+	tag, value, err := readBER(bytes.NewReader([]byte{0x04, 0x81, 0x03, 'a', 'b', 'c'}))
+	assert.Nil(t, err, "should read long form length")
+	assert.Equal(t, byte(0x04), tag)
+	assert.Equal(t, []byte("abc"), value)
+
+	_, _, err = readBER(bytes.NewReader([]byte{0x30, 0x80}))
+	assert.NotNil(t, err, "should reject indefinite length")
+
+	_, _, err = readBER(bytes.NewReader([]byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff}))
+	assert.NotNil(t, err, "should reject oversized elements")
+
+	_, _, err = readBER(bytes.NewReader([]byte{0x04, 0x05, 'a'}))
+	assert.NotNil(t, err, "should reject truncated elements")
+}
+
+// Handshake packet of a server, with the given capabilities.
+func mysqlHandshake(caps uint32) []byte {
+	payload := []byte{mysqlProtocolVersion}
+	payload = append(payload, "8.0.0\x00"...)
+	payload = append(payload, 1, 0, 0, 0)
+	payload = append(payload, "12345678\x00"...)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(caps))
+	payload = append(payload, 0x21, 0x02, 0x00)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(caps>>16))
+	payload = append(payload, 21)
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, "123456789012\x00"...)
+	payload = append(payload, "mysql_native_password\x00"...)
+	return payload
+}
+
+const mysqlServerCaps = mysqlClientLongPassword | mysqlClientProtocol41 | mysqlClientSecureConnection | mysqlClientPluginAuth
+
+func mysqlPreamble(t *testing.T, caps uint32) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		_, _ = conn.Write(encodeMySQLPacket(0, mysqlHandshake(caps)))
+		seq, request, err := readMySQLPacket(reader)
+		if err != nil {
+			return false
+		}
+		assert.Equal(t, byte(1), seq, "SSLRequest should have sequence ID 1")
+		assert.Len(t, request, 32, "SSLRequest should have 32 bytes")
+		assert.NotZero(t, binary.LittleEndian.Uint32(request)&mysqlClientSSL, "SSLRequest should have CLIENT_SSL")
+		return true
+	}
+}
+
+// Session of a server after the upgrade: expects the handshake response
+// (counting the SSLRequest), answers with OK, then echoes commands.
+func mysqlSession(t *testing.T) func(net.Conn) {
+	return func(conn net.Conn) {
+		seq, response, err := readMySQLPacket(conn)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, byte(2), seq, "handshake response should have sequence ID 2")
+		assert.NotZero(t, binary.LittleEndian.Uint32(response)&mysqlClientSSL, "handshake response should have CLIENT_SSL")
+		assert.Equal(t, "response", string(response[4:]))
+		_, _ = conn.Write(encodeMySQLPacket(seq+1, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0}))
+
+		for {
+			seq, command, err := readMySQLPacket(conn)
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(encodeMySQLPacket(seq+1, command))
+		}
+	}
+}
+
+func TestMySQL(t *testing.T) {
+	listener := fakeServer(t, mysqlPreamble(t, mysqlServerCaps|mysqlClientSSL), mysqlSession(t))
+	defer listener.Close()
+
+	conn, err := dialUpgraded(t, listener, MySQL)
+	assert.Nil(t, err, "should upgrade connection")
+	defer conn.Close()
+
+	seq, handshake, err := readMySQLPacket(conn)
+	assert.Nil(t, err, "should read replayed handshake")
+	assert.Equal(t, byte(0), seq)
+	assert.Equal(t, mysqlHandshake(mysqlServerCaps), handshake, "should replay handshake without CLIENT_SSL")
+
+	// Handshake response, written in two parts.
+	response := encodeMySQLPacket(1, append(binary.LittleEndian.AppendUint32(nil, mysqlClientProtocol41), "response"...))
+	_, err = conn.Write(response[:6])
+	assert.Nil(t, err, "should write first part of handshake response")
+	_, err = conn.Write(response[6:])
+	assert.Nil(t, err, "should write second part of handshake response")
+
+	seq, ok, err := readMySQLPacket(conn)
+	assert.Nil(t, err, "should read OK packet")
+	assert.Equal(t, byte(2), seq, "should adjust sequence ID of OK packet")
+	assert.Equal(t, byte(mysqlOKPacket), ok[0])
+
+	// After the connection phase, packets are passed through.
+	_, err = conn.Write(encodeMySQLPacket(0, []byte("\x03SELECT 1")))
+	assert.Nil(t, err, "should write command")
+	seq, result, err := readMySQLPacket(conn)
+	assert.Nil(t, err, "should read command result")
+	assert.Equal(t, byte(1), seq, "should pass sequence IDs through after connection phase")
+	assert.Equal(t, "\x03SELECT 1", string(result))
+}
+
+func TestMySQLNotSupported(t *testing.T) {
+	listener := fakeServer(t, mysqlPreamble(t, mysqlServerCaps), mysqlSession(t))
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, MySQL)
+	assert.ErrorContains(t, err, "doesn't support TLS")
+}
+
+func TestMySQLError(t *testing.T) {
+	listener := fakeServer(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		_, _ = conn.Write(encodeMySQLPacket(0, append([]byte{mysqlErrPacket, 0x69, 0x04}, "Host not allowed"...)))
+		return false
+	}, echo)
+	defer listener.Close()
+
+	_, err := dialUpgraded(t, listener, MySQL)
+	assert.ErrorContains(t, err, "1129 Host not allowed")
+}
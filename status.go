@@ -25,6 +25,8 @@ import (
 	"runtime"
 	"sync"
 	"time"
+
+	"github.com/ghostunnel/ghostunnel/backend"
 )
 
 type statusDialer struct {
@@ -47,6 +49,14 @@ type statusHandler struct {
 	listenAddress       string
 	forwardAddress      string
 	statusTargetAddress string
+	// Status of backends, if balancing or failing over between multiple targets
+	backends     func() []backend.Status
+	activeTarget func() string
+	// Config file and tunnel status (only in run mode)
+	configPath string
+	tunnels    func() []tunnelStatus
+	// Outcome of the most recent config reload (only in run mode)
+	lastReloadResult *reloadResult
 	// Current status
 	listening bool
 	reloading bool
@@ -56,19 +66,23 @@ type statusHandler struct {
 }
 
 type statusResponse struct {
-	Ok             bool      `json:"ok"`
-	Status         string    `json:"status"`
-	ListenAddress  string    `json:"listen_address"`
-	ForwardAddress string    `json:"forward_address"`
-	BackendOk      bool      `json:"backend_ok"`
-	BackendStatus  string    `json:"backend_status"`
-	BackendError   string    `json:"backend_error,omitempty"`
-	Time           time.Time `json:"time"`
-	LastReload     time.Time `json:"last_reload,omitempty"`
-	Hostname       string    `json:"hostname,omitempty"`
-	Message        string    `json:"message"`
-	Revision       string    `json:"revision"`
-	Compiler       string    `json:"compiler"`
+	Ok             bool             `json:"ok"`
+	Status         string           `json:"status"`
+	ListenAddress  string           `json:"listen_address"`
+	ForwardAddress string           `json:"forward_address"`
+	BackendOk      bool             `json:"backend_ok"`
+	BackendStatus  string           `json:"backend_status"`
+	BackendError   string           `json:"backend_error,omitempty"`
+	Time           time.Time        `json:"time"`
+	LastReload     time.Time        `json:"last_reload,omitempty"`
+	Hostname       string           `json:"hostname,omitempty"`
+	Message        string           `json:"message"`
+	Revision       string           `json:"revision"`
+	Compiler       string           `json:"compiler"`
+	ActiveTarget   string           `json:"active_target,omitempty"`
+	Backends       []backend.Status `json:"backends,omitempty"`
+	Tunnels        []tunnelStatus   `json:"tunnels,omitempty"`
+	ReloadResult   *reloadResult    `json:"last_reload_result,omitempty"`
 }
 
 func newStatusHandler(dial func() (net.Conn, error), command, listenAddress, forwardAddress, statusTargetAddress string) *statusHandler {
@@ -95,7 +109,7 @@ func newStatusHandler(dial func() (net.Conn, error), command, listenAddress, for
 
 func (s *statusHandler) Listening() {
 	systemdNotifyReady()
-	systemdNotifyStatus(fmt.Sprintf("listening | %s proxying %s => %s", s.command, s.listenAddress, s.forwardAddress))
+	systemdNotifyStatus(fmt.Sprintf("listening | %s", s.description()))
 	s.mu.Lock()
 	s.listening = true
 	s.reloading = false
@@ -104,16 +118,23 @@ func (s *statusHandler) Listening() {
 
 func (s *statusHandler) Reloading() {
 	systemdNotifyReloading()
-	systemdNotifyStatus(fmt.Sprintf("reloading | %s proxying %s => %s", s.command, s.listenAddress, s.forwardAddress))
+	systemdNotifyStatus(fmt.Sprintf("reloading | %s", s.description()))
 	s.mu.Lock()
 	s.reloading = true
 	s.lastReload = time.Now()
 	s.mu.Unlock()
 }
 
+// ReloadResult records the outcome of reloading the config file.
+func (s *statusHandler) ReloadResult(result reloadResult) {
+	s.mu.Lock()
+	s.lastReloadResult = &result
+	s.mu.Unlock()
+}
+
 func (s *statusHandler) Stopping() {
 	systemdNotifyStopping()
-	systemdNotifyStatus(fmt.Sprintf("stopping | %s proxying %s => %s", s.command, s.listenAddress, s.forwardAddress))
+	systemdNotifyStatus(fmt.Sprintf("stopping | %s", s.description()))
 	s.mu.Lock()
 	s.listening = false
 	s.reloading = false
@@ -121,6 +142,14 @@ func (s *statusHandler) Stopping() {
 	s.mu.Unlock()
 }
 
+// Short description of what we're doing, for systemd status messages
+func (s *statusHandler) description() string {
+	if s.tunnels != nil {
+		return fmt.Sprintf("%s serving tunnels from %s", s.command, s.configPath)
+	}
+	return fmt.Sprintf("%s proxying %s => %s", s.command, s.listenAddress, s.forwardAddress)
+}
+
 func (s *statusHandler) HandleWatchdog() {
 	// TODO(cs): Figure out a better status check for the watchdog.
 	// We don't want the backend check here, because restarting Ghostunnel
@@ -146,14 +175,32 @@ func (s *statusHandler) status() statusResponse {
 	resp.BackendOk = true
 	resp.BackendStatus = "ok"
 
-	if err := s.checkBackendStatus(); err != nil {
+	if s.tunnels != nil {
+		// In run mode, the backend is considered ok only if all tunnels are.
+		resp.Tunnels = s.tunnels()
+		for _, tunnel := range resp.Tunnels {
+			if !tunnel.Ok {
+				resp.BackendOk = false
+				resp.BackendError = fmt.Sprintf("tunnel '%s': %s", tunnel.Name, tunnel.BackendError)
+				resp.BackendStatus = "critical"
+				break
+			}
+		}
+	} else if err := s.checkBackendStatus(); err != nil {
 		resp.BackendOk = false
 		resp.BackendError = err.Error()
 		resp.BackendStatus = "critical"
 	}
+	if s.backends != nil {
+		resp.Backends = s.backends()
+	}
+	if s.activeTarget != nil {
+		resp.ActiveTarget = s.activeTarget()
+	}
 
 	s.mu.Lock()
 	resp.Ok = s.listening && resp.BackendOk
+	resp.ReloadResult = s.lastReloadResult
 	if s.stopping {
 		resp.Message = "stopping"
 	} else if s.reloading {
@@ -194,7 +241,8 @@ func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *statusHandler) checkBackendStatus() error {
 	// If a statusTargetAddress was supplied attempt a HTTP status check.
-	// Otherwise, fallback to a raw TCP status check.
+	// Otherwise, fallback to a raw TCP status check (unless there's no fixed
+	// target, e.g. for forward proxies).
 	if s.statusTargetAddress != "" {
 		resp, err := s.client.Get(s.statusTargetAddress)
 		if err != nil {
@@ -205,7 +253,7 @@ func (s *statusHandler) checkBackendStatus() error {
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("target returned status: %d", resp.StatusCode)
 		}
-	} else {
+	} else if s.dial != nil {
 		conn, err := s.dial()
 		if err != nil {
 			return err
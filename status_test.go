@@ -28,6 +28,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -268,3 +269,29 @@ func statusTargetWithResponseStatusCode(code int) (statusResponse, int) {
 
 	return statusResp, res.StatusCode
 }
+
+func TestStatusHandlerTunnels(t *testing.T) {
+	handler := newStatusHandler(nil, "run", "", "", "")
+	handler.configPath = "config.yaml"
+	handler.tunnels = func() []tunnelStatus {
+		return []tunnelStatus{{Name: "a", Ok: true}}
+	}
+	handler.Listening()
+
+	resp := handler.status()
+	if !resp.Ok || len(resp.Tunnels) != 1 {
+		t.Error("status should be ok and list tunnels if all tunnels are ok")
+	}
+
+	handler.tunnels = func() []tunnelStatus {
+		return []tunnelStatus{{Name: "a", Ok: true}, {Name: "b", Ok: false, BackendError: "down"}}
+	}
+
+	resp = handler.status()
+	if resp.Ok || resp.BackendStatus != "critical" {
+		t.Error("status should be critical if a tunnel is down")
+	}
+	if !strings.Contains(resp.BackendError, "tunnel 'b'") {
+		t.Error("backend error should name the tunnel that is down")
+	}
+}
@@ -0,0 +1,71 @@
+#!/usr/bin/env python3
+
+"""
+Test that client and server negotiate a protocol via ALPN, and that server
+mode forwards connections to the target for the negotiated protocol.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, TlsClient, print_ok, run_ghostunnel, terminate, \
+                   urlopen
+import json
+
+if __name__ == "__main__":
+    ghostunnel_server = None
+    ghostunnel_client = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel server, with a separate target for h2
+        ghostunnel_server = run_ghostunnel(['server',
+                                            '--listen={0}:13001'.format(LOCALHOST),
+                                            '--target={0}:13002'.format(LOCALHOST),
+                                            '--alpn=h2',
+                                            '--alpn=http/1.1',
+                                            '--alpn-target=h2={0}:13003'.format(LOCALHOST),
+                                            '--keystore=server.p12',
+                                            '--cacert=root.crt',
+                                            '--allow-ou=client',
+                                            '--status={0}:{1}'.format(LOCALHOST,
+                                                                      STATUS_PORT)])
+
+        # start ghostunnel client, requesting h2
+        ghostunnel_client = run_ghostunnel(['client',
+                                            '--listen={0}:13004'.format(LOCALHOST),
+                                            '--target=localhost:13001',
+                                            '--alpn=h2',
+                                            '--keystore=client.p12',
+                                            '--cacert=root.crt',
+                                            '--status={0}:13005'.format(LOCALHOST)])
+
+        # block until both are up
+        TcpClient(STATUS_PORT).connect(20)
+        TcpClient(13005).connect(20)
+
+        # connections that negotiated h2 go to the h2 target
+        pair = SocketPair(TcpClient(13004), TcpServer(13003))
+        pair.validate_can_send_from_client("toto", "h2 connection reaches h2 target")
+        pair.validate_can_send_from_server("titi", "h2 connection reaches h2 target")
+        pair.cleanup()
+        print_ok("h2 connection forwarded to h2 target")
+
+        # connections without ALPN go to the default target
+        pair = SocketPair(TlsClient('client', 'root', 13001), TcpServer(13002))
+        pair.validate_can_send_from_client("toto", "connection reaches default target")
+        pair.cleanup()
+        print_ok("connection without ALPN forwarded to default target")
+
+        # negotiated protocols are counted
+        metrics = json.loads(str(urlopen(
+            "https://{0}:{1}/_metrics/json".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+        if 'ghostunnel.conn.alpn.h2' not in [item['metric'] for item in metrics]:
+            raise Exception("missing metric for negotiated protocol")
+        print_ok("negotiated protocol is counted")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel_client)
+        terminate(ghostunnel_server)
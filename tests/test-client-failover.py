@@ -0,0 +1,63 @@
+#!/usr/bin/env python3
+
+"""
+Test that client mode fails over between multiple targets in order of
+priority, and goes back to the first target once it's up again.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TlsServer, print_ok, run_ghostunnel, terminate, status_info
+import time
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['client',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target=localhost:13002',
+                                     '--target=localhost:13003',
+                                     '--target-backoff=1s',
+                                     '--target-max-backoff=2s',
+                                     '--keystore=client.p12',
+                                     '--cacert=root.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # first target is down, connection goes to second target
+        pair = SocketPair(TcpClient(13001), TlsServer('server', 'root', 13003))
+        pair.validate_can_send_from_client("toto", "failed over to second target")
+        pair.validate_can_send_from_server("titi", "failed over to second target")
+        pair.cleanup()
+
+        # note: the status check dials through the tunnel, and both targets
+        # are down at this point, but the active target stays the same.
+        status = status_info()
+        if status['active_target'] != 'localhost:13003':
+            raise Exception("unexpected active target: {0}".format(status['active_target']))
+        if [b['address'] for b in status['backends']] != ['localhost:13002', 'localhost:13003']:
+            raise Exception("unexpected backends: {0}".format(status['backends']))
+        print_ok("status reports second target as active")
+
+        # once the backoff expires, first target takes over again
+        time.sleep(3)
+        pair = SocketPair(TcpClient(13001), TlsServer('server', 'root', 13002))
+        pair.validate_can_send_from_client("toto", "back on first target")
+        pair.cleanup()
+
+        status = status_info()
+        if status['active_target'] != 'localhost:13002':
+            raise Exception("unexpected active target: {0}".format(status['active_target']))
+        print_ok("status reports first target as active")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,75 @@
+#!/usr/bin/env python3
+
+"""
+Test that a client with --forward-proxy connects to the destination requested
+with HTTP CONNECT, and denies destinations that aren't allowed (via SOCKS5).
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, TlsServer, \
+                   print_ok, run_ghostunnel, terminate
+import struct
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['client',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--forward-proxy=connect',
+                                     '--forward-proxy=socks5',
+                                     '--allow-destination=localhost:13002',
+                                     '--keystore=client.p12',
+                                     '--cacert=root.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+        TcpClient(STATUS_PORT).connect(20)
+
+        # allowed destination, with HTTP CONNECT
+        server = TlsServer('server', 'root', 13002)
+        server.listen()
+        client = TcpClient(13001)
+        client.connect(msg='connected to forward proxy')
+        client.get_socket().send(
+            b'CONNECT localhost:13002 HTTP/1.1\r\nHost: localhost:13002\r\n\r\n')
+        server.accept()
+        server.validate_client_cert('client')
+
+        response = b''
+        while not response.endswith(b'\r\n\r\n'):
+            response += client.get_socket().recv(1)
+        if not response.startswith(b'HTTP/1.1 200'):
+            raise Exception('unexpected CONNECT response: {0}'.format(response))
+        print_ok('got CONNECT response: {0}'.format(response.split(b'\r\n')[0]))
+
+        client.get_socket().send(b'hello world')
+        if server.get_socket().recv(11) != b'hello world':
+            raise Exception('did not receive expected string on server')
+        server.get_socket().send(b'hello world')
+        if client.get_socket().recv(11) != b'hello world':
+            raise Exception('did not receive expected string on client')
+        print_ok('sent data through forward proxy')
+        client.cleanup()
+        server.cleanup()
+
+        # destination that isn't allowed, with SOCKS5
+        client = TcpClient(13001)
+        client.connect(msg='connected to forward proxy')
+        client.get_socket().send(b'\x05\x01\x00')
+        if client.get_socket().recv(2) != b'\x05\x00':
+            raise Exception('unexpected SOCKS5 method selection')
+        client.get_socket().send(b'\x05\x01\x00\x03' + bytes([len(b'localhost')]) +
+                                 b'localhost' + struct.pack('>H', 13003))
+        reply = client.get_socket().recv(10)
+        if reply[:2] != b'\x05\x02':
+            raise Exception('destination should not be allowed: {0}'.format(reply))
+        print_ok('destination not allowed by ruleset')
+        client.cleanup()
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,59 @@
+#!/usr/bin/env python3
+
+"""
+Test that ensures that client mode can terminate TLS on its listener, with
+a certificate and client CA from a different PKI than the one of the target.
+"""
+
+from common import LOCALHOST, STATUS_PORT, print_ok, run_ghostunnel, terminate, RootCert, SocketPair, TlsClient, TlsServer
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # PKI between ghostunnel and the server
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # PKI between applications and ghostunnel
+        app_root = RootCert('approot')
+        app_root.create_signed_cert('listener')
+        app_root.create_signed_cert('app')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['client',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target=localhost:13002',
+                                     '--keystore=client.p12',
+                                     '--cacert=root.crt',
+                                     '--verify-ou=server',
+                                     '--listen-cert=listener.crt',
+                                     '--listen-key=listener.key',
+                                     '--listen-cacert=approot.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # connect with an application certificate, confirm that the tunnel is
+        # up and that the server sees the client certificate
+        pair = SocketPair(
+            TlsClient('app', 'approot', 13001), TlsServer('server', 'root', 13002))
+        pair.validate_can_send_from_client(
+            "hello world", "1: client -> server")
+        pair.validate_can_send_from_server(
+            "hello world", "1: server -> client")
+        pair.validate_client_cert("client", "1: server sees client certificate")
+        pair.validate_closing_client_closes_server(
+            "1: client closed -> server closed")
+
+        # applications with a certificate from the other PKI are rejected
+        try:
+            TlsClient('client', 'approot', 13001).connect().get_socket().recv(1)
+            raise Exception("application with untrusted certificate should be rejected")
+        except Exception as e:
+            if "should be rejected" in str(e):
+                raise e
+        print_ok("2: untrusted application rejected")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
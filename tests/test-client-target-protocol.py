@@ -0,0 +1,75 @@
+#!/usr/bin/env python3
+
+"""
+Test that ensures that client mode can upgrade connections to targets that
+speak TLS in-protocol (here, PostgreSQL with SSLRequest) before the handshake.
+"""
+
+import socket
+import ssl
+
+from common import LOCALHOST, STATUS_PORT, TIMEOUT, print_ok, run_ghostunnel, terminate, wrap_socket, RootCert, SocketPair, TcpClient, TlsServer
+
+SSL_REQUEST = b'\x00\x00\x00\x08\x04\xd2\x16\x2f'
+
+
+class PostgresServer(TlsServer):
+    """Fake PostgreSQL server, which only speaks TLS after an SSLRequest."""
+
+    def listen(self):
+        self.listener = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        self.listener.settimeout(TIMEOUT)
+        self.listener.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        self.listener.bind((LOCALHOST, self.port))
+        self.listener.listen(1)
+
+    def accept(self):
+        sock, _ = self.listener.accept()
+        sock.settimeout(TIMEOUT)
+        self.listener.close()
+        request = b''
+        while len(request) < len(SSL_REQUEST):
+            request += sock.recv(len(SSL_REQUEST) - len(request))
+        if request != SSL_REQUEST:
+            raise Exception("unexpected startup message: {0}".format(request))
+        sock.sendall(b'S')
+        self.socket = wrap_socket(sock,
+                                  server_side=True,
+                                  keyfile='{0}.key'.format(self.cert),
+                                  certfile='{0}.crt'.format(self.cert),
+                                  ca_certs='{0}.crt'.format(self.ca),
+                                  cert_reqs=ssl.CERT_REQUIRED)
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['client',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target=localhost:13002',
+                                     '--keystore=client.p12',
+                                     '--cacert=root.crt',
+                                     '--verify-ou=server',
+                                     '--target-protocol=postgres',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # connect in plain text, confirm that the tunnel is up and that the
+        # server sees the client certificate after the upgrade
+        pair = SocketPair(TcpClient(13001), PostgresServer('server', 'root', 13002))
+        pair.validate_can_send_from_client(
+            "hello world", "1: client -> server")
+        pair.validate_can_send_from_server(
+            "hello world", "1: server -> client")
+        pair.validate_client_cert("client", "1: server sees client certificate")
+        pair.validate_closing_client_closes_server(
+            "1: client closed -> server closed")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,86 @@
+#!/usr/bin/env python3
+
+"""
+Test that a client with --connect-proxy and --connect-proxy-auth-file sends
+credentials to the proxy with Basic auth.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TlsServer, print_ok, run_ghostunnel, terminate
+import base64
+import os
+import http.server
+import select
+import threading
+
+EXPECTED_AUTH = 'Basic ' + base64.b64encode(b'user:secret').decode('ascii')
+
+
+class AuthConnectProxyHandler(http.server.BaseHTTPRequestHandler):
+    def do_CONNECT(self):
+        if self.headers.get('Proxy-Authorization') != EXPECTED_AUTH:
+            self.send_response(407)
+            self.end_headers()
+            raise Exception('missing or invalid proxy credentials: {0}'.format(
+                self.headers.get('Proxy-Authorization')))
+        print_ok("got authenticated proxy request for " + self.path)
+        _, port = self.path.split(':')
+        remote = TcpClient(int(port))
+        remote.connect(attempts=5)
+        self.wfile.write(b"HTTP/1.1 200 Connection established\r\n\r\n")
+        sockets = [self.connection, remote.get_socket()]
+        try:
+            for _ in range(0, 1000):
+                reads, _, errs = select.select(sockets, [], sockets, 10)
+                if errs:
+                    break
+                for s in reads:
+                    data = s.recv(8192)
+                    if not data:
+                        return
+                    (sockets[1] if s == sockets[0] else sockets[0]).send(data)
+        finally:
+            remote.cleanup()
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        with open('proxy-credentials', 'w') as f:
+            f.write('user:secret\n')
+
+        httpd = http.server.HTTPServer(
+            (LOCALHOST, 13080), AuthConnectProxyHandler)
+        server = threading.Thread(target=httpd.handle_request)
+        server.start()
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['client',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target=localhost:13002',
+                                     '--keystore=client.p12',
+                                     '--cacert=root.crt',
+                                     '--connect-proxy=http://{0}:13080'.format(LOCALHOST),
+                                     '--connect-proxy-auth-file=proxy-credentials',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # connect to server, confirm that the tunnel is up
+        pair = SocketPair(TcpClient(13001), TlsServer('server', 'root', 13002))
+        pair.validate_can_send_from_client(
+            'hello world', '1: client -> server')
+        pair.validate_can_send_from_server(
+            'hello world', '1: server -> client')
+        pair.validate_closing_client_closes_server('closing client')
+        pair.cleanup()
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
+        if os.path.exists('proxy-credentials'):
+            os.remove('proxy-credentials')
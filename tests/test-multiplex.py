@@ -0,0 +1,76 @@
+#!/usr/bin/env python3
+
+"""
+Test that a client with --multiplex carries connections as streams over a
+single TLS connection to a server with --multiplex, and that the server still
+accepts clients that don't multiplex.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, TlsClient, print_ok, run_ghostunnel, terminate, \
+                   urlopen
+import json
+
+if __name__ == "__main__":
+    ghostunnel_server = None
+    ghostunnel_client = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel server, accepting multiplexed sessions
+        ghostunnel_server = run_ghostunnel(['server',
+                                            '--listen={0}:13001'.format(LOCALHOST),
+                                            '--target={0}:13002'.format(LOCALHOST),
+                                            '--multiplex',
+                                            '--keystore=server.p12',
+                                            '--cacert=root.crt',
+                                            '--allow-ou=client',
+                                            '--status={0}:{1}'.format(LOCALHOST,
+                                                                      STATUS_PORT)])
+
+        # start ghostunnel client, multiplexing over a single connection
+        ghostunnel_client = run_ghostunnel(['client',
+                                            '--listen={0}:13004'.format(LOCALHOST),
+                                            '--target=localhost:13001',
+                                            '--multiplex',
+                                            '--multiplex-connections=1',
+                                            '--keystore=client.p12',
+                                            '--cacert=root.crt',
+                                            '--status={0}:13005'.format(LOCALHOST)])
+
+        # block until both are up
+        TcpClient(STATUS_PORT).connect(20)
+        TcpClient(13005).connect(20)
+
+        # connections are forwarded as streams, including half-closes
+        for i in range(0, 3):
+            pair = SocketPair(TcpClient(13004), TcpServer(13002))
+            pair.validate_can_send_from_client("toto", "stream {0}: client -> server".format(i))
+            pair.validate_can_send_from_server("titi", "stream {0}: server -> client".format(i))
+            pair.validate_half_closing_client_closes_server(
+                "stream {0}: half-closing client closes server".format(i))
+            pair.cleanup()
+
+        # all streams were carried over a single session
+        metrics = json.loads(str(urlopen(
+            "https://{0}:13005/_metrics/json".format(LOCALHOST)).read(), 'utf-8'))
+        values = {m['metric']: m['value'] for m in metrics}
+        if values.get('ghostunnel.mux.sessions.total') != 1:
+            raise Exception("expected one multiplexed session, got {0}".format(
+                values.get('ghostunnel.mux.sessions.total')))
+        if values.get('ghostunnel.mux.streams.total', 0) < 3:
+            raise Exception("expected at least three streams")
+        print_ok("streams share a single session")
+
+        # clients that don't multiplex are still accepted
+        pair = SocketPair(TlsClient('client', 'root', 13001), TcpServer(13002))
+        pair.validate_can_send_from_client("toto", "plain connection works")
+        pair.cleanup()
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel_client)
+        terminate(ghostunnel_server)
@@ -0,0 +1,100 @@
+#!/usr/bin/env python3
+
+"""
+Test that a client with --quic carries connections as streams over a QUIC
+connection to a server with --quic, and that the server checks access
+control flags on the QUIC handshake.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, print_ok, run_ghostunnel, terminate, urlopen
+import json
+import socket
+
+if __name__ == "__main__":
+    ghostunnel_server = None
+    ghostunnel_client = None
+    ghostunnel_other = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+        root.create_signed_cert('client2')
+
+        # start ghostunnel server, listening for QUIC connections
+        ghostunnel_server = run_ghostunnel(['server',
+                                            '--listen={0}:13001'.format(LOCALHOST),
+                                            '--target={0}:13002'.format(LOCALHOST),
+                                            '--quic',
+                                            '--keystore=server.p12',
+                                            '--cacert=root.crt',
+                                            '--allow-ou=client',
+                                            '--status={0}:{1}'.format(LOCALHOST,
+                                                                      STATUS_PORT)])
+
+        # start ghostunnel client, carrying connections over QUIC
+        ghostunnel_client = run_ghostunnel(['client',
+                                            '--listen={0}:13004'.format(LOCALHOST),
+                                            '--target=localhost:13001',
+                                            '--quic',
+                                            '--keystore=client.p12',
+                                            '--cacert=root.crt',
+                                            '--status={0}:13005'.format(LOCALHOST)])
+
+        # block until both are up
+        TcpClient(STATUS_PORT).connect(20)
+        TcpClient(13005).connect(20)
+
+        # connections are forwarded as streams, including half-closes
+        for i in range(0, 3):
+            pair = SocketPair(TcpClient(13004), TcpServer(13002))
+            pair.validate_can_send_from_client("toto", "stream {0}: client -> server".format(i))
+            pair.validate_can_send_from_server("titi", "stream {0}: server -> client".format(i))
+            pair.validate_half_closing_client_closes_server(
+                "stream {0}: half-closing client closes server".format(i))
+            pair.cleanup()
+
+        # all streams were carried over a single QUIC connection
+        metrics = json.loads(str(urlopen(
+            "https://{0}:13005/_metrics/json".format(LOCALHOST)).read(), 'utf-8'))
+        values = {m['metric']: m['value'] for m in metrics}
+        if values.get('ghostunnel.quic.connections.total') != 1:
+            raise Exception("expected one QUIC connection, got {0}".format(
+                values.get('ghostunnel.quic.connections.total')))
+        if values.get('ghostunnel.quic.streams.total', 0) < 3:
+            raise Exception("expected at least three streams")
+        print_ok("streams share a single QUIC connection")
+
+        # the server doesn't listen on TCP
+        with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as sock:
+            if sock.connect_ex((LOCALHOST, 13001)) == 0:
+                raise Exception("server should not accept TCP connections")
+        print_ok("server only accepts QUIC connections")
+
+        # clients that aren't allowed are rejected on the QUIC handshake
+        ghostunnel_other = run_ghostunnel(['client',
+                                           '--listen={0}:13006'.format(LOCALHOST),
+                                           '--target=localhost:13001',
+                                           '--quic',
+                                           '--keystore=client2.p12',
+                                           '--cacert=root.crt',
+                                           '--status={0}:13007'.format(LOCALHOST)])
+        TcpClient(13007).connect(20)
+        client = TcpClient(13006)
+        client.connect(20)
+        client.get_socket().settimeout(10)
+        client.get_socket().send(b'toto')
+        try:
+            if client.get_socket().recv(1) != b'':
+                raise Exception("expected connection to be closed")
+        except ConnectionResetError:
+            pass
+        client.cleanup()
+        print_ok("unauthorized client is rejected")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel_other)
+        terminate(ghostunnel_client)
+        terminate(ghostunnel_server)
@@ -0,0 +1,68 @@
+#!/usr/bin/env python3
+
+"""
+Test that an agent dials out to an edge, and that connections accepted by the
+edge are forwarded through the agent to its target.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, print_ok, run_ghostunnel, terminate, urlopen
+import json
+import time
+
+def agents_connected():
+    metrics = json.loads(str(urlopen(
+        "https://{0}:{1}/_metrics/json".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+    values = {m['metric']: m['value'] for m in metrics}
+    return values.get('ghostunnel.reverse.agents', 0)
+
+if __name__ == "__main__":
+    ghostunnel_edge = None
+    ghostunnel_agent = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel edge, accepting agents and connections
+        ghostunnel_edge = run_ghostunnel(['edge',
+                                          '--listen={0}:13004'.format(LOCALHOST),
+                                          '--agent-listen={0}:13001'.format(LOCALHOST),
+                                          '--keystore=server.p12',
+                                          '--cacert=root.crt',
+                                          '--allow-ou=client',
+                                          '--status={0}:{1}'.format(LOCALHOST,
+                                                                    STATUS_PORT)])
+
+        # start ghostunnel agent, dialing out to the edge
+        ghostunnel_agent = run_ghostunnel(['agent',
+                                           '--edge=localhost:13001',
+                                           '--target={0}:13002'.format(LOCALHOST),
+                                           '--keystore=client.p12',
+                                           '--cacert=root.crt',
+                                           '--verify-ou=server',
+                                           '--status={0}:13005'.format(LOCALHOST)])
+
+        # block until both are up, and the agent registered with the edge
+        TcpClient(STATUS_PORT).connect(20)
+        TcpClient(13005).connect(20)
+        for _ in range(0, 20):
+            if agents_connected() == 1:
+                break
+            time.sleep(0.5)
+        else:
+            raise Exception("agent did not register with edge")
+        print_ok("agent registered with edge")
+
+        # connections to the edge reach the target of the agent
+        for i in range(0, 3):
+            pair = SocketPair(TcpClient(13004), TcpServer(13002))
+            pair.validate_can_send_from_client("toto", "conn {0}: client -> target".format(i))
+            pair.validate_can_send_from_server("titi", "conn {0}: target -> client".format(i))
+            pair.cleanup()
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel_agent)
+        terminate(ghostunnel_edge)
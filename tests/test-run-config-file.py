@@ -0,0 +1,94 @@
+#!/usr/bin/env python3
+
+"""
+Test to check that the run command serves multiple tunnels from a config file.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, TlsClient, print_ok, run_ghostunnel, terminate, \
+                   status_info
+
+import json
+import os
+import ssl
+import socket
+
+if __name__ == "__main__":
+    ghostunnel = None
+    config = 'run-config-file.json'
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client1')
+        root.create_signed_cert('client2')
+
+        # write config: two server tunnels with different ACLs, and one
+        # client tunnel pointing at the first server tunnel.
+        with open(config, 'w') as f:
+            json.dump({'tunnels': [
+                {'name': 'server1', 'mode': 'server',
+                 'listen': '{0}:13001'.format(LOCALHOST),
+                 'target': '{0}:13002'.format(LOCALHOST),
+                 'credentials': {'keystore': 'server.p12', 'cacert': 'root.crt'},
+                 'access': {'ou': ['client1']}},
+                {'name': 'server2', 'mode': 'server',
+                 'listen': '{0}:13003'.format(LOCALHOST),
+                 'target': '{0}:13004'.format(LOCALHOST),
+                 'credentials': {'keystore': 'server.p12', 'cacert': 'root.crt'},
+                 'access': {'ou': ['client2']}},
+                {'name': 'client1', 'mode': 'client',
+                 'listen': '{0}:13005'.format(LOCALHOST),
+                 'target': 'localhost:13001',
+                 'credentials': {'keystore': 'client1.p12', 'cacert': 'root.crt'}},
+            ]}, f)
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['run',
+                                     '--config={0}'.format(config),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # each server tunnel enforces its own ACL
+        pair1 = SocketPair(
+            TlsClient('client1', 'root', 13001), TcpServer(13002))
+        pair1.validate_can_send_from_client("toto", "pair1 works")
+        pair1.cleanup()
+
+        pair2 = SocketPair(
+            TlsClient('client2', 'root', 13003), TcpServer(13004))
+        pair2.validate_can_send_from_client("toto", "pair2 works")
+        pair2.cleanup()
+
+        try:
+            pair3 = SocketPair(
+                TlsClient('client2', 'root', 13001), TcpServer(13002))
+            raise Exception('failed to reject client2 on server1')
+        except (ssl.SSLError, socket.timeout, ConnectionResetError):
+            print_ok("client2 correctly rejected on server1")
+
+        # client tunnel forwards through server tunnel
+        pair4 = SocketPair(TcpClient(13005), TcpServer(13002))
+        pair4.validate_can_send_from_client("toto", "pair4 works")
+        pair4.validate_can_send_from_server("titi", "pair4 works")
+        pair4.cleanup()
+
+        # status reports every tunnel
+        status = status_info()
+        names = [t['name'] for t in status['tunnels']]
+        if names != ['server1', 'server2', 'client1']:
+            raise Exception("unexpected tunnels in status: {0}".format(names))
+        print_ok("status reports all tunnels")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
+        try:
+            os.remove(config)
+        except OSError:
+            pass
@@ -0,0 +1,142 @@
+#!/usr/bin/env python3
+
+"""
+Test to check that the run command applies changes to the config file on
+reload, without dropping established connections.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, TlsClient, print_ok, run_ghostunnel, terminate, \
+                   status_info
+
+import json
+import os
+import signal
+import ssl
+import socket
+import time
+
+
+def server_tunnel(name, listen, target, ou):
+    return {'name': name, 'mode': 'server',
+            'listen': '{0}:{1}'.format(LOCALHOST, listen),
+            'target': '{0}:{1}'.format(LOCALHOST, target),
+            'credentials': {'keystore': 'server.p12', 'cacert': 'root.crt'},
+            'access': {'ou': [ou]}}
+
+
+def write_config(path, tunnels):
+    with open(path, 'w') as f:
+        json.dump({'tunnels': tunnels}, f)
+
+
+def reload(ghostunnel):
+    before = status_info().get('last_reload')
+    ghostunnel.send_signal(signal.SIGHUP)
+    for _ in range(20):
+        time.sleep(0.5)
+        status = status_info()
+        if status.get('last_reload') != before and \
+                status['message'] == 'listening':
+            return status['last_reload_result']
+    raise Exception('no reload result in status')
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    config = 'run-config-reload.json'
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client1')
+        root.create_signed_cert('client2')
+
+        write_config(config, [
+            server_tunnel('server1', 13001, 13002, 'client1'),
+            server_tunnel('server2', 13003, 13004, 'client1'),
+        ])
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['run',
+                                     '--config={0}'.format(config),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # open a connection on server2, which is going to be removed
+        pair1 = SocketPair(
+            TlsClient('client1', 'root', 13003), TcpServer(13004))
+        pair1.validate_can_send_from_client("toto", "pair1 works")
+
+        # update server1 to allow client2 only, remove server2, and add
+        # server3 which takes over the listen address of server2. Note that
+        # landlock rules only cover addresses from the initial config.
+        write_config(config, [
+            server_tunnel('server1', 13001, 13002, 'client2'),
+            server_tunnel('server3', 13003, 13002, 'client1'),
+        ])
+        result = reload(ghostunnel)
+        if result['status'] != 'applied' or \
+                result.get('added') != ['server3'] or \
+                result.get('removed') != ['server2'] or \
+                result.get('updated') != ['server1']:
+            raise Exception('unexpected reload result: {0}'.format(result))
+        print_ok("reload applied")
+
+        # existing connection on removed tunnel still works
+        pair1.validate_can_send_from_client("toto", "pair1 still works")
+        pair1.validate_can_send_from_server("titi", "pair1 still works")
+        pair1.cleanup()
+
+        # updated ACL is enforced for new connections
+        pair2 = SocketPair(
+            TlsClient('client2', 'root', 13001), TcpServer(13002))
+        pair2.validate_can_send_from_client("toto", "pair2 works")
+        pair2.cleanup()
+
+        try:
+            pair3 = SocketPair(
+                TlsClient('client1', 'root', 13001), TcpServer(13002))
+            raise Exception('failed to reject client1 on server1')
+        except (ssl.SSLError, socket.timeout, ConnectionResetError):
+            print_ok("client1 correctly rejected on server1")
+
+        # new tunnel accepts connections
+        pair4 = SocketPair(
+            TlsClient('client1', 'root', 13003), TcpServer(13002))
+        pair4.validate_can_send_from_client("toto", "pair4 works")
+        pair4.cleanup()
+
+        # invalid config is rejected, tunnels keep running
+        write_config(config, [
+            server_tunnel('server1', 13001, 13002, 'client2'),
+            dict(server_tunnel('server4', 13003, 13004, 'client1'),
+                 credentials={'keystore': 'does-not-exist.p12'}),
+        ])
+        result = reload(ghostunnel)
+        if result['status'] != 'rejected':
+            raise Exception('invalid config was not rejected: {0}'.format(result))
+        print_ok("invalid config rejected")
+
+        pair5 = SocketPair(
+            TlsClient('client1', 'root', 13003), TcpServer(13002))
+        pair5.validate_can_send_from_client("toto", "pair5 works")
+        pair5.cleanup()
+
+        names = [t['name'] for t in status_info()['tunnels']]
+        if names != ['server1', 'server3']:
+            raise Exception("unexpected tunnels in status: {0}".format(names))
+        print_ok("status reports current tunnels")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
+        try:
+            os.remove(config)
+        except OSError:
+            pass
@@ -0,0 +1,71 @@
+#!/usr/bin/env python3
+
+"""
+Test that a passthrough tunnel forwards TLS connections without terminating
+them, to a target chosen by the server name in the ClientHello.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TlsClient, TlsServer, print_ok, run_ghostunnel, terminate
+
+import json
+import os
+import ssl
+import socket
+
+if __name__ == "__main__":
+    ghostunnel = None
+    config = 'run-passthrough.json'
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # write config: a passthrough tunnel with a route for localhost, and
+        # a client tunnel that connects through it (and sends SNI localhost).
+        with open(config, 'w') as f:
+            json.dump({'tunnels': [
+                {'name': 'passthrough', 'mode': 'passthrough',
+                 'listen': '{0}:13001'.format(LOCALHOST),
+                 'routes': [{'server-name': 'localhost',
+                             'target': '{0}:13002'.format(LOCALHOST)}]},
+                {'name': 'client', 'mode': 'client',
+                 'listen': '{0}:13003'.format(LOCALHOST),
+                 'target': 'localhost:13001',
+                 'credentials': {'keystore': 'client.p12', 'cacert': 'root.crt'}},
+            ]}, f)
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['run',
+                                     '--config={0}'.format(config),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # TLS is terminated by the target, which sees the client certificate
+        pair = SocketPair(TcpClient(13003), TlsServer('server', 'root', 13002))
+        pair.validate_can_send_from_client("toto", "pair works")
+        pair.validate_can_send_from_server("titi", "pair works")
+        pair.validate_client_cert('client', "target sees client certificate")
+        pair.cleanup()
+
+        # connections without a matching server name are rejected
+        try:
+            client = TlsClient('client', 'root', 13001)
+            client.connect()
+            raise Exception('failed to reject connection without server name')
+        except (ssl.SSLError, socket.timeout, ConnectionResetError, OSError):
+            print_ok("connection without server name rejected")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
+        try:
+            os.remove(config)
+        except OSError:
+            pass
@@ -0,0 +1,66 @@
+#!/usr/bin/env python3
+
+"""
+Test that a server with --accept-proxy-protocol reads the PROXY header sent
+by a trusted load balancer before the TLS handshake, and forwards the real
+client address to the backend.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, TcpServer, \
+                   TIMEOUT, print_ok, run_ghostunnel, terminate, wrap_socket
+import socket
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel, trusting PROXY headers from localhost
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--accept-proxy-protocol=127.0.0.0/8',
+                                     '--proxy-protocol',
+                                     '--proxy-protocol-version=1',
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        target = TcpServer(13002)
+        target.listen()
+
+        # connect like a load balancer would: PROXY header, then TLS
+        header = 'PROXY TCP4 203.0.113.7 127.0.0.1 4321 13001\r\n'
+        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        sock.settimeout(TIMEOUT)
+        sock.connect((LOCALHOST, 13001))
+        sock.sendall(header.encode('ascii'))
+        client = wrap_socket(sock, keyfile='client.key', certfile='client.crt',
+                             ca_certs='root.crt')
+        client.sendall(b'toto')
+
+        # the backend sees the address of the real client
+        target.accept()
+        received = b''
+        while not received.endswith(b'toto'):
+            data = target.get_socket().recv(1024)
+            if not data:
+                break
+            received += data
+        if received != header.encode('ascii') + b'toto':
+            raise Exception('unexpected data on backend: {0}'.format(received))
+        print_ok('backend received real client address')
+
+        client.close()
+        target.cleanup()
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
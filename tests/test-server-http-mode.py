@@ -0,0 +1,98 @@
+#!/usr/bin/env python3
+
+"""
+Test that a server with --http forwards requests to the backend with client
+identity headers, and rejects clients that aren't allowed with a 403 instead
+of dropping the connection.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, TIMEOUT, \
+                   print_ok, run_ghostunnel, terminate
+from http.server import BaseHTTPRequestHandler, HTTPServer
+import http.client
+import json
+import ssl
+import threading
+
+
+class EchoHandler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        body = json.dumps({
+            'path': self.path,
+            'xfcc': self.headers.get('X-Forwarded-Client-Cert'),
+            'xff': self.headers.get('X-Forwarded-For'),
+        }).encode('utf-8')
+        self.send_response(200)
+        self.send_header('Content-Length', str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+
+def request(name, path, headers=None):
+    context = ssl.create_default_context(cafile='root.crt')
+    context.load_cert_chain('{0}.crt'.format(name), '{0}.key'.format(name))
+    conn = http.client.HTTPSConnection(LOCALHOST, 13001, context=context,
+                                       timeout=TIMEOUT)
+    conn.request('GET', path, headers=headers or {})
+    response = conn.getresponse()
+    body = response.read()
+    conn.close()
+    return response.status, body
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    backend = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+        root.create_signed_cert('other')
+
+        backend = HTTPServer((LOCALHOST, 13002), EchoHandler)
+        threading.Thread(target=backend.serve_forever, daemon=True).start()
+
+        # start ghostunnel in HTTP mode
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--http',
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # allowed client, spoofed identity header is replaced
+        status, body = request('client', '/hello',
+                               {'X-Forwarded-Client-Cert': 'Hash=spoofed'})
+        if status != 200:
+            raise Exception('unexpected status {0}'.format(status))
+        seen = json.loads(body)
+        if seen['path'] != '/hello':
+            raise Exception('unexpected path {0}'.format(seen['path']))
+        if not seen['xfcc'] or 'spoofed' in seen['xfcc'] or \
+                'OU=client' not in seen['xfcc']:
+            raise Exception('unexpected identity header {0}'.format(seen['xfcc']))
+        if seen['xff'] != LOCALHOST:
+            raise Exception('unexpected X-Forwarded-For {0}'.format(seen['xff']))
+        print_ok('backend received client identity')
+
+        # client that isn't allowed gets a 403
+        status, _ = request('other', '/hello')
+        if status != 403:
+            raise Exception('expected 403 for other client, got {0}'.format(status))
+        print_ok('other client was denied with 403')
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
+        if backend:
+            backend.shutdown()
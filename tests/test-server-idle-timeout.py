@@ -0,0 +1,68 @@
+#!/usr/bin/env python3
+
+"""
+Test that --idle-timeout closes connections without traffic, and that traffic
+resets the timeout.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TlsClient, TcpServer, SocketPair, print_ok, run_ghostunnel, terminate, urlopen
+import time
+import json
+
+
+def idle_timeouts():
+    metrics = json.loads(str(urlopen(
+        "https://{0}:{1}/_metrics".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+    return [m['value'] for m in metrics if m['metric'] == "ghostunnel.conn.idle.timeout"][0]
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13000'.format(LOCALHOST),
+                                     '--target={0}:13001'.format(LOCALHOST),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--idle-timeout=3s',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # wait for startup
+        TlsClient(None, 'root', STATUS_PORT).connect(20, 'server')
+
+        # connection with traffic in both directions stays open
+        pair = SocketPair(
+            TlsClient('client', 'root', 13000), TcpServer(13001))
+        for i in range(0, 5):
+            pair.validate_can_send_from_client("toto", "client -> server {0}".format(i))
+            pair.validate_can_send_from_server("titi", "server -> client {0}".format(i))
+            time.sleep(1)
+        if idle_timeouts() != 0:
+            raise Exception("connection with traffic should not time out")
+        print_ok("traffic resets the idle timeout")
+
+        # without traffic, the connection is closed
+        timeout = False
+        for _ in range(0, 20):
+            if idle_timeouts() > 0:
+                timeout = True
+                break
+            time.sleep(1)
+        if not timeout:
+            raise Exception("idle connection should time out")
+        if pair.server.get_socket().recv(1) != b'':
+            raise Exception("expected connection to target to be closed")
+        print_ok("idle connection is closed")
+
+        print_ok("OK")
+
+    finally:
+        terminate(ghostunnel)
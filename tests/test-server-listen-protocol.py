@@ -0,0 +1,74 @@
+#!/usr/bin/env python3
+
+"""
+Test that ensures that server mode accepts upgrades to TLS in-protocol from
+clients (here, PostgreSQL with SSLRequest), and forwards the session to a
+plain target.
+"""
+
+import socket
+import ssl
+
+from common import LOCALHOST, STATUS_PORT, TIMEOUT, print_ok, run_ghostunnel, terminate, wrap_socket, RootCert, SocketPair, TcpClient, TcpServer, TlsClient
+
+SSL_REQUEST = b'\x00\x00\x00\x08\x04\xd2\x16\x2f'
+
+
+class PostgresClient(TlsClient):
+    """PostgreSQL client, which asks for TLS with an SSLRequest."""
+
+    def connect(self, attempts=1, peer=None):
+        sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        sock.settimeout(TIMEOUT)
+        sock.connect((LOCALHOST, self.port))
+        sock.sendall(SSL_REQUEST)
+        response = sock.recv(1)
+        if response != b'S':
+            raise Exception("unexpected SSLRequest response: {0}".format(response))
+        self.socket = wrap_socket(sock,
+                                  keyfile='{0}.key'.format(self.cert),
+                                  certfile='{0}.crt'.format(self.cert),
+                                  ca_certs='{0}.crt'.format(self.ca),
+                                  cert_reqs=ssl.CERT_REQUIRED)
+        return self
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--listen-protocol=postgres',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # upgrade to TLS with SSLRequest, confirm that the tunnel is up
+        pair = SocketPair(PostgresClient('client', 'root', 13001), TcpServer(13002))
+        pair.validate_can_send_from_client(
+            "hello world", "1: client -> server")
+        pair.validate_can_send_from_server(
+            "hello world", "1: server -> client")
+        pair.validate_closing_client_closes_server(
+            "1: client closed -> server closed")
+
+        # clients that don't ask for TLS get an error response
+        client = TcpClient(13001)
+        client.connect(1, "2: plain client connected")
+        client.get_socket().sendall(b'\x00\x00\x00\x09\x00\x03\x00\x00\x00')
+        response = client.get_socket().recv(1)
+        if response != b'E':
+            raise Exception("expected error response, got: {0}".format(response))
+        print_ok("2: plain client rejected")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,69 @@
+#!/usr/bin/env python3
+
+"""
+Test that server mode balances connections between multiple targets, and
+fails over to other targets if one of them is down.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, TlsClient, print_ok, run_ghostunnel, terminate, \
+                   status_info
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel with two targets. Active health checks are disabled
+        # here, as TCP checks would show up as connections on our targets.
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--target={0}:13003'.format(LOCALHOST),
+                                     '--target-balance=round-robin',
+                                     '--target-health-interval=0',
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # with both targets up, connections are spread between them
+        servers = [TcpServer(13002), TcpServer(13003)]
+        for server in servers:
+            server.listen()
+        clients = [TlsClient('client', 'root', 13001) for _ in servers]
+        for client in clients:
+            client.connect()
+        for server in servers:
+            server.accept()
+        print_ok("connections balanced between targets")
+        for client in clients:
+            client.cleanup()
+        for server in servers:
+            server.cleanup()
+
+        # with one target down, connections fail over to the other one
+        for i in range(4):
+            pair = SocketPair(
+                TlsClient('client', 'root', 13001), TcpServer(13003))
+            pair.validate_can_send_from_client("toto", "pair {0} works".format(i))
+            pair.cleanup()
+        print_ok("connections fail over if a target is down")
+
+        # status reports all backends
+        backends = status_info()['backends']
+        addresses = [b['address'] for b in backends]
+        if addresses != ['{0}:13002'.format(LOCALHOST), '{0}:13003'.format(LOCALHOST)]:
+            raise Exception("unexpected backends in status: {0}".format(backends))
+        print_ok("status reports all backends")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
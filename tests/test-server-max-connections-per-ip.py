@@ -0,0 +1,74 @@
+#!/usr/bin/env python3
+
+"""
+Test that --max-connections-per-ip rejects connections from a client IP that
+already has as many connections open as the limit allows.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TlsClient, TcpServer, SocketPair, print_ok, run_ghostunnel, terminate, urlopen
+import json
+import time
+
+
+def metric(name):
+    metrics = json.loads(str(urlopen(
+        "https://{0}:{1}/_metrics".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+    return [m['value'] for m in metrics if m['metric'] == name][0]
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13000'.format(LOCALHOST),
+                                     '--target={0}:13001'.format(LOCALHOST),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--max-connections-per-ip=1',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # wait for startup
+        TlsClient(None, 'root', STATUS_PORT).connect(20, 'server')
+
+        # first connection is accepted
+        pair = SocketPair(
+            TlsClient('client', 'root', 13000), TcpServer(13001))
+        pair.validate_can_send_from_client("toto", "first connection works")
+        if metric("ghostunnel.limits.global.connections") != 1:
+            raise Exception("expected one open connection")
+        if metric("ghostunnel.limits.global.per-ip.at-limit") != 1:
+            raise Exception("expected client IP to be at its limit")
+
+        # second connection from the same IP is rejected
+        try:
+            TlsClient('client', 'root', 13000).connect()
+            raise Exception("second connection should be rejected")
+        except Exception as e:
+            if 'should be rejected' in str(e):
+                raise e
+        if metric("ghostunnel.limits.global.rejected") != 1:
+            raise Exception("expected rejected connection to be counted")
+        print_ok("second connection from same IP is rejected")
+
+        # once the first connection is closed, new connections are accepted
+        pair.cleanup()
+        for _ in range(0, 20):
+            if metric("ghostunnel.limits.global.connections") == 0:
+                break
+            time.sleep(0.5)
+        pair = SocketPair(
+            TlsClient('client', 'root', 13000), TcpServer(13001))
+        pair.validate_can_send_from_client("toto", "new connection works")
+
+        print_ok("OK")
+
+    finally:
+        terminate(ghostunnel)
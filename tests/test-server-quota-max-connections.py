@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+
+"""
+Test that --quota-max-connections limits open connections per client
+identity, and that --quota-override replaces the quota of an identity.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TlsClient, TcpServer, SocketPair, print_ok, run_ghostunnel, terminate, urlopen
+import json
+
+
+def rejected():
+    metrics = json.loads(str(urlopen(
+        "https://{0}:{1}/_metrics".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+    return [m['value'] for m in metrics if m['metric'] == "ghostunnel.quota.rejected.connections"][0]
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert(
+            'client1', san="IP:127.0.0.1,URI:spiffe://ghostunnel/client1")
+        root.create_signed_cert(
+            'client2', san="IP:127.0.0.1,URI:spiffe://ghostunnel/client2")
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13000'.format(LOCALHOST),
+                                     '--target={0}:13001'.format(LOCALHOST),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-uri=spiffe://ghostunnel/client1',
+                                     '--allow-uri=spiffe://ghostunnel/client2',
+                                     '--quota-key=uri',
+                                     '--quota-max-connections=1',
+                                     '--quota-override=spiffe://ghostunnel/client2=max-connections:2',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # wait for startup
+        TlsClient(None, 'root', STATUS_PORT).connect(20, 'server')
+
+        # client1 may open one connection
+        pair = SocketPair(
+            TlsClient('client1', 'root', 13000), TcpServer(13001))
+        pair.validate_can_send_from_client("toto", "client1 connection works")
+
+        # a second connection from client1 is closed after the handshake
+        client = TlsClient('client1', 'root', 13000)
+        try:
+            client.connect()
+            if client.get_socket().recv(1) != b'':
+                raise Exception("expected connection over quota to be closed")
+        except Exception as e:
+            if 'expected connection' in str(e):
+                raise e
+        if rejected() != 1:
+            raise Exception("expected connection over quota to be counted")
+        print_ok("connection over quota is rejected")
+
+        # client2 has an override that allows two connections
+        pairs = []
+        for i in range(0, 2):
+            pairs.append(SocketPair(
+                TlsClient('client2', 'root', 13000), TcpServer(13001)))
+            pairs[i].validate_can_send_from_client(
+                "toto", "client2 connection {0} works".format(i))
+        if rejected() != 1:
+            raise Exception("override should allow two connections")
+        print_ok("override replaces quota")
+
+        print_ok("OK")
+
+    finally:
+        terminate(ghostunnel)
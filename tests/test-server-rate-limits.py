@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+
+"""
+Test that --max-read-rate-per-conn paces data read from clients, and that
+data written to clients isn't limited without a write limit.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TlsClient, TcpServer, SocketPair, print_ok, run_ghostunnel, terminate, urlopen
+import json
+import time
+
+
+def throttled():
+    metrics = json.loads(str(urlopen(
+        "https://{0}:{1}/_metrics".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+    return [m['value'] for m in metrics if m['metric'] == "ghostunnel.conn.throttled"][0]
+
+
+def transfer(sender, receiver, size):
+    start = time.time()
+    sender.sendall(b'x' * size)
+    received = 0
+    while received < size:
+        data = receiver.recv(size - received)
+        if not data:
+            raise Exception("connection closed after {0} bytes".format(received))
+        received += len(data)
+    return time.time() - start
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13000'.format(LOCALHOST),
+                                     '--target={0}:13001'.format(LOCALHOST),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--max-read-rate-per-conn=10KB:2KB',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # wait for startup
+        TlsClient(None, 'root', STATUS_PORT).connect(20, 'server')
+
+        pair = SocketPair(
+            TlsClient('client', 'root', 13000), TcpServer(13001))
+        pair.validate_can_send_from_client("toto", "connection works")
+
+        # 30KB at 10KB/s, with a burst of 2KB, take about 2.8 seconds
+        elapsed = transfer(pair.client.get_socket(),
+                           pair.server.get_socket(), 30000)
+        if elapsed < 2:
+            raise Exception(
+                "expected reads to be limited, took {0:.2f}s".format(elapsed))
+        if throttled() == 0:
+            raise Exception("expected throttled reads to be counted")
+        print_ok("reads from client are limited ({0:.2f}s)".format(elapsed))
+
+        # writes to the client aren't limited
+        elapsed = transfer(pair.server.get_socket(),
+                           pair.client.get_socket(), 30000)
+        if elapsed > 1:
+            raise Exception(
+                "expected writes not to be limited, took {0:.2f}s".format(elapsed))
+        print_ok("writes to client are not limited")
+
+        print_ok("OK")
+
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,102 @@
+#!/usr/bin/env python3
+
+"""
+Test that --deny-source rejects connections before the TLS handshake, that
+files of source ranges are re-read on reload, and that the source IP is
+passed to the OPA policy. The file is kept outside of /tmp, which landlock
+allows anyway, to check that it's covered by the landlock rules.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TlsClient, TcpServer, SocketPair, print_ok, run_ghostunnel, terminate, status_info, urlopen
+from tempfile import mkdtemp
+import json
+import os
+import shutil
+import signal
+import time
+
+
+def rejected():
+    metrics = json.loads(str(urlopen(
+        "https://{0}:{1}/_metrics".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+    return [m['value'] for m in metrics if m['metric'] == "ghostunnel.source.rejected"][0]
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    sources_dir = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert(
+            'server',
+            san='DNS:server,IP:127.0.0.1,IP:::1,DNS:localhost')
+        root.create_signed_cert(
+            'client1',
+            san='DNS:client1,IP:127.0.0.1,IP:::1,DNS:localhost')
+        root.create_signed_cert(
+            'client2',
+            san='DNS:client2,IP:127.0.0.1,IP:::1,DNS:localhost')
+
+        # deny connections from localhost, in a file
+        dir_path = os.path.dirname(os.path.realpath(__file__))
+        tmp_dir = mkdtemp()
+        sources_dir = mkdtemp(dir='/var/tmp')
+        shutil.copyfile(dir_path + '/test-server-source-filter.rego',
+                        tmp_dir + '/policy.rego')
+        with open(sources_dir + '/deny.txt', 'w') as f:
+            f.write('# local clients\n127.0.0.0/8\n')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-policy=' + tmp_dir + '/policy.rego',
+                                     '--allow-query=data.policy.allow',
+                                     '--deny-source=file:' + sources_dir + '/deny.txt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # wait for startup
+        TlsClient(None, 'root', STATUS_PORT).connect(20, 'server')
+
+        # connections from a denied source are closed before the handshake
+        try:
+            TlsClient('client1', 'root', 13001).connect()
+            raise Exception('failed to reject denied source')
+        except OSError:
+            pass
+        if rejected() != 1:
+            raise Exception("expected rejected source to be counted")
+        print_ok("denied source is rejected")
+
+        # allow localhost again, and reload
+        with open(sources_dir + '/deny.txt', 'w') as f:
+            f.write('# no one\n')
+        ghostunnel.send_signal(signal.SIGUSR1)
+        while 'last_reload' not in status_info():
+            time.sleep(1)
+        print_ok("reloaded source ranges")
+
+        # the policy allows client1 from localhost
+        pair = SocketPair(
+            TlsClient('client1', 'root', 13001), TcpServer(13002))
+        pair.validate_can_send_from_client("toto", "policy allows client1 from source")
+
+        # other clients are still checked by the policy
+        try:
+            SocketPair(TlsClient('client2', 'root', 13001), TcpServer(13002))
+            raise Exception('failed to reject client2')
+        except OSError:
+            print_ok("policy rejects client2")
+        if rejected() != 1:
+            raise Exception("clients rejected by the policy should not count as rejected sources")
+
+        print_ok("OK")
+
+    finally:
+        terminate(ghostunnel)
+        if sources_dir:
+            shutil.rmtree(sources_dir)
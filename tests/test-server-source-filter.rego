@@ -0,0 +1,7 @@
+package policy
+import input
+default allow := false
+allow {
+    input.certificate.DNSNames[_] == "client1"
+    net.cidr_contains("127.0.0.0/8", input.source.ip)
+}
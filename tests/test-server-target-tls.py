@@ -0,0 +1,51 @@
+#!/usr/bin/env python3
+
+"""
+Test that ensures that server mode can re-encrypt connections to a target
+that requires TLS, with a client certificate from a different PKI.
+"""
+
+from common import LOCALHOST, STATUS_PORT, print_ok, run_ghostunnel, terminate, RootCert, SocketPair, TlsClient, TlsServer
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # PKI between clients and ghostunnel
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # PKI between ghostunnel and the target
+        backend_root = RootCert('backendroot')
+        backend_root.create_signed_cert('backend')
+        backend_root.create_signed_cert('bridge')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target=localhost:13002',
+                                     '--keystore=server.p12',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--target-tls',
+                                     '--target-cert=bridge.crt',
+                                     '--target-key=bridge.key',
+                                     '--target-cacert=backendroot.crt',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # connect with client, confirm that the tunnel is up and that the
+        # target sees the certificate for its own PKI
+        pair = SocketPair(
+            TlsClient('client', 'root', 13001), TlsServer('backend', 'backendroot', 13002))
+        pair.validate_can_send_from_client(
+            "hello world", "1: client -> server")
+        pair.validate_can_send_from_server(
+            "hello world", "1: server -> client")
+        pair.validate_client_cert("bridge", "1: target sees bridge certificate")
+        pair.validate_closing_client_closes_server(
+            "1: client closed -> server closed")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,109 @@
+#!/usr/bin/env python3
+
+"""
+Test that a client with a UDP listener forwards flows of datagrams over TLS to
+a server with a UDP target, and that replies are sent back to the source of
+each flow.
+"""
+
+import socket
+import ssl
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TIMEOUT, TcpClient, \
+                   TlsClient, print_ok, run_ghostunnel, terminate
+
+
+def udp_socket():
+    sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    sock.settimeout(TIMEOUT)
+    sock.bind((LOCALHOST, 0))
+    return sock
+
+
+if __name__ == "__main__":
+    ghostunnel_server = None
+    ghostunnel_client = None
+    target = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # UDP target
+        target = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        target.settimeout(TIMEOUT)
+        target.bind((LOCALHOST, 13002))
+
+        # start ghostunnel server, relaying flows to the UDP target
+        ghostunnel_server = run_ghostunnel(['server',
+                                            '--listen={0}:13001'.format(LOCALHOST),
+                                            '--target=udp:{0}:13002'.format(LOCALHOST),
+                                            '--keystore=server.p12',
+                                            '--cacert=root.crt',
+                                            '--allow-ou=client',
+                                            '--status={0}:{1}'.format(LOCALHOST,
+                                                                      STATUS_PORT)])
+
+        # start ghostunnel client, listening for datagrams
+        ghostunnel_client = run_ghostunnel(['client',
+                                            '--listen=udp:{0}:13004'.format(LOCALHOST),
+                                            '--target=localhost:13001',
+                                            '--keystore=client.p12',
+                                            '--cacert=root.crt',
+                                            '--udp-idle-timeout=10s',
+                                            '--status={0}:13005'.format(LOCALHOST)])
+
+        # block until both are up
+        TcpClient(STATUS_PORT).connect(20)
+        TcpClient(13005).connect(20)
+
+        # each source address is a flow, with a socket of its own on the
+        # server, so that replies go back to the right application
+        sources = [udp_socket(), udp_socket()]
+        for i, source in enumerate(sources):
+            for j in range(0, 3):
+                message = 'flow {0}, datagram {1}'.format(i, j).encode()
+                source.sendto(message, (LOCALHOST, 13004))
+                datagram, flow = target.recvfrom(1024)
+                if datagram != message:
+                    raise Exception("unexpected datagram: {0}".format(datagram))
+                target.sendto(b'reply: ' + datagram, flow)
+                reply, _ = source.recvfrom(1024)
+                if reply != b'reply: ' + message:
+                    raise Exception("unexpected reply: {0}".format(reply))
+        print_ok("datagrams are forwarded in both directions")
+
+        # an empty datagram is a datagram too
+        sources[0].sendto(b'', (LOCALHOST, 13004))
+        datagram, _ = target.recvfrom(1024)
+        if datagram != b'':
+            raise Exception("unexpected datagram: {0}".format(datagram))
+        print_ok("empty datagrams are forwarded")
+
+        for source in sources:
+            source.close()
+
+        # clients that don't negotiate UDP forwarding are rejected
+        client = TlsClient('client', 'root', 13001)
+        client.connect(20)
+        try:
+            client.get_socket().send(b'\x00\x05hello')
+            if client.get_socket().recv(1) != b'':
+                raise Exception("expected connection to be closed")
+        except (ConnectionResetError, BrokenPipeError, ssl.SSLError):
+            pass
+        client.cleanup()
+        try:
+            datagram, _ = target.recvfrom(1024)
+            raise Exception("unexpected datagram: {0}".format(datagram))
+        except socket.timeout:
+            pass
+        print_ok("streams without ALPN are rejected")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel_client)
+        terminate(ghostunnel_server)
+        if target:
+            target.close()
@@ -0,0 +1,107 @@
+#!/usr/bin/env python3
+
+"""
+Test that a client with --websocket carries connections over WebSocket
+connections to a server with --websocket, and that the server still accepts
+clients without --websocket.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, \
+                   TcpServer, print_ok, run_ghostunnel, terminate, urlopen
+import json
+
+if __name__ == "__main__":
+    ghostunnel_server = None
+    ghostunnel_client = None
+    ghostunnel_plain = None
+    ghostunnel_other = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel server, accepting WebSocket upgrades
+        ghostunnel_server = run_ghostunnel(['server',
+                                            '--listen={0}:13001'.format(LOCALHOST),
+                                            '--target={0}:13002'.format(LOCALHOST),
+                                            '--websocket',
+                                            '--websocket-path=/tunnel',
+                                            '--keystore=server.p12',
+                                            '--cacert=root.crt',
+                                            '--allow-ou=client',
+                                            '--status={0}:{1}'.format(LOCALHOST,
+                                                                      STATUS_PORT)])
+
+        # start ghostunnel client, carrying connections over WebSocket
+        ghostunnel_client = run_ghostunnel(['client',
+                                            '--listen={0}:13004'.format(LOCALHOST),
+                                            '--target=localhost:13001',
+                                            '--websocket',
+                                            '--websocket-path=/tunnel',
+                                            '--keystore=client.p12',
+                                            '--cacert=root.crt',
+                                            '--status={0}:13005'.format(LOCALHOST)])
+
+        # block until both are up
+        TcpClient(STATUS_PORT).connect(20)
+        TcpClient(13005).connect(20)
+
+        # connections are forwarded over WebSocket
+        for i in range(0, 3):
+            pair = SocketPair(TcpClient(13004), TcpServer(13002))
+            pair.validate_can_send_from_client("toto", "connection {0}: client -> server".format(i))
+            pair.validate_can_send_from_server("titi", "connection {0}: server -> client".format(i))
+            pair.validate_closing_client_closes_server(
+                "connection {0}: closing client closes server".format(i))
+            pair.cleanup()
+
+        metrics = json.loads(str(urlopen(
+            "https://{0}:{1}/_metrics/json".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8'))
+        values = {m['metric']: m['value'] for m in metrics}
+        if values.get('ghostunnel.websocket.connections.total') != 3:
+            raise Exception("expected three WebSocket connections, got {0}".format(
+                values.get('ghostunnel.websocket.connections.total')))
+        print_ok("connections are upgraded to WebSocket")
+
+        # clients without --websocket are served as usual
+        ghostunnel_plain = run_ghostunnel(['client',
+                                           '--listen={0}:13006'.format(LOCALHOST),
+                                           '--target=localhost:13001',
+                                           '--keystore=client.p12',
+                                           '--cacert=root.crt',
+                                           '--status={0}:13007'.format(LOCALHOST)])
+        TcpClient(13007).connect(20)
+        pair = SocketPair(TcpClient(13006), TcpServer(13002))
+        pair.validate_can_send_from_client("toto", "plain client -> server")
+        pair.validate_can_send_from_server("titi", "server -> plain client")
+        pair.cleanup()
+        print_ok("clients without WebSocket are accepted")
+
+        # clients that use another path are rejected
+        ghostunnel_other = run_ghostunnel(['client',
+                                           '--listen={0}:13008'.format(LOCALHOST),
+                                           '--target=localhost:13001',
+                                           '--websocket',
+                                           '--websocket-path=/other',
+                                           '--keystore=client.p12',
+                                           '--cacert=root.crt',
+                                           '--status={0}:13009'.format(LOCALHOST)])
+        TcpClient(13009).connect(20)
+        client = TcpClient(13008)
+        client.connect(20)
+        client.get_socket().settimeout(10)
+        try:
+            if client.get_socket().recv(1) != b'':
+                raise Exception("expected connection to be closed")
+        except ConnectionResetError:
+            pass
+        client.cleanup()
+        print_ok("client with unknown path is rejected")
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel_other)
+        terminate(ghostunnel_plain)
+        terminate(ghostunnel_client)
+        terminate(ghostunnel_server)
@@ -0,0 +1,1237 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/backend"
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/ghostunnel/ghostunnel/policy"
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/quic"
+	"github.com/ghostunnel/ghostunnel/socket"
+	"github.com/ghostunnel/ghostunnel/starttls"
+	"github.com/ghostunnel/ghostunnel/udp"
+	"github.com/ghostunnel/ghostunnel/websocket"
+)
+
+// tunnelLogger prefixes log messages with the name of a tunnel, so that
+// messages from different tunnels in the same process can be told apart.
+type tunnelLogger struct {
+	name string
+}
+
+func (l tunnelLogger) Printf(format string, v ...interface{}) {
+	logger.Printf("[%s] %s", l.name, fmt.Sprintf(format, v...))
+}
+
+// tunnel is a single listener/target pair declared in a config file, or
+// given by the flags of server or client mode (see flagsListen). Everything
+// except for the listener can be updated in-place on reload.
+type tunnel struct {
+	name     string
+	logger   tunnelLogger
+	listener net.Listener
+	// Listener that terminates TLS, if any (it may be wrapped in listener)
+	tlsListener *certloader.Listener
+	// Listener for QUIC connections, if enabled (server mode only)
+	quicListener *quic.Listener
+	proxy        *proxy.Proxy
+	// Limits on connections to the listener of this tunnel
+	limiter *proxy.Limiter
+	state   atomic.Pointer[tunnelState]
+}
+
+// tunnelState holds the parts of a tunnel that are built from its config,
+// and that are swapped out atomically when the config changes.
+type tunnelState struct {
+	config          config.Tunnel
+	dial            func() (net.Conn, error)
+	tlsConfigSource certloader.TLSConfigSource
+	regoPolicy      policy.Policy
+	// TLS config for the listener (server mode, or client mode with
+	// listen-tls)
+	serverConfig certloader.TLSServerConfig
+	// Credentials for the TLS listener, if any (client mode only)
+	listenTLSConfigSource certloader.TLSConfigSource
+	// TLS to targets, if enabled (server mode only)
+	target *targetTLS
+	// Pool of backends, if balancing between multiple targets (server mode only)
+	pool *backend.Pool
+	// Failover state, if given multiple targets (client mode only)
+	failover *backend.Failover
+	// Upstream proxies to connect to targets through (client mode only)
+	upstream upstreamProxyOptions
+	// Pool of multiplexed sessions, if multiplexing (client mode only)
+	multiplex *mux.Pool
+	// Client for QUIC connections to targets, if enabled (client mode only)
+	quic *quic.Client
+	// Forward proxy, if clients pick the destination (client mode only)
+	forward *forwardProxy
+	// Routes by TLS server name, if any (server mode only)
+	routes routeTable
+	// Targets by protocol negotiated via ALPN, if any (server mode only)
+	alpnTargets alpnTargets
+	// Options for HTTP mode, if enabled (server mode only)
+	http *proxy.HTTPOptions
+	// Quotas per client identity, if any, and the policy that returns
+	// identities (server mode only)
+	quotas      *proxy.Quotas
+	quotaPolicy policy.Policy
+	// Filter for the addresses of clients, if any (server mode only)
+	sources *socket.SourceFilter
+	// Status handler, only used for its backend checks
+	check *statusHandler
+}
+
+type tunnelStatus struct {
+	Name           string           `json:"name"`
+	Mode           string           `json:"mode"`
+	Ok             bool             `json:"ok"`
+	ListenAddress  string           `json:"listen_address"`
+	ForwardAddress string           `json:"forward_address"`
+	BackendStatus  string           `json:"backend_status"`
+	BackendError   string           `json:"backend_error,omitempty"`
+	ActiveTarget   string           `json:"active_target,omitempty"`
+	Backends       []backend.Status `json:"backends,omitempty"`
+}
+
+// Validate settings of a tunnel that can't be checked by the config package
+// on its own, because they depend on global flags or helpers in main.
+func validateTunnel(t config.Tunnel) error {
+	switch t.Mode {
+	case config.ModeServer, config.ModePassthrough:
+		if _, err := socket.ParseCIDRs(t.AcceptProxyProtocol); err != nil {
+			return fmt.Errorf("accept-proxy-protocol: %s", err)
+		}
+		if _, err := socket.LoadSourceFilter(t.Sources.Allow, t.Sources.Deny); err != nil {
+			return fmt.Errorf("sources: %s", err)
+		}
+		for _, target := range t.AllTargets() {
+			if !t.UnsafeTarget && !consideredSafe(target) {
+				return errors.New("target must be unix:PATH or localhost:PORT (unless unsafe-target is set)")
+			}
+		}
+		for _, target := range t.ALPNTargets {
+			if !t.UnsafeTarget && !consideredSafe(target) {
+				return errors.New("alpn-targets must be unix:PATH or localhost:PORT (unless unsafe-target is set)")
+			}
+		}
+		if t.Balance.Policy != "" && !backend.ValidPolicy(t.Balance.Policy) {
+			return fmt.Errorf("invalid balance policy '%s' (must be one of: %s)", t.Balance.Policy, strings.Join(backend.Policies, ", "))
+		}
+		if t.TargetStatus != "" && !strings.HasPrefix(t.TargetStatus, "http://") && !strings.HasPrefix(t.TargetStatus, "https://") {
+			return errors.New("target-status should start with http:// or https://")
+		}
+	case config.ModeClient:
+		if !t.UnsafeListen && !consideredSafe(t.Listen) {
+			return errors.New("listen must be unix:PATH, localhost:PORT, udp:localhost:PORT, systemd:NAME or launchd:NAME (unless unsafe-listen is set)")
+		}
+		if _, err := parseUpstreamProxies(t.AllConnectProxies()); err != nil {
+			return err
+		}
+		if _, err := parseDestinationPatterns(t.ForwardProxy.Allow); err != nil {
+			return fmt.Errorf("forward-proxy: %s", err)
+		}
+		if useLandlock != nil && *useLandlock {
+			for _, destination := range t.ForwardProxy.Allow {
+				if _, port, _ := net.SplitHostPort(destination); port == "*" {
+					return fmt.Errorf("forward-proxy: destination '%s' has a wildcard port, which can't be allowed by --use-landlock", destination)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Validate all tunnels in the config (in addition to config.Validate)
+func validateConfig(cfg *config.Config) error {
+	for _, t := range cfg.Tunnels {
+		if err := validateTunnel(t); err != nil {
+			return fmt.Errorf("invalid config for tunnel '%s': %w", t.Name, err)
+		}
+	}
+	return validateCipherSuites()
+}
+
+// Get the timeouts for a tunnel, falling back to global flags if not set.
+func tunnelTimeouts(t config.Tunnel) (connect, close, maxLifetime time.Duration) {
+	connect, close, maxLifetime = *connectTimeout, *closeTimeout, *maxConnLifetime
+	if t.Timeouts.Connect > 0 {
+		connect = t.Timeouts.Connect
+	}
+	if t.Timeouts.Close > 0 {
+		close = t.Timeouts.Close
+	}
+	if t.Timeouts.MaxConnLifetime > 0 {
+		maxLifetime = t.Timeouts.MaxConnLifetime
+	}
+	return
+}
+
+// Get the handshake, dial and idle timeouts for a tunnel, falling back to
+// global flags if not set.
+func tunnelConnTimeouts(t config.Tunnel) (handshake, dial, idle time.Duration) {
+	handshake, dial, idle = *handshakeTimeout, *dialTimeout, *idleTimeout
+	if t.Timeouts.Handshake > 0 {
+		handshake = t.Timeouts.Handshake
+	}
+	if t.Timeouts.Dial > 0 {
+		dial = t.Timeouts.Dial
+	}
+	if t.Timeouts.Idle > 0 {
+		idle = t.Timeouts.Idle
+	}
+	return
+}
+
+// Get the connection limits for the listener of a tunnel.
+func tunnelLimits(t config.Tunnel) proxy.Limits {
+	return proxy.Limits{
+		MaxConnections:      t.Limits.MaxConnections,
+		MaxConnectionsPerIP: t.Limits.MaxConnectionsPerIP,
+		MaxHandshakes:       t.Limits.MaxHandshakes,
+	}
+}
+
+// Get the rate limits for a tunnel, falling back to global flags for those
+// that are not set.
+func tunnelRateLimits(t config.Tunnel) config.RateLimits {
+	limits := flagRateLimits()
+	if t.RateLimits.Read != "" {
+		limits.Read = t.RateLimits.Read
+	}
+	if t.RateLimits.Write != "" {
+		limits.Write = t.RateLimits.Write
+	}
+	if t.RateLimits.ReadPerConn != "" {
+		limits.ReadPerConn = t.RateLimits.ReadPerConn
+	}
+	if t.RateLimits.WritePerConn != "" {
+		limits.WritePerConn = t.RateLimits.WritePerConn
+	}
+	return limits
+}
+
+// Get the load balancing settings for a tunnel, falling back to global flags
+// if not set.
+func tunnelBalance(t config.Tunnel) config.Balance {
+	balance := config.Balance{
+		Policy:              *serverTargetBalance,
+		HealthCheckInterval: *serverTargetHealthCheck,
+		MaxFailures:         *serverTargetMaxFails,
+		EjectionTime:        *serverTargetEjectionTime,
+	}
+	if t.Balance.Policy != "" {
+		balance.Policy = t.Balance.Policy
+	}
+	if t.Balance.HealthCheckInterval > 0 {
+		balance.HealthCheckInterval = t.Balance.HealthCheckInterval
+	}
+	if t.Balance.MaxFailures > 0 {
+		balance.MaxFailures = t.Balance.MaxFailures
+	}
+	if t.Balance.EjectionTime > 0 {
+		balance.EjectionTime = t.Balance.EjectionTime
+	}
+	return balance
+}
+
+// Get the failover settings for a tunnel, falling back to global flags if
+// not set.
+func tunnelFailover(t config.Tunnel) config.Failover {
+	failover := config.Failover{
+		Backoff:    *clientTargetBackoff,
+		MaxBackoff: *clientTargetMaxBackoff,
+	}
+	if t.Failover.Backoff > 0 {
+		failover.Backoff = t.Failover.Backoff
+	}
+	if t.Failover.MaxBackoff > 0 {
+		failover.MaxBackoff = t.Failover.MaxBackoff
+	}
+	return failover
+}
+
+// Build the TLS config source for a tunnel. If the tunnel doesn't declare
+// its own credentials, we fall back to the global credential flags.
+func tunnelTLSConfigSource(t config.Tunnel) (certloader.TLSConfigSource, error) {
+	creds := t.Credentials
+	if creds.IsEmpty() {
+		if creds.CACert == "" {
+			return getTLSConfigSource(t.DisableAuthentication)
+		}
+		cert, err := certloader.NoCertificate(creds.CACert)
+		if err != nil {
+			return nil, err
+		}
+		return certloader.TLSConfigSourceFromCertificate(cert, logger), nil
+	}
+	return credentialsTLSConfigSource(creds, t.DisableAuthentication)
+}
+
+// Build the TLS config source for the given (non-empty) credentials.
+func credentialsTLSConfigSource(creds config.Credentials, disableAuth bool) (certloader.TLSConfigSource, error) {
+	if creds.UseWorkloadAPI || creds.WorkloadAPIAddr != "" {
+		return certloader.TLSConfigSourceFromWorkloadAPI(creds.WorkloadAPIAddr, disableAuth, logger)
+	}
+
+	var cert certloader.Certificate
+	var err error
+	if creds.Cert != "" {
+		cert, err = certloader.CertificateFromPEMFiles(creds.Cert, creds.Key, creds.CACert)
+	} else {
+		cert, err = certloader.CertificateFromKeystore(creds.Keystore, creds.StorePass, creds.CACert)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return certloader.TLSConfigSourceFromCertificate(cert, logger), nil
+}
+
+// newTunnel sets up the listener and dialer for a tunnel. The tunnel
+// doesn't accept connections until start() is called.
+func newTunnel(cfg config.Tunnel) (*tunnel, error) {
+	t := &tunnel{
+		name:   cfg.Name,
+		logger: tunnelLogger{cfg.Name},
+	}
+
+	state, err := buildTunnelState(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.state.Store(state)
+
+	connect, close, maxLifetime := tunnelTimeouts(cfg)
+	handshake, dial, idle := tunnelConnTimeouts(cfg)
+	var listener net.Listener
+	if cfg.Mode == config.ModeServer && cfg.QUIC {
+		t.quicListener, err = openQUICListener(cfg.Listen, state.serverConfig, handshakeTimeoutOrDefault(handshake, connect), t.logger)
+		listener = t.quicListener
+	} else {
+		listener, err = openListener(cfg.Listen, tunnelUDPIdleTimeout(cfg))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.AcceptProxyProtocol) > 0 {
+		trusted, err := socket.ParseCIDRs(cfg.AcceptProxyProtocol)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = socket.AcceptProxyProtocol(listener, trusted, connect)
+	}
+	if cfg.ListenProtocol != "" {
+		listener = starttls.Listen(listener, cfg.ListenProtocol)
+	}
+	switch cfg.Mode {
+	case config.ModeServer:
+		if t.quicListener == nil {
+			t.tlsListener = certloader.NewListener(listener, state.serverConfig)
+			t.tlsListener.SetSourceFilter(state.sources)
+			listener = t.tlsListener
+		}
+	case config.ModePassthrough:
+		listener = proxy.NewPassthroughListener(listener)
+	case config.ModeClient:
+		if state.serverConfig != nil {
+			t.tlsListener = certloader.NewListener(listener, state.serverConfig)
+			listener = t.tlsListener
+		}
+		if !cfg.ForwardProxy.IsEmpty() {
+			listener = proxy.NewForwardProxyListener(listener, cfg.ForwardProxy.Protocols)
+		}
+	}
+	t.listener = listener
+
+	t.proxy = proxy.New(
+		listener,
+		connect,
+		close,
+		maxLifetime,
+		t.dial,
+		t.logger,
+		proxyLoggerFlags(*quiet),
+		cfg.ProxyProtocol,
+	)
+	t.proxy.Route = t.route
+	t.proxy.SetConnTimeouts(handshake, dial, idle)
+	t.limiter = proxy.NewLimiter("tunnel."+cfg.Name, tunnelLimits(cfg))
+	t.proxy.SetLimiters(globalLimiter(), t.limiter)
+	t.proxy.SetQuotas(state.quotas)
+	t.proxy.SetRateLimits(proxyRateLimits(tunnelRateLimits(cfg)))
+	t.proxy.SetProxyProtocolVersion(tunnelProxyProtocolVersion(cfg))
+	t.proxy.SetMultiplex(tunnelMultiplex(cfg))
+	t.proxy.SetWebSocket(tunnelWebSocket(cfg))
+	t.proxy.SetHTTP(state.http)
+	return t, nil
+}
+
+// buildTunnelState builds the dialer, access control and TLS config for a
+// tunnel. If the previous state is given and the credentials haven't changed,
+// its TLS config source is reused rather than loaded again.
+func buildTunnelState(cfg config.Tunnel, previous *tunnelState) (*tunnelState, error) {
+	state := &tunnelState{config: cfg}
+
+	// Passthrough tunnels don't terminate TLS, so they need no credentials.
+	if cfg.Mode != config.ModePassthrough {
+		if previous != nil && previous.tlsConfigSource != nil &&
+			previous.config.Credentials == cfg.Credentials &&
+			previous.config.DisableAuthentication == cfg.DisableAuthentication {
+			state.tlsConfigSource = previous.tlsConfigSource
+		} else {
+			source, err := tunnelTLSConfigSource(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load credentials: %w", err)
+			}
+			state.tlsConfigSource = source
+		}
+	}
+
+	connect, _, _ := tunnelTimeouts(cfg)
+
+	var err error
+	switch cfg.Mode {
+	case config.ModeServer:
+		err = state.buildServer(connect, previous)
+	case config.ModeClient:
+		err = state.buildClient(connect, previous)
+	case config.ModePassthrough:
+		err = state.buildPassthrough(connect)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mode == config.ModeServer && cfg.Multiplex.Enabled {
+		state.serverConfig = mux.ServerConfig(state.serverConfig)
+	}
+	if cfg.Mode == config.ModeServer {
+		state.quotas, state.quotaPolicy, err = buildQuotas(cfg.Quotas, cfg.Access, connect)
+		if err != nil {
+			return nil, err
+		}
+		state.sources, err = socket.LoadSourceFilter(cfg.Sources.Allow, cfg.Sources.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("sources: %w", err)
+		}
+	}
+
+	// Tunnels with routes check the target of each route instead.
+	if state.routes != nil {
+		return state, nil
+	}
+
+	// NOTE: Like in client mode with flags, the status check for client
+	// tunnels is a TCP check against the server (which is a Ghostunnel).
+	state.check = newStatusHandler(state.dial, cfg.Mode, cfg.Listen, strings.Join(cfg.AllTargets(), ", "), cfg.TargetStatus)
+	return state, nil
+}
+
+// Set up dialer and TLS server config for a tunnel in server mode.
+func (s *tunnelState) buildServer(timeout time.Duration, previous *tunnelState) error {
+	if s.config.TargetTLS.Enabled {
+		if previous != nil && previous.target != nil && previous.config.TargetTLS == s.config.TargetTLS {
+			s.target = previous.target
+		} else {
+			var err error
+			s.target, err = newTargetTLS(s.config.TargetTLS.Credentials, s.config.TargetTLS.ServerName)
+			if err != nil {
+				return fmt.Errorf("unable to load target-tls credentials: %w", err)
+			}
+		}
+	}
+
+	if len(s.config.Routes) > 0 {
+		return s.buildRoutes(timeout, previous)
+	}
+
+	if len(s.config.Targets) > 0 {
+		pool, err := backendPool(s.config.Targets, s.config.TargetStatus, tunnelBalance(s.config), timeout, s.target)
+		if err != nil {
+			return fmt.Errorf("invalid target address: %w", err)
+		}
+		s.pool = pool
+		s.dial = pool.Dial
+	} else if isUDPAddress(s.config.Target) {
+		dial, err := udpBackendDialer(s.config.Target, timeout, tunnelUDPIdleTimeout(s.config))
+		if err != nil {
+			return fmt.Errorf("invalid target address: %w", err)
+		}
+		s.dial = dial
+	} else {
+		dial, err := backendDialer(s.config.Target, timeout, s.target)
+		if err != nil {
+			return fmt.Errorf("invalid target address: %w", err)
+		}
+		s.dial = dial
+	}
+	s.dial = listenProtocolDialer(s.config.ListenProtocol, s.dial, timeout)
+
+	var err error
+	s.alpnTargets, err = newALPNTargets(s.config.ALPNTargets, timeout, s.target)
+	if err != nil {
+		return fmt.Errorf("invalid ALPN target address: %w", err)
+	}
+
+	if s.config.HTTP.Enabled {
+		return s.buildHTTP(timeout)
+	}
+
+	alpn := s.config.ALPN
+	if isUDPAddress(s.config.Target) {
+		alpn = []string{udp.Protocol}
+	}
+	if s.config.WebSocket.Enabled {
+		alpn = []string{websocket.Protocol}
+	}
+	s.serverConfig, s.regoPolicy, err = serverTLSConfig(s.tlsConfigSource, s.config.Access, s.config.DisableAuthentication, alpn, timeout)
+	return err
+}
+
+// Set up TLS server config and HTTP options for a tunnel in HTTP mode. The
+// TLS handshake only checks that the client certificate is valid, access
+// control settings are checked for each request.
+func (s *tunnelState) buildHTTP(timeout time.Duration) error {
+	acl, regoPolicy, err := buildACL(s.config.Access, timeout)
+	if err != nil {
+		return err
+	}
+	s.regoPolicy = regoPolicy
+	s.http, err = newHTTPOptions(acl, s.config.DisableAuthentication, s.config.HTTP.Rules, timeout)
+	if err != nil {
+		return err
+	}
+	s.serverConfig, _, err = serverTLSConfig(s.tlsConfigSource, config.Access{All: true}, s.config.DisableAuthentication, s.config.ALPN, timeout)
+	return err
+}
+
+// Build the TLS server config for the given certificate source, access
+// control settings and ALPN protocols.
+func serverTLSConfig(source certloader.TLSConfigSource, access config.Access, disableAuth bool, alpn []string, timeout time.Duration) (certloader.TLSServerConfig, policy.Policy, error) {
+	config, err := buildServerConfig(*enabledCipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.NextProtos = alpn
+
+	acl, regoPolicy, err := buildACL(access, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if disableAuth {
+		config.ClientAuth = tls.NoClientCert
+	} else {
+		setServerACL(config, acl)
+	}
+
+	serverConfig, err := source.GetServerConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !disableAuth {
+		serverConfig = withSourceACL(serverConfig, acl)
+	}
+	return serverConfig, regoPolicy, nil
+}
+
+// Set up dialers for a tunnel in passthrough mode. The target (if any) is
+// used for connections that don't match a route.
+func (s *tunnelState) buildPassthrough(timeout time.Duration) error {
+	if s.config.Target != "" {
+		dial, err := backendDialer(s.config.Target, timeout, nil)
+		if err != nil {
+			return fmt.Errorf("invalid target address: %w", err)
+		}
+		s.dial = dial
+	}
+	if len(s.config.Routes) == 0 {
+		return nil
+	}
+
+	s.routes = routeTable{}
+	for _, cfg := range s.config.Routes {
+		name := strings.ToLower(cfg.ServerName)
+		dial, err := backendDialer(cfg.Target, timeout, nil)
+		if err != nil {
+			return fmt.Errorf("invalid target address for route '%s': %w", name, err)
+		}
+		s.routes[name] = &tunnelRoute{config: cfg, dial: dial}
+	}
+	return nil
+}
+
+// Set up TLS dialer (and TLS listener config, if any) for a tunnel in client
+// mode.
+func (s *tunnelState) buildClient(timeout time.Duration, previous *tunnelState) error {
+	if err := s.buildListenTLS(previous); err != nil {
+		return err
+	}
+
+	proxies, err := parseUpstreamProxies(s.config.AllConnectProxies())
+	if err != nil {
+		return err
+	}
+	// Like the tunnel's credentials, the CA bundle falls back to --cacert
+	caBundle := s.config.Credentials.CACert
+	if s.config.Credentials.IsEmpty() && caBundle == "" {
+		caBundle = *caBundlePath
+	}
+	s.upstream, err = newUpstreamProxyOptions(proxies, s.config.ConnectProxyFromEnv, s.config.ConnectProxyAuthFile, caBundle)
+	if err != nil {
+		return err
+	}
+
+	config, err := buildClientConfig(*enabledCipherSuites)
+	if err != nil {
+		return err
+	}
+
+	acl, regoPolicy, err := buildACL(s.config.Access, timeout)
+	if err != nil {
+		return err
+	}
+	s.regoPolicy = regoPolicy
+	config.VerifyPeerCertificate = acl.VerifyPeerCertificateClient
+	config.NextProtos = s.config.ALPN
+	if s.config.Multiplex.Enabled {
+		config.NextProtos = []string{mux.Protocol}
+	}
+	if isUDPAddress(s.config.Listen) {
+		config.NextProtos = []string{udp.Protocol}
+	}
+	if s.config.WebSocket.Enabled {
+		config.NextProtos = []string{websocket.Protocol}
+	}
+
+	dialer, err := s.upstream.dialer(&net.Dialer{Timeout: timeout})
+	if err != nil {
+		return err
+	}
+
+	if !s.config.ForwardProxy.IsEmpty() {
+		allow, err := parseDestinationPatterns(s.config.ForwardProxy.Allow)
+		if err != nil {
+			return err
+		}
+		s.forward, err = newForwardProxy(allow, s.tlsConfigSource, config, dialer, timeout)
+		return err
+	}
+
+	if s.config.QUIC {
+		s.quic = newQUICClient(timeout, tunnelLogger{s.config.Name})
+	}
+	s.dial, s.failover, err = clientTargetsDialer(s.tlsConfigSource, config, dialer, s.config.AllTargets(), clientTargetOptions{
+		serverName:  s.config.ServerName,
+		skipResolve: s.upstream.enabled(),
+		protocol:    s.config.TargetProtocol,
+		timeout:     timeout,
+		failover:    tunnelFailover(s.config),
+		quic:        s.quic,
+		websocket:   tunnelWebSocketPath(s.config),
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.config.Multiplex.Enabled {
+		s.multiplex = mux.NewPool(s.dial, mux.PoolOptions{
+			Size:   tunnelMultiplexConnections(s.config),
+			Logger: tunnelLogger{s.config.Name},
+		})
+		s.dial = s.multiplex.Dial
+	}
+	if isUDPAddress(s.config.Listen) {
+		s.dial = udpServerDialer(s.dial)
+	}
+	return nil
+}
+
+// Set up the TLS config for the listener of a client tunnel, if it
+// terminates TLS. Credentials are reused if they haven't changed.
+func (s *tunnelState) buildListenTLS(previous *tunnelState) error {
+	if s.config.ListenTLS.IsEmpty() {
+		return nil
+	}
+	creds := s.config.ListenTLS.Credentials
+	if previous != nil && previous.listenTLSConfigSource != nil && previous.config.ListenTLS == s.config.ListenTLS {
+		s.listenTLSConfigSource = previous.listenTLSConfigSource
+	} else {
+		var err error
+		s.listenTLSConfigSource, err = bridgeTLSConfigSource(creds)
+		if err != nil {
+			return fmt.Errorf("unable to load listen-tls credentials: %w", err)
+		}
+	}
+	var err error
+	s.serverConfig, err = listenTLSConfig(s.listenTLSConfigSource, creds.CACert != "")
+	return err
+}
+
+// Get the number of multiplexed sessions for a client tunnel, falling back
+// to the global flag if not set.
+func tunnelMultiplexConnections(t config.Tunnel) int {
+	if t.Multiplex.Connections > 0 {
+		return t.Multiplex.Connections
+	}
+	return *clientMultiplexConns
+}
+
+// Get the idle timeout for UDP flows of a tunnel, falling back to the global
+// flag if not set.
+func tunnelUDPIdleTimeout(t config.Tunnel) time.Duration {
+	if t.Timeouts.UDPIdle > 0 {
+		return t.Timeouts.UDPIdle
+	}
+	return *udpIdleTimeout
+}
+
+// Version of the PROXY protocol for a tunnel, v2 unless set.
+func tunnelProxyProtocolVersion(t config.Tunnel) int {
+	if t.ProxyProtocolVersion != 0 {
+		return t.ProxyProtocolVersion
+	}
+	return proxy.ProxyProtocolV2
+}
+
+// Multiplexing options for the proxy of a tunnel, nil unless it's a server
+// tunnel that accepts multiplexed sessions.
+func tunnelMultiplex(t config.Tunnel) *mux.Options {
+	if t.Mode != config.ModeServer || !t.Multiplex.Enabled {
+		return nil
+	}
+	return &mux.Options{}
+}
+
+// WebSocket options for the proxy of a tunnel, nil unless it's a server
+// tunnel that accepts WebSocket upgrades.
+func tunnelWebSocket(t config.Tunnel) *websocket.Options {
+	if t.Mode != config.ModeServer || !t.WebSocket.Enabled {
+		return nil
+	}
+	return &websocket.Options{Path: tunnelWebSocketPath(t)}
+}
+
+// Path of WebSocket upgrade requests for a tunnel, empty unless WebSocket is
+// enabled.
+func tunnelWebSocketPath(t config.Tunnel) string {
+	if !t.WebSocket.Enabled {
+		return ""
+	}
+	if t.WebSocket.Path != "" {
+		return t.WebSocket.Path
+	}
+	return websocket.DefaultPath
+}
+
+func (t *tunnel) config() config.Tunnel {
+	return t.state.Load().config
+}
+
+// Dial the backend with the current state of the tunnel.
+func (t *tunnel) dial() (net.Conn, error) {
+	return t.state.Load().dial()
+}
+
+// Pick the dialer for a connection. Forward proxy tunnels dial the
+// destination requested by the client. Tunnels with routes pick the target
+// based on the server name (falling back to the target of passthrough
+// tunnels), others based on the negotiated protocol (if
+// there are ALPN targets) or always use the same dialer. Tunnels with a UDP
+// target only accept clients that negotiated UDP forwarding.
+func (t *tunnel) route(conn net.Conn) (proxy.Dialer, error) {
+	state := t.state.Load()
+	if state.forward != nil {
+		return state.forward.route(conn)
+	}
+	if state.config.Mode == config.ModeServer && isUDPAddress(state.config.Target) {
+		return udpDialer(conn, state.dial)
+	}
+	if state.routes != nil {
+		return state.routes.dialer(conn, state.dial)
+	}
+	return state.alpnTargets.dialer(conn, state.dial), nil
+}
+
+// update applies a new state to a running tunnel. New connections use the
+// new state, established connections are not affected.
+func (t *tunnel) update(state *tunnelState) {
+	if t.tlsListener != nil {
+		t.tlsListener.SetConfig(state.serverConfig)
+		t.tlsListener.SetSourceFilter(state.sources)
+	}
+	if t.quicListener != nil {
+		t.quicListener.SetConfig(state.serverConfig)
+	}
+	if state.pool != nil {
+		state.pool.Start()
+	}
+	previous := t.state.Swap(state)
+	previous.close(state)
+	t.proxy.SetTimeouts(tunnelTimeouts(state.config))
+	t.proxy.SetConnTimeouts(tunnelConnTimeouts(state.config))
+	t.limiter.SetLimits(tunnelLimits(state.config))
+	t.proxy.SetQuotas(state.quotas)
+	t.proxy.SetRateLimits(proxyRateLimits(tunnelRateLimits(state.config)))
+	t.proxy.SetProxyProtocol(state.config.ProxyProtocol)
+	t.proxy.SetProxyProtocolVersion(tunnelProxyProtocolVersion(state.config))
+	t.proxy.SetMultiplex(tunnelMultiplex(state.config))
+	t.proxy.SetWebSocket(tunnelWebSocket(state.config))
+	t.proxy.SetHTTP(state.http)
+}
+
+func (t *tunnel) start() {
+	cfg := t.config()
+	state := t.state.Load()
+	if targets := cfg.AllTargets(); len(targets) > 0 {
+		t.logger.Printf("using target address %s", strings.Join(targets, ", "))
+	}
+	logUpstreamProxies(t.logger, state.upstream)
+	if state.pool != nil {
+		t.logger.Printf("balancing connections between targets using %s", tunnelBalance(cfg).Policy)
+		state.pool.Start()
+	}
+	if state.failover != nil {
+		t.logger.Printf("failing over between targets in order of priority")
+	}
+	if len(cfg.ALPN) > 0 {
+		t.logger.Printf("using ALPN protocols %s", strings.Join(cfg.ALPN, ", "))
+	}
+	if state.multiplex != nil {
+		t.logger.Printf("multiplexing connections over %d TLS connection(s)", tunnelMultiplexConnections(cfg))
+	} else if cfg.Multiplex.Enabled {
+		t.logger.Printf("accepting multiplexed sessions")
+	}
+	if t.quicListener != nil {
+		t.logger.Printf("accepting QUIC connections")
+	}
+	if state.quic != nil {
+		t.logger.Printf("carrying connections over QUIC")
+	}
+	if cfg.WebSocket.Enabled {
+		if cfg.Mode == config.ModeServer {
+			t.logger.Printf("accepting WebSocket upgrades on %s", tunnelWebSocketPath(cfg))
+		} else {
+			t.logger.Printf("carrying connections over WebSocket")
+		}
+	}
+	logLimits(t.logger, tunnelLimits(cfg))
+	logQuotas(t.logger, cfg.Quotas)
+	logRateLimits(t.logger, tunnelRateLimits(cfg))
+	logSourceFilter(t.logger, cfg.Sources.Allow, cfg.Sources.Deny)
+	if len(cfg.AcceptProxyProtocol) > 0 {
+		t.logger.Printf("accepting PROXY protocol headers from %s", strings.Join(cfg.AcceptProxyProtocol, ", "))
+	}
+	if cfg.ListenProtocol != "" {
+		t.logger.Printf("accepting %s upgrades to TLS", cfg.ListenProtocol)
+	}
+	if state.http != nil {
+		t.logger.Printf("proxying HTTP requests")
+	}
+	if cfg.Mode == config.ModePassthrough {
+		t.logger.Printf("passing through TLS connections without terminating them")
+	}
+	if state.routes != nil {
+		t.logger.Printf("routing connections by server name to %d routes", len(state.routes))
+	}
+	if state.target != nil {
+		t.logger.Printf("connecting to targets with TLS")
+	}
+	if state.listenTLSConfigSource != nil {
+		t.logger.Printf("terminating TLS on listener")
+	}
+	if isUDPAddress(cfg.Listen) || (cfg.Mode == config.ModeServer && isUDPAddress(cfg.Target)) {
+		t.logger.Printf("forwarding UDP flows (idle timeout %s)", tunnelUDPIdleTimeout(cfg))
+	}
+	if state.forward != nil {
+		t.logger.Printf("accepting forward proxy requests (%s) for destinations %s", strings.Join(cfg.ForwardProxy.Protocols, ", "), strings.Join(cfg.ForwardProxy.Allow, ", "))
+	}
+	t.logger.Printf("listening for connections on %s", cfg.Listen)
+	go t.proxy.Accept()
+}
+
+// stop stops accepting new connections, and stops health checks.
+func (t *tunnel) stop() {
+	t.proxy.Shutdown()
+	t.state.Load().close(nil)
+}
+
+// Stop the health checks of the pool and close the sessions of the state,
+// except for those it shares with keep (the state it was replaced with, or
+// built from), if any.
+func (s *tunnelState) close(keep *tunnelState) {
+	if keep == nil {
+		keep = &tunnelState{}
+	}
+	if s.pool != nil && s.pool != keep.pool {
+		s.pool.Stop()
+	}
+	if s.multiplex != nil && s.multiplex != keep.multiplex {
+		s.multiplex.Close()
+	}
+	if s.quic != nil && s.quic != keep.quic {
+		s.quic.Close()
+	}
+}
+
+func (t *tunnel) reload() {
+	state := t.state.Load()
+	if state.tlsConfigSource != nil {
+		if err := state.tlsConfigSource.Reload(); err != nil {
+			t.logger.Printf("error reloading TLS configuration: %s", err)
+		}
+	}
+	if state.regoPolicy != nil {
+		if err := state.regoPolicy.Reload(); err != nil {
+			t.logger.Printf("error reloading OPA policy: %s", err)
+		}
+	}
+	if state.quotaPolicy != nil {
+		if err := state.quotaPolicy.Reload(); err != nil {
+			t.logger.Printf("error reloading OPA policy for quotas: %s", err)
+		}
+	}
+	if err := state.target.reload(); err != nil {
+		t.logger.Printf("error reloading target-tls credentials: %s", err)
+	}
+	if state.listenTLSConfigSource != nil {
+		if err := state.listenTLSConfigSource.Reload(); err != nil {
+			t.logger.Printf("error reloading listen-tls credentials: %s", err)
+		}
+	}
+	state.routes.reload(state.tlsConfigSource, t.logger)
+	if t.tlsListener != nil && !state.config.Sources.IsEmpty() {
+		// Re-read files with source ranges.
+		sources, err := socket.LoadSourceFilter(state.config.Sources.Allow, state.config.Sources.Deny)
+		if err != nil {
+			t.logger.Printf("error reloading sources: %s", err)
+		} else {
+			t.tlsListener.SetSourceFilter(sources)
+		}
+	}
+}
+
+func (t *tunnel) status() tunnelStatus {
+	state := t.state.Load()
+	status := tunnelStatus{
+		Name:           state.config.Name,
+		Mode:           state.config.Mode,
+		Ok:             true,
+		ListenAddress:  state.config.Listen,
+		ForwardAddress: strings.Join(state.config.AllTargets(), ", "),
+		BackendStatus:  "ok",
+	}
+	if state.pool != nil {
+		status.Backends = state.pool.Status()
+	}
+	if state.failover != nil {
+		status.ActiveTarget = state.failover.Active()
+		status.Backends = state.failover.Status()
+	}
+	var err error
+	if state.routes != nil {
+		err = state.routes.check()
+		if err == nil && state.dial != nil {
+			err = checkDial(state.dial)
+		}
+	} else {
+		err = state.check.checkBackendStatus()
+	}
+	if err != nil {
+		status.Ok = false
+		status.BackendStatus = "critical"
+		status.BackendError = err.Error()
+	}
+	return status
+}
+
+// tunnelGroup holds all tunnels of a process started from a config file.
+type tunnelGroup struct {
+	mu      sync.Mutex
+	tunnels []*tunnel
+	// Tunnels that were removed on reload, but may still have open connections
+	draining []*tunnel
+	stopping bool
+}
+
+// reloadResult describes the outcome of reloading the config file.
+type reloadResult struct {
+	Status  string   `json:"status"`
+	Reason  string   `json:"reason,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Updated []string `json:"updated,omitempty"`
+}
+
+func (r reloadResult) String() string {
+	if r.Status != "applied" {
+		return fmt.Sprintf("%s (%s)", r.Status, r.Reason)
+	}
+	if len(r.Added)+len(r.Removed)+len(r.Updated) == 0 {
+		return "applied (no changes)"
+	}
+	return fmt.Sprintf("applied (added: %v, removed: %v, updated: %v)", r.Added, r.Removed, r.Updated)
+}
+
+// newTunnelGroup creates all tunnels in the config. If one of them fails
+// to initialize, listeners already opened for the others are closed again.
+func newTunnelGroup(cfg *config.Config) (*tunnelGroup, error) {
+	g := &tunnelGroup{}
+	for _, tc := range cfg.Tunnels {
+		t, err := newTunnel(tc)
+		if err != nil {
+			g.Shutdown()
+			return nil, fmt.Errorf("unable to set up tunnel '%s': %w", tc.Name, err)
+		}
+		g.tunnels = append(g.tunnels, t)
+	}
+	return g, nil
+}
+
+func (g *tunnelGroup) start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, t := range g.tunnels {
+		t.start()
+	}
+}
+
+// reload reloads credentials and policies of all tunnels.
+func (g *tunnelGroup) reload() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, t := range g.tunnels {
+		t.reload()
+	}
+}
+
+// apply diffs the given config against the running tunnels by name, and
+// adds, removes or updates tunnels accordingly. Tunnels that changed their
+// mode or listen address are replaced with a new tunnel. Established
+// connections are kept alive in all cases, including for removed tunnels.
+//
+// All new tunnels and states are built before any change is made, so that
+// if any part of the config is invalid (or a listener can't be opened) the
+// whole config is rejected and the running tunnels are left untouched.
+func (g *tunnelGroup) apply(cfg *config.Config) reloadResult {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopping {
+		return reloadResult{Status: "rejected", Reason: "shutting down"}
+	}
+
+	running := map[string]*tunnel{}
+	unixListeners := map[string]bool{}
+	for _, t := range g.tunnels {
+		running[t.name] = t
+		if isUnixAddress(t.config().Listen) {
+			unixListeners[t.config().Listen] = true
+		}
+	}
+
+	result := reloadResult{Status: "applied"}
+	tunnels := []*tunnel{}
+	added := []*tunnel{}
+	updates := map[*tunnel]*tunnelState{}
+
+	// Phase 1: build everything, bail out on error.
+	abort := func(name string, err error) reloadResult {
+		for _, t := range added {
+			t.stop()
+		}
+		for t, state := range updates {
+			state.close(t.state.Load())
+		}
+		return reloadResult{Status: "rejected", Reason: fmt.Sprintf("tunnel '%s': %s", name, err)}
+	}
+	for _, tc := range cfg.Tunnels {
+		old, ok := running[tc.Name]
+		if ok && reflect.DeepEqual(old.config(), tc) {
+			tunnels = append(tunnels, old)
+			continue
+		}
+		// Tunnels are updated in place, unless settings of their listener
+		// changed.
+		if ok && old.config().Mode == tc.Mode && old.config().Listen == tc.Listen &&
+			slices.Equal(old.config().AcceptProxyProtocol, tc.AcceptProxyProtocol) &&
+			slices.Equal(old.config().ForwardProxy.Protocols, tc.ForwardProxy.Protocols) &&
+			old.config().ListenTLS.IsEmpty() == tc.ListenTLS.IsEmpty() &&
+			old.config().ListenProtocol == tc.ListenProtocol &&
+			(tc.Mode != config.ModeServer || old.config().QUIC == tc.QUIC) &&
+			(!isUDPAddress(tc.Listen) || tunnelUDPIdleTimeout(old.config()) == tunnelUDPIdleTimeout(tc)) {
+			state, err := buildTunnelState(tc, old.state.Load())
+			if err != nil {
+				return abort(tc.Name, err)
+			}
+			updates[old] = state
+			tunnels = append(tunnels, old)
+			result.Updated = append(result.Updated, tc.Name)
+			continue
+		}
+		// Unlike TCP ports, UNIX sockets can't be shared by the old and new
+		// listener while we switch over (and closing the old listener
+		// removes the socket file).
+		if unixListeners[tc.Listen] {
+			return abort(tc.Name, fmt.Errorf("can't open a new listener on %s while it's in use, restart to change the listener settings of tunnels on UNIX sockets", tc.Listen))
+		}
+		t, err := newTunnel(tc)
+		if err != nil {
+			return abort(tc.Name, err)
+		}
+		added = append(added, t)
+		tunnels = append(tunnels, t)
+		if ok {
+			result.Updated = append(result.Updated, tc.Name)
+		} else {
+			result.Added = append(result.Added, tc.Name)
+		}
+	}
+
+	// Phase 2: commit changes.
+	for t, state := range updates {
+		t.update(state)
+	}
+	for _, t := range added {
+		t.start()
+	}
+
+	// Tunnels that are no longer in use stop accepting new connections, but
+	// we keep waiting on them so established connections can drain.
+	keep := map[*tunnel]bool{}
+	for _, t := range tunnels {
+		keep[t] = true
+	}
+	for _, t := range g.tunnels {
+		if keep[t] {
+			continue
+		}
+		t.logger.Printf("no longer accepting connections on %s", t.config().Listen)
+		t.stop()
+		g.draining = append(g.draining, t)
+	}
+	g.tunnels = tunnels
+
+	for _, t := range cfg.Tunnels {
+		delete(running, t.Name)
+	}
+	for name := range running {
+		result.Removed = append(result.Removed, name)
+	}
+	sort.Strings(result.Removed)
+	return result
+}
+
+// Returns true if the given address is a UNIX socket (unix:PATH).
+func isUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+// reloadConfig reads the config file at the given path and applies it.
+func (g *tunnelGroup) reloadConfig(path string) reloadResult {
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = validateConfig(cfg)
+	}
+	if err == nil {
+		err = checkLandlock(cfg)
+	}
+	if err != nil {
+		return reloadResult{Status: "rejected", Reason: err.Error()}
+	}
+	return g.apply(cfg)
+}
+
+// Shutdown stops accepting connections on all tunnels.
+func (g *tunnelGroup) Shutdown() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stopping = true
+	for _, t := range g.tunnels {
+		t.stop()
+	}
+}
+
+// Wait until all tunnels are shut down and connections are drained,
+// including connections on tunnels that were removed on reload.
+func (g *tunnelGroup) Wait() {
+	g.mu.Lock()
+	all := append(append([]*tunnel{}, g.tunnels...), g.draining...)
+	g.mu.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, t := range all {
+		wg.Add(1)
+		go func(p *proxy.Proxy) {
+			defer wg.Done()
+			p.Wait()
+		}(t.proxy)
+	}
+	wg.Wait()
+}
+
+func (g *tunnelGroup) status() []tunnelStatus {
+	g.mu.Lock()
+	tunnels := append([]*tunnel{}, g.tunnels...)
+	g.mu.Unlock()
+
+	out := make([]tunnelStatus, len(tunnels))
+	wg := &sync.WaitGroup{}
+	for i, t := range tunnels {
+		wg.Add(1)
+		go func(i int, t *tunnel) {
+			defer wg.Done()
+			out[i] = t.status()
+		}(i, t)
+	}
+	wg.Wait()
+	return out
+}
+
+// Open listening sockets for all tunnels in a config file.
+func runListen(context *Context) error {
+	if *statusAddress != "" {
+		err := context.serveStatus()
+		if err != nil {
+			logger.Printf("error serving /_status: %s", err)
+			context.tunnels.Shutdown()
+			return err
+		}
+	}
+
+	context.tunnels.start()
+
+	context.status.Listening()
+	context.status.HandleWatchdog()
+	context.signalHandler(context.tunnels)
+	context.tunnels.Wait()
+
+	return nil
+}
@@ -0,0 +1,1060 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/certloader"
+	"github.com/ghostunnel/ghostunnel/config"
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/starttls"
+	"github.com/stretchr/testify/assert"
+)
+
+func testServerTunnel(name, target string) config.Tunnel {
+	return config.Tunnel{
+		Name:   name,
+		Mode:   config.ModeServer,
+		Listen: "127.0.0.1:0",
+		Target: target,
+		Credentials: config.Credentials{
+			Cert:   "test-keys/server-cert.pem",
+			Key:    "test-keys/server-key.pem",
+			CACert: "test-keys/cacert.pem",
+		},
+		Access: config.Access{CNs: []string{"client"}},
+	}
+}
+
+func testClientTunnel(name, target string) config.Tunnel {
+	return config.Tunnel{
+		Name:   name,
+		Mode:   config.ModeClient,
+		Listen: "127.0.0.1:0",
+		Target: target,
+		Credentials: config.Credentials{
+			Cert:   "test-keys/client-cert.pem",
+			Key:    "test-keys/client-key.pem",
+			CACert: "test-keys/cacert.pem",
+		},
+	}
+}
+
+// Set the global flags that tunnels fall back to, for tests that forward
+// connections through tunnels.
+func setTunnelFlags() {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+}
+
+// Create and start a group with the given tunnels, which is shut down at the
+// end of the test.
+func startTunnels(t *testing.T, tunnels ...config.Tunnel) *tunnelGroup {
+	t.Helper()
+	group, err := newTunnelGroup(&config.Config{Tunnels: tunnels})
+	if !assert.Nil(t, err, "should be able to create tunnels") {
+		t.FailNow()
+	}
+	group.start()
+	t.Cleanup(group.Shutdown)
+	return group
+}
+
+// Address of the listener of the i-th tunnel in a group.
+func tunnelAddr(group *tunnelGroup, i int) string {
+	return group.tunnels[i].proxy.Listener.Addr().String()
+}
+
+// Listen on a random port for connections to a target, until the end of the
+// test.
+func listenTarget(t *testing.T) net.Listener {
+	t.Helper()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "should be able to listen on random port") {
+		t.FailNow()
+	}
+	t.Cleanup(func() { target.Close() })
+	return target
+}
+
+// Dial the listener of the i-th tunnel in a group. The connection is closed
+// at the end of the test.
+func dialTunnel(t *testing.T, group *tunnelGroup, i int) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", tunnelAddr(group, i))
+	if !assert.Nil(t, err, "should be able to dial tunnel") {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Write to a connection through tunnels, and check that the data arrives on
+// a new connection to the target. Returns the connection on the target,
+// which is closed at the end of the test.
+func assertForwarded(t *testing.T, conn net.Conn, target net.Listener) net.Conn {
+	t.Helper()
+	_, err := conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write to tunnel")
+
+	if listener, ok := target.(*net.TCPListener); ok {
+		_ = listener.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	backend, err := target.Accept()
+	if !assert.Nil(t, err, "should receive connection on target") {
+		t.FailNow()
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	_ = backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(backend, received)
+	assert.Nil(t, err, "should receive data on target")
+	assert.Equal(t, "hello", string(received))
+	return backend
+}
+
+func TestValidateTunnel(t *testing.T) {
+	tunnel := testServerTunnel("server", "example.com:443")
+	assert.NotNil(t, validateTunnel(tunnel), "should reject unsafe target")
+
+	tunnel.UnsafeTarget = true
+	assert.Nil(t, validateTunnel(tunnel), "should allow unsafe target with unsafe-target")
+
+	tunnel.TargetStatus = "localhost:8080"
+	assert.NotNil(t, validateTunnel(tunnel), "should reject target-status without scheme")
+
+	tunnel = testClientTunnel("client", "example.com:443")
+	tunnel.Listen = "0.0.0.0:8080"
+	assert.NotNil(t, validateTunnel(tunnel), "should reject unsafe listen")
+
+	tunnel.UnsafeListen = true
+	assert.Nil(t, validateTunnel(tunnel), "should allow unsafe listen with unsafe-listen")
+
+	tunnel.ConnectProxy = "ftp://invalid"
+	assert.NotNil(t, validateTunnel(tunnel), "should reject invalid connect proxy")
+
+	tunnel.ConnectProxy = ""
+	tunnel.ConnectProxies = []string{"socks5://localhost:1080", "http://proxy.example.com:3128"}
+	assert.Nil(t, validateTunnel(tunnel), "should allow chain of connect proxies")
+
+	tunnel.ConnectProxies = []string{"socks5://localhost:1080", "socks4://invalid"}
+	assert.NotNil(t, validateTunnel(tunnel), "should reject invalid proxy in chain")
+
+	tunnel = testClientTunnel("client", "")
+	tunnel.ForwardProxy = config.ForwardProxy{Protocols: []string{"socks5"}, Allow: []string{"*.example.com:8000-8999"}}
+	assert.Nil(t, validateTunnel(tunnel), "should allow valid forward proxy destinations")
+
+	tunnel.ForwardProxy.Allow = []string{"*.example.com"}
+	assert.NotNil(t, validateTunnel(tunnel), "should reject forward proxy destination without port")
+
+	enabled, saved := true, useLandlock
+	useLandlock = &enabled
+	tunnel.ForwardProxy.Allow = []string{"*.example.com:*"}
+	assert.NotNil(t, validateTunnel(tunnel), "should reject wildcard port with landlock")
+	useLandlock = saved
+	assert.Nil(t, validateTunnel(tunnel), "should allow wildcard port without landlock")
+
+	tunnel = testServerTunnel("server", "")
+	tunnel.Targets = []string{"localhost:8080", "example.com:8080"}
+	assert.NotNil(t, validateTunnel(tunnel), "should reject unsafe target in targets")
+
+	tunnel.Targets = []string{"localhost:8080", "localhost:8081"}
+	assert.Nil(t, validateTunnel(tunnel), "should allow safe targets")
+
+	tunnel.Balance.Policy = "invalid"
+	assert.NotNil(t, validateTunnel(tunnel), "should reject invalid balance policy")
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	tunnel := testServerTunnel("server", "localhost:8080")
+	connect, close, maxLifetime := tunnelTimeouts(tunnel)
+	assert.Equal(t, *connectTimeout, connect, "should default to global flag")
+	assert.Equal(t, *closeTimeout, close, "should default to global flag")
+	assert.Equal(t, *maxConnLifetime, maxLifetime, "should default to global flag")
+
+	tunnel.Timeouts = config.Timeouts{Connect: time.Second, Close: 2 * time.Second, MaxConnLifetime: time.Hour}
+	connect, close, maxLifetime = tunnelTimeouts(tunnel)
+	assert.Equal(t, time.Second, connect)
+	assert.Equal(t, 2*time.Second, close)
+	assert.Equal(t, time.Hour, maxLifetime)
+}
+
+func TestTunnelConnTimeouts(t *testing.T) {
+	*idleTimeout = time.Minute
+	defer func() { *idleTimeout = 0 }()
+
+	tunnel := testServerTunnel("server", "localhost:8080")
+	handshake, dial, idle := tunnelConnTimeouts(tunnel)
+	assert.Equal(t, *handshakeTimeout, handshake, "should default to global flag")
+	assert.Equal(t, *dialTimeout, dial, "should default to global flag")
+	assert.Equal(t, time.Minute, idle, "should default to global flag")
+
+	tunnel.Timeouts = config.Timeouts{Handshake: time.Second, Dial: 2 * time.Second, Idle: time.Hour}
+	handshake, dial, idle = tunnelConnTimeouts(tunnel)
+	assert.Equal(t, time.Second, handshake)
+	assert.Equal(t, 2*time.Second, dial)
+	assert.Equal(t, time.Hour, idle)
+}
+
+func TestTunnelRateLimits(t *testing.T) {
+	*maxReadRate = "1MiB"
+	*maxWriteRatePerConn = "100KB:1MB"
+	defer func() {
+		*maxReadRate = ""
+		*maxWriteRatePerConn = ""
+	}()
+
+	tunnel := testServerTunnel("server", "localhost:8080")
+	assert.Equal(t, config.RateLimits{Read: "1MiB", WritePerConn: "100KB:1MB"}, tunnelRateLimits(tunnel), "should default to global flags")
+
+	tunnel.RateLimits = config.RateLimits{Read: "10MiB", ReadPerConn: "1MiB"}
+	limits := tunnelRateLimits(tunnel)
+	assert.Equal(t, config.RateLimits{Read: "10MiB", ReadPerConn: "1MiB", WritePerConn: "100KB:1MB"}, limits)
+	assert.Equal(t, proxy.RateLimits{
+		Read:         proxy.Bandwidth{Rate: 10 << 20},
+		ReadPerConn:  proxy.Bandwidth{Rate: 1 << 20},
+		WritePerConn: proxy.Bandwidth{Rate: 100000, Burst: 1000000},
+	}, proxyRateLimits(limits))
+}
+
+func TestTunnelBalance(t *testing.T) {
+	*serverTargetBalance = "round-robin"
+	*serverTargetHealthCheck = 5 * time.Second
+
+	tunnel := testServerTunnel("server", "")
+	balance := tunnelBalance(tunnel)
+	assert.Equal(t, "round-robin", balance.Policy, "should default to global flag")
+	assert.Equal(t, 5*time.Second, balance.HealthCheckInterval, "should default to global flag")
+
+	tunnel.Balance = config.Balance{Policy: "least-connections", HealthCheckInterval: time.Second}
+	balance = tunnelBalance(tunnel)
+	assert.Equal(t, "least-connections", balance.Policy)
+	assert.Equal(t, time.Second, balance.HealthCheckInterval)
+}
+
+func TestTunnelWithTargets(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+
+	targets := []string{}
+	for i := 0; i < 2; i++ {
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err, "should be able to listen on random port")
+		defer target.Close()
+		targets = append(targets, target.Addr().String())
+	}
+
+	cfg := testServerTunnel("server", "")
+	cfg.Targets = targets
+	group, err := newTunnelGroup(&config.Config{Tunnels: []config.Tunnel{cfg}})
+	assert.Nil(t, err, "should be able to create tunnel with multiple targets")
+	if err != nil {
+		return
+	}
+	group.start()
+	defer group.Shutdown()
+
+	status := group.status()
+	assert.Len(t, status, 1)
+	assert.True(t, status[0].Ok, "tunnel should be healthy")
+	assert.Len(t, status[0].Backends, 2, "should report status for each backend")
+	assert.Equal(t, targets[0]+", "+targets[1], status[0].ForwardAddress)
+}
+
+func TestNewTunnelInvalid(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+
+	tunnel := testServerTunnel("server", "invalid")
+	_, err := newTunnel(tunnel)
+	assert.NotNil(t, err, "should reject invalid target")
+
+	tunnel = testServerTunnel("server", "localhost:8080")
+	tunnel.Credentials.Cert = "does-not-exist.pem"
+	_, err = newTunnel(tunnel)
+	assert.NotNil(t, err, "should reject invalid credentials")
+
+	tunnel = testServerTunnel("server", "localhost:8080")
+	tunnel.Access = config.Access{URIs: []string{"spiffe://**/foo/**"}}
+	_, err = newTunnel(tunnel)
+	assert.NotNil(t, err, "should reject invalid URI pattern")
+}
+
+func TestTunnelGroupEndToEnd(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	servers, err := newTunnelGroup(&config.Config{
+		Tunnels: []config.Tunnel{testServerTunnel("server", target.Addr().String())},
+	})
+	assert.Nil(t, err, "should be able to create server tunnel")
+	if err != nil {
+		return
+	}
+
+	serverAddr := servers.tunnels[0].proxy.Listener.Addr().String()
+	clients, err := newTunnelGroup(&config.Config{
+		Tunnels: []config.Tunnel{testClientTunnel("client", serverAddr)},
+	})
+	assert.Nil(t, err, "should be able to create client tunnel")
+	if err != nil {
+		servers.Shutdown()
+		return
+	}
+
+	servers.start()
+	clients.start()
+	defer func() {
+		clients.Shutdown()
+		servers.Shutdown()
+	}()
+
+	conn, err := net.Dial("tcp", clients.tunnels[0].proxy.Listener.Addr().String())
+	assert.Nil(t, err, "should be able to dial client tunnel")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write to client tunnel")
+
+	backend, err := target.Accept()
+	assert.Nil(t, err, "should receive connection on target")
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+
+	_ = backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(backend, received)
+	assert.Nil(t, err, "should receive data on target")
+	assert.Equal(t, "hello", string(received))
+
+	// Note: status check dials the target, so we check it last.
+	status := servers.status()
+	assert.Len(t, status, 1)
+	assert.True(t, status[0].Ok, "server tunnel should be healthy")
+	assert.Equal(t, "server", status[0].Name)
+}
+
+func TestTunnelGroupApply(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+
+	group, err := newTunnelGroup(&config.Config{
+		Tunnels: []config.Tunnel{
+			testServerTunnel("a", "localhost:8080"),
+			testServerTunnel("b", "localhost:8081"),
+		},
+	})
+	assert.Nil(t, err, "should be able to create tunnels")
+	if err != nil {
+		return
+	}
+	group.start()
+	defer group.Shutdown()
+
+	a := group.tunnels[0]
+	aState := a.state.Load()
+
+	// Unchanged config should be a no-op
+	result := group.apply(&config.Config{
+		Tunnels: []config.Tunnel{a.config(), group.tunnels[1].config()},
+	})
+	assert.Equal(t, "applied", result.Status)
+	assert.Empty(t, result.Added)
+	assert.Empty(t, result.Removed)
+	assert.Empty(t, result.Updated)
+	assert.Equal(t, aState, a.state.Load(), "state should not change")
+
+	// Update a (in-place), remove b, add c
+	updated := testServerTunnel("a", "localhost:9090")
+	result = group.apply(&config.Config{
+		Tunnels: []config.Tunnel{updated, testServerTunnel("c", "localhost:8082")},
+	})
+	assert.Equal(t, "applied", result.Status, result.Reason)
+	assert.Equal(t, []string{"c"}, result.Added)
+	assert.Equal(t, []string{"b"}, result.Removed)
+	assert.Equal(t, []string{"a"}, result.Updated)
+	assert.Len(t, group.tunnels, 2)
+	assert.Len(t, group.draining, 1)
+	assert.Same(t, a, group.tunnels[0], "tunnel should be updated in-place")
+	assert.Equal(t, "localhost:9090", a.config().Target)
+	assert.Equal(t, aState.tlsConfigSource, a.state.Load().tlsConfigSource, "should reuse TLS config source")
+
+	// Limits are updated in place
+	limited := updated
+	limited.Limits = config.Limits{MaxConnections: 10, MaxConnectionsPerIP: 2}
+	result = group.apply(&config.Config{
+		Tunnels: []config.Tunnel{limited, testServerTunnel("c", "localhost:8082")},
+	})
+	assert.Equal(t, []string{"a"}, result.Updated)
+	assert.Equal(t, proxy.Limits{MaxConnections: 10, MaxConnectionsPerIP: 2}, a.limiter.Limits())
+	assert.Nil(t, a.state.Load().quotas, "should have no quotas by default")
+
+	// Quotas are built from the config
+	limited.Quotas = config.Quotas{
+		Key:       "uri",
+		Default:   config.Quota{MaxConnections: 5},
+		Overrides: map[string]config.Quota{"spiffe://example.com/batch": {Rate: 1}},
+	}
+	result = group.apply(&config.Config{
+		Tunnels: []config.Tunnel{limited, testServerTunnel("c", "localhost:8082")},
+	})
+	assert.Equal(t, []string{"a"}, result.Updated)
+	quotas := a.state.Load().quotas
+	if assert.NotNil(t, quotas) {
+		assert.Equal(t, proxy.Quota{MaxConnections: 5}, quotas.Default)
+		assert.Equal(t, proxy.Quota{Rate: 1}, quotas.Overrides["spiffe://example.com/batch"])
+	}
+
+	// Sources are built from the config
+	assert.Nil(t, a.state.Load().sources, "should have no source filter by default")
+	limited.Sources = config.Sources{Deny: []string{"10.0.0.0/8"}}
+	result = group.apply(&config.Config{
+		Tunnels: []config.Tunnel{limited, testServerTunnel("c", "localhost:8082")},
+	})
+	assert.Equal(t, []string{"a"}, result.Updated)
+	if sources := a.state.Load().sources; assert.NotNil(t, sources) {
+		assert.False(t, sources.Allowed(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+		assert.True(t, sources.Allowed(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}))
+	}
+
+	// Invalid config should be rejected as a whole
+	invalid := testServerTunnel("d", "localhost:8083")
+	invalid.Credentials.Cert = "does-not-exist.pem"
+	result = group.apply(&config.Config{
+		Tunnels: []config.Tunnel{testServerTunnel("a", "localhost:7070"), invalid},
+	})
+	assert.Equal(t, "rejected", result.Status)
+	assert.Contains(t, result.Reason, "tunnel 'd'")
+	assert.Len(t, group.tunnels, 2)
+	assert.Equal(t, "localhost:9090", a.config().Target, "should not apply partial config")
+
+	result = group.reloadConfig("/does/not/exist")
+	assert.Equal(t, "rejected", result.Status, "should reject missing config file")
+}
+
+func TestTunnelStateClose(t *testing.T) {
+	errDial := errors.New("dial failed")
+	dial := func() (net.Conn, error) { return nil, errDial }
+	shared := mux.NewPool(dial, mux.PoolOptions{})
+	discarded := mux.NewPool(dial, mux.PoolOptions{})
+
+	// Closing a state that was built but not applied (e.g. on a rejected
+	// reload) keeps what it shares with the running state.
+	running := &tunnelState{multiplex: shared}
+	(&tunnelState{multiplex: discarded}).close(running)
+	(&tunnelState{multiplex: shared}).close(running)
+	_, err := shared.Dial()
+	assert.Equal(t, errDial, err, "shared pool should stay open")
+	_, err = discarded.Dial()
+	assert.ErrorContains(t, err, "closed", "discarded pool should be closed")
+
+	running.close(nil)
+	_, err = shared.Dial()
+	assert.ErrorContains(t, err, "closed", "pool should be closed with its tunnel")
+}
+
+func TestTunnelGroupReloadUnixListener(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+
+	path := t.TempDir() + "/server.sock"
+	tc := testServerTunnel("a", "localhost:8080")
+	tc.Listen = "unix:" + path
+	group, err := newTunnelGroup(&config.Config{Tunnels: []config.Tunnel{tc}})
+	assert.Nil(t, err, "should be able to create tunnel")
+	if err != nil {
+		return
+	}
+	group.start()
+	defer group.Shutdown()
+
+	// Settings other than those of the listener are updated in place.
+	updated := tc
+	updated.Target = "localhost:9090"
+	result := group.apply(&config.Config{Tunnels: []config.Tunnel{updated}})
+	assert.Equal(t, "applied", result.Status, result.Reason)
+
+	// The listener can't be replaced while the old one holds the socket.
+	changed := updated
+	changed.AcceptProxyProtocol = []string{"10.0.0.0/8"}
+	result = group.apply(&config.Config{Tunnels: []config.Tunnel{changed}})
+	assert.Equal(t, "rejected", result.Status)
+	assert.Contains(t, result.Reason, "restart")
+	renamed := updated
+	renamed.Name = "b"
+	result = group.apply(&config.Config{Tunnels: []config.Tunnel{renamed}})
+	assert.Equal(t, "rejected", result.Status)
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err, "old listener should still accept connections")
+	if err == nil {
+		conn.Close()
+	}
+
+	// Once the tunnel is removed, the socket can be used again.
+	result = group.apply(&config.Config{Tunnels: []config.Tunnel{testServerTunnel("c", "localhost:8082")}})
+	assert.Equal(t, "applied", result.Status, result.Reason)
+	result = group.apply(&config.Config{Tunnels: []config.Tunnel{changed}})
+	assert.Equal(t, "applied", result.Status, result.Reason)
+}
+
+func TestTunnelGroupReloadKeepsConnections(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	servers, err := newTunnelGroup(&config.Config{
+		Tunnels: []config.Tunnel{testServerTunnel("server", target.Addr().String())},
+	})
+	assert.Nil(t, err, "should be able to create server tunnel")
+	if err != nil {
+		return
+	}
+	serverAddr := servers.tunnels[0].proxy.Listener.Addr().String()
+	clients, err := newTunnelGroup(&config.Config{
+		Tunnels: []config.Tunnel{testClientTunnel("client", serverAddr)},
+	})
+	assert.Nil(t, err, "should be able to create client tunnel")
+	if err != nil {
+		servers.Shutdown()
+		return
+	}
+	servers.start()
+	clients.start()
+	defer servers.Shutdown()
+
+	conn, err := net.Dial("tcp", clients.tunnels[0].proxy.Listener.Addr().String())
+	assert.Nil(t, err, "should be able to dial client tunnel")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	backend, err := target.Accept()
+	assert.Nil(t, err, "should receive connection on target")
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+
+	// Remove the client tunnel while a connection is open
+	result := clients.apply(&config.Config{
+		Tunnels: []config.Tunnel{testClientTunnel("other", serverAddr)},
+	})
+	assert.Equal(t, "applied", result.Status, result.Reason)
+	assert.Equal(t, []string{"client"}, result.Removed)
+	defer clients.Shutdown()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write to drained connection")
+
+	_ = backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(backend, received)
+	assert.Nil(t, err, "should receive data on target after reload")
+	assert.Equal(t, "hello", string(received))
+}
+
+func TestTunnelClientFailover(t *testing.T) {
+	*enabledCipherSuites = "AES,CHACHA"
+	*connectTimeout = 10 * time.Second
+	*closeTimeout = 10 * time.Second
+	*clientTargetBackoff = time.Hour
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	servers, err := newTunnelGroup(&config.Config{
+		Tunnels: []config.Tunnel{testServerTunnel("server", target.Addr().String())},
+	})
+	assert.Nil(t, err, "should be able to create server tunnel")
+	if err != nil {
+		return
+	}
+	servers.start()
+	defer servers.Shutdown()
+
+	// First target is down, so we should fail over to the second one.
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	down.Close()
+
+	cfg := testClientTunnel("client", "")
+	cfg.Targets = []string{down.Addr().String(), servers.tunnels[0].proxy.Listener.Addr().String()}
+	cfg.ServerName = "localhost"
+	clients, err := newTunnelGroup(&config.Config{Tunnels: []config.Tunnel{cfg}})
+	assert.Nil(t, err, "should be able to create client tunnel")
+	if err != nil {
+		return
+	}
+	clients.start()
+	defer clients.Shutdown()
+
+	conn, err := net.Dial("tcp", clients.tunnels[0].proxy.Listener.Addr().String())
+	assert.Nil(t, err, "should be able to dial client tunnel")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write to client tunnel")
+
+	backend, err := target.Accept()
+	assert.Nil(t, err, "should receive connection on target")
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+
+	status := clients.status()
+	assert.Len(t, status, 1)
+	assert.Equal(t, cfg.Targets[1], status[0].ActiveTarget, "second target should be active")
+	assert.Len(t, status[0].Backends, 2)
+	assert.True(t, status[0].Backends[0].Ejected, "first target should be marked down")
+}
+
+func TestTunnelRoutes(t *testing.T) {
+	setTunnelFlags()
+	targets := []net.Listener{listenTarget(t), listenTarget(t)}
+
+	cfg := testServerTunnel("server", "")
+	cfg.Routes = []config.Route{
+		{ServerName: "a.example.com", Target: targets[0].Addr().String()},
+		{
+			ServerName: "*.example.com",
+			Target:     targets[1].Addr().String(),
+			Credentials: config.Credentials{
+				Cert:   "test-keys/root-cert.pem",
+				Key:    "test-keys/root-key.pem",
+				CACert: "test-keys/cacert.pem",
+			},
+		},
+		{ServerName: "denied.example.org", Target: targets[1].Addr().String(), Access: config.Access{CNs: []string{"nobody"}}},
+	}
+	group := startTunnels(t, cfg)
+
+	cert, err := tls.LoadX509KeyPair("test-keys/client-cert.pem", "test-keys/client-key.pem")
+	assert.Nil(t, err, "should be able to load client cert")
+
+	// Dial the tunnel with the given server name, and return the CN of the
+	// server certificate and the connection on the target (if any).
+	dial := func(serverName string, target net.Listener) (string, net.Conn, error) {
+		conn, err := tls.Dial("tcp", tunnelAddr(group, 0), &tls.Config{
+			ServerName:         serverName,
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		defer conn.Close()
+		cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+
+		// With TLS 1.3, the server rejects our certificate after the
+		// handshake completed, so we wait briefly for an alert.
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return cn, nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != nil && err != io.EOF {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return cn, nil, err
+			}
+		}
+		backend, err := target.Accept()
+		return cn, backend, err
+	}
+
+	cn, backend, err := dial("a.example.com", targets[0])
+	assert.Nil(t, err, "should route known server name")
+	assert.Equal(t, "server", cn, "should use tunnel credentials")
+	if backend != nil {
+		backend.Close()
+	}
+
+	cn, backend, err = dial("B.Example.Com", targets[1])
+	assert.Nil(t, err, "should route server name matching wildcard")
+	assert.Equal(t, "root", cn, "should use route credentials")
+	if backend != nil {
+		backend.Close()
+	}
+
+	_, _, err = dial("a.b.example.com", targets[1])
+	assert.NotNil(t, err, "wildcard should only match a single label")
+
+	_, _, err = dial("unknown.example.net", targets[1])
+	assert.NotNil(t, err, "should reject unknown server name")
+
+	_, _, err = dial("denied.example.org", targets[1])
+	assert.NotNil(t, err, "should apply access control of route")
+
+	status := group.status()
+	assert.Len(t, status, 1)
+	assert.True(t, status[0].Ok, "tunnel should be healthy")
+}
+
+func TestTunnelALPN(t *testing.T) {
+	setTunnelFlags()
+	targets := []net.Listener{listenTarget(t), listenTarget(t)}
+
+	server := testServerTunnel("server", targets[0].Addr().String())
+	server.ALPN = []string{"h2", "http/1.1"}
+	server.ALPNTargets = map[string]string{"h2": targets[1].Addr().String()}
+	servers := startTunnels(t, server)
+
+	h2 := testClientTunnel("h2", tunnelAddr(servers, 0))
+	h2.ALPN = []string{"h2"}
+	http1 := testClientTunnel("http1", tunnelAddr(servers, 0))
+	http1.ALPN = []string{"http/1.1"}
+	clients := startTunnels(t, h2, http1)
+
+	// Each client should end up at the target for the protocol it requested.
+	for i, target := range []net.Listener{targets[1], targets[0]} {
+		assertForwarded(t, dialTunnel(t, clients, i), target)
+	}
+}
+
+func TestTunnelPassthrough(t *testing.T) {
+	setTunnelFlags()
+	routed, fallback := listenTarget(t), listenTarget(t)
+
+	cfg := config.Tunnel{
+		Name:   "passthrough",
+		Mode:   config.ModePassthrough,
+		Listen: "127.0.0.1:0",
+		Target: fallback.Addr().String(),
+		Routes: []config.Route{{ServerName: "*.example.com", Target: routed.Addr().String()}},
+	}
+	group := startTunnels(t, cfg)
+
+	// The ClientHello is passed through unmodified to the target for the
+	// server name, or to the fallback target for unknown server names.
+	for serverName, target := range map[string]net.Listener{"a.example.com": routed, "other.example.org": fallback} {
+		go func(serverName string) {
+			_, _ = tls.Dial("tcp", tunnelAddr(group, 0), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		}(serverName)
+
+		_ = target.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		backend, err := target.Accept()
+		if !assert.Nil(t, err, "should receive connection on target for %s", serverName) {
+			return
+		}
+		t.Cleanup(func() { backend.Close() })
+
+		_ = backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header := make([]byte, 1)
+		_, err = io.ReadFull(backend, header)
+		assert.Nil(t, err, "should receive client hello on target")
+		assert.Equal(t, byte(0x16), header[0], "should receive TLS handshake record")
+	}
+}
+
+func TestTunnelTransports(t *testing.T) {
+	setTunnelFlags()
+
+	cases := []struct {
+		name      string
+		configure func(server, client *config.Tunnel)
+	}{
+		{"tcp", func(server, client *config.Tunnel) {}},
+		{"multiplex", func(server, client *config.Tunnel) {
+			server.Multiplex = config.Multiplex{Enabled: true}
+			client.Multiplex = config.Multiplex{Enabled: true, Connections: 1}
+		}},
+		// Servers that don't accept multiplexed sessions get one TLS
+		// connection per client connection.
+		{"multiplex fallback", func(server, client *config.Tunnel) {
+			client.Multiplex = config.Multiplex{Enabled: true, Connections: 1}
+		}},
+		{"quic", func(server, client *config.Tunnel) {
+			server.QUIC = true
+			client.QUIC = true
+		}},
+		{"websocket", func(server, client *config.Tunnel) {
+			server.WebSocket = config.WebSocket{Enabled: true, Path: "/tunnel"}
+			client.WebSocket = config.WebSocket{Enabled: true, Path: "/tunnel"}
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target := listenTarget(t)
+			server := testServerTunnel("server", target.Addr().String())
+			client := testClientTunnel("client", "")
+			c.configure(&server, &client)
+
+			servers := startTunnels(t, server)
+			client.Target = tunnelAddr(servers, 0)
+			clients := startTunnels(t, client)
+
+			for i := 0; i < 3; i++ {
+				assertForwarded(t, dialTunnel(t, clients, 0), target)
+			}
+		})
+	}
+}
+
+func TestTunnelForwardProxy(t *testing.T) {
+	setTunnelFlags()
+	target := listenTarget(t)
+	servers := startTunnels(t, testServerTunnel("server", target.Addr().String()))
+	_, port, _ := net.SplitHostPort(tunnelAddr(servers, 0))
+
+	// Only the server by name is allowed, not by IP address.
+	client := testClientTunnel("client", "")
+	client.ForwardProxy = config.ForwardProxy{
+		Protocols: []string{"connect"},
+		Allow:     []string{"localhost:" + port},
+	}
+	clients := startTunnels(t, client)
+
+	connect := func(destination string) (net.Conn, string) {
+		conn := dialTunnel(t, clients, 0)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "CONNECT "+destination+" HTTP/1.1\r\n\r\n")
+		status := make([]byte, len("HTTP/1.1 200"))
+		_, _ = io.ReadFull(conn, status)
+		return conn, string(status)
+	}
+
+	_, status := connect("127.0.0.1:" + port)
+	assert.Equal(t, "HTTP/1.1 403", status, "should deny destination that isn't allowed")
+
+	conn, status := connect("localhost:" + port)
+	assert.Equal(t, "HTTP/1.1 200", status, "should connect to allowed destination")
+	// Rest of the response line and headers
+	rest := make([]byte, len(" Connection established\r\n\r\n"))
+	_, err := io.ReadFull(conn, rest)
+	assert.Nil(t, err, "should read rest of response")
+	assertForwarded(t, conn, target)
+
+	// Forward proxies have no fixed target to check.
+	assert.True(t, clients.status()[0].Ok, "forward proxy tunnel should be healthy")
+}
+
+func TestTunnelTLSBridge(t *testing.T) {
+	setTunnelFlags()
+
+	// Target that requires TLS (and a client certificate) itself.
+	serverCert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-key.pem")
+	assert.Nil(t, err, "should load server certificate")
+	clientCert, err := tls.LoadX509KeyPair("test-keys/client-cert.pem", "test-keys/client-key.pem")
+	assert.Nil(t, err, "should load client certificate")
+	caBundle, err := certloader.LoadTrustStore("test-keys/cacert.pem")
+	assert.Nil(t, err, "should load CA bundle")
+	target := tls.NewListener(listenTarget(t), &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    caBundle,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	server := testServerTunnel("server", target.Addr().String())
+	server.TargetTLS = config.TargetTLS{
+		Enabled: true,
+		Credentials: config.Credentials{
+			Cert:   "test-keys/client-cert.pem",
+			Key:    "test-keys/client-key.pem",
+			CACert: "test-keys/cacert.pem",
+		},
+		ServerName: "localhost",
+	}
+	servers := startTunnels(t, server)
+
+	client := testClientTunnel("client", tunnelAddr(servers, 0))
+	client.ListenTLS = config.ListenTLS{
+		Credentials: config.Credentials{
+			Cert:   "test-keys/server-cert.pem",
+			Key:    "test-keys/server-key.pem",
+			CACert: "test-keys/cacert.pem",
+		},
+	}
+	clients := startTunnels(t, client)
+
+	conn, err := tls.Dial("tcp", tunnelAddr(clients, 0), &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      caBundle,
+		ServerName:   "localhost",
+	})
+	if !assert.Nil(t, err, "should be able to dial client tunnel with TLS") {
+		return
+	}
+	defer conn.Close()
+	backend := assertForwarded(t, conn, target)
+
+	peers := backend.(*tls.Conn).ConnectionState().PeerCertificates
+	assert.NotEmpty(t, peers, "target should get the target-tls client certificate")
+	if len(peers) > 0 {
+		assert.Equal(t, "client", peers[0].Subject.CommonName)
+	}
+
+	// Applications without a client certificate are rejected.
+	plain, err := tls.Dial("tcp", tunnelAddr(clients, 0), &tls.Config{
+		RootCAs:    caBundle,
+		ServerName: "localhost",
+	})
+	if err == nil {
+		_ = plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = plain.Read(make([]byte, 1))
+		plain.Close()
+	}
+	assert.NotNil(t, err, "should reject applications without a client certificate")
+}
+
+func TestTunnelSTARTTLS(t *testing.T) {
+	setTunnelFlags()
+
+	// Plain SMTP target that echoes commands after its greeting.
+	target := listenTarget(t)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "220 target ESMTP\r\n")
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	server := testServerTunnel("server", target.Addr().String())
+	server.ListenProtocol = starttls.SMTP
+	servers := startTunnels(t, server)
+
+	client := testClientTunnel("client", tunnelAddr(servers, 0))
+	client.TargetProtocol = starttls.SMTP
+	clients := startTunnels(t, client)
+
+	conn := dialTunnel(t, clients, 0)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// The client tunnel upgrades to TLS, and replays the greeting.
+	greeting, err := reader.ReadString('\n')
+	assert.Nil(t, err, "should read greeting")
+	assert.True(t, strings.HasPrefix(greeting, "220 "), "should get greeting")
+
+	_, err = io.WriteString(conn, "EHLO app\r\n")
+	assert.Nil(t, err, "should be able to write to client tunnel")
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err, "should read echo from target")
+	assert.Equal(t, "EHLO app\r\n", line)
+}
+
+func TestTunnelUDP(t *testing.T) {
+	setTunnelFlags()
+	*udpIdleTimeout = time.Minute
+
+	// UDP target that echoes datagrams.
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "should be able to listen on random port") {
+		return
+	}
+	defer target.Close()
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = target.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	servers := startTunnels(t, testServerTunnel("server", "udp:"+target.LocalAddr().String()))
+
+	client := testClientTunnel("client", tunnelAddr(servers, 0))
+	client.Listen = "udp:127.0.0.1:0"
+	clients := startTunnels(t, client, testClientTunnel("stream", tunnelAddr(servers, 0)))
+
+	conn, err := net.Dial("udp", tunnelAddr(clients, 0))
+	if !assert.Nil(t, err, "should be able to dial client tunnel") {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, datagram := range []string{"first", "second"} {
+		_, err = conn.Write([]byte(datagram))
+		assert.Nil(t, err, "should be able to send datagram")
+		reply := make([]byte, 64)
+		n, err := conn.Read(reply)
+		assert.Nil(t, err, "should receive echo from target")
+		assert.Equal(t, datagram, string(reply[:n]))
+	}
+
+	// Clients that didn't negotiate UDP forwarding are rejected.
+	plain := dialTunnel(t, clients, 1)
+	_ = plain.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = plain.Write([]byte("hello"))
+	_, err = plain.Read(make([]byte, 16))
+	assert.NotNil(t, err, "should reject stream from client without UDP forwarding")
+}
+
+func TestTunnelQUIC(t *testing.T) {
+	setTunnelFlags()
+	target := listenTarget(t)
+
+	server := testServerTunnel("server", target.Addr().String())
+	server.QUIC = true
+	servers := startTunnels(t, server)
+	assert.Equal(t, "udp", servers.tunnels[0].proxy.Listener.Addr().Network(), "should listen on a UDP port")
+
+	client := testClientTunnel("client", tunnelAddr(servers, 0))
+	client.QUIC = true
+	assertForwarded(t, dialTunnel(t, startTunnels(t, client), 0), target)
+
+	// Changing the access control settings updates the server in place,
+	// and applies to new QUIC connections.
+	server.Access = config.Access{CNs: []string{"someone-else"}}
+	result := servers.apply(&config.Config{Tunnels: []config.Tunnel{server}})
+	assert.Equal(t, "applied", result.Status)
+	assert.Equal(t, []string{"server"}, result.Updated)
+
+	client.Name = "rejected"
+	conn := dialTunnel(t, startTunnels(t, client), 0)
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "should close connection of client that isn't allowed anymore")
+}
@@ -0,0 +1,92 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/mux"
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"github.com/ghostunnel/ghostunnel/socket"
+	"github.com/ghostunnel/ghostunnel/udp"
+)
+
+// Returned for UDP targets where only streams can be forwarded.
+var errUDPTarget = errors.New("UDP targets are only supported as the single target of a server")
+
+// Returns true if the given address is a UDP socket (udp:HOST:PORT).
+func isUDPAddress(addr string) bool {
+	return strings.HasPrefix(addr, "udp:")
+}
+
+// Open the listener of a client. UDP listeners accept a connection for each
+// flow, which is closed after the given idle timeout (see udp.NewListener).
+func openListener(address string, idle time.Duration) (net.Listener, error) {
+	network, addr, _, err := socket.ParseAddress(address, false)
+	if err != nil {
+		return nil, err
+	}
+	if network != "udp" {
+		return socket.Open(network, addr)
+	}
+	conn, err := socket.OpenPacket(addr)
+	if err != nil {
+		return nil, err
+	}
+	return udp.NewListener(conn, idle), nil
+}
+
+// Get dialer function for a UDP target in server mode. Each connection from
+// a client carries a flow, whose datagrams are sent to the target from a
+// socket of its own (see udp.Dial).
+func udpBackendDialer(target string, timeout, idle time.Duration) (func() (net.Conn, error), error) {
+	_, address, _, err := socket.ParseAddress(target, false)
+	if err != nil {
+		return nil, err
+	}
+	return func() (net.Conn, error) {
+		return udp.Dial(address, timeout, idle)
+	}, nil
+}
+
+// Pick the dialer for a connection to a UDP target. Clients must negotiate
+// udp.Protocol, so that a stream from a client that doesn't forward UDP is
+// never sent to the target as datagrams.
+func udpDialer(conn net.Conn, dial proxy.Dialer) (proxy.Dialer, error) {
+	if mux.NegotiatedProtocol(conn) != udp.Protocol {
+		return nil, fmt.Errorf("client didn't negotiate %s via ALPN", udp.Protocol)
+	}
+	return dial, nil
+}
+
+// Wrap the dialer of a client with a UDP listener, to check that the server
+// negotiated udp.Protocol and forwards flows to a UDP target.
+func udpServerDialer(dial func() (net.Conn, error)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		if mux.NegotiatedProtocol(conn) != udp.Protocol {
+			conn.Close()
+			return nil, fmt.Errorf("server didn't negotiate %s via ALPN (is its target a UDP address?)", udp.Protocol)
+		}
+		return conn, nil
+	}
+}
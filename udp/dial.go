@@ -0,0 +1,60 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package udp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Dial opens a flow to the UDP target at the given address. Frames written
+// to the connection are sent to the target as datagrams, and datagrams from
+// the target are read back as frames. The flow is closed after the idle
+// timeout (unless it's zero).
+func Dial(address string, timeout, idle time.Duration) (net.Conn, error) {
+	c, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(target{c.(*net.UDPConn)}, idle), nil
+}
+
+// target is the endpoint of a flow to a UDP target, over a connected socket.
+type target struct {
+	*net.UDPConn
+}
+
+// Connected sockets report ICMP errors (e.g. port unreachable) for earlier
+// datagrams on later reads and writes. These are ignored, like any other
+// lost datagram, so that the flow survives a restart of the target.
+func (t target) readDatagram(b []byte) (int, error) {
+	for {
+		n, err := t.Read(b)
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return n, err
+		}
+	}
+}
+
+func (t target) writeDatagram(b []byte) error {
+	_, err := t.Write(b)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		datagramsDropped.Inc(1)
+		return nil
+	}
+	return err
+}
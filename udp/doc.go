@@ -0,0 +1,5 @@
+// Package udp forwards UDP datagrams over TLS connections between a
+// Ghostunnel client and server. Each flow (the datagrams exchanged with a
+// source address) is carried over a TLS connection of its own, as a stream
+// of frames prefixed with their length. Peers signal support via ALPN.
+package udp
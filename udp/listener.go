@@ -0,0 +1,217 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package udp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of new flows that can wait to be accepted, and number of datagrams
+// that can wait to be read on a flow. Datagrams that don't fit are dropped,
+// like they would be with a full socket buffer.
+const (
+	acceptBacklog = 128
+	flowBacklog   = 64
+)
+
+// Listener accepts a connection for each flow of datagrams, i.e. for each
+// source address that sends datagrams to the socket it listens on. Reading
+// from a connection returns the datagrams of the flow as frames, frames
+// written to it are sent back to the source address as datagrams.
+type Listener struct {
+	conn    net.PacketConn
+	idle    time.Duration
+	accept  chan net.Conn
+	done    chan struct{}
+	closing sync.Once
+
+	mu    sync.Mutex
+	flows map[string]*flow
+}
+
+// NewListener accepts flows on the given socket. Flows are closed after the
+// idle timeout (unless it's zero), or when the listener is closed.
+func NewListener(conn net.PacketConn, idle time.Duration) *Listener {
+	l := &Listener{
+		conn:   conn,
+		idle:   idle,
+		accept: make(chan net.Conn, acceptBacklog),
+		done:   make(chan struct{}),
+		flows:  map[string]*flow{},
+	}
+	go l.serve()
+	return l
+}
+
+// Accept waits for the first datagram of a new flow.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "udp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close the socket, and all flows.
+func (l *Listener) Close() error {
+	var err error
+	l.closing.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+
+		l.mu.Lock()
+		conns := make([]*conn, 0, len(l.flows))
+		for _, f := range l.flows {
+			conns = append(conns, f.conn)
+		}
+		l.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the socket.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Read datagrams from the socket, and queue them on their flow.
+func (l *Listener) serve() {
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				// Some platforms report ICMP errors for earlier datagrams
+				// on reads, these don't affect other flows.
+				continue
+			}
+		}
+		l.deliver(addr, append([]byte(nil), buffer[:n]...))
+	}
+}
+
+func (l *Listener) deliver(addr net.Addr, datagram []byte) {
+	key := addr.String()
+	l.mu.Lock()
+	f, ok := l.flows[key]
+	if !ok {
+		f = &flow{
+			listener: l,
+			addr:     addr,
+			queue:    make(chan []byte, flowBacklog),
+			closed:   make(chan struct{}),
+			deadline: newDeadline(),
+		}
+		f.conn = newConn(f, l.idle)
+		l.flows[key] = f
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		select {
+		case l.accept <- f.conn:
+		default:
+			datagramsDropped.Inc(1)
+			f.conn.Close()
+			return
+		}
+	}
+
+	select {
+	case f.queue <- datagram:
+	default:
+		datagramsDropped.Inc(1)
+	}
+}
+
+func (l *Listener) remove(f *flow) {
+	key := f.addr.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.flows[key] == f {
+		delete(l.flows, key)
+	}
+}
+
+// flow is the endpoint of a flow accepted by a listener. Datagrams from the
+// source address are queued by the listener, and replies are sent from the
+// socket of the listener.
+type flow struct {
+	listener *Listener
+	conn     *conn
+	addr     net.Addr
+	queue    chan []byte
+	closed   chan struct{}
+	closing  sync.Once
+	deadline *deadline
+}
+
+func (f *flow) readDatagram(b []byte) (int, error) {
+	select {
+	case datagram := <-f.queue:
+		return copy(b, datagram), nil
+	case <-f.closed:
+		return 0, io.EOF
+	case <-f.deadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (f *flow) writeDatagram(b []byte) error {
+	select {
+	case <-f.closed:
+		return net.ErrClosed
+	default:
+	}
+	_, err := f.listener.conn.WriteTo(b, f.addr)
+	return err
+}
+
+func (f *flow) Close() error {
+	f.closing.Do(func() {
+		close(f.closed)
+		f.listener.remove(f)
+	})
+	return nil
+}
+
+func (f *flow) LocalAddr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *flow) RemoteAddr() net.Addr {
+	return f.addr
+}
+
+func (f *flow) SetReadDeadline(t time.Time) error {
+	f.deadline.set(t)
+	return nil
+}
+
+// Datagrams are sent without waiting, so there's no write deadline.
+func (f *flow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
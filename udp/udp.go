@@ -0,0 +1,222 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package udp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Protocol is negotiated via ALPN to signal that a connection carries the
+// datagrams of a UDP flow.
+const Protocol = "ghostunnel-udp/1"
+
+// MaxDatagramSize is the size of the largest datagram that fits in a frame.
+const MaxDatagramSize = 0xffff
+
+// Size of the length prefix of frames.
+const headerSize = 2
+
+var (
+	flowsOpen        = metrics.GetOrRegisterCounter("udp.flows.open", metrics.DefaultRegistry)
+	flowsTotal       = metrics.GetOrRegisterCounter("udp.flows.total", metrics.DefaultRegistry)
+	flowsExpired     = metrics.GetOrRegisterCounter("udp.flows.expired", metrics.DefaultRegistry)
+	datagramsDropped = metrics.GetOrRegisterCounter("udp.datagrams.dropped", metrics.DefaultRegistry)
+)
+
+// endpoint sends and receives the datagrams of a single flow.
+type endpoint interface {
+	// Read a single datagram into b, which is at least MaxDatagramSize long.
+	readDatagram(b []byte) (int, error)
+	writeDatagram(b []byte) error
+
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// conn carries the datagrams of a flow as a stream of frames, so that it can
+// be forwarded over a TLS connection like any other connection. Each frame
+// is a datagram prefixed with its length (16 bits, big-endian). The flow is
+// closed if no datagrams are sent or received for the idle timeout, in which
+// case reads return io.EOF.
+type conn struct {
+	endpoint
+	idle    time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+	closing sync.Once
+	err     error
+
+	// Frame being read, and buffer to read datagrams into.
+	pending []byte
+	buffer  []byte
+	// Incomplete frame that was written, waiting for the rest.
+	partial []byte
+}
+
+func newConn(e endpoint, idle time.Duration) *conn {
+	c := &conn{
+		endpoint: e,
+		idle:     idle,
+		buffer:   make([]byte, headerSize+MaxDatagramSize),
+	}
+	if idle > 0 {
+		c.timer = time.AfterFunc(idle, c.expire)
+	}
+	flowsOpen.Inc(1)
+	flowsTotal.Inc(1)
+	return c
+}
+
+func (c *conn) expire() {
+	c.expired.Store(true)
+	flowsExpired.Inc(1)
+	c.Close()
+}
+
+// Push back the idle timeout after a datagram was sent or received.
+func (c *conn) active() {
+	if c.timer != nil {
+		c.timer.Reset(c.idle)
+	}
+}
+
+// Read returns the next datagram of the flow as a frame.
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.readDatagram(c.buffer[headerSize:])
+		if err != nil {
+			if c.expired.Load() {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		c.active()
+		binary.BigEndian.PutUint16(c.buffer, uint16(n))
+		c.pending = c.buffer[:headerSize+n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends each complete frame in b (or completed by b) as a datagram.
+// Frames may be split across writes.
+func (c *conn) Write(b []byte) (int, error) {
+	c.partial = append(c.partial, b...)
+	frames := c.partial
+	for len(frames) >= headerSize {
+		n := headerSize + int(binary.BigEndian.Uint16(frames))
+		if len(frames) < n {
+			break
+		}
+		if err := c.writeDatagram(frames[headerSize:n]); err != nil {
+			if c.expired.Load() {
+				return 0, net.ErrClosed
+			}
+			return 0, err
+		}
+		c.active()
+		frames = frames[n:]
+	}
+	c.partial = append(c.partial[:0], frames...)
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.closing.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		flowsOpen.Dec(1)
+		c.err = c.endpoint.Close()
+	})
+	return c.err
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// deadline is a deadline that can be waited on with a channel, which is
+// closed when the deadline passes (like the deadlines of net.Pipe).
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// Set the deadline. A zero value means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait for it to close the channel.
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(wait, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// Get a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,258 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func frame(datagram string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(datagram))), datagram...)
+}
+
+func readFrame(t *testing.T, conn net.Conn) string {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(conn, header)
+	assert.Nil(t, err, "should read frame header")
+	datagram := make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(conn, datagram)
+	assert.Nil(t, err, "should read frame")
+	return string(datagram)
+}
+
+// Start a UDP server that echoes datagrams back to their source.
+func echoServer(t *testing.T) net.PacketConn {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	go func() {
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return server
+}
+
+func listen(t *testing.T, idle time.Duration) *Listener {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	return NewListener(conn, idle)
+}
+
+func TestDialFraming(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+
+	conn, err := Dial(server.LocalAddr().String(), time.Second, time.Minute)
+	assert.Nil(t, err, "should dial UDP target")
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Two frames in a single write, and a frame split across writes.
+	_, err = conn.Write(append(frame("first"), frame("second")...))
+	assert.Nil(t, err, "should write frames")
+	third := frame("third")
+	_, err = conn.Write(third[:1])
+	assert.Nil(t, err, "should write partial frame header")
+	_, err = conn.Write(third[1:4])
+	assert.Nil(t, err, "should write partial frame")
+	_, err = conn.Write(third[4:])
+	assert.Nil(t, err, "should write rest of frame")
+
+	assert.Equal(t, "first", readFrame(t, conn))
+	assert.Equal(t, "second", readFrame(t, conn))
+	assert.Equal(t, "third", readFrame(t, conn))
+
+	// Empty datagrams are frames too.
+	_, err = conn.Write(frame(""))
+	assert.Nil(t, err, "should write empty frame")
+	assert.Equal(t, "", readFrame(t, conn))
+}
+
+func TestDialIgnoresUnreachableTarget(t *testing.T) {
+	// Find a port that nothing listens on.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	address := server.LocalAddr().String()
+	server.Close()
+
+	conn, err := Dial(address, time.Second, time.Minute)
+	assert.Nil(t, err, "should dial UDP target")
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(frame("hello"))
+		assert.Nil(t, err, "should drop datagrams for unreachable target")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 16))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "should time out rather than fail, got %v", err)
+}
+
+func TestDialIdleTimeout(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+
+	conn, err := Dial(server.LocalAddr().String(), time.Second, 100*time.Millisecond)
+	assert.Nil(t, err, "should dial UDP target")
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write(frame("hello"))
+	assert.Nil(t, err, "should write frame")
+	assert.Equal(t, "hello", readFrame(t, conn))
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 16))
+	assert.Equal(t, io.EOF, err, "should close idle flow")
+	assert.True(t, time.Since(start) < 2*time.Second, "should close idle flow after idle timeout")
+
+	_, err = conn.Write(frame("hello"))
+	assert.True(t, errors.Is(err, net.ErrClosed), "should not write to expired flow")
+}
+
+func TestListenerFlows(t *testing.T) {
+	listener := listen(t, time.Minute)
+	defer listener.Close()
+
+	clients := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("udp", listener.Addr().String())
+		assert.Nil(t, err, "should dial listener")
+		defer client.Close()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		clients = append(clients, client)
+	}
+
+	// Each source address is a flow, with all of its datagrams.
+	_, err := clients[0].Write([]byte("a1"))
+	assert.Nil(t, err, "should send datagram")
+	first, err := listener.Accept()
+	assert.Nil(t, err, "should accept first flow")
+	defer first.Close()
+	_ = first.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(t, clients[0].LocalAddr().String(), first.RemoteAddr().String())
+
+	_, err = clients[1].Write([]byte("b1"))
+	assert.Nil(t, err, "should send datagram")
+	_, err = clients[0].Write([]byte("a2"))
+	assert.Nil(t, err, "should send datagram")
+	second, err := listener.Accept()
+	assert.Nil(t, err, "should accept second flow")
+	defer second.Close()
+	_ = second.SetDeadline(time.Now().Add(5 * time.Second))
+
+	assert.Equal(t, "a1", readFrame(t, first))
+	assert.Equal(t, "a2", readFrame(t, first))
+	assert.Equal(t, "b1", readFrame(t, second))
+
+	// Replies are sent back to the source address of the flow.
+	_, err = second.Write(frame("b-reply"))
+	assert.Nil(t, err, "should write frame")
+	reply := make([]byte, 64)
+	n, err := clients[1].Read(reply)
+	assert.Nil(t, err, "should receive reply")
+	assert.Equal(t, "b-reply", string(reply[:n]))
+
+	// A closed flow is replaced by a new one on the next datagram.
+	first.Close()
+	_, err = clients[0].Write([]byte("a3"))
+	assert.Nil(t, err, "should send datagram")
+	third, err := listener.Accept()
+	assert.Nil(t, err, "should accept new flow")
+	defer third.Close()
+	_ = third.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(t, "a3", readFrame(t, third))
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	listener := listen(t, 100*time.Millisecond)
+	defer listener.Close()
+
+	client, err := net.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should dial listener")
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err, "should send datagram")
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept flow")
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(t, "hello", readFrame(t, conn))
+
+	_, err = conn.Read(make([]byte, 16))
+	assert.Equal(t, io.EOF, err, "should close idle flow")
+}
+
+func TestListenerReadDeadline(t *testing.T) {
+	listener := listen(t, time.Minute)
+	defer listener.Close()
+
+	client, err := net.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should dial listener")
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err, "should send datagram")
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept flow")
+	defer conn.Close()
+	assert.Equal(t, "hello", readFrame(t, conn))
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 16))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "should time out, got %v", err)
+
+	// Reads work again once the deadline is cleared.
+	_ = conn.SetReadDeadline(time.Time{})
+	_, err = client.Write([]byte("again"))
+	assert.Nil(t, err, "should send datagram")
+	assert.Equal(t, "again", readFrame(t, conn))
+}
+
+func TestListenerClose(t *testing.T) {
+	listener := listen(t, time.Minute)
+
+	client, err := net.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should dial listener")
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err, "should send datagram")
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept flow")
+	defer conn.Close()
+	assert.Equal(t, "hello", readFrame(t, conn))
+
+	listener.Close()
+	_, err = listener.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed), "should not accept after close")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 16))
+	assert.Equal(t, io.EOF, err, "should close flows with listener")
+}
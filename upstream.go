@@ -0,0 +1,348 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ghostunnel/ghostunnel/proxy"
+	"golang.org/x/net/http/httpproxy"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// Schemes of upstream proxy URLs, and their default ports.
+var upstreamProxyPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// Check that an upstream proxy URL has a supported scheme and a host.
+func validateUpstreamProxy(u *url.URL) error {
+	if _, ok := upstreamProxyPorts[u.Scheme]; !ok {
+		return fmt.Errorf("invalid proxy %s, must have HTTP, HTTPS, SOCKS5 or SOCKS5H scheme", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid proxy %s, must have a host", u.Redacted())
+	}
+	return nil
+}
+
+// Parse and validate a list of upstream proxy URLs.
+func parseUpstreamProxies(proxies []string) ([]*url.URL, error) {
+	urls := make([]*url.URL, 0, len(proxies))
+	for _, p := range proxies {
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateUpstreamProxy(u); err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// Read proxy credentials from a file, in the form "user:password". Returns
+// nil if no file is given.
+func readProxyCredentials(path string) (*url.Userinfo, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read proxy credentials: %w", err)
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok || user == "" {
+		return nil, errors.New("invalid proxy credentials, must be in the form user:password")
+	}
+	return url.UserPassword(user, password), nil
+}
+
+// upstreamProxyOptions describes how client mode connects to its targets:
+// directly, through a chain of proxies, or through the proxy given by the
+// environment for each target.
+type upstreamProxyOptions struct {
+	// Proxies to connect through, in order. The first proxy is dialed
+	// directly, each other proxy through the ones before it.
+	chain []*url.URL
+	// Pick the proxy from HTTPS_PROXY (or HTTP_PROXY) and NO_PROXY.
+	fromEnv bool
+	// Credentials for proxies that don't have any in their URL.
+	credentials *url.Userinfo
+	// TLS config for HTTPS proxies.
+	tlsConfig *tls.Config
+}
+
+// Check if targets are dialed through a proxy, in which case they may not be
+// resolvable locally.
+func (o upstreamProxyOptions) enabled() bool {
+	return len(o.chain) > 0 || o.fromEnv
+}
+
+// Wrap a dialer to connect through upstream proxies, if any.
+func (o upstreamProxyOptions) dialer(dialer *net.Dialer) (Dialer, error) {
+	if o.fromEnv {
+		return &envProxyDialer{
+			proxyFunc: envProxyConfig().ProxyFunc(),
+			options:   o,
+			dialer:    dialer,
+		}, nil
+	}
+	return o.chainDialer(o.chain, dialer)
+}
+
+// Build a dialer that connects through the given proxies, in order.
+func (o upstreamProxyOptions) chainDialer(chain []*url.URL, dialer *net.Dialer) (Dialer, error) {
+	var forward Dialer = dialer
+	for _, u := range chain {
+		if err := validateUpstreamProxy(u); err != nil {
+			return nil, err
+		}
+		credentials := u.User
+		if credentials == nil {
+			credentials = o.credentials
+		}
+		address := upstreamProxyAddress(u)
+
+		switch u.Scheme {
+		case "http", "https":
+			forward = &connectDialer{
+				proxy:       u,
+				address:     address,
+				credentials: credentials,
+				forward:     forward,
+				tlsConfig:   o.tlsConfig,
+				timeout:     dialer.Timeout,
+			}
+		case "socks5", "socks5h":
+			var auth *netproxy.Auth
+			if credentials != nil {
+				password, _ := credentials.Password()
+				auth = &netproxy.Auth{User: credentials.Username(), Password: password}
+			}
+			socks, err := netproxy.SOCKS5("tcp", address, auth, forward)
+			if err != nil {
+				return nil, err
+			}
+			forward = socks
+			if u.Scheme == "socks5" {
+				// Unlike socks5h, socks5 proxies only get IP addresses.
+				forward = &resolvingDialer{forward: socks, timeout: dialer.Timeout}
+			}
+		}
+	}
+	return forward, nil
+}
+
+// Address (host:port) of an upstream proxy, with the default port for its
+// scheme if none is given.
+func upstreamProxyAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = upstreamProxyPorts[u.Scheme]
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Proxy settings from the environment. As targets are dialed with TLS, the
+// proxy is taken from HTTPS_PROXY, falling back to HTTP_PROXY if unset.
+// Targets listed in NO_PROXY (and loopback addresses) are dialed directly.
+func envProxyConfig() *httpproxy.Config {
+	config := httpproxy.FromEnvironment()
+	if config.HTTPSProxy == "" {
+		config.HTTPSProxy = config.HTTPProxy
+	}
+	return config
+}
+
+// envProxyDialer picks the proxy for each target from the environment.
+type envProxyDialer struct {
+	proxyFunc func(*url.URL) (*url.URL, error)
+	options   upstreamProxyOptions
+	dialer    *net.Dialer
+}
+
+func (d *envProxyDialer) Dial(network, address string) (net.Conn, error) {
+	u, err := d.proxyFunc(&url.URL{Scheme: "https", Host: address})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy in environment: %w", err)
+	}
+	if u == nil {
+		return d.dialer.Dial(network, address)
+	}
+	dialer, err := d.options.chainDialer([]*url.URL{u}, d.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial(network, address)
+}
+
+// resolvingDialer resolves the host of each address locally, and dials the
+// resolved addresses in turn until one succeeds.
+type resolvingDialer struct {
+	forward Dialer
+	timeout time.Duration
+}
+
+func (d *resolvingDialer) Dial(network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.forward.Dial(network, address)
+	}
+
+	ctx := context.Background()
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.forward.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// connectDialer connects through an HTTP(S) proxy, using CONNECT requests.
+// Credentials, if any, are sent with Basic auth.
+type connectDialer struct {
+	proxy       *url.URL
+	address     string
+	credentials *url.Userinfo
+	forward     Dialer
+	tlsConfig   *tls.Config
+	timeout     time.Duration
+}
+
+func (d *connectDialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("network type '%s' unsupported by proxy (only 'tcp')", network)
+	}
+	conn, err := d.forward.Dial("tcp", d.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed dialing proxy %s: %w", d.proxy.Redacted(), err)
+	}
+
+	conn, err = d.connect(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", d.proxy.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// Send a CONNECT request on a connection to the proxy, and wait for it to
+// succeed. Returns the connection to use for the tunnel.
+func (d *connectDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	if d.proxy.Scheme == "https" {
+		config := &tls.Config{}
+		if d.tlsConfig != nil {
+			config = d.tlsConfig.Clone()
+		}
+		config.ServerName = d.proxy.Hostname()
+		conn = tls.Client(conn, config)
+	}
+	if d.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.credentials != nil {
+		password, _ := d.credentials.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(d.credentials.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, fmt.Errorf("failed writing CONNECT request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, fmt.Errorf("failed reading CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT to %s failed: %s", address, resp.Status)
+	}
+
+	// The target may already have sent data after the response.
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection with data that was already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Log the upstream proxies used to connect to targets, if any.
+func logUpstreamProxies(logger proxy.Logger, options upstreamProxyOptions) {
+	if options.fromEnv {
+		config := envProxyConfig()
+		logger.Printf("using proxy from environment (proxy: '%s', no proxy: '%s')", redactProxy(config.HTTPSProxy), config.NoProxy)
+		return
+	}
+	for i, u := range options.chain {
+		logger.Printf("using upstream proxy #%d %s", i+1, u.Redacted())
+	}
+}
+
+// Redact credentials in a proxy URL, for logging.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,6 @@
+// Package websocket carries connections between a Ghostunnel client and
+// server over WebSocket connections (wss://), so that they can pass through
+// proxies and middleboxes that only allow HTTP(S). Data is sent as binary
+// messages over the TLS connection, after an HTTP upgrade. Peers signal
+// support via ALPN.
+package websocket
@@ -0,0 +1,289 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Protocol is negotiated via ALPN on TLS connections that carry a WebSocket
+// connection. It's the protocol browsers use for wss:// connections, so that
+// the connection looks like any other to middleboxes.
+const Protocol = "http/1.1"
+
+// DefaultPath is the path of upgrade requests, if no other path is set.
+const DefaultPath = "/"
+
+var (
+	connectionsOpen  = metrics.GetOrRegisterCounter("websocket.connections.open", metrics.DefaultRegistry)
+	connectionsTotal = metrics.GetOrRegisterCounter("websocket.connections.total", metrics.DefaultRegistry)
+	upgradeErrors    = metrics.GetOrRegisterCounter("websocket.upgrades.errors", metrics.DefaultRegistry)
+)
+
+// Ping the peer periodically, so that proxies and load balancers don't close
+// connections that are idle for a while (e.g. pooled database connections).
+const keepAlivePeriod = 30 * time.Second
+
+// Time to wait for the close message to be sent when closing a connection.
+const closeTimeout = time.Second
+
+// Options for WebSocket connections.
+type Options struct {
+	// Path of upgrade requests. Defaults to DefaultPath.
+	Path string
+}
+
+func (o Options) path() string {
+	if o.Path != "" {
+		return o.Path
+	}
+	return DefaultPath
+}
+
+// Client upgrades a TLS connection to a server to a WebSocket connection. The
+// host is sent in the Host header of the upgrade request. The connection is
+// closed if the upgrade fails.
+func Client(conn net.Conn, host string, options Options, timeout time.Duration) (*Conn, error) {
+	dialer := gorilla.Dialer{
+		NetDialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		HandshakeTimeout: timeout,
+	}
+	u := url.URL{Scheme: "wss", Host: host, Path: options.path()}
+	ws, resp, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		_ = conn.Close()
+		upgradeErrors.Inc(1)
+		if resp != nil {
+			return nil, fmt.Errorf("WebSocket upgrade rejected by server: %s", resp.Status)
+		}
+		return nil, err
+	}
+	return newConn(ws, conn), nil
+}
+
+// Server reads an upgrade request from a client, and upgrades the connection
+// to a WebSocket connection. Requests for other paths get a 404, and invalid
+// requests an error response. The connection is not closed if the upgrade
+// fails.
+func Server(conn net.Conn, options Options, timeout time.Duration) (*Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		upgradeErrors.Inc(1)
+		return nil, fmt.Errorf("invalid upgrade request: %w", err)
+	}
+
+	w := &responseWriter{conn: conn, reader: reader, header: http.Header{}}
+	if req.URL.Path != options.path() {
+		upgradeErrors.Inc(1)
+		w.reject(http.StatusNotFound)
+		return nil, fmt.Errorf("upgrade request for unknown path '%s'", req.URL.Path)
+	}
+
+	upgrader := gorilla.Upgrader{
+		HandshakeTimeout: timeout,
+		Error: func(_ http.ResponseWriter, _ *http.Request, status int, _ error) {
+			w.reject(status)
+		},
+	}
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		upgradeErrors.Inc(1)
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return newConn(ws, conn), nil
+}
+
+// responseWriter lets the upgrader take over a connection that didn't come
+// from an http.Server. Error responses are written straight to the
+// connection.
+type responseWriter struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	header http.Header
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *responseWriter) WriteHeader(int) {}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(w.reader, bufio.NewWriter(w.conn)), nil
+}
+
+func (w *responseWriter) reject(status int) {
+	resp := http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Connection": {"close"}},
+	}
+	_ = resp.Write(w.conn)
+}
+
+// Conn is a connection carried over a WebSocket connection, as a stream of
+// binary messages. It exposes the TLS connection state of the underlying
+// connection, so that it can be used like a *tls.Conn for logging and
+// routing.
+type Conn struct {
+	ws   *gorilla.Conn
+	conn net.Conn
+
+	// Held while reading, reader is the message being read (if any)
+	readMu sync.Mutex
+	reader io.Reader
+
+	closing sync.Once
+	done    chan struct{}
+}
+
+func newConn(ws *gorilla.Conn, conn net.Conn) *Conn {
+	connectionsOpen.Inc(1)
+	connectionsTotal.Inc(1)
+	c := &Conn{ws: ws, conn: conn, done: make(chan struct{})}
+	go c.keepAlive()
+	return c
+}
+
+func (c *Conn) keepAlive() {
+	ticker := time.NewTicker(keepAlivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = c.ws.WriteControl(gorilla.PingMessage, nil, time.Now().Add(keepAlivePeriod))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Read reads data from messages sent by the peer, and returns io.EOF once
+// the peer closed the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		if c.reader == nil {
+			_, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, readError(err)
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends data as a binary message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(gorilla.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close message to the peer, and closes the connection.
+func (c *Conn) Close() error {
+	var err error
+	c.closing.Do(func() {
+		close(c.done)
+		connectionsOpen.Dec(1)
+		_ = c.ws.WriteControl(gorilla.CloseMessage,
+			gorilla.FormatCloseMessage(gorilla.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+		err = c.ws.Close()
+	})
+	return err
+}
+
+// ConnectionState returns the state of the TLS handshake of the underlying
+// connection, if it's a TLS connection.
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer of the underlying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// Peers closing the connection is the end of the stream.
+func readError(err error) error {
+	if gorilla.IsCloseError(err, gorilla.CloseNormalClosure, gorilla.CloseGoingAway) {
+		return io.EOF
+	}
+	var closeErr *gorilla.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code == gorilla.CloseAbnormalClosure {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
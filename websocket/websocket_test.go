@@ -0,0 +1,157 @@
+/*-
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Connect a client and server over a TLS connection on loopback, and run
+// upgrade on the server side of it.
+func connect(t *testing.T, upgrade func(net.Conn)) net.Conn {
+	cert := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{Protocol},
+	})
+	assert.Nil(t, err, "should be able to listen on random port")
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		upgrade(conn)
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{Protocol},
+	})
+	assert.Nil(t, err, "should be able to connect to listener")
+	return conn
+}
+
+func TestUpgrade(t *testing.T) {
+	options := Options{Path: "/tunnel"}
+	upgraded := make(chan *Conn, 1)
+	conn := connect(t, func(conn net.Conn) {
+		ws, err := Server(conn, options, 5*time.Second)
+		assert.Nil(t, err, "server should accept upgrade")
+		upgraded <- ws
+	})
+
+	client, err := Client(conn, "example.com", options, 5*time.Second)
+	assert.Nil(t, err, "client should be able to upgrade")
+	if err != nil {
+		return
+	}
+	server := <-upgraded
+	if server == nil {
+		return
+	}
+	defer server.Close()
+	assert.Equal(t, Protocol, client.ConnectionState().NegotiatedProtocol, "should expose TLS state")
+	assert.Equal(t, Protocol, server.ConnectionState().NegotiatedProtocol, "should expose TLS state")
+
+	// Data is a stream, regardless of how it's split into messages.
+	message := bytes.Repeat([]byte("0123456789"), 10000)
+	go func() {
+		_, _ = client.Write(message[:5])
+		_, _ = client.Write(message[5:])
+	}()
+	received := make([]byte, len(message))
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(server, received)
+	assert.Nil(t, err, "server should read data")
+	assert.Equal(t, message, received)
+
+	_, err = server.Write([]byte("reply"))
+	assert.Nil(t, err, "server should be able to write")
+	reply := make([]byte, 5)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(client, reply)
+	assert.Nil(t, err, "client should read reply")
+	assert.Equal(t, "reply", string(reply))
+
+	// Closing the connection is the end of the stream for the peer.
+	assert.Nil(t, client.Close(), "should close client")
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "server should read EOF after close")
+}
+
+func TestRejectsUnknownPath(t *testing.T) {
+	rejected := make(chan error, 1)
+	conn := connect(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, err := Server(conn, Options{Path: "/tunnel"}, 5*time.Second)
+		rejected <- err
+	})
+
+	_, err := Client(conn, "example.com", Options{Path: "/other"}, 5*time.Second)
+	assert.NotNil(t, err, "client should fail to upgrade")
+	assert.Contains(t, err.Error(), "404")
+	assert.NotNil(t, <-rejected, "server should reject upgrade")
+}
+
+func TestRejectsPlainRequest(t *testing.T) {
+	rejected := make(chan error, 1)
+	conn := connect(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, err := Server(conn, Options{}, 5*time.Second)
+		rejected <- err
+	})
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	assert.Nil(t, err, "should be able to send request")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Nil(t, err, "should get a response")
+	if err == nil {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	assert.NotNil(t, <-rejected, "server should reject request without upgrade")
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}